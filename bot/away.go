@@ -0,0 +1,87 @@
+package bot
+
+import (
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// awayCapability is the IRCv3 capability telling us when members of our channels go away or come back
+const awayCapability = "away-notify"
+
+// keepAway marks a new connection away like the one it replaces so it is marked away after registering
+func keepAway(oldSvr client.IrcServerInterface, newSvr client.IrcServerInterface) {
+	oldState := oldSvr.GetState()
+	newState := newSvr.GetState()
+	if oldState == nil || newState == nil {
+		return
+	}
+	newState.SetAway(oldState.Away())
+}
+
+// setAway sends AWAY to a server (marking us back if reason is empty), returning false if the server is invalid
+func (b *BananaBoatBot) setAway(svrName string, reason string) bool {
+	state := b.getServerState(svrName)
+	if state == nil || isDCCChat(svrName) {
+		return false
+	}
+	// Recorded right away so it survives reconnecting before the message is sent
+	state.SetAway(reason)
+	msg := &irc.Message{Command: irc.AWAY}
+	if len(reason) > 0 {
+		msg.Params = []string{reason}
+	}
+	b.sendMessage(svrName, msg)
+	return true
+}
+
+// luaLibSetAway marks us away on a server with a reason (kept after reconnecting)
+func (b *BananaBoatBot) luaLibSetAway(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	reason := luaState.CheckString(2)
+	if len(reason) == 0 {
+		luaState.ArgError(2, "reason mustn't be empty")
+	}
+	if !b.setAway(svrName, reason) {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("invalid server"))
+		return 2
+	}
+	luaState.Push(lua.LTrue)
+	return 1
+}
+
+// luaLibBack marks us as no longer away on a server
+func (b *BananaBoatBot) luaLibBack(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	if !b.setAway(svrName, "") {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("invalid server"))
+		return 2
+	}
+	luaState.Push(lua.LTrue)
+	return 1
+}
+
+// luaLibAway returns the reason we (or nick if given) are marked away for on a server (nil if we aren't)
+func (b *BananaBoatBot) luaLibAway(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	nick := luaState.OptString(2, "")
+	state := b.getServerState(svrName)
+	if state != nil && len(nick) > 0 {
+		// Away status of others is only known for members of channels we have joined
+		reason, ok := state.AwayReason(nick)
+		if !ok {
+			luaState.Push(lua.LNil)
+			return 1
+		}
+		luaState.Push(lua.LString(reason))
+		return 1
+	}
+	if state == nil || len(state.Away()) == 0 {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LString(state.Away()))
+	return 1
+}
@@ -3,7 +3,9 @@ package bot
 import (
 	"context"
 	"crypto/rand"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,9 +15,12 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/fatalbanana/bananaboatbot/redis"
+	"github.com/fatalbanana/bananaboatbot/store"
 	"github.com/yuin/gopher-lua"
 	"golang.org/x/net/html"
 	irc "gopkg.in/sorcix/irc.v2"
@@ -25,49 +30,169 @@ import (
 type BananaBoatBot struct {
 	// Config contains elements that are passed on initialization
 	Config *BananaBoatBotConfig
+	// channels maps server names to channels to join after connecting
+	channels map[string][]channelSetting
+	// commands holds commands invoked by prefixed messages
+	commands *commandSettings
+	// connectGovernors maps server names to governors limiting how often we connect
+	connectGovernors sync.Map
+	// cooldowns holds cooldowns set by scripts
+	cooldowns *cooldowns
 	// curNet is set to friendly name of network we're handling a message from
 	curNet string
+	// ctcpCooldowns rate-limits replies to CTCP queries
+	ctcpCooldowns *cooldowns
+	// ctcpReplies maps CTCP commands to how they are answered
+	ctcpReplies map[string]ctcpReply
+	// dcc describes which files offered by DCC SEND are received (nil if none are)
+	dcc *dccSettings
+	// dccTransfers is the number of files being received by DCC
+	dccTransfers int32
 	// curMessage is set to the message being handled
 	curMessage *irc.Message
-	// handlers is a map of IRC command names to Lua functions
-	handlers map[string]*lua.LFunction
-	// handlersMutex protects the handlers map
+	// curTags is set to the allowed tags of the message being handled
+	curTags map[string]string
+	// curTime is set to when the message being handled was sent
+	curTime time.Time
+	// externals is a map of IRC command names to external handlers
+	externals map[string]*externalHandler
+	// forbidDowngrade is set if HTTP helpers shouldn't follow redirects from https to http
+	forbidDowngrade bool
+	// forwardPolicies maps server names to how being forwarded to another channel is handled
+	forwardPolicies map[string]string
+	// handlers is a map of IRC command names to Lua handlers
+	handlers map[string]*luaHandler
+	// handlersMutex protects the handlers map (and channels, commands, ctcpReplies, dcc, externals, forbidDowngrade, forwardPolicies, locale, maxMessages, monitors, newlines, notifier, quitMessages, rejoinPolicies, services & tagAllowlists)
 	handlersMutex sync.RWMutex
+	// handovers maps server names to new connections which will replace the current ones once ready
+	handovers sync.Map
+	// health maps server names to statistics used to score their health
+	health sync.Map
 	// httpClient is used for HTTP requests
 	httpClient http.Client
+	// joinedOnceChannels is the set of join-once channels joined since startup
+	joinedOnceChannels sync.Map
+	// locale is the default locale used by helpers
+	locale string
+	// maxMessages is the default limit of messages returned by a handler
+	maxMessages int
+	// luaContexts maps pooled Lua states to the message they are handling
+	luaContexts sync.Map
 	// luaMutex protects shared Lua state
 	luaMutex sync.Mutex
 	// luaPool is a pool for when shared state is undesirable
-	luaPool sync.Pool
+	luaPool *luaStatePool
 	// luaState contains shared Lua state
 	luaState *lua.LState
+	// memoryChecked is when memory usage was last checked (Unix nanoseconds, accessed atomically)
+	memoryChecked int64
+	// memorySheds counts how often cached state was shed because of memory usage (accessed atomically)
+	memorySheds uint64
+	// modeCooldowns rate-limits enforcing channel modes
+	modeCooldowns *cooldowns
+	// monitors maps server names to nicks whose presence is tracked
+	monitors map[string][]string
+	// newlines is how line breaks in trailing parameters are handled
+	newlines string
 	// nick is the default nick of the bot
 	nick string
+	// nonces remembers nonces of verified signed messages to prevent replays
+	nonces *cooldowns
+	// notifier sends connection events to an admin channel if configured
+	notifier *notifier
+	// presences maps server names to the presence of monitored nicks
+	presences sync.Map
 	// realname is the default "real name" of the bot
 	realname string
+	// redisSubscriptions maps Redis subscriptions made by scripts to functions cancelling them
+	redisSubscriptions sync.Map
+	// regexps caches patterns compiled by scripts
+	regexps regexpCache
+	// rejoinMutex protects rejoinState
+	rejoinMutex sync.Mutex
+	// rejoinPolicies maps server names to how channels we were kicked from are rejoined (nil if they aren't)
+	rejoinPolicies map[string]*rejoinPolicy
+	// rejoins maps servers and channels to attempts to rejoin them
+	rejoins sync.Map
+	// reloadMutex ensures only one reload runs at a time (concurrent reloads are queued)
+	reloadMutex sync.Mutex
+	// requestClient is used for HTTP requests to URLs given by scripts
+	requestClient http.Client
+	// timerID is the id of the last timer started by scripts (accessed atomically)
+	timerID uint64
+	// timers maps ids to timers started by scripts
+	timers sync.Map
+	// timersPending is the number of timers in timers (accessed atomically)
+	timersPending int32
+	// generation is incremented whenever the script is reloaded (accessed atomically)
+	generation uint64
 	// username is the default username of the bot
 	username string
+	// whoisRequests maps servers and nicks to WHOIS requests waiting for replies
+	whoisRequests sync.Map
+	// reconnectStrategy is the default strategy of reconnecting to servers (nil for the built-in backoff)
+	reconnectStrategy *client.ReconnectStrategy
+	// reconnecting is the set of servers which have been disconnected
+	reconnecting sync.Map
+	// sendMutex serialises queueing of messages returned by handlers
+	sendMutex sync.Mutex
 	// servers is a map of friendly names to IRC servers
 	Servers sync.Map
 	// mutex for handling of servers
 	serversMutex sync.Mutex
+	// sqlStatements is the set of statements prepared by scripts
+	sqlStatements sync.Map
+	// stsPolicies maps lower-cased hosts to their strict transport security policies
+	stsPolicies sync.Map
+	// services maps server names to templates of commands sent to services
+	services map[string]map[string]string
+	// quitMessages maps server names to the reason sent in QUIT (empty for the default)
+	quitMessages map[string]string
+	// tagAllowlists maps server names to tags of inbound messages exposed to Lua
+	tagAllowlists map[string]tagAllowlist
+	// stateMutex protects stateSubscribers
+	stateMutex sync.Mutex
+	// stateSubscribers is the set of channels receiving connection state changes
+	stateSubscribers map[chan StateEvent]struct{}
 }
 
 // Close handles shutdown-related tasks
 func (b *BananaBoatBot) Close(ctx context.Context) {
 	log.Print("Shutting down")
+	b.handovers.Range(func(k, value interface{}) bool {
+		value.(*handover).stop()
+		value.(*handover).svr.Close(ctx)
+		return true
+	})
+	// Servers are closed at once so waiting for them to receive QUIT takes no longer than for one
+	var wg sync.WaitGroup
 	b.Servers.Range(func(k, value interface{}) bool {
-		value.(client.IrcServerInterface).Close(ctx)
+		wg.Add(1)
+		go func(svrName string, svr client.IrcServerInterface) {
+			defer wg.Done()
+			svr.Close(client.ContextWithQuitMessage(ctx, b.quitMessage(svrName)))
+		}(k.(string), value.(client.IrcServerInterface))
 		return true
 	})
+	wg.Wait()
+	b.stopRejoins()
+	b.stopTimers()
+	b.closeSQLStatements()
+	b.stopRedisSubscriptions()
 	b.luaMutex.Lock()
 	b.luaState.Close()
 	b.luaMutex.Unlock()
+	b.luaPool.Close()
 }
 
 func luaParamsFromMessage(svrName string, msg *irc.Message) []lua.LValue {
+	params := msg.Params
+	// Handlers see joins as they are without IRCv3 extended-join (which adds account and realname)
+	if msg.Command == irc.JOIN && len(params) > 1 {
+		params = params[:1]
+	}
 	// Make empty list of parameters to pass to Lua
-	luaParams := make([]lua.LValue, len(msg.Params)+4)
+	luaParams := make([]lua.LValue, len(params)+4)
 	// First parameter is the name of the server
 	luaParams[0] = lua.LString(svrName)
 	// Following three parameters are nick/user/host if set
@@ -75,30 +200,109 @@ func luaParamsFromMessage(svrName string, msg *irc.Message) []lua.LValue {
 		luaParams[1] = lua.LString(msg.Prefix.Name)
 		luaParams[2] = lua.LString(msg.Prefix.User)
 		luaParams[3] = lua.LString(msg.Prefix.Host)
+	} else {
+		luaParams[1] = lua.LNil
+		luaParams[2] = lua.LNil
+		luaParams[3] = lua.LNil
 	}
 	// Fifth parameter onwards is unpacked parameters of the irc.Message
 	pi := 0
 	for i := 4; i < len(luaParams); i++ {
-		luaParams[i] = lua.LString(msg.Params[pi])
+		luaParams[i] = lua.LString(params[pi])
 		pi++
 	}
 	return luaParams
 }
 
-func (b *BananaBoatBot) handleLuaReturnValues(ctx context.Context, svrName string, luaState *lua.LState) {
+// sendMessage queues a message to be sent to the named server
+func (b *BananaBoatBot) sendMessage(net string, ircMessage *irc.Message) {
+	svr, ok := b.Servers.Load(net)
+	if !ok {
+		log.Printf("Invalid server: %s", net)
+		return
+	}
+	select {
+	case svr.(client.IrcServerInterface).GetMessages() <- *ircMessage:
+		b.recordMessage(net, false)
+	default:
+		log.Printf("Channel full, message to server dropped: %s", ircMessage)
+		b.recordMessage(net, true)
+	}
+}
+
+// swapServer replaces a server in the map and moves messages queued for the old one to the new one
+// serversMutex must be held by the caller
+func (b *BananaBoatBot) swapServer(svrName string, newSvr client.IrcServerInterface) (client.IrcServerInterface, bool) {
+	oldSvrI, ok := b.Servers.Load(svrName)
+	b.Servers.Store(svrName, newSvr)
+	if !ok {
+		return nil, false
+	}
+	oldSvr := oldSvrI.(client.IrcServerInterface)
+	oldMessages := oldSvr.GetMessages()
+	newMessages := newSvr.GetMessages()
+	for {
+		select {
+		case msg := <-oldMessages:
+			select {
+			case newMessages <- msg:
+			default:
+				log.Printf("Channel full, queued message to server dropped: %s", &msg)
+			}
+		default:
+			return oldSvr, true
+		}
+	}
+}
+
+// outboundMessage is a message returned by a handler together with the server it should be sent to
+type outboundMessage struct {
+	// net is the friendly name of the server
+	net string
+	// msg is the message itself
+	msg *irc.Message
+}
+
+// handleLuaReturnValues sends messages returned by a handler (at most maxMessages of them)
+func (b *BananaBoatBot) handleLuaReturnValues(ctx context.Context, svrName string, luaState *lua.LState, maxMessages int) {
+	messages := b.messagesFromLua(svrName, luaState.Get(-1), maxMessages)
+	// Queue messages of a handler together so they aren't interleaved with those of others
+	b.sendMutex.Lock()
+	defer b.sendMutex.Unlock()
+	for _, m := range messages {
+		b.sendMessage(m.net, m.msg)
+	}
+}
+
+// messagesFromLua converts the return value of a handler to messages (at most maxMessages of them)
+func (b *BananaBoatBot) messagesFromLua(svrName string, lv lua.LValue, maxMessages int) []outboundMessage {
 	// Ignore nil
-	lv := luaState.Get(-1)
 	if lv.Type() == lua.LTNil {
-		return
+		return nil
 	}
 	// Get table result
-	res := luaState.CheckTable(-1)
+	res, ok := lv.(*lua.LTable)
+	if !ok {
+		log.Printf("[%s] Handler returned %s, expected table or nil", svrName, lv.Type())
+		return nil
+	}
+	var messages []outboundMessage
+	// Get how to handle line breaks in trailing parameters
+	b.handlersMutex.RLock()
+	newlines := b.newlines
+	b.handlersMutex.RUnlock()
+	// Count messages so we can stop runaway handlers flooding
+	count := 0
 	// For each numeric index in the table result...
 	res.ForEach(func(index lua.LValue, messageL lua.LValue) {
 		var command string
 		var params []string
 		// Get the nested table..
 		if message, ok := messageL.(*lua.LTable); ok {
+			count++
+			if count > maxMessages {
+				return
+			}
 			// Get 'command' string from table
 			lv := message.RawGetString("command")
 			command = lua.LVAsString(lv)
@@ -114,35 +318,40 @@ func (b *BananaBoatBot) handleLuaReturnValues(ctx context.Context, svrName strin
 			if paramsT, ok := lv.(*lua.LTable); ok {
 				// Make a list of parameters
 				params = make([]string, paramsT.MaxN())
-				// Copy parameters from Lua
-				paramsIndex := 0
-				paramsT.ForEach(func(index lua.LValue, paramL lua.LValue) {
-					params[paramsIndex] = lua.LVAsString(paramL)
-					paramsIndex++
-				})
+				// Copy parameters from Lua (missing parameters become empty strings)
+				for i := range params {
+					params[i] = lua.LVAsString(paramsT.RawGetInt(i + 1))
+				}
 			} else {
 				// No parameters, make an empty array
 				params = make([]string, 0)
 			}
-			// Create irc.Message
-			ircMessage := &irc.Message{
-				Command: command,
-				Params:  params,
+			// Get explicit 'trailing' parameter from table
+			if trailing, ok := message.RawGetString("trailing").(lua.LString); ok {
+				params = append(params, string(trailing))
 			}
-			// Send it to the server
-			svr, ok := b.Servers.Load(net)
-			if ok {
-				select {
-				case svr.(client.IrcServerInterface).GetMessages() <- *ircMessage:
-					break
-				default:
-					log.Printf("Channel full, message to server dropped: %s", ircMessage)
-				}
-			} else {
-				log.Printf("Lua eror: Invalid server: %s", net)
+			// Create irc.Messages
+			ircMessages, err := buildMessages(command, params, newlines, b.prefixLength(net))
+			if err != nil {
+				log.Printf("[%s] Handler returned invalid message: %s", svrName, err)
+				return
+			}
+			for _, ircMessage := range ircMessages {
+				messages = append(messages, outboundMessage{net: net, msg: ircMessage})
 			}
 		}
 	})
+	if count > maxMessages {
+		log.Printf("[%s] Handler returned %d messages, dropped all but the first %d", svrName, count, maxMessages)
+	}
+	return messages
+}
+
+// getMaxMessages returns the default limit of messages returned by a handler
+func (b *BananaBoatBot) getMaxMessages() int {
+	b.handlersMutex.RLock()
+	defer b.handlersMutex.RUnlock()
+	return b.maxMessages
 }
 
 // HandleHandlers invokes any registered Lua handlers for a command
@@ -151,24 +360,101 @@ func (b *BananaBoatBot) HandleHandlers(ctx context.Context, svrName string, msg
 		// Log message
 		log.Printf("[%s] %s", svrName, msg)
 	}
+	// Message belongs to a new connection which hasn't replaced the current one yet
+	if h, ok := b.pendingHandover(ctx, svrName); ok {
+		b.handleHandover(ctx, svrName, h, msg)
+		return
+	}
+	// Copies of our own messages echoed by the server are only passed to ECHO handlers
+	if echo := b.echoedMessage(svrName, msg); echo != nil {
+		msg = echo
+	}
+	// Only pass on tags scripts are allowed to see
+	if tags := client.TagsFromContext(ctx); tags != nil {
+		ctx = client.ContextWithTags(ctx, b.allowedTags(svrName, tags))
+	}
+	// Messages which didn't come from a server are treated as received now
+	if _, ok := client.TimeFromContext(ctx); !ok {
+		ctx = client.ContextWithTime(ctx, time.Now())
+	}
+	// Registration succeeded, forget about earlier failures
+	if msg.Command == irc.RPL_WELCOME {
+		b.clearReconnectState(svrName)
+		if _, ok := b.reconnecting.Load(svrName); ok {
+			b.reconnecting.Delete(svrName)
+			b.notify(svrName, "reconnected")
+		} else {
+			b.notify(svrName, "connected")
+		}
+		b.publishState(svrName, StateConnected, "")
+		b.updateHealth(svrName)
+		b.joinChannels(svrName)
+	}
+	// Joining a channel forwarded us to another one
+	if msg.Command == client.ErrLinkChannel {
+		b.handleForward(svrName, msg)
+	}
+	// Channels we were kicked from might need rejoining
+	switch msg.Command {
+	case irc.KICK, irc.ERR_CHANNELISFULL, irc.ERR_INVITEONLYCHAN, irc.ERR_BANNEDFROMCHAN, irc.ERR_BADCHANNELKEY:
+		b.handleRejoin(svrName, msg)
+	}
+	// Channel modes might need enforcing
+	switch msg.Command {
+	case irc.MODE, irc.RPL_CHANNELMODEIS, irc.RPL_ENDOFNAMES, irc.ERR_CHANOPRIVSNEEDED:
+		b.handleModes(svrName, msg)
+	}
+	// Replies to WHOIS requested by scripts are collected
+	switch msg.Command {
+	case irc.RPL_WHOISUSER, irc.RPL_WHOISSERVER, irc.RPL_WHOISOPERATOR, irc.RPL_WHOISIDLE, irc.RPL_WHOISCHANNELS,
+		rplWhoisAccount, rplWhoisActually, rplWhoisHost, rplWhoisSecure, irc.RPL_AWAY, irc.ERR_NOSUCHNICK, irc.RPL_ENDOFWHOIS,
+		client.BatchCommand:
+		b.handleWhois(ctx, svrName, msg)
+	}
+	// Monitored nicks might have come online or gone offline
+	switch msg.Command {
+	case irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD, irc.RPL_ISON, rplMonOnline, rplMonOffline, errMonListFull:
+		b.handleMonitor(ctx, svrName, msg)
+	}
+	// Keepalive PING was answered
+	if msg.Command == irc.PONG {
+		b.updateLag(svrName)
+	}
+	// Invoke command if message is one, answer CTCP queries and receive files offered by DCC
+	if msg.Command == irc.PRIVMSG {
+		b.handleCommand(ctx, svrName, msg)
+		b.handleCTCP(ctx, svrName, msg)
+		b.handleDCC(ctx, svrName, msg)
+	}
 	// Get read mutex for handlers map
 	b.handlersMutex.RLock()
+	// Forward message to external handler if one is registered
+	if ext, ok := b.externals[msg.Command]; ok {
+		go b.handleExternal(ctx, svrName, msg, ext)
+	}
 	// If we have a function corresponding to this command...
-	if luaFunction, ok := b.handlers[msg.Command]; ok {
+	if handler, ok := b.handlers[msg.Command]; ok && !handler.disabled {
+		// Get limit of messages handler may return
+		maxMessages := handler.maxMessages
+		if maxMessages == 0 {
+			maxMessages = b.maxMessages
+		}
 		// Release read mutex for handlers
 		b.handlersMutex.RUnlock()
 		// Deferred release of lua state mutex
 		defer b.luaMutex.Unlock()
-		// Make list of parameters to pass to Lua
-		luaParams := luaParamsFromMessage(svrName, msg)
 		// Get Lua mutex
 		b.luaMutex.Lock()
+		// Make list of parameters to pass to Lua
+		luaParams := handler.paramsForMessage(b.luaState, svrName, msg)
 		// Store some state information
 		b.curMessage = msg
 		b.curNet = svrName
+		b.curTags = client.TagsFromContext(ctx)
+		b.curTime = messageTime(ctx)
 		// Call function
 		err := b.luaState.CallByParam(lua.P{
-			Fn:      luaFunction,
+			Fn:      handler.fn,
 			NRet:    1,
 			Protect: true,
 		}, luaParams...)
@@ -178,7 +464,7 @@ func (b *BananaBoatBot) HandleHandlers(ctx context.Context, svrName string, msg
 			return
 		}
 		// Handle return values
-		b.handleLuaReturnValues(ctx, svrName, b.luaState)
+		b.handleLuaReturnValues(ctx, svrName, b.luaState, maxMessages)
 		// Clear stack
 		b.luaState.SetTop(0)
 	} else {
@@ -190,10 +476,20 @@ func (b *BananaBoatBot) HandleHandlers(ctx context.Context, svrName string, msg
 // ReconnectServers reconnects servers on error
 func (b *BananaBoatBot) HandleErrors(ctx context.Context, svrName string, err error) {
 	// Log the error
-	log.Printf("[%s] Connection error: %s", svrName, err)
+	errorClass := client.ClassifyError(err)
+	log.Printf("[%s] Connection error (%s): %s", svrName, errorClass, err)
 
 	b.serversMutex.Lock()
 
+	// Error belongs to a new connection we are handing over to, try again with the current one still up
+	if h, ok := b.pendingHandover(ctx, svrName); ok {
+		newSvr, svrCtx := b.retryHandover(ctx, svrName, h)
+		b.serversMutex.Unlock()
+		newSvr.ReconnectWait(svrCtx)
+		b.dialServer(svrCtx, svrName, newSvr, b.connectDelay(svrName))
+		return
+	}
+
 	// Try reconnect to the server if still configured
 	svr, ok := b.Servers.Load(svrName)
 	// Server is no longer configured, do nothing
@@ -207,20 +503,55 @@ func (b *BananaBoatBot) HandleErrors(ctx context.Context, svrName string, err er
 		b.serversMutex.Unlock()
 		return
 	}
+	b.reconnecting.Store(svrName, struct{}{})
+	b.recordDisconnect(svrName)
+	// Remember failure in case we are restarted
+	if exp := s.GetReconnectExp(); exp != nil {
+		b.saveReconnectState(svrName, atomic.LoadUint64(exp))
+	}
 	s.Close(ctx)
+	// The new connection must use TLS if the server told us to
+	var stsError *client.STSUpgradeError
+	if errors.As(err, &stsError) {
+		b.upgradeSTS(svrName, s.GetSettings().Host, stsError.Port)
+	}
 	newSvr, svrCtx := b.Config.NewIrcServer(
 		b.luaState.Context(),
 		svrName,
 		s.GetSettings())
 	newSvr.SetReconnectExp(*(s.GetReconnectExp()))
-	b.Servers.Store(svrName, newSvr)
+	keepAway(s, newSvr)
+	// Don't reconnect before the connect governor allows it
+	delay := b.connectDelay(svrName)
+	// Back off for as long as the server asked us to if we were throttled
+	var serverError *client.ServerError
+	if errors.As(err, &serverError) && serverError.Throttled {
+		log.Printf("[%s] Throttled by server, waiting at least %s before reconnecting", svrName, serverError.RetryAfter)
+		if serverError.RetryAfter > delay {
+			delay = serverError.RetryAfter
+		}
+	}
+	if delay > 0 {
+		newSvr.SetReconnectDelay(delay)
+	}
+	b.swapServer(svrName, newSvr)
 	b.serversMutex.Unlock()
+	// Notify outside of serversMutex (notifications need handlersMutex which ReloadLua holds while taking serversMutex)
+	b.notify(svrName, "disconnected (%s): %s", errorClass, err)
+	b.publishState(svrName, StateDisconnected, fmt.Sprintf("%s: %s", errorClass, err))
+	b.updateHealth(svrName)
+	// Lag of the old connection no longer applies until the new one answers a PING
+	lagGauge.DeleteLabelValues(svrName)
+	b.publishState(svrName, StateReconnecting, "")
 	newSvr.ReconnectWait(svrCtx)
+	b.publishState(svrName, StateConnecting, "")
 	newSvr.Dial(svrCtx)
 }
 
 // ReloadLua deals with reloading Lua parts
 func (b *BananaBoatBot) ReloadLua(ctx context.Context) error {
+	b.reloadMutex.Lock()
+	defer b.reloadMutex.Unlock()
 	b.luaMutex.Lock()
 	defer func() {
 		// Clear stack and release Lua mutex
@@ -228,6 +559,11 @@ func (b *BananaBoatBot) ReloadLua(ctx context.Context) error {
 		b.luaMutex.Unlock()
 	}()
 
+	// Timers are started, statements prepared and channels subscribed to again by the script
+	atomic.AddUint64(&b.generation, 1)
+	b.stopTimers()
+	b.closeSQLStatements()
+	b.stopRedisSubscriptions()
 	if err := b.luaState.DoFile(b.Config.LuaFile); err != nil {
 		return err
 	}
@@ -256,17 +592,36 @@ func (b *BananaBoatBot) ReloadLua(ctx context.Context) error {
 		b.username = username
 	}
 
+	// Get default 'reconnect' strategy (servers may override its fields)
+	b.reconnectStrategy = b.reconnectStrategyFromLua(tbl.RawGetString("reconnect"), nil)
+
 	lv = tbl.RawGetString("handlers")
 	defer b.handlersMutex.Unlock()
 	b.handlersMutex.Lock()
 	luaCommands := make(map[string]struct{})
 	if handlerTbl, ok := lv.(*lua.LTable); ok {
-		handlerTbl.ForEach(func(commandName lua.LValue, handlerFuncL lua.LValue) {
-			if handlerFunc, ok := handlerFuncL.(*lua.LFunction); ok {
-				commandNameStr := lua.LVAsString(commandName)
-				b.handlers[commandNameStr] = handlerFunc
-				luaCommands[commandNameStr] = struct{}{}
+		// Suspicious handler names are only skipped in strict mode
+		strictHandlers := lua.LVAsBool(tbl.RawGetString("strict_handlers"))
+		handlerTbl.ForEach(func(commandName lua.LValue, handlerL lua.LValue) {
+			commandNameStr, warning, err := handlerName(commandName)
+			if err != nil {
+				log.Printf("Lua reload error: ignoring handler: %s", err)
+				return
+			}
+			if len(warning) > 0 {
+				if strictHandlers {
+					log.Printf("Lua reload error: ignoring handler: %s", warning)
+					return
+				}
+				log.Printf("Lua reload warning: %s", warning)
+			}
+			handler, err := handlerFromLua(handlerL)
+			if err != nil {
+				log.Printf("Lua reload error: handler for %s: %s", commandNameStr, err)
+				return
 			}
+			b.handlers[commandNameStr] = handler
+			luaCommands[commandNameStr] = struct{}{}
 		})
 	} else {
 		return fmt.Errorf("lua reload error: unexpected handlers type: %s", lv.Type())
@@ -279,8 +634,90 @@ func (b *BananaBoatBot) ReloadLua(ctx context.Context) error {
 		}
 	}
 
+	// Get 'max_messages' from table
+	b.maxMessages = defaultMaxMessages
+	if maxMessages, ok := tbl.RawGetString("max_messages").(lua.LNumber); ok && maxMessages >= 1 {
+		b.maxMessages = int(maxMessages)
+	}
+
+	// Get 'commands' and related settings from table
+	b.commands = commandSettingsFromTable(tbl)
+
+	// Get 'ctcp' replies from table
+	b.ctcpReplies = ctcpRepliesFromLua(tbl.RawGetString("ctcp"))
+
+	// Get 'dcc' settings from table
+	b.dcc = dccSettingsFromLua(tbl.RawGetString("dcc"))
+
+	// Get 'newlines' from table
+	b.newlines = NewlinesSplit
+	if newlines := lua.LVAsString(tbl.RawGetString("newlines")); len(newlines) > 0 {
+		if validNewlines(newlines) {
+			b.newlines = newlines
+		} else {
+			log.Printf("Lua reload error: ignoring invalid newlines: %s", newlines)
+		}
+	}
+
+	// Get 'http_forbid_downgrade' from table
+	b.forbidDowngrade = lua.LVAsBool(tbl.RawGetString("http_forbid_downgrade"))
+
+	// Get 'locale' from table
+	b.locale = defaultLocale
+	if locale := lua.LVAsString(tbl.RawGetString("locale")); len(locale) > 0 {
+		b.locale = locale
+	}
+
+	// Get 'externals' from table
+	externals := make(map[string]*externalHandler)
+	lv = tbl.RawGetString("externals")
+	if externalTbl, ok := lv.(*lua.LTable); ok {
+		externalTbl.ForEach(func(commandName lua.LValue, settingsLV lua.LValue) {
+			commandNameStr := lua.LVAsString(commandName)
+			settings, ok := settingsLV.(*lua.LTable)
+			if !ok {
+				log.Printf("Lua reload error: external handler for %s: unexpected type: %s", commandNameStr, settingsLV.Type())
+				return
+			}
+			ext, err := externalHandlerFromTable(settings)
+			if err != nil {
+				log.Printf("Lua reload error: external handler for %s: %s", commandNameStr, err)
+				return
+			}
+			externals[commandNameStr] = ext
+		})
+	}
+	b.externals = externals
+
+	// Get 'notify' from table
+	b.notifier = nil
+	lv = tbl.RawGetString("notify")
+	if notifyTbl, ok := lv.(*lua.LTable); ok {
+		n, err := notifierFromTable(notifyTbl)
+		if err != nil {
+			log.Printf("Lua reload error: notify: %s", err)
+		} else {
+			b.notifier = n
+		}
+	}
+
 	// Make map of server names collected from Lua
 	luaServerNames := make(map[string]struct{})
+	// Make map of channels to join collected from Lua
+	channels := make(map[string][]channelSetting)
+	// Make map of services templates collected from Lua
+	services := make(map[string]map[string]string)
+	// Make map of channel forwarding policies collected from Lua
+	forwardPolicies := make(map[string]string)
+	// Make map of rejoin policies collected from Lua
+	rejoinPolicies := make(map[string]*rejoinPolicy)
+	// Make map of tag allowlists collected from Lua
+	tagAllowlists := make(map[string]tagAllowlist)
+	// Make map of QUIT reasons collected from Lua ('quit_message' of the bot is the default)
+	defaultQuitMessage := lua.LVAsString(tbl.RawGetString("quit_message"))
+	quitMessages := make(map[string]string)
+	// Make map of nicks to monitor collected from Lua
+	monitors := make(map[string][]string)
 	// Get 'servers' from table
 	lv = tbl.RawGetString("servers")
 	// Get table value
@@ -288,113 +725,119 @@ func (b *BananaBoatBot) ReloadLua(ctx context.Context) error {
 		// Iterate over nested tables...
 		serverTbl.ForEach(func(serverName lua.LValue, serverSettingsLV lua.LValue) {
 			// Get nested table
-			if serverSettings, ok := serverSettingsLV.(*lua.LTable); ok {
-
-				// Get 'server' string from table
-				lv = serverSettings.RawGetString("server")
-				host := lua.LVAsString(lv)
-
-				// Get 'tls' bool from table (default false)
-				var tls bool
-				lv = serverSettings.RawGetString("tls")
-				if lv, ok := lv.(lua.LBool); ok {
-					tls = bool(lv)
-				}
-
-				// Get 'tls_verify' bool from table (default true)
-				verifyTLS := true
-				lv = serverSettings.RawGetString("tls_verify")
-				if lv == lua.LFalse {
-					verifyTLS = false
-				}
-
-				// Get 'port' from table (use default from so-called config)
-				portInt := b.Config.DefaultIrcPort
-				lv = serverSettings.RawGetString("port")
-				if port, ok := lv.(lua.LNumber); ok {
-					portInt = int(port)
-				}
-
-				// Get 'nick' from table - use default if unavailable
-				var nick string
-				lv = serverSettings.RawGetString("nick")
-				if lv, ok := lv.(lua.LString); ok {
-					nick = lua.LVAsString(lv)
-				} else {
-					nick = b.nick
-				}
-
-				// Get 'realname' from table - use default if unavailable
-				var realname string
-				lv = serverSettings.RawGetString("realname")
-				if lv, ok := lv.(lua.LString); ok {
-					realname = lua.LVAsString(lv)
-				} else {
-					realname = b.realname
-				}
-
-				// Get 'username' from table - use default if unavailable
-				var username string
-				lv = serverSettings.RawGetString("username")
-				if lv, ok := lv.(lua.LString); ok {
-					username = lua.LVAsString(lv)
-				} else {
-					username = b.username
-				}
+			if settingsTbl, ok := serverSettingsLV.(*lua.LTable); ok {
 
 				// Remember we found this key
 				serverNameStr := lua.LVAsString(serverName)
 				luaServerNames[serverNameStr] = struct{}{}
-				createServer := false
-				serverSettings := &client.IrcServerSettings{
-					Host:          host,
-					Port:          portInt,
-					TLS:           tls,
-					VerifyTLS:     verifyTLS,
-					Nick:          nick,
-					MaxReconnect:  float64(b.Config.MaxReconnect),
-					Realname:      realname,
-					Username:      username,
-					ErrorCallback: b.HandleErrors,
-					InputCallback: b.HandleHandlers,
+				// Get 'channels' table from table
+				if channelsTbl, ok := settingsTbl.RawGetString("channels").(*lua.LTable); ok {
+					channels[serverNameStr] = channelsFromTable(channelsTbl)
+				}
+				// Get 'services' from table
+				services[serverNameStr] = servicesFromLua(settingsTbl.RawGetString("services"))
+				// Get 'channel_forward' policy from table
+				forwardPolicies[serverNameStr] = forwardPolicyFromLua(settingsTbl.RawGetString("channel_forward"))
+				// Get 'rejoin' policy from table
+				rejoinPolicies[serverNameStr] = rejoinPolicyFromLua(settingsTbl.RawGetString("rejoin"))
+				// Get 'tags' allowlist from table
+				tagAllowlists[serverNameStr] = tagAllowlistFromLua(settingsTbl.RawGetString("tags"))
+				// Get 'quit_message' string from table
+				quitMessages[serverNameStr] = defaultQuitMessage
+				if quitMessage := lua.LVAsString(settingsTbl.RawGetString("quit_message")); len(quitMessage) > 0 {
+					quitMessages[serverNameStr] = quitMessage
+				}
+				// Get 'monitor' list of nicks from table
+				if nicks := monitorFromLua(settingsTbl.RawGetString("monitor")); nicks != nil {
+					monitors[serverNameStr] = nicks
 				}
+				createServer := false
+				serverSettings := b.serverSettingsFromTable(settingsTbl)
+				b.getConnectGovernor(serverNameStr).setLimit(connectGovernorFromTable(settingsTbl))
 				// Check if server already exists and/or if we need to (re)create it
-				if oldSvr, ok := b.Servers.Load(serverNameStr); ok {
+				// This is done under serversMutex so HandleErrors can't replace the server meanwhile
+				b.serversMutex.Lock()
+				// Keep a handover in progress if settings are unchanged, otherwise forget about it
+				if h, ok := b.handovers.Load(serverNameStr); ok && sameServerSettings(h.(*handover).svr.GetSettings(), serverSettings) {
+					b.serversMutex.Unlock()
+					return
+				}
+				b.cancelHandover(ctx, serverNameStr)
+				oldSvr, exists := b.Servers.Load(serverNameStr)
+				if exists {
 					oldSettings := oldSvr.(client.IrcServerInterface).GetSettings()
-					if !(oldSettings.Host == serverSettings.Host &&
-						oldSettings.Port == serverSettings.Port &&
-						oldSettings.TLS == serverSettings.TLS &&
-						oldSettings.VerifyTLS == serverSettings.VerifyTLS &&
-						oldSettings.Nick == serverSettings.Nick &&
-						oldSettings.Realname == serverSettings.Realname &&
-						oldSettings.Username == serverSettings.Username) {
+					if !sameServerSettings(oldSettings, serverSettings) {
 						createServer = true
 					}
 				} else {
 					createServer = true
 				}
-				if createServer {
+				_, reconnecting := b.reconnecting.Load(serverNameStr)
+				if !createServer {
+					b.serversMutex.Unlock()
+				} else if exists && !reconnecting && lua.LVAsBool(settingsTbl.RawGetString("handover")) {
+					// Replace the connection only once the new one is ready
+					b.startHandover(ctx, serverNameStr, serverSettings, channels[serverNameStr], oldSvr.(client.IrcServerInterface))
+					b.serversMutex.Unlock()
+				} else {
 					log.Printf("Creating new IRC server: %s", serverNameStr)
 					// Create new IRC server
 					svr, svrCtx := b.Config.NewIrcServer(ctx, serverNameStr, serverSettings)
-					// Set server to map
-					oldSvr, ok := b.Servers.Load(serverNameStr)
+					// Replace server in map before closing the old one so messages aren't lost
+					oldSvr, ok := b.swapServer(serverNameStr, svr)
+					b.serversMutex.Unlock()
 					if ok {
 						log.Printf("Destroying pre-existing IRC server: %s", serverNameStr)
-						oldSvr.(client.IrcServerInterface).Close(ctx)
+						oldSvr.Close(ctx)
+						keepAway(oldSvr, svr)
+					}
+					// Resume backoff if server was failing before we were restarted
+					if exp, ok := b.loadReconnectState(serverNameStr); ok {
+						log.Printf("Restoring reconnect state of IRC server: %s", serverNameStr)
+						svr.SetReconnectExp(exp)
+						b.publishState(serverNameStr, StateReconnecting, "")
+						go func() {
+							svr.ReconnectWait(svrCtx)
+							b.publishState(serverNameStr, StateConnecting, "")
+							b.dialServer(svrCtx, serverNameStr, svr, b.connectDelay(serverNameStr))
+						}()
+					} else {
+						b.publishState(serverNameStr, StateConnecting, "")
+						go b.dialServer(svrCtx, serverNameStr, svr, b.connectDelay(serverNameStr))
 					}
-					b.Servers.Store(serverNameStr, svr)
-					go svr.(client.IrcServerInterface).Dial(svrCtx)
 				}
 			}
 		})
 	}
+	b.channels = channels
+	b.services = services
+	b.forwardPolicies = forwardPolicies
+	b.rejoinPolicies = rejoinPolicies
+	b.tagAllowlists = tagAllowlists
+	b.quitMessages = quitMessages
+	oldMonitors := b.monitors
+	b.monitors = monitors
+	for svrName := range luaServerNames {
+		if !sameStrings(oldMonitors[svrName], monitors[svrName]) {
+			b.refreshMonitor(svrName, oldMonitors[svrName], monitors[svrName])
+		}
+	}
 
 	// Remove servers no longer defined in Lua
+	// Hold serversMutex so HandleErrors can't resurrect a server we are removing
+	b.serversMutex.Lock()
+	defer b.serversMutex.Unlock()
 	b.Servers.Range(func(k, value interface{}) bool {
-		if _, ok := luaServerNames[k.(string)]; !ok {
+		// Chats aren't defined in Lua
+		if _, ok := luaServerNames[k.(string)]; !ok && !isDCCChat(k.(string)) {
 			log.Printf("Destroying removed IRC server: %s", k)
-			go value.(client.IrcServerInterface).Close(ctx)
+			b.cancelHandover(ctx, k.(string))
+			b.presences.Delete(k)
+			healthGauge.DeleteLabelValues(k.(string))
+			lagGauge.DeleteLabelValues(k.(string))
+			b.health.Delete(k)
+			b.connectGovernors.Delete(k)
+			go value.(client.IrcServerInterface).Close(client.ContextWithQuitMessage(ctx, defaultQuitMessage))
 			b.Servers.Delete(k)
 		}
 		return true
@@ -421,6 +864,10 @@ func (b *BananaBoatBot) luaLibOpenWeatherMap(luaState *lua.LState) int {
 	apiKey := luaState.CheckString(1)
 	location := luaState.CheckString(2)
 	owmURL := fmt.Sprintf(b.Config.OwmURLTemplate, apiKey, location)
+	// Ask for conditions in the language of the current locale
+	if lang := localeLanguage(b.currentLocale(luaState)); len(lang) > 0 {
+		owmURL += "&lang=" + url.QueryEscape(lang)
+	}
 	resp, err := b.httpClient.Get(owmURL)
 	if err != nil {
 		log.Printf("HTTP client error: %s", err)
@@ -459,8 +906,9 @@ func (b *BananaBoatBot) luaLibOpenWeatherMap(luaState *lua.LState) int {
 }
 
 type LuisResponse struct {
-	TopScoringIntent LuisTopScoringIntent `json:"topScoringIntent"`
-	Entities         []LuisEntity         `json:"entities"`
+	TopScoringIntent LuisTopScoringIntent   `json:"topScoringIntent"`
+	Intents          []LuisTopScoringIntent `json:"intents"`
+	Entities         []LuisEntity           `json:"entities"`
 }
 
 type LuisTopScoringIntent struct {
@@ -474,23 +922,56 @@ type LuisEntity struct {
 	Score  float64 `json:"score"`
 }
 
+// luisEntitiesTable converts entities returned by luis.ai to a Lua table
+func luisEntitiesTable(luaState *lua.LState, entities []LuisEntity) *lua.LTable {
+	entsTbl := luaState.CreateTable(len(entities), 0)
+	for _, e := range entities {
+		entTbl := luaState.CreateTable(0, 3)
+		luaState.RawSet(entTbl, lua.LString("entity"), lua.LString(e.Entity))
+		luaState.RawSet(entTbl, lua.LString("type"), lua.LString(e.Type))
+		luaState.RawSet(entTbl, lua.LString("score"), lua.LNumber(e.Score))
+		entsTbl.Append(entTbl)
+	}
+	return entsTbl
+}
+
 // luaLibLuisPredict predicts intention using luis.ai
 func (b *BananaBoatBot) luaLibLuisPredict(luaState *lua.LState) int {
 	region := luaState.CheckString(1)
 	appID := luaState.CheckString(2)
 	endpointKey := luaState.CheckString(3)
 	utterance := luaState.CheckString(4)
+	// Optional table of options
+	optsTbl := luaState.OptTable(5, luaState.CreateTable(0, 0))
+	asTable := lua.LVAsString(optsTbl.RawGetString("format")) == "table"
+	top := 0
+	if lv, ok := optsTbl.RawGetString("top").(lua.LNumber); ok {
+		top = int(lv)
+	}
 	if len(utterance) > 500 {
 		utterance = utterance[:500]
 	}
 	luisURL := fmt.Sprintf(b.Config.LuisURLTemplate, region, appID, endpointKey, url.QueryEscape(utterance))
+	// We need a verbose response to get all intents
+	if asTable {
+		u, err := url.Parse(luisURL)
+		if err != nil {
+			log.Printf("Luis URL invalid: %s", err)
+			return 0
+		}
+		q := u.Query()
+		q.Set("verbose", "true")
+		u.RawQuery = q.Encode()
+		luisURL = u.String()
+	}
 	resp, err := b.httpClient.Get(luisURL)
 	if err != nil {
 		log.Printf("HTTP client error: %s", err)
 		return 0
 	}
+	defer resp.Body.Close()
 	if ct, ok := resp.Header["Content-Type"]; ok {
-		if ct[0][:16] != "application/json" {
+		if !strings.HasPrefix(ct[0], "application/json") {
 			log.Printf("Luis GET aborted: wrong content-type: %s", ct[0])
 			return 0
 		}
@@ -512,26 +993,46 @@ func (b *BananaBoatBot) luaLibLuisPredict(luaState *lua.LState) int {
 	if luisResponse.TopScoringIntent.Intent == "" {
 		return 0
 	}
-	luaState.Push(lua.LString(luisResponse.TopScoringIntent.Intent))
-	luaState.Push(lua.LNumber(luisResponse.TopScoringIntent.Score))
-	entsTbl := luaState.CreateTable(0, 0)
-	i := 1
-	for _, e := range luisResponse.Entities {
-		entTbl := luaState.CreateTable(0, 0)
-		luaState.RawSet(entTbl, lua.LString("entity"), lua.LString(e.Entity))
-		luaState.RawSet(entTbl, lua.LString("type"), lua.LString(e.Type))
-		luaState.RawSet(entTbl, lua.LString("score"), lua.LNumber(e.Score))
-		luaState.RawSetInt(entsTbl, i, entTbl)
-		i++
+	if !asTable {
+		luaState.Push(lua.LString(luisResponse.TopScoringIntent.Intent))
+		luaState.Push(lua.LNumber(luisResponse.TopScoringIntent.Score))
+		luaState.Push(luisEntitiesTable(luaState, luisResponse.Entities))
+		return 3
+	}
+	// Fall back to top scoring intent if we didn't get a list
+	intents := luisResponse.Intents
+	if len(intents) == 0 {
+		intents = []LuisTopScoringIntent{luisResponse.TopScoringIntent}
+	}
+	if top > 0 && len(intents) > top {
+		intents = intents[:top]
 	}
-	luaState.Push(entsTbl)
-	return 3
+	intentsTbl := luaState.CreateTable(len(intents), 0)
+	for _, i := range intents {
+		intentTbl := luaState.CreateTable(0, 2)
+		luaState.RawSet(intentTbl, lua.LString("intent"), lua.LString(i.Intent))
+		luaState.RawSet(intentTbl, lua.LString("score"), lua.LNumber(i.Score))
+		intentsTbl.Append(intentTbl)
+	}
+	res := luaState.CreateTable(0, 4)
+	luaState.RawSet(res, lua.LString("intent"), lua.LString(luisResponse.TopScoringIntent.Intent))
+	luaState.RawSet(res, lua.LString("score"), lua.LNumber(luisResponse.TopScoringIntent.Score))
+	luaState.RawSet(res, lua.LString("entities"), luisEntitiesTable(luaState, luisResponse.Entities))
+	luaState.RawSet(res, lua.LString("intents"), intentsTbl)
+	luaState.Push(res)
+	return 1
 }
 
 // luaLibRandom provides access to cryptographic random numbers in Lua
 func (b *BananaBoatBot) luaLibRandom(luaState *lua.LState) int {
 	// First argument should be int for upper bound (probably at least 1)
 	i := luaState.ToInt(1)
+	// Upper bound must be positive or rand.Int panics
+	if i < 1 {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(fmt.Sprintf("invalid upper bound: %d", i)))
+		return 2
+	}
 	// Generate random integer given user supplied range
 	r, err := rand.Int(rand.Reader, big.NewInt(int64(i)))
 	// Add 1 to result
@@ -550,58 +1051,206 @@ func (b *BananaBoatBot) luaLibRandom(luaState *lua.LState) int {
 	return 2
 }
 
-// luaLibWorker runs a task in a goroutine
-func (b *BananaBoatBot) luaLibWorker(luaState *lua.LState) int {
-	defer luaState.SetTop(0)
-	// First parameter should be function
-	functionProto := luaState.CheckFunction(1).Proto
-	// Rest of parameters are parameters for that function
-	numParams := luaState.GetTop()
-	if numParams == 1 {
+const (
+	// maxWorkerParams is the maximum number of parameters which may be passed to a worker
+	maxWorkerParams = 32
+	// maxWorkerDepth is the maximum nesting depth of tables passed to a worker
+	maxWorkerDepth = 16
+)
+
+// copyWorkerValue copies tables passed to a worker so that they aren't shared between states
+func copyWorkerValue(luaState *lua.LState, lv lua.LValue, seen map[*lua.LTable]*lua.LTable, depth int) (lua.LValue, error) {
+	switch v := lv.(type) {
+	case *lua.LTable:
+		// Table was already copied (it's referenced more than once or contains a cycle)
+		if copied, ok := seen[v]; ok {
+			return copied, nil
+		}
+		if depth >= maxWorkerDepth {
+			return nil, errors.New("tables nested too deeply")
+		}
+		copied := luaState.CreateTable(v.MaxN(), 0)
+		seen[v] = copied
+		var err error
+		v.ForEach(func(key lua.LValue, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			switch key.Type() {
+			case lua.LTString, lua.LTNumber, lua.LTBool:
+				break
+			default:
+				err = fmt.Errorf("unsupported table key type: %s", key.Type())
+				return
+			}
+			value, err = copyWorkerValue(luaState, value, seen, depth+1)
+			if err == nil {
+				copied.RawSet(key, value)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return copied, nil
+	case *lua.LUserData, *lua.LState, lua.LChannel:
+		return nil, fmt.Errorf("unsupported type: %s", lv.Type())
+	}
+	return lv, nil
+}
+
+// bindWorkerValue recreates functions found in copied parameters for use in a new state
+func bindWorkerValue(luaState *lua.LState, lv lua.LValue, seen map[*lua.LTable]struct{}) lua.LValue {
+	switch v := lv.(type) {
+	case *lua.LFunction:
+		if v.IsG {
+			return luaState.NewFunction(v.GFunction)
+		}
+		return luaState.NewFunctionFromProto(v.Proto)
+	case *lua.LTable:
+		if _, ok := seen[v]; ok {
+			return v
+		}
+		seen[v] = struct{}{}
+		// Collect keys first so we don't modify the table while iterating over it
+		var keys []lua.LValue
+		v.ForEach(func(key lua.LValue, value lua.LValue) {
+			keys = append(keys, key)
+		})
+		for _, key := range keys {
+			v.RawSet(key, bindWorkerValue(luaState, v.RawGet(key), seen))
+		}
+	}
+	return lv
+}
+
+// checkWorkerFunction returns the Lua function at index n which should be run by a worker
+func checkWorkerFunction(luaState *lua.LState, n int) *lua.LFunction {
+	luaFunction := luaState.CheckFunction(n)
+	if luaFunction.IsG {
+		luaState.ArgError(n, "Lua function expected")
+	}
+	return luaFunction
+}
+
+// copyWorkerParams copies parameters from index n onwards which should be passed to a worker
+func copyWorkerParams(luaState *lua.LState, n int, seen map[*lua.LTable]*lua.LTable) []lua.LValue {
+	numParams := luaState.GetTop() - n + 1
+	if numParams > maxWorkerParams {
+		luaState.ArgError(maxWorkerParams+n, fmt.Sprintf("too many parameters (maximum is %d)", maxWorkerParams))
+	}
+	if numParams < 0 {
 		numParams = 0
-	} else {
-		numParams--
 	}
 	luaParams := make([]lua.LValue, numParams)
-	goIndex := 0
-	for i := 2; goIndex < numParams; i++ {
-		lv := luaState.Get(i)
-		luaParams[goIndex] = lv
-		goIndex++
-	}
-	// Run function in new goroutine
-	go func(functionProto *lua.FunctionProto, curNet string, curMessage *irc.Message) {
-		// Get luaState from pool
-		newState := b.luaPool.Get().(*lua.LState)
-		defer func() {
-			// Clear stack and return state to pool
-			newState.SetTop(0)
-			b.luaPool.Put(newState)
-		}()
-		// Create function from prototype
-		luaFunction := newState.NewFunctionFromProto(functionProto)
-		// Sanitise parameters
-		for i, v := range luaParams {
-			if v.Type() == lua.LTFunction {
-				luaParams[i] = newState.NewFunctionFromProto(v.(*lua.LFunction).Proto)
-			}
-		}
-		// Call function
-		err := newState.CallByParam(lua.P{
-			Fn:      luaFunction,
-			NRet:    1,
-			Protect: true,
-		}, luaParams...)
+	// Copy parameters so tables aren't shared with the new state
+	for i := range luaParams {
+		lv, err := copyWorkerValue(luaState, luaState.Get(i+n), seen, 0)
 		if err != nil {
-			log.Printf("worker: error calling Lua: %s", err)
-			return
+			luaState.ArgError(i+n, err.Error())
 		}
-		// Handle return values
-		b.handleLuaReturnValues(newState.Context(), curNet, newState)
-	}(functionProto, b.curNet, b.curMessage)
+		luaParams[i] = lv
+	}
+	return luaParams
+}
+
+// luaLibWorker runs a task in a goroutine
+func (b *BananaBoatBot) luaLibWorker(luaState *lua.LState) int {
+	defer luaState.SetTop(0)
+	// First parameter should be a Lua function
+	luaFunction := checkWorkerFunction(luaState, 1)
+	// Rest of parameters are parameters for that function
+	luaParams := copyWorkerParams(luaState, 2, make(map[*lua.LTable]*lua.LTable))
+	b.startWorker(luaState, luaFunction.Proto, luaParams)
 	return 0
 }
 
+// luaLibWorkerWithContext runs a task in a goroutine passing it a context table as first parameter
+func (b *BananaBoatBot) luaLibWorkerWithContext(luaState *lua.LState) int {
+	defer luaState.SetTop(0)
+	// First parameter should be a context table or nil to describe the current message
+	contextT := luaState.OptTable(1, nil)
+	if contextT == nil {
+		contextT = b.messageContextTable(luaState)
+	}
+	// Second parameter should be a Lua function
+	luaFunction := checkWorkerFunction(luaState, 2)
+	// Context is copied like other parameters (tables it shares with them stay shared)
+	seen := make(map[*lua.LTable]*lua.LTable)
+	contextCopy, err := copyWorkerValue(luaState, contextT, seen, 0)
+	if err != nil {
+		luaState.ArgError(1, err.Error())
+	}
+	luaParams := append([]lua.LValue{contextCopy}, copyWorkerParams(luaState, 3, seen)...)
+	b.startWorker(luaState, luaFunction.Proto, luaParams)
+	return 0
+}
+
+// messageContextTable describes the message a Lua state is handling for use as worker context
+func (b *BananaBoatBot) messageContextTable(luaState *lua.LState) *lua.LTable {
+	contextT := luaState.CreateTable(0, 7)
+	net, msg := b.currentMessage(luaState)
+	if msg == nil {
+		return contextT
+	}
+	contextT.RawSetString("net", lua.LString(net))
+	contextT.RawSetString("command", lua.LString(msg.Command))
+	if msg.Prefix != nil {
+		contextT.RawSetString("nick", lua.LString(msg.Prefix.Name))
+		contextT.RawSetString("user", lua.LString(msg.Prefix.User))
+		contextT.RawSetString("host", lua.LString(msg.Prefix.Host))
+	}
+	if target := replyTarget(msg); len(target) > 0 {
+		contextT.RawSetString("target", lua.LString(target))
+	}
+	if t := b.currentTime(luaState); !t.IsZero() {
+		contextT.RawSetString("time", lua.LNumber(float64(t.UnixNano())/float64(time.Second)))
+	}
+	return contextT
+}
+
+// startWorker runs a function with copied parameters in a new goroutine
+func (b *BananaBoatBot) startWorker(luaState *lua.LState, functionProto *lua.FunctionProto, luaParams []lua.LValue) {
+	curNet, curMessage := b.currentMessage(luaState)
+	curTags := b.currentTags(luaState)
+	curTime := b.currentTime(luaState)
+	generation := b.currentGeneration(luaState)
+	go b.runWorker(&messageContext{net: curNet, msg: curMessage, tags: curTags, time: curTime, generation: generation}, functionProto, luaParams)
+}
+
+// runWorker runs a function with copied parameters in a pooled Lua state
+func (b *BananaBoatBot) runWorker(msgCtx *messageContext, functionProto *lua.FunctionProto, luaParams []lua.LValue) {
+	// Get luaState from pool
+	newState := b.luaPool.Get()
+	// Remember which message the worker was started for
+	b.luaContexts.Store(newState, msgCtx)
+	defer func() {
+		// Clear stack and return state to pool
+		b.luaContexts.Delete(newState)
+		newState.SetTop(0)
+		b.luaPool.Put(newState)
+		b.checkMemory()
+	}()
+	// Create function from prototype
+	luaFunction := newState.NewFunctionFromProto(functionProto)
+	// Sanitise parameters
+	bound := make(map[*lua.LTable]struct{})
+	for i, v := range luaParams {
+		luaParams[i] = bindWorkerValue(newState, v, bound)
+	}
+	// Call function
+	err := newState.CallByParam(lua.P{
+		Fn:      luaFunction,
+		NRet:    1,
+		Protect: true,
+	}, luaParams...)
+	if err != nil {
+		log.Printf("worker: error calling Lua: %s", err)
+		return
+	}
+	// Handle return values
+	b.handleLuaReturnValues(newState.Context(), msgCtx.net, newState, b.getMaxMessages())
+}
+
 // luaLibGetTitle tries to get the HTML title of a URL
 func (b *BananaBoatBot) luaLibGetTitle(luaState *lua.LState) int {
 	// First argument should be some URL to try process
@@ -610,9 +1259,10 @@ func (b *BananaBoatBot) luaLibGetTitle(luaState *lua.LState) int {
 	resp, err := b.httpClient.Get(u)
 	// Handle HTTP request failure
 	if err != nil {
-		luaState.Push(lua.LNil)
 		log.Printf("HTTP client error: %s", err)
-		return 1
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(httpErrorMessage(err)))
+		return 2
 	}
 	// Expect to see text/html content-type
 	if ct, ok := resp.Header["Content-Type"]; ok {
@@ -683,14 +1333,85 @@ func (b *BananaBoatBot) luaLibGetTitle(luaState *lua.LState) int {
 func (b *BananaBoatBot) luaLibLoader(luaState *lua.LState) int {
 	// Create map of function names to functions
 	exports := map[string]lua.LGFunction{
-		"get_title":    b.luaLibGetTitle,
-		"luis_predict": b.luaLibLuisPredict,
-		"owm":          b.luaLibOpenWeatherMap,
-		"random":       b.luaLibRandom,
-		"worker":       b.luaLibWorker,
+		"account":             b.luaLibAccount,
+		"away":                b.luaLibAway,
+		"back":                b.luaLibBack,
+		"batch":               b.luaLibBatch,
+		"cancel_timer":        b.luaLibCancelTimer,
+		"capabilities":        b.luaLibCapabilities,
+		"casefold":            b.luaLibCaseFold,
+		"channel_forward":     b.luaLibChannelForward,
+		"channel_modes":       b.luaLibChannelModes,
+		"chathistory":         b.luaLibChatHistory,
+		"closest":             b.luaLibClosest,
+		"cooldown_remaining":  b.luaLibCooldownRemaining,
+		"cooldown_reset":      b.luaLibCooldownReset,
+		"cooldown_set":        b.luaLibCooldownSet,
+		"cron":                b.luaLibCron,
+		"ctcp_reply":          b.luaLibCTCPReply,
+		"ctcp_request":        b.luaLibCTCPRequest,
+		"dcc_chat":            b.luaLibDCCChat,
+		"disable_handler":     b.luaLibDisableHandler,
+		"enable_handler":      b.luaLibEnableHandler,
+		"format_bytes":        b.luaLibFormatBytes,
+		"format_table":        b.luaLibFormatTable,
+		"format_time":         b.luaLibFormatTime,
+		"get_title":           b.luaLibGetTitle,
+		"has_op":              b.luaLibHasOp,
+		"hmac_sha256":         b.luaLibHMACSHA256,
+		"http_request":        b.luaLibHTTPRequest,
+		"humanize_duration":   b.luaLibHumanizeDuration,
+		"in_channel":          b.luaLibInChannel,
+		"is_online":           b.luaLibIsOnline,
+		"is_valid_channel":    b.luaLibIsValidChannel,
+		"is_valid_nick":       b.luaLibIsValidNick,
+		"isupport":            b.luaLibISupport,
+		"json_decode":         b.luaLibJSONDecode,
+		"json_encode":         b.luaLibJSONEncode,
+		"kv_delete":           b.luaLibKVDelete,
+		"kv_get":              b.luaLibKVGet,
+		"kv_keys":             b.luaLibKVKeys,
+		"kv_scan":             b.luaLibKVScan,
+		"kv_set":              b.luaLibKVSet,
+		"lag":                 b.luaLibLag,
+		"levenshtein":         b.luaLibLevenshtein,
+		"list_handlers":       b.luaLibListHandlers,
+		"locale":              b.luaLibLocale,
+		"luis_predict":        b.luaLibLuisPredict,
+		"members":             b.luaLibMembers,
+		"memory_stats":        b.luaLibMemoryStats,
+		"message_time":        b.luaLibMessageTime,
+		"motd":                b.luaLibMOTD,
+		"names_equal":         b.luaLibNamesEqual,
+		"owm":                 b.luaLibOpenWeatherMap,
+		"param":               b.luaLibParam,
+		"parse_duration":      b.luaLibParseDuration,
+		"parse_int":           b.luaLibParseInt,
+		"parse_number":        b.luaLibParseNumber,
+		"random":              b.luaLibRandom,
+		"request":             b.luaLibRequest,
+		"server_health":       b.luaLibServerHealth,
+		"set_away":            b.luaLibSetAway,
+		"sign_message":        b.luaLibSignMessage,
+		"tags":                b.luaLibTags,
+		"test_handler":        b.luaLibTestHandler,
+		"timer":               b.luaLibTimer,
+		"topic":               b.luaLibTopic,
+		"verify_message":      b.luaLibVerifyMessage,
+		"weighted_choice":     b.luaLibWeightedChoice,
+		"whois":               b.luaLibWhois,
+		"worker":              b.luaLibWorker,
+		"worker_with_context": b.luaLibWorkerWithContext,
+	}
+	// Add helpers for sending commands to services
+	for name := range servicesPackages[defaultServicesPackage] {
+		exports[name] = b.luaLibServices(name)
 	}
 	// Convert map to Lua table and push to stack
 	mod := luaState.SetFuncs(luaState.NewTable(), exports)
+	mod.RawSetString("redis", b.redisModule(luaState))
+	mod.RawSetString("regexp", b.regexpModule(luaState))
+	mod.RawSetString("sql", b.sqlModule(luaState))
 	luaState.Push(mod)
 	return 1
 }
@@ -698,16 +1419,32 @@ func (b *BananaBoatBot) luaLibLoader(luaState *lua.LState) int {
 type BananaBoatBotConfig struct {
 	// Default port for IRC
 	DefaultIrcPort int
+	// Allow HTTP requests made by scripts to connect to loopback, link-local and private addresses
+	HTTPPrivate bool
 	// Path to script to be loaded
 	LuaFile string
 	// Shall we log each received command or not
 	LogCommands bool
+	// Seconds after which idle pooled Lua states are closed (0 keeps them forever)
+	LuaIdleTimeout int
+	// Maximum number of pooled Lua states; workers wait for a state if all are in use (0 is unlimited)
+	MaxLuaStates int
+	// Soft limit of memory usage in bytes approaching which cached state is shed (0 disables)
+	MemoryLimit uint64
 	// Format String for Luis.ai URL
 	LuisURLTemplate string
 	// Maximum reconnect interval in seconds
 	MaxReconnect int
 	// Format String for OpenWeathermap URL
 	OwmURLTemplate string
+	// Redis is the Redis server used by scripts (optional)
+	Redis *redis.Client
+	// Seconds for which persisted reconnect state is considered relevant
+	ReconnectStateTTL int
+	// SQL is the SQLite database used by scripts (optional)
+	SQL *sql.DB
+	// Store is used for persistent state (optional)
+	Store *store.Store
 	// NewIrcServer creates a new irc server
 	NewIrcServer func(parentCtx context.Context, serverName string, settings *client.IrcServerSettings) (client.IrcServerInterface, context.Context)
 }
@@ -740,27 +1477,39 @@ func NewBananaBoatBot(ctx context.Context, config *BananaBoatBotConfig) *BananaB
 
 	// Create BananaBoatBot
 	b := BananaBoatBot{
-		Config:   config,
-		handlers: make(map[string]*lua.LFunction),
-		nick:     "BananaBoatBot",
-		realname: "Banana Boat Bot",
-		username: "bananarama",
+		Config:        config,
+		cooldowns:     newCooldowns(),
+		handlers:      make(map[string]*luaHandler),
+		locale:        defaultLocale,
+		maxMessages:   defaultMaxMessages,
+		ctcpCooldowns: newCooldowns(),
+		modeCooldowns: newCooldowns(),
+		newlines:      NewlinesSplit,
+		nonces:        newCooldowns(),
+		nick:          "BananaBoatBot",
+		realname:      "Banana Boat Bot",
+		username:      "bananarama",
 	}
 
 	// Create new shared Lua state
 	b.luaState = b.newLuaState(ctx)
 
 	// Create new pool of Lua state
-	b.luaPool = sync.Pool{
-		New: func() interface{} {
-			return b.newLuaState(ctx)
-		},
+	b.luaPool = newLuaStatePool(ctx, time.Duration(config.LuaIdleTimeout)*time.Second, config.MaxLuaStates, func() *lua.LState {
+		return b.newLuaState(ctx)
+	})
+
+	// Watch memory usage if limited
+	if config.MemoryLimit > 0 {
+		go b.memoryLoop(ctx)
 	}
 
 	// Create HTTP client
 	b.httpClient = http.Client{
-		Timeout: time.Second * 60,
+		CheckRedirect: b.checkRedirect,
+		Timeout:       time.Second * 60,
 	}
+	b.requestClient = b.newRequestClient(config.HTTPPrivate)
 
 	// Call Lua script and process result
 	err := b.ReloadLua(ctx)
@@ -1,18 +1,31 @@
 package bot_test
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fatalbanana/bananaboatbot/bot"
 	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/fatalbanana/bananaboatbot/redis"
+	"github.com/fatalbanana/bananaboatbot/store"
 	"github.com/fatalbanana/bananaboatbot/test"
+	"github.com/prometheus/client_golang/prometheus"
 	irc "gopkg.in/sorcix/irc.v2"
 )
 
@@ -60,6 +73,197 @@ func TestReload(t *testing.T) {
 	}
 }
 
+func TestReloadKeepsQueuedMessages(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/trivial1.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	// Queue a message for the server
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "HELLO"},
+	})
+	oldSvrI, _ := b.Servers.Load("test")
+	// Reload with changed settings so server is recreated
+	b.Config.LuaFile = "../test/trivial3.lua"
+	err := b.ReloadLua(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svrI, _ := b.Servers.Load("test")
+	if svrI == oldSvrI {
+		t.Fatal("Server wasn't recreated")
+	}
+	// Message should have moved to the new server
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	select {
+	case msg := <-messages:
+		if msg.Params[0] != "nick1" || msg.Params[1] != "HELLO" {
+			t.Fatalf("Got wrong message: %s", &msg)
+		}
+	default:
+		t.Fatal("Queued message was lost")
+	}
+}
+
+func TestConcurrentReloads(t *testing.T) {
+	ctx := context.TODO()
+	// Count servers created
+	var created int32
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile: "../test/trivial1.lua",
+		NewIrcServer: func(ctx context.Context, name string, settings *client.IrcServerSettings) (client.IrcServerInterface, context.Context) {
+			atomic.AddInt32(&created, 1)
+			return test.NewMockIrcServer(ctx, name, settings)
+		},
+	})
+	defer b.Close(ctx)
+	// Fire reloads with changed settings concurrently
+	b.Config.LuaFile = "../test/trivial3.lua"
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- b.ReloadLua(ctx)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Server should have been recreated exactly once
+	if created != 2 {
+		t.Fatalf("Expected 2 servers to be created, got %d", created)
+	}
+	svrI, ok := b.Servers.Load("test")
+	if !ok {
+		t.Fatal("Server is missing")
+	}
+	if nick := svrI.(client.IrcServerInterface).GetSettings().Nick; nick != "testbot2" {
+		t.Fatalf("Server has wrong nick: %s", nick)
+	}
+}
+
+func TestHandover(t *testing.T) {
+	ctx := context.TODO()
+	// Remember servers created and their contexts
+	var mutex sync.Mutex
+	var servers []client.IrcServerInterface
+	var contexts []context.Context
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile: "../test/handover1.lua",
+		NewIrcServer: func(ctx context.Context, name string, settings *client.IrcServerSettings) (client.IrcServerInterface, context.Context) {
+			svr, svrCtx := test.NewMockIrcServer(ctx, name, settings)
+			mutex.Lock()
+			servers = append(servers, svr)
+			contexts = append(contexts, svrCtx)
+			mutex.Unlock()
+			return svr, svrCtx
+		},
+	})
+	defer b.Close(ctx)
+	oldSvr := servers[0]
+	// Change address of server
+	b.Config.LuaFile = "../test/handover2.lua"
+	err := b.ReloadLua(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	if len(servers) != 2 {
+		t.Fatalf("Expected 2 servers to be created, got %d", len(servers))
+	}
+	newSvr, newCtx := servers[1], contexts[1]
+	mutex.Unlock()
+	current := func() client.IrcServerInterface {
+		svrI, ok := b.Servers.Load("test")
+		if !ok {
+			t.Fatal("Server is missing")
+		}
+		return svrI.(client.IrcServerInterface)
+	}
+	if current() != oldSvr {
+		t.Fatal("Server was replaced before new connection was ready")
+	}
+	// Reloading unchanged settings shouldn't restart the handover
+	err = b.ReloadLua(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	if len(servers) != 2 {
+		t.Fatalf("Expected 2 servers to be created, got %d", len(servers))
+	}
+	mutex.Unlock()
+	// Messages from new connection aren't passed to handlers
+	b.HandleHandlers(newCtx, "test", &irc.Message{
+		Command: irc.PRIVMSG,
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Params:  []string{"testbot1", "HELLO"},
+	})
+	select {
+	case msg := <-oldSvr.GetMessages():
+		t.Fatalf("Unexpected message to old server: %s", &msg)
+	case msg := <-newSvr.GetMessages():
+		t.Fatalf("Unexpected message to new server: %s", &msg)
+	default:
+	}
+	// New connection answers PINGs (the client picks another nick if ours is taken)
+	b.HandleHandlers(newCtx, "test", &irc.Message{
+		Command: irc.PING,
+		Params:  []string{"token"},
+	})
+	if msg := <-newSvr.GetMessages(); msg.String() != "PONG token" {
+		t.Fatalf("Expected %q, got %q", "PONG token", msg.String())
+	}
+	// New connection is registered and joins channels
+	welcome := &irc.Message{
+		Command: irc.RPL_WELCOME,
+		Params:  []string{"testbot1_", "Welcome"},
+	}
+	newSvr.GetState().Handle(welcome)
+	b.HandleHandlers(newCtx, "test", welcome)
+	msg := <-newSvr.GetMessages()
+	if msg.String() != "JOIN #chan" {
+		t.Fatalf("Expected JOIN, got %q", msg.String())
+	}
+	if current() != oldSvr {
+		t.Fatal("Server was replaced before channels were joined")
+	}
+	// Messages queued meanwhile go to the old connection
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Command: irc.PRIVMSG,
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Params:  []string{"testbot1", "HELLO"},
+	})
+	// Joining channels completes the handover
+	join := &irc.Message{
+		Command: irc.JOIN,
+		Prefix:  &irc.Prefix{Name: "testbot1_"},
+		Params:  []string{"#chan"},
+	}
+	newSvr.GetState().Handle(join)
+	b.HandleHandlers(newCtx, "test", join)
+	if current() != newSvr {
+		t.Fatal("Server wasn't replaced after handover")
+	}
+	// Queued message was moved and nick is taken back
+	for _, expected := range []string{"PRIVMSG nick1 HELLO", "NICK testbot1"} {
+		msg := <-newSvr.GetMessages()
+		if msg.String() != expected {
+			t.Fatalf("Expected %q, got %q", expected, msg.String())
+		}
+	}
+}
+
 func TestLuis(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		b, err := json.Marshal(&bot.LuisResponse{
@@ -109,6 +313,66 @@ func TestLuis(t *testing.T) {
 	}
 }
 
+func TestLuisTable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Intents are only returned in verbose mode
+		if r.URL.Query().Get("verbose") != "true" {
+			t.Errorf("Request wasn't verbose: %s", r.URL)
+		}
+		b, err := json.Marshal(&bot.LuisResponse{
+			Entities: []bot.LuisEntity{
+				bot.LuisEntity{
+					Entity: "WORLD",
+					Score:  0.5,
+					Type:   "Thing",
+				},
+			},
+			Intents: []bot.LuisTopScoringIntent{
+				bot.LuisTopScoringIntent{
+					Intent: "Hello",
+					Score:  0.5,
+				},
+				bot.LuisTopScoringIntent{
+					Intent: "Goodbye",
+					Score:  0.25,
+				},
+				bot.LuisTopScoringIntent{
+					Intent: "None",
+					Score:  0.125,
+				},
+			},
+			TopScoringIntent: bot.LuisTopScoringIntent{
+				Intent: "Hello",
+				Score:  0.5,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-type", "application/json")
+		w.Write(b)
+	}))
+	defer ts.Close()
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:         "../test/luis_table.lua",
+		LuisURLTemplate: fmt.Sprintf("%s?region=%%s&appid=%%s&key=%%s&verbose=false&utterance=%%s", ts.URL),
+		NewIrcServer:    test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "HELLO"},
+	})
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	msg := <-messages
+	expected := "Hello 0.5 WORLD Hello=0.5,Goodbye=0.25"
+	if msg.Params[1] != expected {
+		t.Fatalf("Got wrong response: %s (expected %s)", msg.Params[1], expected)
+	}
+}
+
 func TestOwm(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		b, err := json.Marshal(&bot.OWMResponse{
@@ -124,6 +388,10 @@ func TestOwm(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		// Conditions should be requested in the language of the default locale
+		if lang := r.URL.Query().Get("lang"); lang != "en" {
+			t.Errorf("Got wrong language: %s", lang)
+		}
 		w.Header().Set("Content-type", "application/json")
 		w.Write(b)
 	}))
@@ -183,69 +451,2697 @@ func TestTitleScrape(t *testing.T) {
 	}
 }
 
-func makeErrorHandler(b *bot.BananaBoatBot, done chan struct{}) func(context.Context, string, error) {
-	return func(ctx context.Context, svrName string, err error) {
-		b.HandleErrors(ctx, svrName, err)
-		done <- struct{}{}
-	}
+func TestTitleRedirect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		case "/gopher":
+			http.Redirect(w, r, "gopher://example.com/", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/title":
+			w.Header().Set("Content-type", "text/html")
+			w.Write([]byte(`<html><head><title>asdf</title></head></html>`))
+		default:
+			http.Redirect(w, r, "/title", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		fmt.Sprintf("return bb.get_title('%s/redirect')", ts.URL):               "asdf",
+		fmt.Sprintf("return select(2, bb.get_title('%s/file'))", ts.URL):        "redirect to file:///etc/passwd not allowed: scheme file isn't http or https",
+		fmt.Sprintf("return select(2, bb.get_title('%s/gopher'))", ts.URL):      "redirect to gopher://example.com/ not allowed: scheme gopher isn't http or https",
+		fmt.Sprintf("return select(2, bb.get_title('%s/loop')) ~= nil", ts.URL): "true",
+	})
 }
 
-// Test error handling
-func TestHandleServerError(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	l, serverPort := test.FakeServer(t)
+func TestJSON(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.json_encode({1, 'two', true})":                     `[1,"two",true]`,
+		"return bb.json_encode({b = {x = 1.5}, a = '<&>'})":           `{"a":"<&>","b":{"x":1.5}}`,
+		"return bb.json_encode({})":                                   "{}",
+		"return bb.json_encode({[1] = 'a', [3] = 'c'})":               `{"1":"a","3":"c"}`,
+		"return bb.json_encode('line\\nbreak')":                       `"line\nbreak"`,
+		"local t = {} t.self = t return select(2, bb.json_encode(t))": "table contains a cycle",
+		"return select(2, bb.json_encode({f = function() end}))":      "unsupported type: function",
+		"return select(2, bb.json_encode(0/0))":                       "unsupported number: NaN",
+		"local v = bb.json_decode('{\"list\": [1, 2, {\"n\": null}], \"s\": \"x\"}') return #v.list .. v.s .. tostring(v.list[3].n)": "3xnil",
+		"return bb.json_decode(bb.json_encode({name = 'bob', karma = 3})).karma":                                                     "3",
+		"return bb.json_decode('null')":                                                  "nil",
+		"local v = bb.json_decode('[1,null,3]') return tostring(v[2]) .. v[3]":           "nil3",
+		"return select(2, bb.json_decode('{'))":                                          "unexpected end of JSON input",
+		"return select(2, bb.json_decode(string.rep('[', 200) .. string.rep(']', 200)))": "JSON nested too deeply",
+	})
+}
 
-	done := make(chan struct{}, 1)
+func TestRegexp(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.regexp.match([[^!(\\w+)]], '!weather london')":                               "true",
+		"return bb.regexp.match('(?i)^HELLO', 'hello there')":                                   "true",
+		"return bb.regexp.match('^x', 'hello')":                                                 "false",
+		"return table.concat({bb.regexp.find([[(\\w+)@(\\w+)]], 'mail bob@example now')}, ' ')": "bob@example bob example",
+		"return bb.regexp.find('z', 'abc')":                                                     "nil",
+		"local out = {} for _, m in ipairs(bb.regexp.find_all([[(?P<k>\\w+)=(\\d+)]], 'a=1 b=2 c=x')) do table.insert(out, m.k .. m[3]) end return table.concat(out, ',')": "a1,b2",
+		"return #bb.regexp.find_all('a', 'aaaa', 2)":                                                                          "2",
+		"return bb.regexp.replace([[(\\w+)@(\\w+)]], 'bob@example', '${2} at $1')":                                            "example at bob",
+		"return bb.regexp.replace([[\\bcat\\b]], 'cat concat cat', function(m) return m:upper() end)":                         "CAT concat CAT",
+		"return bb.regexp.replace('[aeiou]', 'banana', function(m) if m == 'a' then return '4' end end)":                      "b4n4n4",
+		"return bb.regexp.replace('a', 'banana', 4)":                                                                          "b4n4n4",
+		"return bb.regexp.replace('a', 'banana', function() return 4 end)":                                                    "b4n4n4",
+		"return select(2, pcall(bb.regexp.replace, 'a', 'banana', function() return {} end))":                                 "<string>:1: invalid replacement value (a table)",
+		"local re = bb.regexp.compile([[^(\\d+)\\+(\\d+)$]]) local _, a, b = re:find('2+3') return re:match('2+3') and a + b": "5",
+		"return select(2, bb.regexp.compile('('))":                                                                            "error parsing regexp: missing closing ): `(`",
+		"return select(2, pcall(bb.regexp.match, '(', 'x'))":                                                                  "<string>:1: bad argument #1 to (anonymous) (error parsing regexp: missing closing ): `(`)",
+	})
+}
 
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			conn.Close()
-			done <- struct{}{}
+func TestHTTPRequest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Method", r.Method)
+			w.Header().Add("X-Multi", "a")
+			w.Header().Add("X-Multi", "b")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "%s %s", r.Header.Get("Authorization"), body)
+		case "/large":
+			w.Write(bytes.Repeat([]byte("x"), 2<<20))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		default:
+			http.NotFound(w, r)
 		}
-	}()
+	}))
+	defer ts.Close()
+	ctx := context.TODO()
+	// Requests to private addresses aren't allowed by default
+	b := newHelpersBot(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		fmt.Sprintf("return select(2, bb.http_request{url = '%s/echo'})", ts.URL):                                               "connecting to private addresses not allowed",
+		fmt.Sprintf("return select(2, bb.http_request{url = '%s/echo'})", strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)): "connecting to private addresses not allowed",
+	})
+	b.Close(ctx)
+	b = bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		HTTPPrivate:  true,
+		LuaFile:      "../test/helpers.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		fmt.Sprintf("local status, headers, body = bb.http_request{method = 'post', url = '%s/echo', headers = {Authorization = 'Bearer x'}, body = '{}'} return status .. ' ' .. headers['x-method'] .. ' ' .. headers['x-multi'] .. ' ' .. body", ts.URL): "201 POST a, b Bearer x {}",
+		fmt.Sprintf("return bb.http_request{url = '%s/missing'}", ts.URL):                                "404",
+		fmt.Sprintf("return select(2, bb.http_request{url = '%s/large'})", ts.URL):                       "response larger than 1048576 bytes",
+		fmt.Sprintf("return select(2, bb.http_request{url = '%s/slow', timeout = 0.05}) ~= nil", ts.URL): "true",
+		fmt.Sprintf("return select(2, bb.http_request{url = '%s/file'})", ts.URL):                        "redirect to file:///etc/passwd not allowed: scheme file isn't http or https",
+		"return select(2, pcall(bb.http_request, {url = 'file:///etc/passwd'}))":                         "<string>:1: bad argument #1 to (anonymous) (url must be http or https)",
+	})
+}
 
-	// Create BananaBoatBot
+func TestExternal(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &bot.ExternalRequest{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Net != "test" || req.Nick != "nick1" || len(req.Params) != 2 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		b, err := json.Marshal([]bot.ExternalMessage{
+			bot.ExternalMessage{
+				Command: irc.PRIVMSG,
+				Params:  []string{req.Nick, strings.ToLower(req.Params[1])},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-type", "application/json")
+		w.Write(b)
+	}))
+	defer ts.Close()
+	os.Setenv("BANANABOAT_TEST_URL", ts.URL)
+	defer os.Unsetenv("BANANABOAT_TEST_URL")
+	ctx := context.TODO()
 	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
 		LogCommands:  true,
-		LuaFile:      "../test/trivial1.lua",
+		LuaFile:      "../test/external.lua",
 		MaxReconnect: 0,
 		NewIrcServer: test.NewMockIrcServer,
 	})
+	defer b.Close(ctx)
+	// Say hello
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "HELLO"},
+	})
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	msg := <-messages
+	if msg.Command != irc.PRIVMSG {
+		t.Fatalf("Got wrong message type in response: %s", msg.Command)
+	}
+	if msg.Params[0] != "nick1" || msg.Params[1] != "hello" {
+		t.Fatalf("Got wrong parameters in response: %s", strings.Join(msg.Params, ","))
+	}
+}
 
-	// Naive approach to faking error won't work properly (but here for coverage)
-	b.HandleErrors(ctx, "test", errors.New("something went wrong"))
+func TestBadReturnValues(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/badreturn.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	// Bad return values should be ignored
+	for _, input := range []string{"string", "number", "boolean", "HELLO"} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{"testbot1", input},
+		})
+	}
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	msg := <-messages
+	if msg.Params[1] != "HELLO" {
+		t.Fatalf("Got wrong parameters in response: %s", strings.Join(msg.Params, ","))
+	}
+}
 
-	handleErrors := makeErrorHandler(b, done)
+func TestWorkerParams(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LogCommands:  true,
+		LuaFile:      "../test/worker.lua",
+		MaxReconnect: 0,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{"nested", "NESTED"},
+		{"param", "param"},
+		{"context", "nick1: done"},
+		{"custom", "result for #chan"},
+		{"many", "too many parameters"},
+		{"keys", "unsupported table key type"},
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{"testbot1", tc.input},
+		})
+		msg := <-messages
+		if msg.Params[0] != "nick1" || !strings.Contains(msg.Params[1], tc.expected) {
+			t.Fatalf("Got wrong parameters in response to %s: %s", tc.input, strings.Join(msg.Params, ","))
+		}
+	}
+}
 
-	// Create settings for superfluous client
-	settings := &client.IrcServerSettings{
-		Host:          "localhost",
-		Port:          serverPort,
-		TLS:           false,
-		Nick:          "testbot1",
-		Realname:      "testbotr",
-		Username:      "testbotu",
-		Password:      "yodel",
-		ErrorCallback: handleErrors,
-		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
-			// Not relevant
-		},
+func TestTimers(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LogCommands:  true,
+		LuaFile:      "../test/timers.lua",
+		MaxReconnect: 0,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	msg := <-messages
+	if strings.Join(msg.Params, " ") != "#loaded loaded" {
+		t.Fatalf("Got wrong message from timer started while loading: %s", strings.Join(msg.Params, " "))
 	}
-	// Create client
-	svrI, svrCtx := client.NewIrcServer(ctx, "test", settings)
-	// Replace existing client with our one
-	b.Servers.Store("test", svrI)
-	// Dial server
-	svrI.(client.IrcServerInterface).Dial(svrCtx)
-	// Wait for dropped connection
-	<-done
-	// Wait for error handling
-	<-done
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{"timer", "tick"},
+		{"cron", "true false"},
+		{"badcron", "value out of range"},
+		{"nevercron", "schedule never runs"},
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{"testbot1", tc.input},
+		})
+		msg := <-messages
+		if msg.Params[0] != "nick1" || !strings.Contains(msg.Params[1], tc.expected) {
+			t.Fatalf("Got wrong parameters in response to %s: %s", tc.input, strings.Join(msg.Params, ","))
+		}
+	}
+	// Reloading cancels pending timers
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "pending"},
+	})
+	if err := b.ReloadLua(ctx); err != nil {
+		t.Fatal(err)
+	}
+	msg = <-messages
+	if strings.Join(msg.Params, " ") != "#loaded loaded" {
+		t.Fatalf("Got wrong message after reload: %s", strings.Join(msg.Params, " "))
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("Got message from cancelled timer: %s", strings.Join(msg.Params, " "))
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestTimersReload(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer ts.Close()
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		HTTPPrivate:  true,
+		LogCommands:  true,
+		LuaFile:      "../test/timers.lua",
+		MaxReconnect: 0,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	<-messages
+	// Worker starts timers while the script is reloaded
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "flood"},
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.ReloadLua(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// Worker of the old script starts a timer after the reload
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "stale " + ts.URL},
+	})
+	<-started
+	if err := b.ReloadLua(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	refused := false
+	for {
+		select {
+		case msg := <-messages:
+			switch strings.Join(msg.Params, " ") {
+			case "#stale script was reloaded":
+				refused = true
+			case "#stale stale":
+				t.Fatal("Got message from timer started by script before reload")
+			}
+		case <-time.After(300 * time.Millisecond):
+			if !refused {
+				t.Fatal("Timer started by script before reload wasn't refused")
+			}
+			return
+		}
+	}
+}
+
+// newHelpersBot creates a bot using test/helpers.lua
+func newHelpersBot(ctx context.Context) *bot.BananaBoatBot {
+	return bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LogCommands:  true,
+		LuaFile:      "../test/helpers.lua",
+		MaxReconnect: 0,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+}
+
+// testHelpers evaluates Lua expressions using test/helpers.lua and checks the results
+func testHelpers(ctx context.Context, t *testing.T, b *bot.BananaBoatBot, cases map[string]string) {
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	for input, expected := range cases {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{"testbot1", input},
+		})
+		msg := <-messages
+		if msg.Params[1] != expected {
+			t.Errorf("%s: %s != %s", input, msg.Params[1], expected)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.levenshtein('kitten', 'sitting')":                           "3",
+		"return bb.levenshtein('', 'abc')":                                     "3",
+		"return bb.levenshtein('same', 'same')":                                "0",
+		"return bb.levenshtein('naïve', 'naive')":                              "1",
+		"return bb.closest('hepl', {'help', 'hello', 'weather'})":              "help",
+		"return select(2, bb.closest('wether', {'help', 'hello', 'weather'}))": "1",
+		"return bb.closest('x', {})":                                           "nil",
+	})
+}
+
+func TestParam(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.param(1)":  "testbot1",
+		"return bb.param(2)":  "return bb.param(2)",
+		"return bb.param(3)":  "",
+		"return bb.param(0)":  "",
+		"return bb.param(-1)": "",
+	})
+}
+
+func TestCooldown(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.cooldown_remaining('PRIVMSG:test:#chan:nick1')":                             "0",
+		"bb.cooldown_set('a', 60); return bb.cooldown_remaining('a') > 59":                     "true",
+		"bb.cooldown_set('b', 60); bb.cooldown_reset('b'); return bb.cooldown_remaining('b')":  "0",
+		"bb.cooldown_set('c', 60); bb.cooldown_set('c', 0); return bb.cooldown_remaining('c')": "0",
+	})
+}
+
+func TestParse(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.parse_int(' 42 ')":                "42",
+		"return bb.parse_int('-3', -5, 5)":           "-3",
+		"return bb.parse_int('4x')":                  "nil",
+		"return select(2, bb.parse_int('4.5'))":      "invalid integer: 4.5",
+		"return select(2, bb.parse_int('7', 1, 6))":  "out of range: 7 (expected 1 to 6)",
+		"return select(2, bb.parse_int('1e999'))":    "invalid integer: 1e999",
+		"return bb.parse_number('1.5')":              "1.5",
+		"return select(2, bb.parse_number('nan'))":   "invalid number: nan",
+		"return select(2, bb.parse_number('1e999'))": "invalid number: 1e999",
+		"return select(2, bb.random(0))":             "invalid upper bound: 0",
+	})
+}
+
+func TestWeightedChoice(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.weighted_choice({a = 0, b = -1, c = 2})":   "c",
+		"return select(2, bb.weighted_choice({a = 0}))":       "no positive weights",
+		"return select(2, bb.weighted_choice({a = 'heavy'}))": "no positive weights",
+	})
+	// Check distribution over many samples
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	counts := make(map[string]int)
+	samples := 4000
+	for i := 0; i < samples; i++ {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{"testbot1", "return bb.weighted_choice({a = 1, b = 3, c = 0})"},
+		})
+		msg := <-messages
+		counts[msg.Params[1]]++
+	}
+	// Expect 1000 a and 3000 b (standard deviation is about 27)
+	if counts["a"] < 800 || counts["a"] > 1200 || counts["a"]+counts["b"] != samples {
+		t.Fatalf("Got unexpected distribution: %v", counts)
+	}
+}
+
+func TestLag(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.lag('test')":    "nil",
+		"return bb.lag('invalid')": "nil",
+	})
+	// Simulate answered PING
+	svrI, _ := b.Servers.Load("test")
+	state := svrI.(client.IrcServerInterface).GetState()
+	state.SetPingSent("token")
+	time.Sleep(time.Millisecond)
+	pong := &irc.Message{
+		Prefix:  &irc.Prefix{Name: "irc.example.com"},
+		Command: irc.PONG,
+		Params:  []string{"irc.example.com", "token"},
+	}
+	state.Handle(pong)
+	b.HandleHandlers(ctx, "test", pong)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.lag('test') >= 1": "true",
+	})
+}
+
+func TestAway(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.away('test')":                        "nil",
+		"return bb.set_away('invalid', 'gone fishing')": "nil",
+	})
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	for _, tc := range []struct {
+		input    string
+		expected string
+		away     string
+	}{
+		{"return bb.set_away('test', 'gone fishing')", "AWAY :gone fishing", "gone fishing"},
+		{"return bb.back('test')", "AWAY", ""},
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{"testbot1", tc.input},
+		})
+		if msg := <-messages; msg.String() != tc.expected {
+			t.Fatalf("%s: sent %q instead of %q", tc.input, msg.String(), tc.expected)
+		}
+		if msg := <-messages; msg.Params[1] != "true" {
+			t.Fatalf("%s: returned %s", tc.input, msg.Params[1])
+		}
+		if away := svrI.(client.IrcServerInterface).GetState().Away(); away != tc.away {
+			t.Fatalf("%s: away is %q instead of %q", tc.input, away, tc.away)
+		}
+	}
+}
+
+func TestMOTD(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.motd('test')":    "nil",
+		"return bb.motd('invalid')": "nil",
+	})
+	svrI, _ := b.Servers.Load("test")
+	state := svrI.(client.IrcServerInterface).GetState()
+	for _, msg := range []*irc.Message{
+		&irc.Message{Command: irc.RPL_MOTDSTART, Params: []string{"testbot1", "- irc.example.com Message of the day - "}},
+		&irc.Message{Command: irc.RPL_MOTD, Params: []string{"testbot1", "- Maintenance tonight"}},
+		&irc.Message{Command: irc.RPL_ENDOFMOTD, Params: []string{"testbot1", "End of /MOTD command."}},
+	} {
+		state.Handle(msg)
+	}
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.motd('test')": "Maintenance tonight",
+	})
+}
+
+func TestISupport(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	svrI.(client.IrcServerInterface).GetState().Handle(&irc.Message{
+		Command: irc.RPL_ISUPPORT,
+		Params:  []string{"testbot1", "NETWORK=Banana", "NICKLEN=9", "WHOX", "are supported by this server"},
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.isupport('test', 'network')":                       "Banana",
+		"return bb.isupport('test', 'NICKLEN')":                       "9",
+		"return bb.isupport('test', 'WHOX')":                          "true",
+		"return bb.isupport('test', 'CHANLEN')":                       "nil",
+		"return bb.isupport('nope', 'NETWORK')":                       "nil",
+		"local t = bb.isupport('test') return t.NETWORK .. t.NICKLEN": "Banana9",
+	})
+}
+
+func TestCaseFold(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.casefold('test', 'Nick[1]')":                "nick{1}",
+		"return bb.casefold('nope', 'Nick^')":                  "nick~",
+		"return bb.names_equal('test', '#Chan|', '#chan\\\\')": "true",
+		"return bb.names_equal('test', 'nick', 'nick2')":       "false",
+	})
+	svrI, _ := b.Servers.Load("test")
+	svrI.(client.IrcServerInterface).GetState().Handle(&irc.Message{
+		Command: irc.RPL_ISUPPORT,
+		Params:  []string{"testbot1", "CASEMAPPING=ascii", "are supported by this server"},
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.casefold('test', 'Nick[1]')":           "nick[1]",
+		"return bb.names_equal('test', 'NICK', 'nick')":   "true",
+		"return bb.names_equal('test', 'nick[', 'nick{')": "false",
+	})
+}
+
+func TestIsValid(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	cases := map[string]string{
+		"return bb.is_valid_nick('test', 'nick[1]')":                      "true",
+		"return bb.is_valid_nick('test', '1nick')":                        "false",
+		"return bb.is_valid_nick('test', 'nick name')":                    "false",
+		"return bb.is_valid_nick('test', 'averyveryverylongnick')":        "true",
+		"return bb.is_valid_channel('test', '#chan')":                     "true",
+		"return bb.is_valid_channel('test', '&chan')":                     "true",
+		"return bb.is_valid_channel('test', '#')":                         "false",
+		"return bb.is_valid_channel('test', '#a,#b')":                     "false",
+		"return bb.is_valid_channel('test', 'chan')":                      "false",
+		"return bb.is_valid_channel('test', '!chan')":                     "false",
+		"return bb.is_valid_channel('test', '#averyveryverylongchannel')": "true",
+	}
+	testHelpers(ctx, t, b, cases)
+	// Limits advertised by server are applied
+	svrI, _ := b.Servers.Load("test")
+	svrI.(client.IrcServerInterface).GetState().Handle(&irc.Message{
+		Command: irc.RPL_ISUPPORT,
+		Params:  []string{"testbot1", "NICKLEN=9", "CHANTYPES=#!", "CHANLEN=16", "are supported by this server"},
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.is_valid_nick('test', 'averyveryverylongnick')":        "false",
+		"return bb.is_valid_channel('test', '&chan')":                     "false",
+		"return bb.is_valid_channel('test', '!chan')":                     "true",
+		"return bb.is_valid_channel('test', '#averyveryverylongchannel')": "false",
+	})
+}
+
+func TestServices(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/services.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	format := "local m = %s return m.command .. ' ' .. m.net .. ' ' .. table.concat(m.params, ':')"
+	testHelpers(ctx, t, b, map[string]string{
+		fmt.Sprintf(format, "bb.chanserv_op('test', '#chan', 'nick1')"):            "PRIVMSG test ChanServ:OP #chan nick1",
+		fmt.Sprintf(format, "bb.chanserv_invite('test', '#chan')"):                 "PRIVMSG test ChanServ:INVITE #chan",
+		fmt.Sprintf(format, "bb.nickserv_regain('test', 'testbot1', 'secret')"):    "PRIVMSG test NickServ:RECOVER testbot1 secret",
+		fmt.Sprintf(format, "bb.nickserv_regain('other', 'testbot1', 'secret')"):   "PRIVMSG other NickServ:REGAIN testbot1 secret",
+		fmt.Sprintf(format, "bb.chanserv_op('other', '#chan', 'nick1')"):           "PRIVMSG other ChanServ:OP #chan nick1 +",
+		fmt.Sprintf(format, "bb.memoserv_send('unknown', 'nick1', 'hello there')"): "PRIVMSG unknown MemoServ:SEND nick1 hello there",
+	})
+}
+
+func TestSigning(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.hmac_sha256('key', 'The quick brown fox jumps over the lazy dog')":                                                                  "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		"local s = bb.sign_message('k', 'do it') local p = bb.verify_message('k', s) local _, err = bb.verify_message('k', s) return p .. ': ' .. err": "do it: replayed signature",
+		"local _, err = bb.verify_message('other', bb.sign_message('k', 'do it')) return err":                                                          "bad signature",
+		"local _, err = bb.verify_message('k', 'x' .. bb.sign_message('k', 'do it')) return err":                                                       "bad signature",
+		"local _, err = bb.verify_message('k', 'do it') return err":                                                                                    "missing signature",
+		"local _, err = bb.verify_message('k', 'do it bbsig:1') return err":                                                                            "malformed signature",
+		"local _, err = bb.verify_message('k', 'hi bbsig:1000:abcd:' .. bb.hmac_sha256('k', '1000:abcd:hi')) return err":                               "signature expired",
+	})
+}
+
+func TestLocale(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	// Default locale is used if none is configured
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.locale()":           "en",
+		"return bb.format_bytes(100)":  "100 B",
+		"return bb.format_bytes(1536)": "1.5 KiB",
+		"return bb.format_time(0)":     "01/01/1970 12:00 AM UTC",
+	})
+	// Channels may override the global locale
+	b.Config.LuaFile = "../test/locale.lua"
+	err := b.ReloadLua(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	for channel, expected := range map[string]string{
+		"#plain":  "de 1,5 KiB 01.01.1970 00:00 UTC",
+		"#FRENCH": "fr_FR 1,5 KiB 01/01/1970 00:00 UTC",
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{channel, "formats"},
+		})
+		msg := <-messages
+		if msg.Params[1] != expected {
+			t.Fatalf("Got wrong response in %s: %s", channel, msg.Params[1])
+		}
+	}
+}
+
+func TestTestHandler(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/test_handler.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	boss := &irc.Prefix{Name: "boss", User: "b", Host: "host.example.com"}
+	for _, tc := range []struct {
+		prefix   *irc.Prefix
+		text     string
+		expected string
+	}{
+		{boss, "!debug !echo", "test PRIVMSG #chan,hello world"},
+		{boss, "!debug JOIN", "test PRIVMSG #chan,welcome; test PRIVMSG #chan,boss"},
+		{boss, "!debug FOO", "no such handler: FOO"},
+		{&irc.Prefix{Name: "nobody", User: "n", Host: "example.org"}, "!debug !echo", "permission denied"},
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  tc.prefix,
+			Command: irc.PRIVMSG,
+			Params:  []string{"#chan", tc.text},
+		})
+		msg := <-messages
+		if msg.Params[1] != tc.expected {
+			t.Fatalf("Got wrong response to %s: %s", tc.text, msg.Params[1])
+		}
+		// Messages returned by tested handlers must not be sent
+		if len(messages) > 0 {
+			t.Fatalf("Unexpected message sent: %s", <-messages)
+		}
+	}
+}
+
+// idleLuaStates returns the number of idle pooled Lua states from metrics
+func idleLuaStates(t *testing.T) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "bananaboat_lua_states_idle" {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatal("Metric not found")
+	return 0
+}
+
+func TestIdleLuaStates(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:        "../test/helpers.lua",
+		LuaIdleTimeout: 1,
+		NewIrcServer:   test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	// Run a worker so a pooled state is used
+	testHelpers(ctx, t, b, map[string]string{
+		"bb.worker(function() end) return 'ok'": "ok",
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for idleLuaStates(t) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("State wasn't returned to pool")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// State should be closed once it was idle for long enough
+	for idleLuaStates(t) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Idle state wasn't closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// evalHelper evaluates a Lua expression using test/helpers.lua and returns the result
+func evalHelper(ctx context.Context, b *bot.BananaBoatBot, input string) string {
+	svrI, _ := b.Servers.Load("test")
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", input},
+	})
+	msg := <-svrI.(client.IrcServerInterface).GetMessages()
+	return msg.Params[1]
+}
+
+// waitForHelper evaluates a Lua expression until it returns the expected result
+func waitForHelper(ctx context.Context, t *testing.T, b *bot.BananaBoatBot, input string, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := evalHelper(ctx, b, input)
+		if got == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %s != %s", input, got, expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemoryLimits(t *testing.T) {
+	ctx := context.TODO()
+	stats := "local s = bb.memory_stats() return s.lua_states .. '/' .. s.lua_states_idle"
+	// Workers share a single state if only one may be created
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/helpers.lua",
+		MaxLuaStates: 1,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"for i = 1, 5 do bb.worker(function() end) end return 'ok'": "ok",
+	})
+	waitForHelper(ctx, t, b, stats, "1/1")
+	// Idle states are closed when memory usage approaches the limit
+	b = bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/helpers.lua",
+		MemoryLimit:  1,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"bb.worker(function() end) return 'ok'":   "ok",
+		"return bb.memory_stats().limit":          "1",
+		"return bb.memory_stats().usage > 0":      "true",
+		"return bb.memory_stats().max_lua_states": "0",
+		"bb.cooldown_set('x', 60) return 'ok'":    "ok",
+	})
+	// Cases are evaluated in random order so the cooldown is counted separately
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.memory_stats().cooldowns": "1",
+	})
+	waitForHelper(ctx, t, b, "return bb.memory_stats().sheds > 0", "true")
+	testHelpers(ctx, t, b, map[string]string{
+		stats: "0/0",
+	})
+}
+
+func TestEval(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/eval.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	boss := &irc.Prefix{Name: "boss", User: "b", Host: "host.example.com"}
+	bossCtx := client.ContextWithTags(ctx, map[string]string{"account": "Boss"})
+	for code, expected := range map[string]string{
+		"1 + 2":                     "3",
+		"return 1, 'two'":           "1, two",
+		"bb.levenshtein('a', 'b')":  "1",
+		"local x = 1":               "nil",
+		"string.rep('a', 50)":       strings.Repeat("a", 20) + "...",
+		"os":                        "nil",
+		"dofile":                    "nil",
+		"io.open('/etc/passwd')":    "error:",
+		"while true do end":         "error:",
+		"require 'os'":              "error:",
+		"bb.worker":                 "nil",
+		"bb.timer":                  "nil",
+		"bb.http_request":           "nil",
+		"bb.regexp.match('a', 'a')": "true",
+		"string.rep('x', 1e10)":     "error:",
+		"('x'):rep(1e10)":           "error:",
+		"local s, t = string.rep('x', 1e5), {} while true do table.insert(t, s .. tostring(t)) end": "error: memory limit",
+	} {
+		b.HandleHandlers(bossCtx, "test", &irc.Message{
+			Prefix:  boss,
+			Command: irc.PRIVMSG,
+			Params:  []string{"#chan", "!eval " + code},
+		})
+		msg := <-messages
+		if msg.Params[0] != "#chan" || !strings.HasPrefix(msg.Params[1], expected) {
+			t.Fatalf("Got wrong response to %s: %s", code, &msg)
+		}
+	}
+	// Only allowed accounts may use eval, matching an admin hostmask isn't enough
+	for _, tc := range []struct {
+		ctx    context.Context
+		prefix *irc.Prefix
+	}{
+		{client.ContextWithTags(ctx, map[string]string{"account": "nobody"}), boss},
+		{ctx, boss},
+	} {
+		b.HandleHandlers(tc.ctx, "test", &irc.Message{
+			Prefix:  tc.prefix,
+			Command: irc.PRIVMSG,
+			Params:  []string{"#chan", "!eval 1"},
+		})
+	}
+	if len(messages) > 0 {
+		t.Fatalf("Eval by other account was answered: %s", <-messages)
+	}
+	// The account is trusted whatever the hostmask
+	b.HandleHandlers(bossCtx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nobody", User: "n", Host: "example.org"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"#chan", "!eval 1"},
+	})
+	if msg := <-messages; msg.Params[1] != "1" {
+		t.Fatalf("Got wrong response to eval: %s", &msg)
+	}
+}
+
+func TestKV(t *testing.T) {
+	ctx := context.TODO()
+	// Functions fail without a database
+	b := newHelpersBot(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return select(2, bb.kv_get('quotes', 'key'))": "no database configured",
+	})
+	b.Close(ctx)
+	dir, err := ioutil.TempDir("", "bananaboatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.NewStore(&store.StoreConfig{
+		Path: filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Internal state isn't visible to scripts
+	err = s.Set(bot.JoinOnceBucket, "test/#chan", []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/helpers.lua",
+		NewIrcServer: test.NewMockIrcServer,
+		Store:        s,
+	})
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.kv_set('quotes', '#chan/2', 'two')":   "true",
+		"return bb.kv_set('quotes', '#chan/1', 'one')":   "true",
+		"return bb.kv_set('quotes', '#other/1', 'one')":  "true",
+		"return bb.kv_set('quotes', '#chan/3', 'three')": "true",
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.kv_set('quotes', '#chan/3', nil)": "true",
+		"return bb.kv_delete('quotes', '#other/1')":  "true",
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.kv_get('quotes', '#chan/1')":                        "one",
+		"return bb.kv_get('quotes', '#chan/3')":                        "nil",
+		"return bb.kv_get('quotes', '#other/1')":                       "nil",
+		"return bb.kv_get('" + bot.JoinOnceBucket + "', 'test/#chan')": "nil",
+		"return table.concat(bb.kv_keys('quotes', '#chan/'), ',')":     "#chan/1,#chan/2",
+		"return table.concat(bb.kv_keys('quotes', '', 1), ',')":        "#chan/1",
+		"local out = {} local n = bb.kv_scan('quotes', '#chan/', function(k, v) table.insert(out, k .. '=' .. v) end) return n .. ' ' .. table.concat(out, ',')": "2 #chan/1=one,#chan/2=two",
+		"return bb.kv_scan('quotes', '', function() return false end)":                                                                                           "1",
+	})
+}
+
+func TestSQL(t *testing.T) {
+	ctx := context.TODO()
+	// Functions fail without a database
+	b := newHelpersBot(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return select(2, bb.sql.query('SELECT 1'))": "no SQL database configured",
+	})
+	b.Close(ctx)
+	dir, err := ioutil.TempDir("", "bananaboatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := store.OpenSQL(filepath.Join(dir, "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b = bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/helpers.lua",
+		NewIrcServer: test.NewMockIrcServer,
+		SQL:          db,
+	})
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.sql.exec('CREATE TABLE karma (nick TEXT PRIMARY KEY, score INTEGER NOT NULL)')": "0",
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return select(2, bb.sql.exec('INSERT INTO karma VALUES (?, ?)', 'alice', 3))": "1",
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"local stmt = bb.sql.prepare('INSERT INTO karma VALUES (?, ?) ON CONFLICT(nick) DO UPDATE SET score = score + excluded.score') stmt:exec('bob', 1) stmt:exec('bob', 1) local n = stmt:exec('alice', -1) stmt:close() return n": "1",
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"local out = {} for _, row in ipairs(bb.sql.query('SELECT nick, score FROM karma ORDER BY nick')) do table.insert(out, row.nick .. '=' .. row.score) end return table.concat(out, ',')": "alice=2,bob=2",
+		"return #bb.sql.query('SELECT * FROM karma WHERE nick = ?', 'carol')": "0",
+		// Parameters are bound rather than interpolated
+		"return bb.sql.query('SELECT ? AS s', \"'; DROP TABLE karma; --\")[1].s": "'; DROP TABLE karma; --",
+		"return bb.sql.query('SELECT ? IS NULL AS n', nil)[1].n":                 "1",
+		"return select(2, bb.sql.query('SELECT * FROM missing')) ~= nil":         "true",
+		"return select(2, pcall(bb.sql.exec, 'SELECT ?', {}))":                   "<string>:1: bad argument #2 to (anonymous) (unsupported type: table)",
+	})
+}
+
+func TestRedis(t *testing.T) {
+	ctx := context.TODO()
+	// Functions fail without a server
+	b := newHelpersBot(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return select(2, bb.redis.get('key'))": "no Redis server configured",
+	})
+	b.Close(ctx)
+	r, err := redis.NewClient(test.FakeRedis(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b = bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/helpers.lua",
+		NewIrcServer: test.NewMockIrcServer,
+		Redis:        r,
+	})
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.redis.set('seen:alice', 'yesterday')": "true",
+		"return bb.redis.set('temp', 'x', 60)":           "true",
+		"return bb.redis.incr('karma:bob')":              "1",
+		"return bb.redis.expire('missing', 60)":          "false",
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.redis.get('seen:alice')":                        "yesterday",
+		"return bb.redis.get('missing')":                           "nil",
+		"return bb.redis.incr('karma:bob')":                        "2",
+		"return bb.redis.expire('karma:bob', 60)":                  "true",
+		"return select(2, bb.redis.incr('temp'))":                  "ERR value is not an integer or out of range",
+		"return bb.redis.publish('events', 'nobody')":              "0",
+		"return select(2, pcall(bb.redis.set, 'temp', 'x', 0))":    "<string>:1: bad argument #3 to (anonymous) (expiry must be positive)",
+		"return select(2, pcall(bb.redis.expire, 'karma:bob', 0))": "<string>:1: bad argument #2 to (anonymous) (expiry must be positive)",
+	})
+	if ttl, err := r.Do(ctx, "TTL", "temp"); err != nil || ttl != int64(60) {
+		t.Fatalf("Unexpected TTL of temp: %v %v", ttl, err)
+	}
+	// Messages published to channels are passed to subscribed functions
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.redis.subscribe('events', function(channel, message) return { {net = 'test', command = 'PRIVMSG', params = {'#chan', channel .. ': ' .. message}} } end)": "true",
+	})
+	for {
+		n, err := r.Do(ctx, "PUBLISH", "events", "deployed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == int64(1) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	svrI, _ := b.Servers.Load("test")
+	msg := <-svrI.(client.IrcServerInterface).GetMessages()
+	if strings.Join(msg.Params, " ") != "#chan events: deployed" {
+		t.Fatalf("Got wrong message from subscription: %s", strings.Join(msg.Params, " "))
+	}
+	// The same function can't subscribe to a channel twice and subscriptions are limited
+	testHelpers(ctx, t, b, map[string]string{
+		"subscriber = function(channel, message) end; return bb.redis.subscribe('dup', subscriber)": "true",
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return select(2, bb.redis.subscribe('dup', subscriber))":                                                             "function already subscribed to dup",
+		"for i = 1, 100 do local ok, err = bb.redis.subscribe('channel' .. i, subscriber); if not ok then return err end end": "too many Redis subscriptions (maximum is 100)",
+	})
+	// Reloading cancels subscriptions
+	if err := b.ReloadLua(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		n, err := r.Do(ctx, "PUBLISH", "events", "again")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == int64(0) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInChannel(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	svrI.(client.IrcServerInterface).GetState().Handle(&irc.Message{
+		Prefix:  &irc.Prefix{Name: "testbot1"},
+		Command: irc.JOIN,
+		Params:  []string{"#chan"},
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.in_channel('test', '#Chan')":  "true",
+		"return bb.in_channel('test', '#other')": "false",
+		"return bb.in_channel('nope', '#chan')":  "false",
+	})
+}
+
+func TestChannelMembers(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	for _, msg := range []*irc.Message{
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot1"}, Command: irc.JOIN, Params: []string{"#chan"}},
+		&irc.Message{Command: irc.RPL_TOPIC, Params: []string{"testbot1", "#chan", "hello world"}},
+		&irc.Message{Command: irc.RPL_TOPICWHOTIME, Params: []string{"testbot1", "#chan", "nick1", "1500000000"}},
+		&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"testbot1", "=", "#chan", "@testbot1 +nick1 @+nick2!n2@host2"}},
+		&irc.Message{Command: irc.RPL_ENDOFNAMES, Params: []string{"testbot1", "#chan", "End of /NAMES list"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot1"}, Command: irc.MODE, Params: []string{"#chan", "+ok", "nick2", "secret"}},
+	} {
+		svrI.(client.IrcServerInterface).GetState().Handle(msg)
+	}
+	testHelpers(ctx, t, b, map[string]string{
+		"local out = {} for _, m in ipairs(bb.members('test', '#Chan')) do table.insert(out, m.prefix .. m.nick) end return table.concat(out, ' ')": "+nick1 @+nick2 @testbot1",
+		"local m = bb.members('test', '#chan')[2] return m.user .. '@' .. m.host .. ' ' .. m.prefix":                                                "n2@host2 @+",
+		"return bb.members('test', '#chan')[1].host":            "nil",
+		"return bb.members('test', '#other')":                   "nil",
+		"return bb.members('nope', '#chan')":                    "nil",
+		"return table.concat({bb.topic('test', '#chan')}, ' ')": "hello world nick1 1500000000",
+		"return bb.topic('test', '#other')":                     "nil",
+		"return bb.has_op('test', '#chan', 'NICK2')":            "true",
+		"return bb.has_op('test', '#chan', 'nick1')":            "false",
+		"return bb.has_op('test', '#other', 'testbot1')":        "false",
+		"return bb.channel_modes('test', '#chan')":              "+k secret",
+	})
+}
+
+func TestAccount(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	for _, msg := range []*irc.Message{
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot1"}, Command: irc.JOIN, Params: []string{"#chan", "*", "Bot"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "alice"}, Command: irc.JOIN, Params: []string{"#chan", "alice_acct", "Alice"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "nick1"}, Command: irc.JOIN, Params: []string{"#chan", "nick1_acct", "Nick"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "alice"}, Command: irc.AWAY, Params: []string{"Gone fishing"}},
+	} {
+		svrI.(client.IrcServerInterface).GetState().Handle(msg)
+	}
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.account('test', 'ALICE')":             "alice_acct",
+		"return bb.account('test', 'bob')":               "nil",
+		"return bb.account('test')":                      "nick1_acct",
+		"return bb.account('other')":                     "nil",
+		"return bb.members('test', '#chan')[1].account":  "alice_acct",
+		"return bb.members('test', '#chan')[1].realname": "Alice",
+		"return bb.members('test', '#chan')[1].away":     "Gone fishing",
+		"return bb.away('test', 'alice')":                "Gone fishing",
+		"return bb.away('test', 'nick1')":                "nil",
+	})
+	// The account tag of the message is preferred
+	testHelpers(client.ContextWithTags(ctx, map[string]string{"account": "tagged"}), t, b, map[string]string{
+		"return bb.account('test')": "tagged",
+	})
+}
+
+func TestExtendedJoin(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/join.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	// Account and realname added by extended-join aren't passed to handlers
+	for _, params := range [][]string{{"#chan"}, {"#chan", "alice_acct", "Alice"}} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "alice"},
+			Command: irc.JOIN,
+			Params:  params,
+		})
+		msg := <-svrI.(client.IrcServerInterface).GetMessages()
+		if msg.String() != "PRIVMSG #log :1 #chan" {
+			t.Fatalf("Unexpected parameters of JOIN %v: %s", params, &msg)
+		}
+	}
+}
+
+func TestChannelForward(t *testing.T) {
+	ctx := context.TODO()
+	forward := &irc.Message{
+		Command: client.ErrLinkChannel,
+		Params:  []string{"testbot1", "#old", "#new", "Forwarding to another channel"},
+	}
+	join := &irc.Message{
+		Prefix:  &irc.Prefix{Name: "testbot1"},
+		Command: irc.JOIN,
+		Params:  []string{"#new"},
+	}
+	// By default we stay in the channel we were forwarded to
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	for _, msg := range []*irc.Message{forward, join} {
+		svrI.(client.IrcServerInterface).GetState().Handle(msg)
+		b.HandleHandlers(ctx, "test", msg)
+	}
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.channel_forward('test', '#old')":   "#new",
+		"return bb.channel_forward('test', '#other')": "nil",
+		"return bb.in_channel('test', '#new')":        "true",
+	})
+	// Otherwise we leave it
+	b = bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/forward.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ = b.Servers.Load("test")
+	svrI.(client.IrcServerInterface).GetState().Handle(forward)
+	b.HandleHandlers(ctx, "test", forward)
+	msg := <-svrI.(client.IrcServerInterface).GetMessages()
+	if msg.String() != "PART #new :Tried to join #old" {
+		t.Fatalf("Expected PART, got %q", msg.String())
+	}
+}
+
+func TestEchoMessage(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/echo.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	svr := svrI.(client.IrcServerInterface)
+	if caps := svr.GetSettings().Capabilities; strings.Join(caps, " ") != "server-time account-notify account-tag extended-join multi-prefix userhost-in-names away-notify echo-message" {
+		t.Fatalf("Wrong capabilities requested: %v", caps)
+	}
+	expect := func(msg *irc.Message, expected string) {
+		b.HandleHandlers(ctx, "test", msg)
+		select {
+		case reply := <-svr.GetMessages():
+			if reply.String() != expected {
+				t.Fatalf("Expected %q, got %q", expected, reply.String())
+			}
+		default:
+			t.Fatalf("Expected %q, got nothing", expected)
+		}
+	}
+	us := &irc.Prefix{Name: "testbot1", User: "a", Host: "example.com"}
+	own := &irc.Message{Prefix: us, Command: irc.PRIVMSG, Params: []string{"#chan", "hello world"}}
+	// Our messages aren't echoed unless the server enabled echo-message
+	expect(own, "PRIVMSG #log :got hello world")
+	svr.GetState().Handle(&irc.Message{Command: irc.CAP, Params: []string{"testbot1", irc.CAP_ACK, "echo-message"}})
+	expect(own, "PRIVMSG #log :delivered PRIVMSG #chan hello world")
+	expect(&irc.Message{Prefix: &irc.Prefix{Name: "TESTBOT1"}, Command: irc.NOTICE, Params: []string{"nick1", "hi"}}, "PRIVMSG #log :delivered NOTICE nick1 hi")
+	// Messages of others are handled as usual
+	expect(&irc.Message{Prefix: &irc.Prefix{Name: "nick1"}, Command: irc.PRIVMSG, Params: []string{"#chan", "hello"}}, "PRIVMSG #log :got hello")
+}
+
+func TestReconnectStrategy(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/reconnect.lua",
+		MaxReconnect: 3600,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	svr := svrI.(client.IrcServerInterface)
+	expected := client.ReconnectStrategy{
+		Base:       2 * time.Second,
+		Jitter:     0.1,
+		Max:        30 * time.Second,
+		Multiplier: 3,
+		ResetAfter: time.Minute,
+	}
+	if strategy := svr.GetSettings().Reconnect; strategy == nil || *strategy != expected {
+		t.Fatalf("Wrong reconnect strategy: %+v", strategy)
+	}
+	hugeI, _ := b.Servers.Load("huge")
+	if strategy := hugeI.(client.IrcServerInterface).GetSettings().Reconnect; strategy == nil || strategy.Max != time.Hour {
+		t.Fatalf("Invalid reconnect strategy wasn't ignored: %+v", strategy)
+	}
+	svr.GetSettings().ReconnectCallback(ctx, "test", 3, 1500*time.Millisecond)
+	select {
+	case reply := <-svr.GetMessages():
+		if reply.String() != "PRIVMSG #log :attempt 3 in 1.5" {
+			t.Fatalf("Got wrong reply: %q", reply.String())
+		}
+	default:
+		t.Fatal("RECONNECT wasn't handled")
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	ctx := context.TODO()
+	os.Unsetenv("BANANABOAT_TEST_MONITOR")
+	defer os.Unsetenv("BANANABOAT_TEST_MONITOR")
+	for _, useMonitor := range []bool{true, false} {
+		b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+			LuaFile:      "../test/monitor.lua",
+			NewIrcServer: test.NewMockIrcServer,
+		})
+		svrI, _ := b.Servers.Load("test")
+		svr := svrI.(client.IrcServerInterface)
+		handle := func(msg *irc.Message) {
+			svr.GetState().Handle(msg)
+			b.HandleHandlers(ctx, "test", msg)
+		}
+		// ISON is sent asynchronously so messages are waited for
+		expect := func(expected string) {
+			timeout := time.After(time.Second)
+			if len(expected) == 0 {
+				timeout = time.After(10 * time.Millisecond)
+			}
+			select {
+			case msg := <-svr.GetMessages():
+				if msg.String() != expected {
+					t.Fatalf("Expected %q, got %q", expected, msg.String())
+				}
+			case <-timeout:
+				if len(expected) > 0 {
+					t.Fatalf("Expected %q, got nothing", expected)
+				}
+			}
+		}
+		if useMonitor {
+			handle(&irc.Message{Command: irc.RPL_ISUPPORT, Params: []string{"testbot1", "MONITOR=100", "are supported by this server"}})
+		}
+		handle(&irc.Message{Command: irc.RPL_ENDOFMOTD, Params: []string{"testbot1", "End of /MOTD command."}})
+		if useMonitor {
+			expect("MONITOR + alice,bob")
+		} else {
+			expect("ISON alice bob")
+		}
+		expect("")
+		// Monitoring is only started once per connection
+		handle(&irc.Message{Command: irc.RPL_ENDOFMOTD, Params: []string{"testbot1", "End of /MOTD command."}})
+		expect("")
+		online := func(nicks ...string) {
+			if useMonitor {
+				handle(&irc.Message{Command: "730", Params: []string{"testbot1", strings.Join(nicks, ",")}})
+			} else {
+				var names []string
+				for _, nick := range nicks {
+					names = append(names, irc.ParsePrefix(nick).Name)
+				}
+				handle(&irc.Message{Command: irc.RPL_ISON, Params: []string{"testbot1", strings.Join(names, " ")}})
+			}
+		}
+		offline := func(nick string) {
+			if useMonitor {
+				handle(&irc.Message{Command: "731", Params: []string{"testbot1", nick}})
+			} else {
+				handle(&irc.Message{Command: irc.RPL_ISON, Params: []string{"testbot1", ""}})
+			}
+		}
+		host := "host.example"
+		if !useMonitor {
+			// ISON doesn't tell us hosts
+			host = ""
+		}
+		// Unmonitored nicks are ignored
+		online("alice!a@host.example", "carol!c@host.example")
+		expect("PRIVMSG #chan :online alice " + host)
+		expect("")
+		testHelpers(ctx, t, b, map[string]string{
+			"return bb.is_online('test', 'ALICE')": "true",
+			"return bb.is_online('test', 'bob')":   tern(useMonitor, "nil", "false"),
+			"return bb.is_online('test', 'carol')": "nil",
+		})
+		// Repeated presence isn't reported
+		online("alice!a@host.example")
+		expect("")
+		offline("alice")
+		expect("PRIVMSG #chan :offline alice")
+		if !useMonitor {
+			// Labeled replies to ISON only tell about the nicks asked about
+			online("alice!a@host.example")
+			expect("PRIVMSG #chan :online alice ")
+			isonCtx := client.ContextWithRequest(ctx, &irc.Message{Command: irc.ISON, Params: []string{"bob"}})
+			b.HandleHandlers(isonCtx, "test", &irc.Message{Command: irc.RPL_ISON, Params: []string{"testbot1", ""}})
+			expect("")
+			testHelpers(ctx, t, b, map[string]string{
+				"return bb.is_online('test', 'alice')": "true",
+			})
+		}
+		// Changing monitored nicks updates the MONITOR list
+		os.Setenv("BANANABOAT_TEST_MONITOR", "dave")
+		if err := b.ReloadLua(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if useMonitor {
+			expect("MONITOR - bob")
+			expect("MONITOR + dave")
+		}
+		expect("")
+		os.Unsetenv("BANANABOAT_TEST_MONITOR")
+		b.Close(ctx)
+	}
+}
+
+// tern returns a if cond is true and b otherwise
+func tern(cond bool, a string, b string) string {
+	if cond {
+		return a
+	}
+	return b
+}
+
+func TestWhois(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/whois.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	svr := svrI.(client.IrcServerInterface)
+	expect := func(expected string) {
+		select {
+		case msg := <-svr.GetMessages():
+			if msg.String() != expected {
+				t.Fatalf("Expected %q, got %q", expected, msg.String())
+			}
+		default:
+			if len(expected) > 0 {
+				t.Fatalf("Expected %q, got nothing", expected)
+			}
+		}
+	}
+	whois := func(nick string) {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{"testbot1", "return bb.whois('test', '" + nick + "', announce_whois)"},
+		})
+		expect("WHOIS " + nick)
+		expect("PRIVMSG nick1 true")
+	}
+	whois("alice")
+	// Asking again while waiting for replies doesn't send WHOIS again
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "return bb.whois('test', 'ALICE', announce_whois)"},
+	})
+	expect("PRIVMSG nick1 true")
+	for _, msg := range []*irc.Message{
+		{Command: irc.RPL_WHOISUSER, Params: []string{"testbot1", "Alice", "a", "host.example", "*", "Alice Example"}},
+		{Command: irc.RPL_WHOISCHANNELS, Params: []string{"testbot1", "Alice", "@#ops +#chat"}},
+		{Command: irc.RPL_WHOISCHANNELS, Params: []string{"testbot1", "Alice", "#more"}},
+		{Command: irc.RPL_WHOISIDLE, Params: []string{"testbot1", "Alice", "12", "1700000000", "seconds idle, signon time"}},
+		{Command: "330", Params: []string{"testbot1", "Alice", "acct", "is logged in as"}},
+		{Command: "671", Params: []string{"testbot1", "Alice", "is using a secure connection"}},
+	} {
+		b.HandleHandlers(ctx, "test", msg)
+	}
+	expect("")
+	b.HandleHandlers(ctx, "test", &irc.Message{Command: irc.RPL_ENDOFWHOIS, Params: []string{"testbot1", "Alice", "End of /WHOIS list."}})
+	// Both callbacks get the result
+	for i := 0; i < 2; i++ {
+		expect("PRIVMSG #chan :Alice a host.example Alice Example acct 12 @#ops,+#chat,#more true")
+	}
+	expect("")
+	// Replies to WHOIS nobody asked for are ignored
+	b.HandleHandlers(ctx, "test", &irc.Message{Command: irc.RPL_ENDOFWHOIS, Params: []string{"testbot1", "Alice", "End of /WHOIS list."}})
+	expect("")
+	whois("bob")
+	b.HandleHandlers(ctx, "test", &irc.Message{Command: irc.ERR_NOSUCHNICK, Params: []string{"testbot1", "bob", "No such nick/channel"}})
+	b.HandleHandlers(ctx, "test", &irc.Message{Command: irc.RPL_ENDOFWHOIS, Params: []string{"testbot1", "bob", "End of /WHOIS list."}})
+	expect("PRIVMSG #chan :error bob: no such nick")
+	expect("")
+	// Labeled replies are tied to the request even if they don't name the nick asked about
+	whois("carol")
+	whoisCtx := client.ContextWithRequest(ctx, &irc.Message{Command: irc.WHOIS, Params: []string{"carol"}})
+	otherCtx := client.ContextWithRequest(ctx, &irc.Message{Command: irc.ISON, Params: []string{"carol"}})
+	b.HandleHandlers(otherCtx, "test", &irc.Message{Command: irc.ERR_NOSUCHNICK, Params: []string{"testbot1", "carol", "No such nick/channel"}})
+	expect("")
+	b.HandleHandlers(whoisCtx, "test", &irc.Message{Command: irc.RPL_WHOISUSER, Params: []string{"testbot1", "Carol2", "c", "host.example", "*", "Carol"}})
+	b.HandleHandlers(whoisCtx, "test", &irc.Message{Command: irc.RPL_ENDOFWHOIS, Params: []string{"testbot1", "Carol2", "End of /WHOIS list."}})
+	expect("PRIVMSG #chan :Carol2 c host.example Carol none nil  false")
+	expect("")
+	// The labeled-response batch ending finishes requests the server didn't finish replying to
+	whois("dave")
+	b.HandleHandlers(client.ContextWithRequest(ctx, &irc.Message{Command: irc.WHOIS, Params: []string{"dave"}}), "test", &irc.Message{Command: client.BatchCommand, Params: []string{"-w1"}})
+	expect("PRIVMSG #chan :error dave: no reply")
+	expect("")
+}
+
+func TestModeEnforcement(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/modes.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	svr := svrI.(client.IrcServerInterface)
+	handle := func(msg *irc.Message) {
+		svr.GetState().Handle(msg)
+		b.HandleHandlers(ctx, "test", msg)
+	}
+	expect := func(expected string) {
+		select {
+		case msg := <-svr.GetMessages():
+			if msg.String() != expected {
+				t.Fatalf("Expected %q, got %q", expected, msg.String())
+			}
+		default:
+			if len(expected) > 0 {
+				t.Fatalf("Expected %q, got nothing", expected)
+			}
+		}
+	}
+	// Without ops nothing is done
+	handle(&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.MODE, Params: []string{"#enforced", "-n"}})
+	expect("")
+	// Being opped makes us check modes
+	handle(&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.MODE, Params: []string{"#enforced", "+o", "testbot1"}})
+	expect("MODE #enforced")
+	handle(&irc.Message{Command: irc.RPL_CHANNELMODEIS, Params: []string{"testbot1", "#enforced", "+ilk", "10", "secret"}})
+	expect("MODE #enforced +nt-i")
+	// Enforcing again soon after is avoided
+	handle(&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.MODE, Params: []string{"#enforced", "-t"}})
+	expect("")
+	// Channels without configured modes are left alone
+	handle(&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.MODE, Params: []string{"#other", "+o", "testbot1"}})
+	handle(&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.MODE, Params: []string{"#other", "-nt"}})
+	expect("")
+}
+
+func TestNumericHandlers(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/numeric.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	for _, tc := range []struct {
+		msg      *irc.Message
+		expected string
+	}{
+		{
+			&irc.Message{Command: irc.RPL_CHANNELMODEIS, Params: []string{"testbot1", "#chan", "+lk", "10", "secret"}},
+			"324 secret #chan,+lk,10 3",
+		},
+		{
+			&irc.Message{Command: irc.RPL_ISUPPORT, Params: []string{"testbot1", "NICKLEN=30", "are supported by this server"}},
+			"testbot1 NICKLEN=30",
+		},
+		{
+			&irc.Message{Command: "999", Params: []string{"testbot1"}},
+			"999 nil 0",
+		},
+	} {
+		b.HandleHandlers(ctx, "test", tc.msg)
+		msg := <-messages
+		if msg.Params[1] != tc.expected {
+			t.Fatalf("Expected %q, got %q", tc.expected, msg.Params[1])
+		}
+	}
+}
+
+func TestHandlerNames(t *testing.T) {
+	ctx := context.TODO()
+	list := "local h = bb.list_handlers() return tostring(h['']) .. ' ' .. tostring(h['BAD NAME']) .. ' ' .. " +
+		"tostring(h.notice) .. ' ' .. tostring(h['433']) .. ' ' .. tostring(h['1']) .. ' ' .. tostring(h.PRIVMSG)"
+	for luaFile, expected := range map[string]string{
+		// Suspicious handlers are registered with a warning unless handlers are strict
+		"../test/handler_names.lua":        "nil nil true true true true",
+		"../test/handler_names_strict.lua": "nil nil nil nil nil true",
+	} {
+		b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+			LuaFile:      luaFile,
+			NewIrcServer: test.NewMockIrcServer,
+		})
+		testHelpers(ctx, t, b, map[string]string{
+			list: expected,
+		})
+		b.Close(ctx)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	svrI.(client.IrcServerInterface).GetState().Handle(&irc.Message{
+		Command: irc.CAP,
+		Params:  []string{"testbot1", irc.CAP_ACK, "server-time message-tags"},
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return table.concat(bb.capabilities('test'), ',')": "message-tags,server-time",
+		"return bb.capabilities('invalid')":                 "nil",
+	})
+}
+
+func TestServerPassword(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/password.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	if password := svrI.(client.IrcServerInterface).GetSettings().Password; password != "user/network:secret" {
+		t.Fatalf("Got wrong server password: %q", password)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/notify.lua",
+		MaxReconnect: 0,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	welcome := &irc.Message{
+		Command: irc.RPL_WELCOME,
+		Params:  []string{"testbot1", "Welcome"},
+	}
+	for _, tc := range []struct {
+		repeat   int
+		expected string
+	}{
+		{1, "[test] connected"},
+		// Events within the interval should be coalesced
+		{2, "[test] connected (x2)"},
+	} {
+		for i := 0; i < tc.repeat; i++ {
+			b.HandleHandlers(ctx, "test", welcome)
+		}
+		msg := <-messages
+		if msg.Params[0] != "#ops" || msg.Params[1] != tc.expected {
+			t.Fatalf("Got wrong parameters in notification: %s", strings.Join(msg.Params, ","))
+		}
+	}
+}
+
+func TestHandlerArgs(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/curry.lua",
+		MaxReconnect: 0,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	for command, expected := range map[string]string{
+		irc.PRIVMSG: "hello world!",
+		irc.NOTICE:  "psst world...",
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: command,
+			Params:  []string{"testbot1", "world"},
+		})
+		msg := <-messages
+		if msg.Params[0] != "nick1" || msg.Params[1] != expected {
+			t.Fatalf("Got wrong parameters in response to %s: %s", command, strings.Join(msg.Params, ","))
+		}
+	}
+}
+
+func makeErrorHandler(b *bot.BananaBoatBot, done chan struct{}) func(context.Context, string, error) {
+	return func(ctx context.Context, svrName string, err error) {
+		b.HandleErrors(ctx, svrName, err)
+		done <- struct{}{}
+	}
+}
+
+// Test error handling
+func TestHandleServerError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, serverPort := test.FakeServer(t)
+
+	done := make(chan struct{}, 1)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			conn.Close()
+			done <- struct{}{}
+		}
+	}()
+
+	// Create BananaBoatBot
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LogCommands:  true,
+		LuaFile:      "../test/trivial1.lua",
+		MaxReconnect: 0,
+		NewIrcServer: test.NewMockIrcServer,
+	})
+
+	// Naive approach to faking error won't work properly (but here for coverage)
+	b.HandleErrors(ctx, "test", errors.New("something went wrong"))
+
+	handleErrors := makeErrorHandler(b, done)
+
+	// Create settings for superfluous client
+	settings := &client.IrcServerSettings{
+		Host:          "localhost",
+		Port:          serverPort,
+		TLS:           false,
+		Nick:          "testbot1",
+		Realname:      "testbotr",
+		Username:      "testbotu",
+		Password:      "yodel",
+		ErrorCallback: handleErrors,
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			// Not relevant
+		},
+	}
+	// Create client
+	svrI, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	// Replace existing client with our one
+	b.Servers.Store("test", svrI)
+	// Dial server
+	svrI.(client.IrcServerInterface).Dial(svrCtx)
+	// Wait for dropped connection
+	<-done
+	// Wait for error handling
+	<-done
+}
+
+func TestRestoreReconnectState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bananaboatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.NewStore(&store.StoreConfig{
+		Path: filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, tc := range []struct {
+		lastFailure time.Time
+		expected    uint64
+	}{
+		// Recent failure should be restored
+		{time.Now(), 42},
+		// Old failure should be forgotten
+		{time.Now().Add(-2 * time.Hour), 0},
+	} {
+		state, err := json.Marshal(&bot.ReconnectState{
+			Exp:         42,
+			LastFailure: tc.lastFailure,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Set(bot.ReconnectStateBucket, "test", state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.TODO()
+		b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+			LuaFile:           "../test/trivial1.lua",
+			MaxReconnect:      0,
+			NewIrcServer:      test.NewMockIrcServer,
+			ReconnectStateTTL: 3600,
+			Store:             s,
+		})
+		svrI, _ := b.Servers.Load("test")
+		var exp uint64
+		if expP := svrI.(client.IrcServerInterface).GetReconnectExp(); expP != nil {
+			exp = *expP
+		}
+		if exp != tc.expected {
+			t.Fatalf("Got wrong reconnect exponent: %d != %d", exp, tc.expected)
+		}
+		// Successful registration should clear state
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"testbot1", "Welcome"},
+		})
+		v, err := s.Get(bot.ReconnectStateBucket, "test")
+		if err != nil || v != nil {
+			t.Fatalf("Reconnect state wasn't cleared: %s %s", v, err)
+		}
+		b.Close(ctx)
+	}
+}
+
+func TestSTSPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bananaboatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.NewStore(&store.StoreConfig{
+		Path: filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.TODO()
+	var mutex sync.Mutex
+	var contexts []context.Context
+	newBot := func() *bot.BananaBoatBot {
+		return bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+			LuaFile: "../test/trivial1.lua",
+			NewIrcServer: func(ctx context.Context, name string, settings *client.IrcServerSettings) (client.IrcServerInterface, context.Context) {
+				svr, svrCtx := test.NewMockIrcServer(ctx, name, settings)
+				svr.SetReconnectExp(0)
+				mutex.Lock()
+				contexts = append(contexts, svrCtx)
+				mutex.Unlock()
+				return svr, svrCtx
+			},
+			Store: s,
+		})
+	}
+	settings := func(b *bot.BananaBoatBot) *client.IrcServerSettings {
+		svrI, _ := b.Servers.Load("test")
+		return svrI.(client.IrcServerInterface).GetSettings()
+	}
+	b := newBot()
+	host := settings(b).Host
+	if _, ok := settings(b).STSLookup(host); ok {
+		t.Fatal("Got policy before any was advertised")
+	}
+	// Policies advertised over insecure connections apply until we are restarted
+	mutex.Lock()
+	svrCtx := contexts[0]
+	mutex.Unlock()
+	b.HandleErrors(svrCtx, "test", &client.STSUpgradeError{Name: "test", Port: 6697})
+	if policy, ok := settings(b).STSLookup(host); !ok || policy.Port != 6697 {
+		t.Fatalf("Connections weren't upgraded: %v", policy)
+	}
+	// Policies advertised over secure connections are persisted
+	settings(b).STSCallback(ctx, "test", strings.ToUpper(host), client.STSPolicy{Port: 6697, Expires: time.Now().Add(time.Hour)})
+	b.Close(ctx)
+	b = newBot()
+	if policy, ok := settings(b).STSLookup(host); !ok || policy.Port != 6697 {
+		t.Fatalf("Policy wasn't restored: %v", policy)
+	}
+	// Policies with a duration of zero are removed
+	settings(b).STSCallback(ctx, "test", host, client.STSPolicy{Port: 6697})
+	if _, ok := settings(b).STSLookup(host); ok {
+		t.Fatal("Policy wasn't removed")
+	}
+	if v, err := s.Get(bot.STSBucket, host); err != nil || v != nil {
+		t.Fatalf("Policy wasn't removed from the store: %s %s", v, err)
+	}
+	// Expired policies are forgotten
+	settings(b).STSCallback(ctx, "test", host, client.STSPolicy{Port: 6697, Expires: time.Now().Add(time.Millisecond)})
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := settings(b).STSLookup(host); ok {
+		t.Fatal("Expired policy was used")
+	}
+	b.Close(ctx)
+}
+
+func TestJoinChannels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bananaboatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.NewStore(&store.StoreConfig{
+		Path: filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.TODO()
+	// connect simulates registration and returns channels joined in response
+	connect := func(b *bot.BananaBoatBot) string {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"testbot1", "Welcome"},
+		})
+		svrI, _ := b.Servers.Load("test")
+		messages := svrI.(client.IrcServerInterface).GetMessages()
+		var joined []string
+		for {
+			select {
+			case msg := <-messages:
+				if msg.Command != irc.JOIN {
+					t.Fatalf("Got unexpected message: %s", msg)
+				}
+				joined = append(joined, strings.Join(msg.Params, " "))
+			default:
+				return strings.Join(joined, ",")
+			}
+		}
+	}
+	config := &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/channels.lua",
+		NewIrcServer: test.NewMockIrcServer,
+		Store:        s,
+	}
+	b := bot.NewBananaBoatBot(ctx, config)
+	// Join-once channel is joined on first connect
+	if joined := connect(b); joined != "#always,#secret hunter2,#Announce" {
+		t.Fatalf("Joined wrong channels on first connect: %s", joined)
+	}
+	// But not on reconnect
+	if joined := connect(b); joined != "#always,#secret hunter2" {
+		t.Fatalf("Joined wrong channels on reconnect: %s", joined)
+	}
+	b.Close(ctx)
+	// Nor after restart
+	b = bot.NewBananaBoatBot(ctx, config)
+	defer b.Close(ctx)
+	if joined := connect(b); joined != "#always,#secret hunter2" {
+		t.Fatalf("Joined wrong channels after restart: %s", joined)
+	}
+}
+
+func TestStateEvents(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/trivial1.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	events, unsubscribe := b.SubscribeStates()
+	defer unsubscribe()
+	// Stream events over HTTP too
+	ts := httptest.NewServer(http.HandlerFunc(b.ServeStateEvents))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Got wrong content-type: %s", ct)
+	}
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Command: irc.RPL_WELCOME,
+		Params:  []string{"testbot1", "Welcome"},
+	})
+	event := <-events
+	if event.Net != "test" || event.State != bot.StateConnected || event.Time.IsZero() {
+		t.Fatalf("Got wrong event: %+v", event)
+	}
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "event: connected\n" {
+		t.Fatalf("Got wrong line from event stream: %q", line)
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, `data: {"net":"test","state":"connected"`) {
+		t.Fatalf("Got wrong line from event stream: %q", line)
+	}
+}
+
+func TestMaxMessages(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/maxmessages.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	for _, tc := range []struct {
+		command  string
+		expected int
+	}{
+		// Handler limit
+		{irc.PRIVMSG, 3},
+		// Default limit
+		{irc.NOTICE, 5},
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: tc.command,
+			Params:  []string{"testbot1", "flood"},
+		})
+		if len(messages) != tc.expected {
+			t.Fatalf("Got wrong number of messages from %s handler: %d != %d", tc.command, len(messages), tc.expected)
+		}
+		for len(messages) > 0 {
+			<-messages
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/commands.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	user := &irc.Prefix{Name: "nick1", User: "u", Host: "elsewhere.org"}
+	admin := &irc.Prefix{Name: "boss", User: "u", Host: "office.example.com"}
+	for _, tc := range []struct {
+		prefix   *irc.Prefix
+		text     string
+		expected []string
+	}{
+		{user, "!echo hello there", []string{"hello there"}},
+		{user, "!help", []string{"Commands: !echo", "Use !help <command> for details"}},
+		{admin, "!help", []string{"Commands: !echo !secret", "Use !help <command> for details"}},
+		{user, "!help !echo", []string{"!echo: Repeat text"}},
+		{user, "!help secret", []string{"No such command: !secret"}},
+		{admin, "!help secret", []string{"!secret: Admin stuff"}},
+		// Admin commands are ignored for other users
+		{user, "!secret", nil},
+		{admin, "!secret", []string{"secret"}},
+		{user, "not a command", nil},
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  tc.prefix,
+			Command: irc.PRIVMSG,
+			Params:  []string{"#chan", tc.text},
+		})
+		var got []string
+		for len(messages) > 0 {
+			msg := <-messages
+			if msg.Params[0] != "#chan" {
+				t.Fatalf("Got reply to wrong target: %s", msg)
+			}
+			got = append(got, msg.Params[1])
+		}
+		if strings.Join(got, "|") != strings.Join(tc.expected, "|") {
+			t.Fatalf("Got wrong response to %s from %s: %q", tc.text, tc.prefix.Name, got)
+		}
+	}
+}
+
+func TestToggleHandlers(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/toggle.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	for _, tc := range []struct {
+		command  string
+		text     string
+		expected string
+	}{
+		{irc.NOTICE, "hi", "notice"},
+		{irc.PRIVMSG, "missing", "false"},
+		{irc.PRIVMSG, "off", "true"},
+		{irc.PRIVMSG, "list", "NOTICE=false PRIVMSG=true"},
+		// Disabled handler shouldn't respond
+		{irc.NOTICE, "hi", ""},
+		{irc.PRIVMSG, "on", "true"},
+		{irc.NOTICE, "hi", "notice"},
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: tc.command,
+			Params:  []string{"testbot1", tc.text},
+		})
+		var got string
+		if len(messages) > 0 {
+			msg := <-messages
+			got = msg.Params[1]
+		}
+		if got != tc.expected {
+			t.Fatalf("Got wrong response to %s %s: %q != %q", tc.command, tc.text, got, tc.expected)
+		}
+	}
+	// Reload enables handlers again
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "off"},
+	})
+	<-messages
+	b.ReloadLua(ctx)
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.NOTICE,
+		Params:  []string{"testbot1", "hi"},
+	})
+	if len(messages) != 1 {
+		t.Fatal("Handler wasn't enabled by reload")
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.server_health('test')":                        "100",
+		"return select(2, bb.server_health('test')).disconnects": "0",
+		"return select(2, bb.server_health('test')).connects":    "1",
+		"return bb.server_health('invalid')":                     "nil",
+	})
+	// Fill up queue so further messages are dropped
+	for i := 0; i < 15; i++ {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{"testbot1", "return 1"},
+		})
+	}
+	// 5 of 18 messages were dropped
+	report := b.ServerHealth("test")
+	if report.Score != 94 {
+		t.Fatalf("Got wrong health score: %+v", report)
+	}
+}
+
+func TestDurations(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.parse_duration('2h30m')":                        "9000",
+		"return bb.parse_duration('90s')":                          "90",
+		"return bb.parse_duration('1d')":                           "86400",
+		"return bb.parse_duration('1w 1d 1h')":                     "694800",
+		"return bb.parse_duration('0')":                            "0",
+		"return select(2, bb.parse_duration('soon'))":              `invalid duration: "soon"`,
+		"return select(2, bb.parse_duration('5'))":                 `invalid duration: "5"`,
+		"return select(2, bb.parse_duration('100000000w'))":        `duration too large: "100000000w"`,
+		"return select(2, bb.parse_duration('2562047h 2562047h'))": `duration too large: "2562047h 2562047h"`,
+		"return bb.humanize_duration(9000)":                        "2 hours 30 minutes",
+		"return bb.humanize_duration(90061)":                       "1 day 1 hour 1 minute 1 second",
+		"return bb.humanize_duration(90061, 2)":                    "1 day 1 hour",
+		"return bb.humanize_duration(0)":                           "0 seconds",
+		"return bb.humanize_duration(bb.parse_duration('1d'))":     "1 day",
+	})
+}
+
+func TestFormatTable(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return table.concat(bb.format_table({{'nick', 'seen'}, {'alice', 3}, {'bob', 12}}, {header = true, align = {nil, 'right'}}), '|')": "nick   seen|-----------|alice     3|bob      12",
+		"return table.concat(bb.format_table({{'a', 'bb'}, {'ccc'}}, {style = 'box'}), '|')":                                                "┌─────┬────┐|│ a   │ bb │|│ ccc │    │|└─────┴────┘",
+		"return table.concat(bb.format_table({{'abcdef', 'x'}}, {max_width = 4, separator = ' | '}), '|')":                                  "abc… | x",
+		"return bb.format_table({{'abcdef', 'ghijkl'}}, {max_line = 8})[1]":                                                                 "abcde…",
+		"return #bb.format_table({})": "0",
+		"local rows = {} for i = 1, 20 do rows[i] = {i} end local lines = bb.format_table(rows) return #lines .. ' ' .. lines[#lines]":                                 "10 … 11 more rows",
+		"local rows = {} for i = 1, 20 do rows[i] = {i} end local lines = bb.format_table(rows, {style = 'box', header = true}) return #lines .. ' ' .. lines[#lines]": "10 … 14 more rows",
+		"local rows = {} for i = 1, 20 do rows[i] = {i} end return #bb.format_table(rows, {max_lines = 1, style = 'box', header = true})":                              "4",
+		"local rows = {} for i = 1, 20 do rows[i] = {i} end return #bb.format_table(rows, {max_lines = 30})":                                                           "20",
+	})
+}
+
+func TestTags(t *testing.T) {
+	tags := map[string]string{
+		"msgid":               "abc",
+		"time":                "2020-01-01T00:00:00.000Z",
+		"+example.com/vendor": "a b",
+	}
+	ctx := context.TODO()
+	tagsCtx := client.ContextWithTags(ctx, tags)
+	// Common tags are exposed by default
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	testHelpers(tagsCtx, t, b, map[string]string{
+		"return bb.tags().msgid":                  "abc",
+		"return bb.tags().time":                   "2020-01-01T00:00:00.000Z",
+		"return bb.tags()['+example.com/vendor']": "nil",
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return next(bb.tags())": "nil",
+	})
+	// Allowlist may be configured
+	b = bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/tags.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	testHelpers(tagsCtx, t, b, map[string]string{
+		"return bb.tags().msgid":                  "nil",
+		"return bb.tags()['+example.com/vendor']": "a b",
+	})
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	state := svrI.(client.IrcServerInterface).GetState()
+	state.Handle(&irc.Message{Command: "BATCH", Params: []string{"+split1", "netsplit", "irc.example.com", "irc2.example.com"}})
+	batchCtx := client.ContextWithTags(ctx, map[string]string{"batch": "split1"})
+	testHelpers(batchCtx, t, b, map[string]string{
+		"return bb.batch('test')":                               "netsplit",
+		"return table.concat(select(2, bb.batch('test')), ' ')": "irc.example.com irc2.example.com",
+		"return bb.batch('test', 'split1')":                     "netsplit",
+		"return bb.batch('test', 'other')":                      "nil",
+		"return bb.request('test')":                             "nil",
+		"return bb.request('test', 'bb1')":                      "nil",
+		"return bb.batch('nope')":                               "nil",
+	})
+	// Messages outside batches and batches which ended aren't in a batch
+	testHelpers(ctx, t, b, map[string]string{
+		"return bb.batch('test')": "nil",
+	})
+	state.Handle(&irc.Message{Command: "BATCH", Params: []string{"-split1"}})
+	testHelpers(batchCtx, t, b, map[string]string{
+		"return bb.batch('test')": "nil",
+	})
+}
+
+func TestMessageTime(t *testing.T) {
+	ctx := context.TODO()
+	b := newHelpersBot(ctx)
+	defer b.Close(ctx)
+	// Server time is preferred
+	timeCtx := client.ContextWithTime(ctx, time.Date(2020, 1, 1, 0, 0, 0, 500000000, time.UTC))
+	testHelpers(timeCtx, t, b, map[string]string{
+		"return bb.message_time() == 1577836800.5": "true",
+	})
+	// Otherwise messages are timestamped when handled
+	start := time.Now().Unix()
+	input := fmt.Sprintf("return bb.message_time() >= %d and bb.message_time() <= %d", start, start+5)
+	testHelpers(ctx, t, b, map[string]string{
+		input: "true",
+	})
+}
+
+func TestChatHistory(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/chathistory.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	testHelpers(ctx, t, b, map[string]string{
+		"return select(2, bb.chathistory('test', 'latest', '#test'))":    "chathistory isn't supported",
+		"return select(2, bb.chathistory('invalid', 'latest', '#test'))": "invalid server",
+	})
+	svrI, _ := b.Servers.Load("test")
+	svr := svrI.(client.IrcServerInterface)
+	svr.GetState().Handle(&irc.Message{
+		Command: irc.CAP,
+		Params:  []string{"testbot1", irc.CAP_ACK, "batch draft/chathistory"},
+	})
+	testHelpers(ctx, t, b, map[string]string{
+		"return select(2, bb.chathistory('test', 'around', '#test'))":        "unsupported subcommand: AROUND",
+		"return select(2, bb.chathistory('test', 'before', '#test', 'abc'))": `invalid reference: "abc"`,
+	})
+	// Requests are sent to the server
+	messages := svr.GetMessages()
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "return bb.chathistory('test', 'before', '#test', 1577836800, 5)"},
+	})
+	for _, expected := range []string{
+		"CHATHISTORY BEFORE #test timestamp=2020-01-01T00:00:00.000Z 5",
+		"PRIVMSG nick1 true",
+	} {
+		if msg := <-messages; msg.String() != expected {
+			t.Fatalf("Expected %q, got %q", expected, msg.String())
+		}
+	}
+	// Replies are passed to the CHATHISTORY handler
+	b.HandleBatch(ctx, "test", &client.Batch{
+		Ref:    "h1",
+		Type:   client.BatchChatHistory,
+		Params: []string{"#test"},
+		Messages: []client.BatchMessage{
+			{
+				Message: &irc.Message{
+					Prefix:  &irc.Prefix{Name: "nick1", User: "u", Host: "h"},
+					Command: irc.PRIVMSG,
+					Params:  []string{"#test", "old"},
+				},
+				Tags: map[string]string{"msgid": "abc", "+secret": "x"},
+				Time: time.Unix(1577836800, 0),
+			},
+			{
+				Message: &irc.Message{
+					Prefix:  &irc.Prefix{Name: "nick2"},
+					Command: irc.PART,
+					Params:  []string{"#test"},
+				},
+			},
+		},
+	})
+	if msg := <-messages; msg.String() != "PRIVMSG #test :2 nick1 old abc ok" {
+		t.Fatalf("Got wrong reply: %s", msg.String())
+	}
+}
+
+func TestRejoin(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/rejoin.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	kick := func(channel string, reason string) {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "op"},
+			Command: irc.KICK,
+			Params:  []string{channel, "testbot1", reason},
+		})
+	}
+	// expectJoin checks whether a JOIN is sent soon
+	expectJoin := func(expected string) {
+		select {
+		case msg := <-messages:
+			if msg.String() != expected {
+				t.Fatalf("Expected %q, got %q", expected, msg.String())
+			}
+		case <-time.After(500 * time.Millisecond):
+			if len(expected) > 0 {
+				t.Fatalf("Timed out waiting for %q", expected)
+			}
+		}
+	}
+	// Channels are rejoined using their key
+	kick("#secret", "bye")
+	expectJoin("JOIN #secret hunter2")
+	// Failing to rejoin is retried until attempts are exhausted
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Command: irc.ERR_BANNEDFROMCHAN,
+		Params:  []string{"testbot1", "#secret", "Cannot join channel (+b)"},
+	})
+	expectJoin("JOIN #secret hunter2")
+	kick("#secret", "bye")
+	expectJoin("")
+	// Vetoed channels aren't rejoined
+	kick("#other", "spam")
+	expectJoin("")
+	// Others are
+	kick("#other", "bye")
+	expectJoin("JOIN #other")
+	// Kicks of others are ignored
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "op"},
+		Command: irc.KICK,
+		Params:  []string{"#other", "nick1", "bye"},
+	})
+	expectJoin("")
+}
+
+func TestCTCPReplies(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/ctcp.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	for _, tc := range []struct {
+		nick     string
+		target   string
+		text     string
+		expected string
+	}{
+		{"nick1", "#chan", "\x01VERSION\x01", "NOTICE nick1 :\x01VERSION TestBot 1.0\x01"},
+		{"nick2", "#chan", "\x01ping 123 456\x01", "NOTICE nick2 :\x01PING 123 456\x01"},
+		{"nick3", "#chan", "\x01FINGER\x01", "NOTICE nick3 :\x01FINGER hello nick3\x01"},
+		{"nick4", "#chan", "\x01CLIENTINFO\x01", "NOTICE nick4 :\x01CLIENTINFO CLIENTINFO FINGER PING TIME VERSION\x01"},
+		// Replies to a nick are rate-limited
+		{"nick1", "#chan", "\x01VERSION\x01", ""},
+		// Queries which aren't configured or whose function returns nil aren't answered
+		{"nick5", "#chan", "\x01USERINFO\x01", ""},
+		{"nick6", "#quiet", "\x01FINGER\x01", ""},
+		{"nick7", "#chan", "VERSION", ""},
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: tc.nick},
+			Command: irc.PRIVMSG,
+			Params:  []string{tc.target, tc.text},
+		})
+		select {
+		case msg := <-messages:
+			if msg.String() != tc.expected {
+				t.Fatalf("Expected %q, got %q", tc.expected, msg.String())
+			}
+		default:
+			if len(tc.expected) > 0 {
+				t.Fatalf("Expected %q, got nothing", tc.expected)
+			}
+		}
+	}
+}
+
+func TestConnectGovernor(t *testing.T) {
+	ctx := context.TODO()
+	// Remember contexts of servers created
+	var mutex sync.Mutex
+	var contexts []context.Context
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile: "../test/governor.lua",
+		NewIrcServer: func(ctx context.Context, name string, settings *client.IrcServerSettings) (client.IrcServerInterface, context.Context) {
+			svr, svrCtx := test.NewMockIrcServer(ctx, name, settings)
+			svr.SetReconnectExp(0)
+			mutex.Lock()
+			contexts = append(contexts, svrCtx)
+			mutex.Unlock()
+			return svr, svrCtx
+		},
+	})
+	defer b.Close(ctx)
+	report := b.ServerHealth("test")
+	if report.Connects != 1 || report.ConnectCooldown != 0 {
+		t.Fatalf("Got wrong connect statistics: %+v", report)
+	}
+	// Reconnecting exceeds the limit so a cooldown is imposed
+	mutex.Lock()
+	svrCtx := contexts[0]
+	mutex.Unlock()
+	b.HandleErrors(svrCtx, "test", errors.New("something went wrong"))
+	report = b.ServerHealth("test")
+	if report.Connects != 1 || report.ConnectCooldown <= 0 || report.ConnectCooldown > 500*time.Millisecond {
+		t.Fatalf("Got wrong connect statistics: %+v", report)
+	}
+	// Cooldown expires with the window
+	time.Sleep(600 * time.Millisecond)
+	report = b.ServerHealth("test")
+	if report.Connects != 1 || report.ConnectCooldown != 0 {
+		t.Fatalf("Got wrong connect statistics: %+v", report)
+	}
+}
+
+func TestOutboundMessages(t *testing.T) {
+	for _, tc := range []struct {
+		luaFile  string
+		input    string
+		expected []string
+	}{
+		{"../test/outbound.lua", "topic", []string{"TOPIC #chan :multi word topic"}},
+		{"../test/outbound.lua", "lines", []string{"PRIVMSG nick1 line1", "PRIVMSG nick1 line2", "PRIVMSG nick1 line3"}},
+		{"../test/outbound_space.lua", "lines", []string{"PRIVMSG nick1 :line1 line2 line3"}},
+		// Long text is split and CTCP messages are quoted and truncated
+		{"../test/outbound.lua", "long", []string{
+			"NOTICE nick1 :" + strings.TrimSuffix(strings.Repeat("abcd ", 79), " "),
+			"NOTICE nick1 :" + strings.Repeat("abcd ", 21),
+		}},
+		{"../test/outbound.lua", "ctcp", []string{"NOTICE nick1 :\x01VERSION bananaboat 1.0\x01"}},
+		{"../test/outbound.lua", "longctcp", []string{"NOTICE nick1 :\x01PING " + strings.Repeat("x", 389) + "\x01"}},
+		{"../test/outbound.lua", "version", []string{"NOTICE nick1 :\x01VERSION bananaboat\x01"}},
+		// Invalid messages are dropped
+		{"../test/outbound.lua", "spaces", nil},
+		{"../test/outbound.lua", "inject", nil},
+	} {
+		ctx := context.TODO()
+		b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+			LuaFile:      tc.luaFile,
+			NewIrcServer: test.NewMockIrcServer,
+		})
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: "nick1"},
+			Command: irc.PRIVMSG,
+			Params:  []string{"testbot1", tc.input},
+		})
+		svrI, _ := b.Servers.Load("test")
+		messages := svrI.(client.IrcServerInterface).GetMessages()
+		var got []string
+		for len(messages) > 0 {
+			msg := <-messages
+			got = append(got, msg.String())
+		}
+		if strings.Join(got, "|") != strings.Join(tc.expected, "|") {
+			t.Errorf("%s %s: got %q", tc.luaFile, tc.input, got)
+		}
+		b.Close(ctx)
+	}
+}
+
+func TestOutboundPrefixLength(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/outbound.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	svr := svrI.(client.IrcServerInterface)
+	// Text fills the line once we know how the server relays our messages
+	svr.GetState().Handle(&irc.Message{
+		Prefix:  &irc.Prefix{Name: "testbot1", User: "a", Host: "example.com"},
+		Command: irc.JOIN,
+		Params:  []string{"#chan"},
+	})
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick1"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", "long"},
+	})
+	messages := svr.GetMessages()
+	expected := []string{
+		"NOTICE nick1 :" + strings.TrimSuffix(strings.Repeat("abcd ", 94), " "),
+		"NOTICE nick1 :" + strings.Repeat("abcd ", 6),
+	}
+	for _, e := range expected {
+		select {
+		case msg := <-messages:
+			if msg.String() != e {
+				t.Fatalf("Expected %q, got %q", e, msg.String())
+			}
+			// Relayed line must fit in 512 bytes including CRLF
+			if n := len(":testbot1!a@example.com ") + len(msg.String()) + 2; n > 512 {
+				t.Fatalf("Relayed line is %d bytes", n)
+			}
+		default:
+			t.Fatalf("Expected %q, got nothing", e)
+		}
+	}
+}
+
+func TestDCC(t *testing.T) {
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "dcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("BANANABOAT_TEST_DCC_DIR", dir)
+	data := []byte("banana boat")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	// Offers to connect to private addresses are ignored by default
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/dcc.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	svrI, _ := b.Servers.Load("test")
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "friend", User: "u", Host: "example.com"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", fmt.Sprintf("\x01DCC SEND private.txt 2130706433 %d %d\x01", port, len(data))},
+	})
+	select {
+	case msg := <-svrI.(client.IrcServerInterface).GetMessages():
+		t.Fatalf("Offer on loopback was accepted: %s", &msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+	b.Close(ctx)
+	b = bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/dcc_private.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ = b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Read acknowledgements until the file was received
+			conn.Write(data)
+			io.Copy(ioutil.Discard, conn)
+			conn.Close()
+		}
+	}()
+	for _, tc := range []struct {
+		nick     string
+		target   string
+		text     string
+		expected string
+	}{
+		{"friend", "testbot1", fmt.Sprintf("\x01DCC SEND banana.txt 2130706433 %d %d\x01", port, len(data)), "PRIVMSG friend :got 11 bytes"},
+		// Files over the limit aren't received
+		{"friend", "testbot1", fmt.Sprintf("\x01DCC SEND big.txt 2130706433 %d 1000\x01", port), "PRIVMSG friend :failed: big.txt"},
+		// Offers from others or to channels are ignored
+		{"stranger", "testbot1", fmt.Sprintf("\x01DCC SEND evil.txt 2130706433 %d %d\x01", port, len(data)), ""},
+		{"friend", "#chan", fmt.Sprintf("\x01DCC SEND chan.txt 2130706433 %d %d\x01", port, len(data)), ""},
+	} {
+		b.HandleHandlers(ctx, "test", &irc.Message{
+			Prefix:  &irc.Prefix{Name: tc.nick, User: "u", Host: "example.com"},
+			Command: irc.PRIVMSG,
+			Params:  []string{tc.target, tc.text},
+		})
+		select {
+		case msg := <-messages:
+			if msg.String() != tc.expected {
+				t.Fatalf("Expected %q, got %q", tc.expected, msg.String())
+			}
+		case <-time.After(500 * time.Millisecond):
+			if len(tc.expected) > 0 {
+				t.Fatalf("Timed out waiting for %q", tc.expected)
+			}
+		}
+	}
+	if received, _ := ioutil.ReadFile(filepath.Join(dir, "banana.txt")); string(received) != string(data) {
+		t.Fatalf("Unexpected content: %q", received)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected only one file to be received, got %d", len(files))
+	}
+}
+
+func TestDCCChat(t *testing.T) {
+	ctx := context.TODO()
+	b := bot.NewBananaBoatBot(ctx, &bot.BananaBoatBotConfig{
+		LuaFile:      "../test/dcc_chat.lua",
+		NewIrcServer: test.NewMockIrcServer,
+	})
+	defer b.Close(ctx)
+	svrI, _ := b.Servers.Load("test")
+	messages := svrI.(client.IrcServerInterface).GetMessages()
+	// expectEcho checks that lines sent in a chat are answered by the PRIVMSG handler
+	expectEcho := func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("hello\n"))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "echo: hello\n" {
+			t.Fatalf("Unexpected line: %q", line)
+		}
+	}
+	// Chats offered by allowed users are accepted
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "friend", User: "u", Host: "example.com"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"testbot1", fmt.Sprintf("\x01DCC CHAT chat 2130706433 %d\x01", l.Addr().(*net.TCPAddr).Port)},
+	})
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(conn)
+	if _, ok := b.Servers.Load("dcc:test:friend"); !ok {
+		t.Fatal("Expected chat to be added to servers")
+	}
+	// Chats are removed once closed
+	conn.Close()
+	for i := 0; ; i++ {
+		if _, ok := b.Servers.Load("dcc:test:friend"); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Expected chat to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Chats can be offered by scripts
+	b.HandleHandlers(ctx, "test", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "friend", User: "u", Host: "example.com"},
+		Command: irc.PRIVMSG,
+		Params:  []string{"#chan", "chat with me"},
+	})
+	var addr string
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			if msg.Params[0] == "#chan" {
+				if msg.Params[1] != "dcc:test:friend" {
+					t.Fatalf("Unexpected reply: %s", msg.String())
+				}
+				continue
+			}
+			args := strings.TrimPrefix(strings.Trim(msg.Params[1], "\x01"), "DCC ")
+			if addr, err = client.ParseDCCChat(args); err != nil {
+				t.Fatalf("Unexpected offer %q: %s", msg.String(), err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for offer")
+		}
+	}
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectEcho(conn)
 }
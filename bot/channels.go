@@ -0,0 +1,154 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// JoinOnceBucket is the store bucket recording channels which should only be joined once
+const JoinOnceBucket = "join_once"
+
+const (
+	// ForwardFollow stays in channels we were forwarded to
+	ForwardFollow = "follow"
+	// ForwardPart leaves channels we were forwarded to
+	ForwardPart = "part"
+)
+
+// channelSetting describes a channel to join after connecting
+type channelSetting struct {
+	// key is the channel key if any
+	key string
+	// locale is the locale used by helpers when handling messages from the channel
+	locale string
+	// modes are channel modes to keep set (e.g. "+nt-i")
+	modes string
+	// name is the name of the channel
+	name string
+	// once is set if the channel should only be joined on first connect
+	once bool
+}
+
+// channelsFromTable reads channels to join from Lua
+func channelsFromTable(tbl *lua.LTable) []channelSetting {
+	var channels []channelSetting
+	tbl.ForEach(func(_ lua.LValue, channelLV lua.LValue) {
+		switch channelLV := channelLV.(type) {
+		// Plain strings are channels to join on every connect
+		case lua.LString:
+			channels = append(channels, channelSetting{name: string(channelLV)})
+		case *lua.LTable:
+			channel := channelSetting{
+				key:    lua.LVAsString(channelLV.RawGetString("key")),
+				locale: lua.LVAsString(channelLV.RawGetString("locale")),
+				modes:  lua.LVAsString(channelLV.RawGetString("modes")),
+				name:   lua.LVAsString(channelLV.RawGetString("name")),
+				once:   lua.LVAsBool(channelLV.RawGetString("once")),
+			}
+			if len(channel.name) == 0 {
+				log.Print("Lua reload error: ignoring channel without name")
+				return
+			}
+			channels = append(channels, channel)
+		default:
+			log.Printf("Lua reload error: ignoring channel of unexpected type: %s", channelLV.Type())
+		}
+	})
+	return channels
+}
+
+// forwardPolicyFromLua reads how channel forwarding is handled from Lua
+func forwardPolicyFromLua(lv lua.LValue) string {
+	switch policy := lua.LVAsString(lv); policy {
+	case "":
+		return ForwardFollow
+	case ForwardFollow, ForwardPart:
+		return policy
+	default:
+		log.Printf("Lua reload error: ignoring invalid channel_forward: %s", policy)
+		return ForwardFollow
+	}
+}
+
+// handleForward handles being forwarded to another channel when joining one
+func (b *BananaBoatBot) handleForward(svrName string, msg *irc.Message) {
+	if len(msg.Params) < 3 {
+		return
+	}
+	from, to := msg.Params[1], msg.Params[2]
+	b.handlersMutex.RLock()
+	policy := b.forwardPolicies[svrName]
+	b.handlersMutex.RUnlock()
+	if policy != ForwardPart {
+		log.Printf("[%s] Joining %s forwarded us to %s", svrName, from, to)
+		return
+	}
+	log.Printf("[%s] Joining %s forwarded us to %s, leaving it", svrName, from, to)
+	b.sendMessage(svrName, &irc.Message{
+		Command: irc.PART,
+		Params:  []string{to, fmt.Sprintf("Tried to join %s", from)},
+	})
+}
+
+// joinOnceKey returns the key used to remember we joined a channel
+func joinOnceKey(svrName string, channel string) string {
+	return fmt.Sprintf("%s/%s", svrName, strings.ToLower(channel))
+}
+
+// joinedOnce returns true if a join-once channel was joined before
+func (b *BananaBoatBot) joinedOnce(svrName string, channel string) bool {
+	key := joinOnceKey(svrName, channel)
+	if _, ok := b.joinedOnceChannels.Load(key); ok {
+		return true
+	}
+	if b.Config.Store == nil {
+		return false
+	}
+	v, err := b.Config.Store.Get(JoinOnceBucket, key)
+	if err != nil {
+		log.Printf("[%s] Failed to load join-once state: %s", svrName, err)
+		return false
+	}
+	return v != nil
+}
+
+// setJoinedOnce remembers we joined a join-once channel
+func (b *BananaBoatBot) setJoinedOnce(svrName string, channel string) {
+	key := joinOnceKey(svrName, channel)
+	b.joinedOnceChannels.Store(key, struct{}{})
+	if b.Config.Store == nil {
+		return
+	}
+	err := b.Config.Store.Set(JoinOnceBucket, key, []byte{1})
+	if err != nil {
+		log.Printf("[%s] Failed to save join-once state: %s", svrName, err)
+	}
+}
+
+// joinChannels joins channels configured for a server
+func (b *BananaBoatBot) joinChannels(svrName string) {
+	b.handlersMutex.RLock()
+	channels := b.channels[svrName]
+	b.handlersMutex.RUnlock()
+	for _, channel := range channels {
+		if channel.once {
+			// Don't rejoin channels we might have been removed from
+			if b.joinedOnce(svrName, channel.name) {
+				continue
+			}
+			b.setJoinedOnce(svrName, channel.name)
+		}
+		params := []string{channel.name}
+		if len(channel.key) > 0 {
+			params = append(params, channel.key)
+		}
+		b.sendMessage(svrName, &irc.Message{
+			Command: irc.JOIN,
+			Params:  params,
+		})
+	}
+}
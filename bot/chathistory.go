@@ -0,0 +1,137 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// defaultChatHistoryLimit is the number of messages requested by chathistory() if no limit is given
+const defaultChatHistoryLimit = 50
+
+// chatHistoryMessageTable describes a replayed message for Lua
+func (b *BananaBoatBot) chatHistoryMessageTable(luaState *lua.LState, svrName string, bm client.BatchMessage) *lua.LTable {
+	msg := bm.Message
+	messageT := luaState.CreateTable(0, 9)
+	messageT.RawSetString("command", lua.LString(msg.Command))
+	if msg.Prefix != nil {
+		messageT.RawSetString("nick", lua.LString(msg.Prefix.Name))
+		messageT.RawSetString("user", lua.LString(msg.Prefix.User))
+		messageT.RawSetString("host", lua.LString(msg.Prefix.Host))
+	}
+	paramsT := luaState.CreateTable(len(msg.Params), 0)
+	for _, p := range msg.Params {
+		paramsT.Append(lua.LString(p))
+	}
+	messageT.RawSetString("params", paramsT)
+	if len(msg.Params) > 0 {
+		messageT.RawSetString("target", lua.LString(msg.Params[0]))
+		messageT.RawSetString("text", lua.LString(msg.Params[len(msg.Params)-1]))
+	}
+	tags := b.allowedTags(svrName, bm.Tags)
+	tagsT := luaState.CreateTable(0, len(tags))
+	for k, v := range tags {
+		tagsT.RawSetString(k, lua.LString(v))
+	}
+	messageT.RawSetString("tags", tagsT)
+	messageT.RawSetString("time", lua.LNumber(float64(bm.Time.UnixNano())/float64(time.Second)))
+	return messageT
+}
+
+// HandleBatch passes replayed messages of a chathistory batch to the CHATHISTORY handler
+func (b *BananaBoatBot) HandleBatch(ctx context.Context, svrName string, batch *client.Batch) {
+	if batch.Type != client.BatchChatHistory {
+		return
+	}
+	// Batch belongs to a new connection which hasn't replaced the current one yet
+	if _, ok := b.pendingHandover(ctx, svrName); ok {
+		return
+	}
+	var target string
+	if len(batch.Params) > 0 {
+		target = batch.Params[0]
+	}
+	if batch.Dropped > 0 {
+		log.Printf("[%s] Dropped %d messages of history of %s", svrName, batch.Dropped, target)
+	}
+	b.handlersMutex.RLock()
+	handler, ok := b.handlers[client.ChatHistory]
+	if !ok || handler.disabled {
+		b.handlersMutex.RUnlock()
+		return
+	}
+	maxMessages := handler.maxMessages
+	if maxMessages == 0 {
+		maxMessages = b.maxMessages
+	}
+	b.handlersMutex.RUnlock()
+	b.luaMutex.Lock()
+	defer b.luaMutex.Unlock()
+	// Handler gets the server, target and a list of messages
+	messagesT := b.luaState.CreateTable(len(batch.Messages), 0)
+	for _, bm := range batch.Messages {
+		messagesT.Append(b.chatHistoryMessageTable(b.luaState, svrName, bm))
+	}
+	// Replies go to the target of the history
+	b.curMessage = &irc.Message{
+		Command: client.ChatHistory,
+		Params:  []string{target},
+	}
+	b.curNet = svrName
+	b.curTags = nil
+	b.curTime = time.Now()
+	err := b.luaState.CallByParam(lua.P{
+		Fn:      handler.fn,
+		NRet:    1,
+		Protect: true,
+	}, handler.params([]lua.LValue{lua.LString(svrName), lua.LString(target), messagesT})...)
+	if err != nil {
+		log.Printf("Handler for %s failed: %s", client.ChatHistory, err)
+		return
+	}
+	b.handleLuaReturnValues(ctx, svrName, b.luaState, maxMessages)
+	b.luaState.SetTop(0)
+}
+
+// luaLibChatHistory requests history of a target which is passed to the CHATHISTORY handler
+// Reference is nil (latest messages), a Unix timestamp or a "msgid=..." or "timestamp=..." string
+func (b *BananaBoatBot) luaLibChatHistory(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	subcommand := luaState.CheckString(2)
+	target := luaState.CheckString(3)
+	var reference string
+	switch ref := luaState.Get(4).(type) {
+	case lua.LNumber:
+		reference = client.ChatHistoryTimestamp(time.Unix(0, int64(float64(ref)*float64(time.Second))))
+	case lua.LString:
+		reference = string(ref)
+	case *lua.LNilType:
+	default:
+		luaState.ArgError(4, "reference must be a number or string")
+	}
+	limit := luaState.OptInt(5, defaultChatHistoryLimit)
+	state := b.getServerState(svrName)
+	if state == nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("invalid server"))
+		return 2
+	}
+	if !state.SupportsChatHistory() {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("chathistory isn't supported"))
+		return 2
+	}
+	msg, err := client.NewChatHistory(subcommand, target, reference, limit)
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	b.sendMessage(svrName, msg)
+	luaState.Push(lua.LTrue)
+	return 1
+}
@@ -0,0 +1,244 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// defaultCommandPrefix is the default prefix of commands in messages
+	defaultCommandPrefix = "!"
+	// defaultHelpTrigger is the default name of the built-in help command
+	defaultHelpTrigger = "help"
+	// maxHelpLength is the maximum length of text in a single help message
+	maxHelpLength = 400
+)
+
+// commandSettings holds commands invoked by prefixed messages
+type commandSettings struct {
+	// admins are hostmasks of users allowed to run admin commands
+	admins []*regexp.Regexp
+	// commands maps command names to handlers
+	commands map[string]*luaHandler
+	// eval configures the built-in command running Lua snippets for admins (nil if disabled)
+	eval *evalSettings
+	// helpTrigger is the name of the built-in help command (empty if disabled)
+	helpTrigger string
+	// prefix is the prefix identifying commands
+	prefix string
+}
+
+// hostmaskRegexp converts a hostmask glob such as *!*@example.com to a regexp
+func hostmaskRegexp(mask string) (*regexp.Regexp, error) {
+	expr := regexp.QuoteMeta(mask)
+	expr = strings.Replace(expr, `\*`, `.*`, -1)
+	expr = strings.Replace(expr, `\?`, `.`, -1)
+	return regexp.Compile("(?i)^" + expr + "$")
+}
+
+// commandSettingsFromTable reads commands and related settings from Lua
+func commandSettingsFromTable(tbl *lua.LTable) *commandSettings {
+	cs := &commandSettings{
+		commands: make(map[string]*luaHandler),
+		prefix:   defaultCommandPrefix,
+	}
+	if prefix, ok := tbl.RawGetString("command_prefix").(lua.LString); ok {
+		cs.prefix = string(prefix)
+	}
+	// Get 'commands' table from table
+	if commandTbl, ok := tbl.RawGetString("commands").(*lua.LTable); ok {
+		commandTbl.ForEach(func(commandName lua.LValue, handlerL lua.LValue) {
+			commandNameStr := lua.LVAsString(commandName)
+			handler, err := handlerFromLua(handlerL)
+			if err != nil {
+				log.Printf("Lua reload error: command %s: %s", commandNameStr, err)
+				return
+			}
+			cs.commands[strings.ToLower(commandNameStr)] = handler
+		})
+	}
+	// Get 'admins' table from table
+	if adminTbl, ok := tbl.RawGetString("admins").(*lua.LTable); ok {
+		adminTbl.ForEach(func(_ lua.LValue, maskL lua.LValue) {
+			re, err := hostmaskRegexp(lua.LVAsString(maskL))
+			if err != nil {
+				log.Printf("Lua reload error: admin %s: %s", lua.LVAsString(maskL), err)
+				return
+			}
+			cs.admins = append(cs.admins, re)
+		})
+	}
+	// Get 'help' from table - either true or a table with settings
+	switch helpLV := tbl.RawGetString("help").(type) {
+	case lua.LBool:
+		if helpLV {
+			cs.helpTrigger = defaultHelpTrigger
+		}
+	case *lua.LTable:
+		cs.helpTrigger = defaultHelpTrigger
+		if trigger, ok := helpLV.RawGetString("trigger").(lua.LString); ok && len(trigger) > 0 {
+			cs.helpTrigger = strings.ToLower(string(trigger))
+		}
+	}
+	// Get 'eval' from table - either true or a table with settings
+	cs.eval = evalSettingsFromLua(tbl.RawGetString("eval"))
+	return cs
+}
+
+// isAdmin returns true if the sender of a message is an admin
+func (cs *commandSettings) isAdmin(prefix *irc.Prefix) bool {
+	if prefix == nil {
+		return false
+	}
+	mask := fmt.Sprintf("%s!%s@%s", prefix.Name, prefix.User, prefix.Host)
+	for _, re := range cs.admins {
+		if re.MatchString(mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// replyTarget returns where replies to a PRIVMSG should be sent
+func replyTarget(msg *irc.Message) string {
+	if len(msg.Params) > 0 && len(msg.Params[0]) > 0 && strings.ContainsAny(msg.Params[0][:1], "#&+!") {
+		return msg.Params[0]
+	}
+	if msg.Prefix != nil {
+		return msg.Prefix.Name
+	}
+	return ""
+}
+
+// helpLines returns help text for commands visible to a user
+// handlersMutex must be held by the caller
+func (cs *commandSettings) helpLines(admin bool, topic string) []string {
+	// Help for a single command
+	if len(topic) > 0 {
+		topic = strings.ToLower(strings.TrimPrefix(topic, cs.prefix))
+		handler, ok := cs.commands[topic]
+		if !ok || handler.disabled || (handler.admin && !admin) {
+			return []string{fmt.Sprintf("No such command: %s%s", cs.prefix, topic)}
+		}
+		if len(handler.description) == 0 {
+			return []string{fmt.Sprintf("%s%s: no description", cs.prefix, topic)}
+		}
+		return []string{fmt.Sprintf("%s%s: %s", cs.prefix, topic, handler.description)}
+	}
+	// List of commands
+	var names []string
+	for name, handler := range cs.commands {
+		if handler.disabled || (handler.admin && !admin) {
+			continue
+		}
+		names = append(names, cs.prefix+name)
+	}
+	sort.Strings(names)
+	var lines []string
+	line := "Commands:"
+	for _, name := range names {
+		if len(line)+len(name)+1 > maxHelpLength {
+			lines = append(lines, line)
+			line = "Commands:"
+		}
+		line += " " + name
+	}
+	lines = append(lines, line)
+	lines = append(lines, fmt.Sprintf("Use %s%s <command> for details", cs.prefix, cs.helpTrigger))
+	return lines
+}
+
+// handleCommand invokes a command if a PRIVMSG is one
+func (b *BananaBoatBot) handleCommand(ctx context.Context, svrName string, msg *irc.Message) {
+	if len(msg.Params) < 2 {
+		return
+	}
+	b.handlersMutex.RLock()
+	cs := b.commands
+	maxMessages := b.maxMessages
+	b.handlersMutex.RUnlock()
+	if cs == nil || !strings.HasPrefix(msg.Params[1], cs.prefix) {
+		return
+	}
+	// Split command name from arguments
+	text := strings.TrimPrefix(msg.Params[1], cs.prefix)
+	fields := strings.SplitN(strings.TrimSpace(text), " ", 2)
+	name := strings.ToLower(fields[0])
+	var args string
+	if len(fields) > 1 {
+		args = strings.TrimSpace(fields[1])
+	}
+	if len(name) == 0 {
+		return
+	}
+	admin := cs.isAdmin(msg.Prefix)
+	target := replyTarget(msg)
+	// Built-in help command
+	if len(cs.helpTrigger) > 0 && name == cs.helpTrigger {
+		if _, ok := cs.commands[name]; !ok {
+			b.handlersMutex.RLock()
+			lines := cs.helpLines(admin, args)
+			b.handlersMutex.RUnlock()
+			for _, line := range lines {
+				b.sendMessage(svrName, &irc.Message{
+					Command: irc.PRIVMSG,
+					Params:  []string{target, line},
+				})
+			}
+			return
+		}
+	}
+	// Built-in eval command
+	if cs.eval != nil && name == cs.eval.trigger {
+		if _, ok := cs.commands[name]; !ok {
+			if !b.mayEval(ctx, svrName, msg, cs.eval) {
+				log.Printf("[%s] Refused eval from %s", svrName, msg.Prefix)
+				return
+			}
+			go b.handleEval(ctx, svrName, msg, cs.eval, args)
+			return
+		}
+	}
+	b.handlersMutex.RLock()
+	handler, ok := cs.commands[name]
+	disabled := ok && handler.disabled
+	b.handlersMutex.RUnlock()
+	if !ok || disabled {
+		return
+	}
+	if handler.admin && !admin {
+		log.Printf("[%s] Refused admin command %s from %s", svrName, name, msg.Prefix)
+		return
+	}
+	if handler.maxMessages > 0 {
+		maxMessages = handler.maxMessages
+	}
+	// Call command with same parameters as a PRIVMSG handler but with arguments instead of text
+	luaParams := luaParamsFromMessage(svrName, msg)
+	luaParams[len(luaParams)-1] = lua.LString(args)
+	b.luaMutex.Lock()
+	defer b.luaMutex.Unlock()
+	b.curMessage = msg
+	b.curNet = svrName
+	b.curTags = client.TagsFromContext(ctx)
+	b.curTime = messageTime(ctx)
+	err := b.luaState.CallByParam(lua.P{
+		Fn:      handler.fn,
+		NRet:    1,
+		Protect: true,
+	}, handler.params(luaParams)...)
+	if err != nil {
+		log.Printf("Command %s failed: %s", name, err)
+		return
+	}
+	b.handleLuaReturnValues(ctx, svrName, b.luaState, maxMessages)
+	b.luaState.SetTop(0)
+}
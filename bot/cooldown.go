@@ -0,0 +1,129 @@
+package bot
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// maxCooldowns is the number of cooldowns above which we prune expired ones
+const maxCooldowns = 1024
+
+// cooldowns tracks when cooldowns set by scripts expire
+type cooldowns struct {
+	// expiry maps keys to expiry time
+	expiry map[string]time.Time
+	// mutex protects expiry
+	mutex sync.Mutex
+}
+
+// remaining returns time remaining before a cooldown expires
+func (c *cooldowns) remaining(key string) time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	expiry, ok := c.expiry[key]
+	if !ok {
+		return 0
+	}
+	remaining := time.Until(expiry)
+	if remaining <= 0 {
+		delete(c.expiry, key)
+		return 0
+	}
+	return remaining
+}
+
+// reset removes a cooldown
+func (c *cooldowns) reset(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.expiry, key)
+}
+
+// set sets a cooldown to expire after duration
+func (c *cooldowns) set(key string, duration time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Prune expired cooldowns so the map doesn't grow forever
+	if len(c.expiry) >= maxCooldowns {
+		c.pruneExpired()
+	}
+	c.expiry[key] = time.Now().Add(duration)
+}
+
+// pruneExpired removes expired cooldowns and returns how many were removed (mutex must be held)
+func (c *cooldowns) pruneExpired() int {
+	now := time.Now()
+	n := 0
+	for k, v := range c.expiry {
+		if !v.After(now) {
+			delete(c.expiry, k)
+			n++
+		}
+	}
+	return n
+}
+
+// shed removes expired cooldowns and those expiring soonest beyond keep (negative keeps all unexpired ones)
+func (c *cooldowns) shed(keep int) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := c.pruneExpired()
+	if keep < 0 || len(c.expiry) <= keep {
+		return n
+	}
+	keys := make([]string, 0, len(c.expiry))
+	for k := range c.expiry {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.expiry[keys[i]].Before(c.expiry[keys[j]])
+	})
+	for _, k := range keys[:len(keys)-keep] {
+		delete(c.expiry, k)
+		n++
+	}
+	return n
+}
+
+// size returns the number of cooldowns
+func (c *cooldowns) size() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.expiry)
+}
+
+// newCooldowns creates cooldowns
+func newCooldowns() *cooldowns {
+	return &cooldowns{
+		expiry: make(map[string]time.Time),
+	}
+}
+
+// luaLibCooldownRemaining returns seconds remaining before a cooldown expires (0 if not set)
+func (b *BananaBoatBot) luaLibCooldownRemaining(luaState *lua.LState) int {
+	key := luaState.CheckString(1)
+	luaState.Push(lua.LNumber(b.cooldowns.remaining(key).Seconds()))
+	return 1
+}
+
+// luaLibCooldownReset removes a cooldown
+func (b *BananaBoatBot) luaLibCooldownReset(luaState *lua.LState) int {
+	key := luaState.CheckString(1)
+	b.cooldowns.reset(key)
+	return 0
+}
+
+// luaLibCooldownSet sets a cooldown to expire after some seconds
+func (b *BananaBoatBot) luaLibCooldownSet(luaState *lua.LState) int {
+	key := luaState.CheckString(1)
+	seconds := luaState.CheckNumber(2)
+	if seconds <= 0 {
+		b.cooldowns.reset(key)
+		return 0
+	}
+	b.cooldowns.set(key, time.Duration(float64(seconds)*float64(time.Second)))
+	return 0
+}
@@ -0,0 +1,227 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// ctcpDelimiter marks the start and end of CTCP messages
+	ctcpDelimiter = "\x01"
+	// ctcpReplyInterval is the minimum time between CTCP replies to a nick
+	ctcpReplyInterval = 3 * time.Second
+	// defaultCTCPVersion is the reply to CTCP VERSION if none is configured
+	defaultCTCPVersion = "BananaBoatBot"
+)
+
+// ctcpReply describes how a CTCP query is answered: with fixed text, a built-in reply or by a Lua function
+type ctcpReply struct {
+	// builtin is set if the query is answered in Go
+	builtin bool
+	// fn returns the reply (nil for no reply)
+	fn *lua.LFunction
+	// text is the fixed reply
+	text string
+}
+
+// ctcpBuiltins are queries which have a built-in reply
+var ctcpBuiltins = map[string]struct{}{
+	"CLIENTINFO": {},
+	"PING":       {},
+	"TIME":       {},
+	"VERSION":    {},
+}
+
+// ctcpRepliesFromLua reads how CTCP queries are answered from a table mapping commands to true (built-in reply),
+// reply text or a function returning it
+func ctcpRepliesFromLua(lv lua.LValue) map[string]ctcpReply {
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		if lv != lua.LNil {
+			log.Printf("Lua reload error: ignoring ctcp of unexpected type: %s", lv.Type())
+		}
+		return nil
+	}
+	replies := make(map[string]ctcpReply)
+	tbl.ForEach(func(commandLV lua.LValue, replyLV lua.LValue) {
+		command := strings.ToUpper(lua.LVAsString(commandLV))
+		switch reply := replyLV.(type) {
+		case lua.LBool:
+			if !bool(reply) {
+				return
+			}
+			if _, ok := ctcpBuiltins[command]; !ok {
+				log.Printf("Lua reload error: no built-in reply to CTCP %s", command)
+				return
+			}
+			replies[command] = ctcpReply{builtin: true}
+		case lua.LString:
+			replies[command] = ctcpReply{text: string(reply)}
+		case *lua.LFunction:
+			replies[command] = ctcpReply{fn: reply}
+		default:
+			log.Printf("Lua reload error: ignoring reply to CTCP %s of unexpected type: %s", command, replyLV.Type())
+		}
+	})
+	return replies
+}
+
+// parseCTCP returns the command and arguments of a CTCP message (ok is false if text isn't one)
+func parseCTCP(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, ctcpDelimiter) {
+		return "", "", false
+	}
+	// The closing delimiter is optional
+	inner := strings.TrimSuffix(text[1:], ctcpDelimiter)
+	fields := strings.SplitN(inner, " ", 2)
+	if len(fields[0]) == 0 {
+		return "", "", false
+	}
+	var args string
+	if len(fields) > 1 {
+		args = fields[1]
+	}
+	return strings.ToUpper(fields[0]), args, true
+}
+
+// builtinCTCPReply returns the built-in reply to a CTCP query
+func builtinCTCPReply(command string, args string, replies map[string]ctcpReply) string {
+	switch command {
+	case "CLIENTINFO":
+		commands := make([]string, 0, len(replies))
+		for c := range replies {
+			commands = append(commands, c)
+		}
+		sort.Strings(commands)
+		return strings.Join(commands, " ")
+	case "PING":
+		return args
+	case "TIME":
+		return time.Now().Format(time.RFC1123Z)
+	case "VERSION":
+		return defaultCTCPVersion
+	}
+	return ""
+}
+
+// ctcpReplyText returns the reply to a CTCP query (ok is false if it isn't answered)
+func (b *BananaBoatBot) ctcpReplyText(svrName string, msg *irc.Message, command string, args string, replies map[string]ctcpReply) (string, bool) {
+	reply, ok := replies[command]
+	switch {
+	case !ok:
+		return "", false
+	case reply.builtin:
+		return builtinCTCPReply(command, args, replies), true
+	case reply.fn == nil:
+		return reply.text, true
+	}
+	b.luaMutex.Lock()
+	defer b.luaMutex.Unlock()
+	defer b.luaState.SetTop(0)
+	b.curMessage = msg
+	b.curNet = svrName
+	b.curTags = nil
+	b.curTime = time.Now()
+	luaParams := luaParamsFromMessage(svrName, &irc.Message{Prefix: msg.Prefix})
+	err := b.luaState.CallByParam(lua.P{
+		Fn:      reply.fn,
+		NRet:    1,
+		Protect: true,
+	}, append(luaParams, lua.LString(msg.Params[0]), lua.LString(args))...)
+	if err != nil {
+		log.Printf("Reply to CTCP %s failed: %s", command, err)
+		return "", false
+	}
+	text, ok := b.luaState.Get(-1).(lua.LString)
+	return string(text), ok
+}
+
+// handleCTCP answers CTCP queries configured in the ctcp table (at most one every ctcpReplyInterval per nick)
+func (b *BananaBoatBot) handleCTCP(ctx context.Context, svrName string, msg *irc.Message) {
+	if len(msg.Params) < 2 || msg.Prefix == nil {
+		return
+	}
+	command, args, ok := parseCTCP(msg.Params[1])
+	if !ok {
+		return
+	}
+	b.handlersMutex.RLock()
+	replies := b.ctcpReplies
+	newlines := b.newlines
+	b.handlersMutex.RUnlock()
+	if _, ok := replies[command]; !ok {
+		return
+	}
+	key := joinOnceKey(svrName, msg.Prefix.Name)
+	if b.ctcpCooldowns.remaining(key) > 0 {
+		return
+	}
+	b.ctcpCooldowns.set(key, ctcpReplyInterval)
+	text, ok := b.ctcpReplyText(svrName, msg, command, args, replies)
+	if !ok {
+		return
+	}
+	messages, err := buildMessages(irc.NOTICE, []string{msg.Prefix.Name, ctcpText(command, text)}, newlines, b.prefixLength(svrName))
+	if err != nil {
+		log.Printf("[%s] Invalid reply to CTCP %s: %s", svrName, command, err)
+		return
+	}
+	for _, m := range messages {
+		b.sendMessage(svrName, m)
+	}
+}
+
+// quoteCTCP makes sure a CTCP message is delimited, contains no stray delimiters and fits in limit bytes
+func quoteCTCP(text string, limit int) string {
+	inner := strings.Replace(text, ctcpDelimiter, "", -1)
+	// Truncate rather than split as the parts wouldn't be valid CTCP messages
+	if limit > 2 && len(inner) > limit-2 {
+		i := limit - 2
+		for i > 0 && !utf8.RuneStart(inner[i]) {
+			i--
+		}
+		inner = inner[:i]
+	}
+	return ctcpDelimiter + inner + ctcpDelimiter
+}
+
+// ctcpText returns the text of a CTCP message given its command and optional parameters
+func ctcpText(command string, text string) string {
+	command = strings.ToUpper(command)
+	if len(text) > 0 {
+		return ctcpDelimiter + command + " " + text + ctcpDelimiter
+	}
+	return ctcpDelimiter + command + ctcpDelimiter
+}
+
+// luaCTCPMessage pushes a message carrying a CTCP message in the form returned by handlers
+func luaCTCPMessage(luaState *lua.LState, command string) int {
+	target := luaState.CheckString(1)
+	ctcpCommand := luaState.CheckString(2)
+	text := luaState.OptString(3, "")
+	messageT := luaState.CreateTable(0, 2)
+	messageT.RawSetString("command", lua.LString(command))
+	paramsT := luaState.CreateTable(2, 0)
+	paramsT.Append(lua.LString(target))
+	paramsT.Append(lua.LString(ctcpText(ctcpCommand, text)))
+	messageT.RawSetString("params", paramsT)
+	luaState.Push(messageT)
+	return 1
+}
+
+// luaLibCTCPReply returns a NOTICE carrying a CTCP reply
+func (b *BananaBoatBot) luaLibCTCPReply(luaState *lua.LState) int {
+	return luaCTCPMessage(luaState, irc.NOTICE)
+}
+
+// luaLibCTCPRequest returns a PRIVMSG carrying a CTCP request
+func (b *BananaBoatBot) luaLibCTCPRequest(luaState *lua.LState) int {
+	return luaCTCPMessage(luaState, irc.PRIVMSG)
+}
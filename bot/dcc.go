@@ -0,0 +1,332 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// defaultDCCMaxSize is the size limit of files received by DCC if none is configured
+	defaultDCCMaxSize = 10 * 1024 * 1024
+	// maxDCCTransfers is the number of files received at once, further offers are ignored
+	maxDCCTransfers = 3
+	// maxDCCChats is the number of chats open at once
+	maxDCCChats = 5
+	// dccChatPrefix starts the names of chats which are handled like servers
+	dccChatPrefix = "dcc:"
+)
+
+// dccSettings describes which DCC offers are accepted
+type dccSettings struct {
+	// address is advertised in chats we offer (nil if we can't offer chats)
+	address net.IP
+	// allow are hostmasks of users whose offers are accepted
+	allow []*regexp.Regexp
+	// callback receives the result of each transfer (nil if none)
+	callback *lua.LFunction
+	// chat is set if chats are accepted
+	chat bool
+	// dir is where files are saved (empty if files aren't received)
+	dir string
+	// maxSize is the size limit of files in bytes
+	maxSize int64
+	// private is set if offers to connect to loopback, link-local and private addresses are accepted
+	private bool
+}
+
+// dccSettingsFromLua reads DCC settings from a table of 'dir', 'max_size', 'allow' (hostmasks), 'callback',
+// 'chat', 'address' and 'private'; nil is returned if DCC is disabled
+func dccSettingsFromLua(lv lua.LValue) *dccSettings {
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		if lv != lua.LNil {
+			log.Printf("Lua reload error: ignoring dcc of unexpected type: %s", lv.Type())
+		}
+		return nil
+	}
+	ds := &dccSettings{
+		dir:     lua.LVAsString(tbl.RawGetString("dir")),
+		maxSize: defaultDCCMaxSize,
+	}
+	ds.chat = lua.LVAsBool(tbl.RawGetString("chat"))
+	ds.private = lua.LVAsBool(tbl.RawGetString("private"))
+	if address := lua.LVAsString(tbl.RawGetString("address")); len(address) > 0 {
+		if ds.address = net.ParseIP(address); ds.address == nil {
+			log.Printf("Lua reload error: ignoring invalid dcc address: %s", address)
+		}
+	}
+	if maxSize, ok := tbl.RawGetString("max_size").(lua.LNumber); ok && maxSize >= 1 {
+		ds.maxSize = int64(maxSize)
+	}
+	if allowTbl, ok := tbl.RawGetString("allow").(*lua.LTable); ok {
+		allowTbl.ForEach(func(_ lua.LValue, maskL lua.LValue) {
+			re, err := hostmaskRegexp(lua.LVAsString(maskL))
+			if err != nil {
+				log.Printf("Lua reload error: dcc allow %s: %s", lua.LVAsString(maskL), err)
+				return
+			}
+			ds.allow = append(ds.allow, re)
+		})
+	}
+	switch callback := tbl.RawGetString("callback").(type) {
+	case *lua.LFunction:
+		ds.callback = callback
+	case *lua.LNilType:
+	default:
+		log.Printf("Lua reload error: ignoring dcc callback of unexpected type: %s", callback.Type())
+	}
+	return ds
+}
+
+// allowed returns true if offers from the sender of a message are accepted
+func (ds *dccSettings) allowed(prefix *irc.Prefix) bool {
+	mask := prefix.String()
+	for _, re := range ds.allow {
+		if re.MatchString(mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAddress returns an error if offers to connect to an address aren't accepted
+func (ds *dccSettings) checkAddress(addr string) error {
+	if ds.private {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return fmt.Errorf("private address not allowed: %s", host)
+	}
+	return nil
+}
+
+// handleDCC receives files offered to us by DCC SEND and accepts DCC CHAT if the sender is allowed to
+func (b *BananaBoatBot) handleDCC(ctx context.Context, svrName string, msg *irc.Message) {
+	if len(msg.Params) < 2 || msg.Prefix == nil || isDCCChat(svrName) {
+		return
+	}
+	command, args, ok := parseCTCP(msg.Params[1])
+	if !ok || command != "DCC" {
+		return
+	}
+	b.handlersMutex.RLock()
+	settings := b.dcc
+	b.handlersMutex.RUnlock()
+	if settings == nil {
+		return
+	}
+	// Offers are sent to us rather than channels
+	state := b.getServerState(svrName)
+	if state == nil || !state.EqualFold(msg.Params[0], state.Nick()) {
+		return
+	}
+	if !settings.allowed(msg.Prefix) {
+		log.Printf("[%s] Ignoring DCC from %s (not allowed)", svrName, msg.Prefix)
+		return
+	}
+	if strings.HasPrefix(strings.ToUpper(args), "CHAT ") {
+		b.acceptDCCChat(svrName, msg.Prefix, settings, args)
+		return
+	}
+	if len(settings.dir) == 0 {
+		return
+	}
+	offer, err := client.ParseDCCSend(args)
+	if err == nil {
+		err = settings.checkAddress(offer.Addr)
+	}
+	if err != nil {
+		log.Printf("[%s] Ignoring DCC from %s: %s", svrName, msg.Prefix, err)
+		return
+	}
+	if atomic.AddInt32(&b.dccTransfers, 1) > maxDCCTransfers {
+		atomic.AddInt32(&b.dccTransfers, -1)
+		log.Printf("[%s] Ignoring DCC from %s (too many transfers)", svrName, msg.Prefix)
+		return
+	}
+	log.Printf("[%s] Receiving %q from %s", svrName, offer.Filename, msg.Prefix)
+	go func() {
+		defer atomic.AddInt32(&b.dccTransfers, -1)
+		path, size, err := offer.Receive(ctx, settings.dir, settings.maxSize)
+		if err != nil {
+			log.Printf("[%s] Receiving %q from %s failed: %s", svrName, offer.Filename, msg.Prefix, err)
+		}
+		b.dccCallback(ctx, svrName, msg, settings, offer, path, size, err)
+	}()
+}
+
+// dccCallback passes the result of a transfer to the DCC callback
+func (b *BananaBoatBot) dccCallback(ctx context.Context, svrName string, msg *irc.Message, settings *dccSettings, offer *client.DCCOffer, path string, size int64, transferErr error) {
+	if settings.callback == nil {
+		return
+	}
+	b.handlersMutex.RLock()
+	maxMessages := b.maxMessages
+	b.handlersMutex.RUnlock()
+	b.luaMutex.Lock()
+	defer b.luaMutex.Unlock()
+	defer b.luaState.SetTop(0)
+	// Result has the name offered, the path saved to, number of bytes received and error (if any)
+	resultT := b.luaState.CreateTable(0, 4)
+	resultT.RawSetString("filename", lua.LString(offer.Filename))
+	resultT.RawSetString("size", lua.LNumber(size))
+	if transferErr != nil {
+		resultT.RawSetString("error", lua.LString(transferErr.Error()))
+	} else {
+		resultT.RawSetString("path", lua.LString(path))
+	}
+	// Replies go to the sender
+	b.curMessage = &irc.Message{
+		Prefix:  msg.Prefix,
+		Command: irc.PRIVMSG,
+		Params:  []string{msg.Prefix.Name},
+	}
+	b.curNet = svrName
+	b.curTags = nil
+	b.curTime = time.Now()
+	luaParams := luaParamsFromMessage(svrName, &irc.Message{Prefix: msg.Prefix})
+	err := b.luaState.CallByParam(lua.P{
+		Fn:      settings.callback,
+		NRet:    1,
+		Protect: true,
+	}, append(luaParams, resultT)...)
+	if err != nil {
+		log.Printf("[%s] DCC callback failed: %s", svrName, err)
+		return
+	}
+	b.handleLuaReturnValues(ctx, svrName, b.luaState, maxMessages)
+}
+
+// isDCCChat returns true if a server name belongs to a chat
+func isDCCChat(svrName string) bool {
+	return strings.HasPrefix(svrName, dccChatPrefix)
+}
+
+// dccChatName returns the name of a chat with nick which is handled like a server
+func dccChatName(svrName string, nick string) string {
+	return dccChatPrefix + svrName + ":" + nick
+}
+
+// acceptDCCChat connects to a chat offered to us if chats are accepted
+func (b *BananaBoatBot) acceptDCCChat(svrName string, peer *irc.Prefix, settings *dccSettings, args string) {
+	if !settings.chat {
+		return
+	}
+	addr, err := client.ParseDCCChat(args)
+	if err == nil {
+		err = settings.checkAddress(addr)
+	}
+	if err != nil {
+		log.Printf("[%s] Ignoring DCC from %s: %s", svrName, peer, err)
+		return
+	}
+	if _, err := b.startDCCChat(svrName, peer, client.DialDCCChat(addr)); err != nil {
+		log.Printf("[%s] Ignoring DCC CHAT from %s: %s", svrName, peer, err)
+	}
+}
+
+// startDCCChat adds a chat with peer to the servers so handlers can use it like any server, returning its name
+func (b *BananaBoatBot) startDCCChat(svrName string, peer *irc.Prefix, connect func(ctx context.Context) (net.Conn, error)) (string, error) {
+	state := b.getServerState(svrName)
+	if state == nil {
+		return "", errors.New("invalid server")
+	}
+	name := dccChatName(svrName, peer.Name)
+	settings := &client.IrcServerSettings{
+		Nick:          state.Nick(),
+		ErrorCallback: b.handleDCCChatError,
+		InputCallback: b.HandleHandlers,
+	}
+	b.serversMutex.Lock()
+	chats := 0
+	b.Servers.Range(func(k, _ interface{}) bool {
+		if isDCCChat(k.(string)) {
+			chats++
+		}
+		return true
+	})
+	if _, ok := b.Servers.Load(name); ok {
+		b.serversMutex.Unlock()
+		return "", errors.New("chat already open")
+	}
+	if chats >= maxDCCChats {
+		b.serversMutex.Unlock()
+		return "", errors.New("too many chats")
+	}
+	chat, chatCtx := client.NewDCCChat(b.luaState.Context(), name, peer, settings, connect)
+	b.Servers.Store(name, chat)
+	b.serversMutex.Unlock()
+	go chat.Dial(chatCtx)
+	return name, nil
+}
+
+// handleDCCChatError removes a chat which ended (chats aren't reconnected)
+func (b *BananaBoatBot) handleDCCChatError(ctx context.Context, name string, err error) {
+	log.Printf("[%s] DCC CHAT ended: %s", name, err)
+	b.serversMutex.Lock()
+	defer b.serversMutex.Unlock()
+	svr, ok := b.Servers.Load(name)
+	// Error doesn't belong to the current chat
+	if !ok || svr.(client.IrcServerInterface).Done() != ctx.Done() {
+		return
+	}
+	svr.(client.IrcServerInterface).Close(ctx)
+	b.Servers.Delete(name)
+	b.health.Delete(name)
+}
+
+// luaLibDCCChat offers a chat to a user returning the name of the server used to talk to them
+func (b *BananaBoatBot) luaLibDCCChat(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	nick := luaState.CheckString(2)
+	b.handlersMutex.RLock()
+	settings := b.dcc
+	b.handlersMutex.RUnlock()
+	if settings == nil || settings.address == nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("dcc address isn't configured"))
+		return 2
+	}
+	if isDCCChat(svrName) || b.getServerState(svrName) == nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("invalid server"))
+		return 2
+	}
+	offer, accept, err := client.ListenDCCChat(":0", settings.address)
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	name, err := b.startDCCChat(svrName, &irc.Prefix{Name: nick}, accept)
+	if err != nil {
+		// Stop listening
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		accept(ctx)
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	b.sendMessage(svrName, &irc.Message{
+		Command: irc.PRIVMSG,
+		Params:  []string{nick, ctcpText("DCC", offer)},
+	})
+	luaState.Push(lua.LString(name))
+	return 1
+}
@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// durationPartRegexp matches a number followed by a unit such as "2h" or "1.5d"
+var durationPartRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([a-zµ]+)\s*`)
+
+// durationUnits are units not supported by time.ParseDuration
+var durationUnits = map[string]time.Duration{
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// humanizeUnits are units used by humanizeDuration from largest to smallest
+var humanizeUnits = []struct {
+	name    string
+	seconds int64
+}{
+	{"day", 86400},
+	{"hour", 3600},
+	{"minute", 60},
+	{"second", 1},
+}
+
+// parseDuration parses durations like time.ParseDuration does but also accepts days and weeks
+func parseDuration(s string) (time.Duration, error) {
+	rest := strings.ToLower(strings.TrimSpace(s))
+	if rest == "0" {
+		return 0, nil
+	}
+	if len(rest) == 0 {
+		return 0, errors.New("empty duration")
+	}
+	var total time.Duration
+	tooLarge := fmt.Errorf("duration too large: %q", s)
+	for len(rest) > 0 {
+		m := durationPartRegexp.FindStringSubmatch(rest)
+		if m == nil {
+			return 0, fmt.Errorf("invalid duration: %q", s)
+		}
+		rest = rest[len(m[0]):]
+		if unit, ok := durationUnits[m[2]]; ok {
+			n, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration: %q", s)
+			}
+			// Check against what's left before converting as the result would overflow
+			if n*float64(unit) >= float64(math.MaxInt64-total) {
+				return 0, tooLarge
+			}
+			total += time.Duration(n * float64(unit))
+			continue
+		}
+		d, err := time.ParseDuration(m[1] + m[2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", s)
+		}
+		if d > math.MaxInt64-total {
+			return 0, tooLarge
+		}
+		total += d
+	}
+	return total, nil
+}
+
+// humanizeDuration describes a number of seconds in words using at most precision units (0 is unlimited)
+func humanizeDuration(seconds float64, precision int) string {
+	sign := ""
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	remaining := int64(math.Round(seconds))
+	var parts []string
+	for _, unit := range humanizeUnits {
+		if precision > 0 && len(parts) >= precision {
+			break
+		}
+		n := remaining / unit.seconds
+		if n == 0 {
+			continue
+		}
+		remaining -= n * unit.seconds
+		name := unit.name
+		if n != 1 {
+			name += "s"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", n, name))
+	}
+	if len(parts) == 0 {
+		return "0 seconds"
+	}
+	return sign + strings.Join(parts, " ")
+}
+
+// luaLibParseDuration returns the number of seconds in a duration such as "2h30m" or nil and an error
+func (b *BananaBoatBot) luaLibParseDuration(luaState *lua.LState) int {
+	d, err := parseDuration(luaState.CheckString(1))
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	luaState.Push(lua.LNumber(d.Seconds()))
+	return 1
+}
+
+// luaLibHumanizeDuration describes a number of seconds in words such as "2 hours 30 minutes"
+func (b *BananaBoatBot) luaLibHumanizeDuration(luaState *lua.LState) int {
+	seconds := luaState.CheckNumber(1)
+	precision := luaState.OptInt(2, 0)
+	luaState.Push(lua.LString(humanizeDuration(float64(seconds), precision)))
+	return 1
+}
@@ -0,0 +1,33 @@
+package bot
+
+import (
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// EchoCommand is the command of the synthetic message telling handlers the server echoed a message we sent
+	// Its prefix is ours and its parameters are the command (PRIVMSG or NOTICE), target and text of the message
+	EchoCommand = "ECHO"
+	// echoCapability makes the server send us copies of our messages once they were delivered (IRCv3 echo-message)
+	echoCapability = "echo-message"
+)
+
+// echoedMessage returns a synthetic ECHO message if msg is a copy of a message we sent echoed by the server
+// (nil otherwise) so our own messages don't trigger handlers for messages of others
+func (b *BananaBoatBot) echoedMessage(svrName string, msg *irc.Message) *irc.Message {
+	if (msg.Command != irc.PRIVMSG && msg.Command != irc.NOTICE) || msg.Prefix == nil || len(msg.Params) < 2 {
+		return nil
+	}
+	if isDCCChat(svrName) {
+		return nil
+	}
+	state := b.getServerState(svrName)
+	if state == nil || !state.HasCapability(echoCapability) || !state.EqualFold(msg.Prefix.Name, state.Nick()) {
+		return nil
+	}
+	return &irc.Message{
+		Prefix:  msg.Prefix,
+		Command: EchoCommand,
+		Params:  []string{msg.Command, msg.Params[0], msg.Params[len(msg.Params)-1]},
+	}
+}
@@ -0,0 +1,349 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// defaultEvalMaxOutput is the default maximum length of output of the built-in eval command
+	defaultEvalMaxOutput = 400
+	// defaultEvalTimeout is the default time snippets run by the built-in eval command may take
+	defaultEvalTimeout = 5 * time.Second
+	// defaultEvalTrigger is the default name of the built-in eval command
+	defaultEvalTrigger = "eval"
+	// evalMaxMemory is how much memory snippets may use in addition to what was used when they started
+	evalMaxMemory = 64 << 20
+	// evalMaxString is the longest string string.rep may create in the sandbox
+	evalMaxString = 1 << 20
+	// evalMemoryCheckInterval is the interval between checks of memory usage while snippets run
+	evalMemoryCheckInterval = 50 * time.Millisecond
+)
+
+// evalSettings configures the built-in command running Lua snippets for admins
+type evalSettings struct {
+	// accounts are services accounts which may use the command
+	accounts []string
+	// allow are names of libraries opened in addition to the safe ones (such as os or io)
+	allow []string
+	// allowFuncs are names of bananaboat functions available in addition to the safe ones (such as worker)
+	allowFuncs []string
+	// maxOutput is the maximum length of output in bytes
+	maxOutput int
+	// timeout is how long snippets may run for
+	timeout time.Duration
+	// trigger is the name of the command
+	trigger string
+}
+
+// evalSafeLibs are libraries always opened in the sandbox
+var evalSafeLibs = map[string]lua.LGFunction{
+	lua.CoroutineLibName: lua.OpenCoroutine,
+	lua.MathLibName:      lua.OpenMath,
+	lua.StringLibName:    lua.OpenString,
+	lua.TabLibName:       lua.OpenTable,
+}
+
+// evalUnsafeLibs are libraries which are only opened in the sandbox if explicitly allowed
+var evalUnsafeLibs = map[string]lua.LGFunction{
+	lua.ChannelLibName: lua.OpenChannel,
+	lua.DebugLibName:   lua.OpenDebug,
+	lua.IoLibName:      lua.OpenIo,
+	lua.OsLibName:      lua.OpenOs,
+}
+
+// evalSafeFuncs are bananaboat functions which only read state or compute values and are always available in the sandbox
+// (functions running code in other states, running processes or doing network or storage I/O must be allowed)
+var evalSafeFuncs = []string{
+	"account",
+	"capabilities",
+	"casefold",
+	"channel_forward",
+	"channel_modes",
+	"closest",
+	"cooldown_remaining",
+	"format_bytes",
+	"format_table",
+	"format_time",
+	"has_op",
+	"humanize_duration",
+	"in_channel",
+	"is_online",
+	"is_valid_channel",
+	"is_valid_nick",
+	"isupport",
+	"json_decode",
+	"json_encode",
+	"lag",
+	"levenshtein",
+	"list_handlers",
+	"locale",
+	"members",
+	"memory_stats",
+	"message_time",
+	"motd",
+	"names_equal",
+	"param",
+	"parse_duration",
+	"parse_int",
+	"parse_number",
+	"random",
+	"regexp",
+	"server_health",
+	"tags",
+	"topic",
+	"weighted_choice",
+}
+
+// evalSettingsFromLua reads settings of the eval command which is either true or a table with settings
+func evalSettingsFromLua(lv lua.LValue) *evalSettings {
+	es := &evalSettings{
+		maxOutput: defaultEvalMaxOutput,
+		timeout:   defaultEvalTimeout,
+		trigger:   defaultEvalTrigger,
+	}
+	switch lv := lv.(type) {
+	case lua.LBool:
+		if !lv {
+			return nil
+		}
+	case *lua.LTable:
+		if trigger, ok := lv.RawGetString("trigger").(lua.LString); ok && len(trigger) > 0 {
+			es.trigger = strings.ToLower(string(trigger))
+		}
+		if timeout, ok := lv.RawGetString("timeout").(lua.LNumber); ok && timeout > 0 {
+			es.timeout = time.Duration(float64(timeout) * float64(time.Second))
+		}
+		if maxOutput, ok := lv.RawGetString("max_output").(lua.LNumber); ok && maxOutput > 0 {
+			es.maxOutput = int(maxOutput)
+		}
+		if accountsTbl, ok := lv.RawGetString("accounts").(*lua.LTable); ok {
+			accountsTbl.ForEach(func(_ lua.LValue, accountLV lua.LValue) {
+				es.accounts = append(es.accounts, lua.LVAsString(accountLV))
+			})
+		}
+		if allowTbl, ok := lv.RawGetString("allow").(*lua.LTable); ok {
+			allowTbl.ForEach(func(_ lua.LValue, libLV lua.LValue) {
+				lib := lua.LVAsString(libLV)
+				// Names which aren't libraries are bananaboat functions
+				if _, ok := evalUnsafeLibs[lib]; !ok {
+					es.allowFuncs = append(es.allowFuncs, lib)
+					return
+				}
+				es.allow = append(es.allow, lib)
+			})
+		}
+	default:
+		return nil
+	}
+	if len(es.accounts) == 0 {
+		log.Printf("Lua reload error: eval: no accounts may use it")
+	}
+	return es
+}
+
+// mayEval returns true if the sender of a message is known to be logged in to an account which may use eval
+// (hostmasks aren't trusted as snippets can do anything the bot can)
+func (b *BananaBoatBot) mayEval(ctx context.Context, svrName string, msg *irc.Message, es *evalSettings) bool {
+	account, ok := client.TagsFromContext(ctx)["account"]
+	if !ok {
+		state := b.getServerState(svrName)
+		if state == nil || msg.Prefix == nil {
+			return false
+		}
+		account, ok = state.Account(msg.Prefix.Name)
+	}
+	if !ok || len(account) == 0 {
+		return false
+	}
+	for _, allowed := range es.accounts {
+		if b.foldCase(svrName, allowed) == b.foldCase(svrName, account) {
+			return true
+		}
+	}
+	return false
+}
+
+// openLib opens a Lua library in a state
+func openLib(luaState *lua.LState, name string, fn lua.LGFunction) {
+	luaState.Push(luaState.NewFunction(fn))
+	luaState.Push(lua.LString(name))
+	luaState.Call(1, 0)
+}
+
+// evalModule returns the bananaboat library restricted to safe functions and those allowed
+func (b *BananaBoatBot) evalModule(luaState *lua.LState, allow []string) *lua.LTable {
+	luaState.Push(luaState.NewFunction(b.luaLibLoader))
+	luaState.Call(0, 1)
+	full := luaState.Get(-1).(*lua.LTable)
+	luaState.Pop(1)
+	mod := luaState.CreateTable(0, len(evalSafeFuncs)+len(allow))
+	for _, name := range evalSafeFuncs {
+		mod.RawSetString(name, full.RawGetString(name))
+	}
+	for _, name := range allow {
+		lv := full.RawGetString(name)
+		if lv == lua.LNil {
+			log.Printf("eval: ignoring unknown library or function: %s", name)
+			continue
+		}
+		mod.RawSetString(name, lv)
+	}
+	return mod
+}
+
+// evalStringRep is string.rep refusing to create strings longer than evalMaxString
+func evalStringRep(luaState *lua.LState) int {
+	str := luaState.CheckString(1)
+	n := luaState.CheckInt(2)
+	if n <= 0 || len(str) == 0 {
+		luaState.Push(lua.LString(""))
+		return 1
+	}
+	if n > evalMaxString/len(str) {
+		luaState.ArgError(2, fmt.Sprintf("result longer than %d bytes", evalMaxString))
+	}
+	luaState.Push(lua.LString(strings.Repeat(str, n)))
+	return 1
+}
+
+// exceedsEvalMemory returns true if memory usage grew by more than evalMaxMemory since it was start
+// (garbage is collected before giving up so only live objects count)
+func exceedsEvalMemory(start uint64) bool {
+	if memoryUsage() <= start+evalMaxMemory {
+		return false
+	}
+	runtime.GC()
+	return memoryUsage() > start+evalMaxMemory
+}
+
+// newSandboxState creates a Lua state without access to files, processes or the network unless allowed
+func (b *BananaBoatBot) newSandboxState(ctx context.Context, es *evalSettings) *lua.LState {
+	luaState := lua.NewState(lua.Options{SkipOpenLibs: true})
+	luaState.SetContext(ctx)
+	openLib(luaState, lua.LoadLibName, lua.OpenPackage)
+	openLib(luaState, lua.BaseLibName, lua.OpenBase)
+	for name, fn := range evalSafeLibs {
+		openLib(luaState, name, fn)
+	}
+	for _, name := range es.allow {
+		openLib(luaState, name, evalUnsafeLibs[name])
+	}
+	// Huge strings would be allocated before the snippet could be stopped
+	if strTbl, ok := luaState.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		strTbl.RawSetString("rep", luaState.NewFunction(evalStringRep))
+	}
+	// Don't load code from files
+	luaState.SetGlobal("dofile", lua.LNil)
+	luaState.SetGlobal("loadfile", lua.LNil)
+	if pkg, ok := luaState.GetGlobal(lua.LoadLibName).(*lua.LTable); ok {
+		pkg.RawSetString("path", lua.LString(""))
+		pkg.RawSetString("cpath", lua.LString(""))
+	}
+	// Provide access to our library functions which can't escape the sandbox
+	luaState.PreloadModule("bananaboat", func(luaState *lua.LState) int {
+		luaState.Push(b.evalModule(luaState, es.allowFuncs))
+		return 1
+	})
+	if err := luaState.DoString("bb = require 'bananaboat'"); err != nil {
+		log.Printf("eval: failed to load library: %s", err)
+	}
+	return luaState
+}
+
+// evalLua runs a snippet in a sandbox and returns its results or error as text
+func (b *BananaBoatBot) evalLua(ctx context.Context, svrName string, msg *irc.Message, es *evalSettings, code string) string {
+	ctx, cancel := context.WithTimeout(ctx, es.timeout)
+	defer cancel()
+	luaState := b.newSandboxState(ctx, es)
+	defer luaState.Close()
+	// Library functions should see the message which invoked eval
+	b.luaContexts.Store(luaState, &messageContext{net: svrName, msg: msg, tags: client.TagsFromContext(ctx), time: messageTime(ctx)})
+	defer b.luaContexts.Delete(luaState)
+	// Snippets using too much memory (such as by growing tables) are stopped
+	var exceeded int32
+	start := memoryUsage()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(evalMemoryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				if exceedsEvalMemory(start) {
+					atomic.StoreInt32(&exceeded, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	// Try snippet as an expression first
+	fn, err := luaState.LoadString("return " + code)
+	if err != nil {
+		fn, err = luaState.LoadString(code)
+		if err != nil {
+			return fmt.Sprintf("error: %s", err)
+		}
+	}
+	err = luaState.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    lua.MultRet,
+		Protect: true,
+	})
+	if atomic.LoadInt32(&exceeded) == 1 {
+		return fmt.Sprintf("error: memory limit exceeded (%s)", formatBytes(evalMaxMemory, defaultLocale))
+	}
+	if err != nil {
+		return fmt.Sprintf("error: %s", err)
+	}
+	results := make([]string, luaState.GetTop())
+	for i := range results {
+		results[i] = luaState.ToStringMeta(luaState.Get(i + 1)).String()
+	}
+	if len(results) == 0 {
+		return "nil"
+	}
+	return strings.Join(results, ", ")
+}
+
+// truncateOutput limits output to maxOutput bytes
+func truncateOutput(output string, maxOutput int) string {
+	if len(output) <= maxOutput {
+		return output
+	}
+	i := maxOutput
+	for i > 0 && !utf8.RuneStart(output[i]) {
+		i--
+	}
+	return output[:i] + "..."
+}
+
+// handleEval runs a snippet for an allowed account and replies with the result
+func (b *BananaBoatBot) handleEval(ctx context.Context, svrName string, msg *irc.Message, es *evalSettings, code string) {
+	log.Printf("[%s] Eval by %s: %s", svrName, msg.Prefix, code)
+	output := truncateOutput(b.evalLua(ctx, svrName, msg, es, code), es.maxOutput)
+	ircMessages, err := buildMessages(irc.PRIVMSG, []string{replyTarget(msg), output}, NewlinesSpace, b.prefixLength(svrName))
+	if err != nil {
+		log.Printf("[%s] Eval output invalid: %s", svrName, err)
+		return
+	}
+	for _, ircMessage := range ircMessages {
+		b.sendMessage(svrName, ircMessage)
+	}
+}
@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// StateConnecting is published when we start connecting to a server
+	StateConnecting = "connecting"
+	// StateConnected is published when registration with a server succeeded
+	StateConnected = "connected"
+	// StateDisconnected is published when a connection failed
+	StateDisconnected = "disconnected"
+	// StateReconnecting is published when we are waiting to reconnect to a server
+	StateReconnecting = "reconnecting"
+	// stateEventBuffer is the number of events buffered per subscriber
+	stateEventBuffer = 32
+)
+
+// StateEvent describes a change of connection state of a server
+type StateEvent struct {
+	// Net is the friendly name of the server
+	Net string `json:"net"`
+	// State is the new connection state
+	State string `json:"state"`
+	// Time is when the state changed
+	Time time.Time `json:"time"`
+	// Detail is additional information such as an error message
+	Detail string `json:"detail,omitempty"`
+}
+
+// SubscribeStates returns a channel receiving connection state changes and a function to unsubscribe
+func (b *BananaBoatBot) SubscribeStates() (<-chan StateEvent, func()) {
+	ch := make(chan StateEvent, stateEventBuffer)
+	b.stateMutex.Lock()
+	if b.stateSubscribers == nil {
+		b.stateSubscribers = make(map[chan StateEvent]struct{})
+	}
+	b.stateSubscribers[ch] = struct{}{}
+	b.stateMutex.Unlock()
+	return ch, func() {
+		b.stateMutex.Lock()
+		delete(b.stateSubscribers, ch)
+		b.stateMutex.Unlock()
+	}
+}
+
+// publishState sends a connection state change to subscribers
+func (b *BananaBoatBot) publishState(svrName string, state string, detail string) {
+	b.stateMutex.Lock()
+	defer b.stateMutex.Unlock()
+	// Nothing to do if nobody is listening
+	if len(b.stateSubscribers) == 0 {
+		return
+	}
+	event := StateEvent{
+		Net:    svrName,
+		State:  state,
+		Time:   time.Now(),
+		Detail: detail,
+	}
+	for ch := range b.stateSubscribers {
+		// Drop events for subscribers which aren't keeping up
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// ServeStateEvents streams connection state changes as server-sent events
+func (b *BananaBoatBot) ServeStateEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := b.SubscribeStates()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			data, err := json.Marshal(&event)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.State, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
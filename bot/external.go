@@ -0,0 +1,194 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// defaultExternalTimeout is used if no timeout is configured for an external handler
+	defaultExternalTimeout = 10 * time.Second
+	// maxExternalResponse is the maximum size of response we read from an external handler
+	maxExternalResponse = 1 << 20
+)
+
+// ExternalRequest is sent as JSON to external handlers
+type ExternalRequest struct {
+	Net     string   `json:"net"`
+	Command string   `json:"command"`
+	Nick    string   `json:"nick"`
+	User    string   `json:"user"`
+	Host    string   `json:"host"`
+	Params  []string `json:"params"`
+}
+
+// ExternalMessage is a message returned as JSON by external handlers
+type ExternalMessage struct {
+	Command string   `json:"command"`
+	Net     string   `json:"net,omitempty"`
+	Params  []string `json:"params"`
+}
+
+// externalHandler describes a subprocess or HTTP endpoint handling a command
+type externalHandler struct {
+	// args is the command line of a subprocess to run
+	args []string
+	// timeout is how long we wait for the handler to respond
+	timeout time.Duration
+	// url is the address of an HTTP endpoint to POST to
+	url string
+}
+
+// externalHandlerFromTable reads settings for an external handler from Lua
+func externalHandlerFromTable(tbl *lua.LTable) (*externalHandler, error) {
+	ext := &externalHandler{
+		timeout: defaultExternalTimeout,
+	}
+	// Get 'url' string from table
+	lv := tbl.RawGetString("url")
+	ext.url = lua.LVAsString(lv)
+	// Get 'command' table from table
+	lv = tbl.RawGetString("command")
+	if argsTbl, ok := lv.(*lua.LTable); ok {
+		argsTbl.ForEach(func(index lua.LValue, argL lua.LValue) {
+			ext.args = append(ext.args, lua.LVAsString(argL))
+		})
+	}
+	// Exactly one of these should be set
+	if len(ext.url) == 0 && len(ext.args) == 0 {
+		return nil, errors.New("neither url nor command is set")
+	}
+	if len(ext.url) > 0 && len(ext.args) > 0 {
+		return nil, errors.New("only one of url or command may be set")
+	}
+	// Get 'timeout' in seconds from table
+	lv = tbl.RawGetString("timeout")
+	if timeout, ok := lv.(lua.LNumber); ok && timeout > 0 {
+		ext.timeout = time.Duration(float64(timeout) * float64(time.Second))
+	}
+	return ext, nil
+}
+
+// callHTTP posts a request to an HTTP endpoint and returns the response body
+func (b *BananaBoatBot) callHTTP(ctx context.Context, ext *externalHandler, reqBody []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, ext.url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-OK status: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxExternalResponse))
+}
+
+// callProcess runs a subprocess with request on stdin and returns its stdout
+func callProcess(ctx context.Context, ext *externalHandler, reqBody []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, ext.args[0], ext.args[1:]...)
+	cmd.Stdin = bytes.NewReader(reqBody)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Read one byte more than allowed to tell if the output is too large
+	respBody, readErr := ioutil.ReadAll(io.LimitReader(stdout, maxExternalResponse+1))
+	if len(respBody) > maxExternalResponse {
+		// Don't leave the process blocked writing the rest
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("output larger than %d bytes", maxExternalResponse)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return respBody, readErr
+}
+
+// handleExternal forwards a message to an external handler and routes its response
+func (b *BananaBoatBot) handleExternal(ctx context.Context, svrName string, msg *irc.Message, ext *externalHandler) {
+	// Build request
+	request := &ExternalRequest{
+		Net:     svrName,
+		Command: msg.Command,
+		Params:  msg.Params,
+	}
+	if msg.Prefix != nil {
+		request.Nick = msg.Prefix.Name
+		request.User = msg.Prefix.User
+		request.Host = msg.Prefix.Host
+	}
+	reqBody, err := json.Marshal(request)
+	if err != nil {
+		log.Printf("External handler for %s failed: %s", msg.Command, err)
+		return
+	}
+	// Call handler with timeout
+	ctx, cancel := context.WithTimeout(ctx, ext.timeout)
+	defer cancel()
+	var respBody []byte
+	if len(ext.url) > 0 {
+		respBody, err = b.callHTTP(ctx, ext, reqBody)
+	} else {
+		respBody, err = callProcess(ctx, ext, reqBody)
+	}
+	if err != nil {
+		log.Printf("External handler for %s failed: %s", msg.Command, err)
+		return
+	}
+	// Empty response means there is nothing to send
+	if len(bytes.TrimSpace(respBody)) == 0 {
+		return
+	}
+	var messages []ExternalMessage
+	err = json.Unmarshal(respBody, &messages)
+	if err != nil {
+		log.Printf("External handler for %s returned invalid response: %s", msg.Command, err)
+		return
+	}
+	// Get luaState from pool
+	luaState := b.luaPool.Get()
+	defer func() {
+		// Clear stack and return state to pool
+		luaState.SetTop(0)
+		b.luaPool.Put(luaState)
+		b.checkMemory()
+	}()
+	// Convert messages to Lua table as if returned by a Lua handler
+	res := luaState.CreateTable(len(messages), 0)
+	for _, m := range messages {
+		messageT := luaState.CreateTable(0, 3)
+		messageT.RawSetString("command", lua.LString(m.Command))
+		if len(m.Net) > 0 {
+			messageT.RawSetString("net", lua.LString(m.Net))
+		}
+		paramsT := luaState.CreateTable(len(m.Params), 0)
+		for _, p := range m.Params {
+			paramsT.Append(lua.LString(p))
+		}
+		messageT.RawSetString("params", paramsT)
+		res.Append(messageT)
+	}
+	luaState.Push(res)
+	// Handle return values
+	b.handleLuaReturnValues(ctx, svrName, luaState, b.getMaxMessages())
+}
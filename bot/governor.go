@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+)
+
+// defaultConnectWindow is the default period over which connects to a server are limited
+const defaultConnectWindow = time.Hour
+
+// connectGovernor limits how often we connect to a server
+type connectGovernor struct {
+	// connects are times of connects within the window (including scheduled ones)
+	connects []time.Time
+	// max is the maximum number of connects within the window (0 is unlimited)
+	max int
+	// mutex protects connectGovernor
+	mutex sync.Mutex
+	// window is the period over which connects are counted
+	window time.Duration
+}
+
+// connectGovernorFromTable reads connect limits of a server from Lua
+func connectGovernorFromTable(tbl *lua.LTable) (int, time.Duration) {
+	var max int
+	if n, ok := tbl.RawGetString("max_connects").(lua.LNumber); ok && n > 0 {
+		max = int(n)
+	}
+	window := defaultConnectWindow
+	if n, ok := tbl.RawGetString("connect_window").(lua.LNumber); ok && n > 0 {
+		window = time.Duration(float64(n) * float64(time.Second))
+	}
+	return max, window
+}
+
+// getConnectGovernor returns the connect governor of a server
+func (b *BananaBoatBot) getConnectGovernor(svrName string) *connectGovernor {
+	g, _ := b.connectGovernors.LoadOrStore(svrName, &connectGovernor{window: defaultConnectWindow})
+	return g.(*connectGovernor)
+}
+
+// setLimit configures the governor
+func (g *connectGovernor) setLimit(max int, window time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.max = max
+	g.window = window
+}
+
+// prune forgets connects older than the window (mutex must be held)
+func (g *connectGovernor) prune(now time.Time) {
+	i := 0
+	for i < len(g.connects) && now.Sub(g.connects[i]) > g.window {
+		i++
+	}
+	g.connects = g.connects[i:]
+}
+
+// reserve schedules a connect and returns how long to wait before connecting
+func (g *connectGovernor) reserve() time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	g.prune(now)
+	at := now
+	if g.max > 0 && len(g.connects) >= g.max {
+		// Wait until the oldest connect counted against the limit leaves the window
+		at = g.connects[len(g.connects)-g.max].Add(g.window)
+	}
+	if n := len(g.connects); n > 0 && g.connects[n-1].After(at) {
+		at = g.connects[n-1]
+	}
+	g.connects = append(g.connects, at)
+	return at.Sub(now)
+}
+
+// stats returns the number of connects within the window and the remaining cooldown
+func (g *connectGovernor) stats() (int, time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	g.prune(now)
+	connects := 0
+	var cooldown time.Duration
+	for _, t := range g.connects {
+		if t.After(now) {
+			cooldown = t.Sub(now)
+		} else {
+			connects++
+		}
+	}
+	return connects, cooldown
+}
+
+// connectDelay schedules a connect to a server and returns how long to wait beforehand
+func (b *BananaBoatBot) connectDelay(svrName string) time.Duration {
+	delay := b.getConnectGovernor(svrName).reserve()
+	if delay > 0 {
+		log.Printf("[%s] Connecting too often, waiting %s before connecting", svrName, delay.Round(time.Second))
+		connectsThrottledCounter.WithLabelValues(svrName).Inc()
+	}
+	return delay
+}
+
+// dialServer connects to a server once the connect governor allows it
+func (b *BananaBoatBot) dialServer(ctx context.Context, svrName string, svr client.IrcServerInterface, delay time.Duration) {
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+	svr.Dial(ctx)
+}
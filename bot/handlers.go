@@ -0,0 +1,279 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// defaultMaxMessages is the default limit of messages a handler may return
+const defaultMaxMessages = 100
+
+// luaHandler is a Lua function registered to handle a command
+type luaHandler struct {
+	// admin is set if only admins may invoke the handler as a command
+	admin bool
+	// args are prepended to parameters passed to fn
+	args []lua.LValue
+	// description is shown by the built-in help command
+	description string
+	// disabled is set if the handler was disabled at runtime (protected by handlersMutex)
+	disabled bool
+	// fn is the function to be called
+	fn *lua.LFunction
+	// maxMessages overrides the limit of messages the handler may return if set
+	maxMessages int
+	// numeric is set if parameters of numeric replies are passed parsed instead of unpacked
+	numeric bool
+}
+
+// handlerFromLua reads a handler which is either a function or a {func=..., args={...}, max_messages=...} table
+func handlerFromLua(lv lua.LValue) (*luaHandler, error) {
+	switch v := lv.(type) {
+	case *lua.LFunction:
+		return &luaHandler{fn: v}, nil
+	case *lua.LTable:
+		fn, ok := v.RawGetString("func").(*lua.LFunction)
+		if !ok {
+			return nil, fmt.Errorf("unexpected func type: %s", v.RawGetString("func").Type())
+		}
+		h := &luaHandler{
+			admin:   lua.LVAsBool(v.RawGetString("admin")),
+			fn:      fn,
+			numeric: lua.LVAsBool(v.RawGetString("numeric")),
+		}
+		// Get 'description' (or 'help') string from table
+		h.description = lua.LVAsString(v.RawGetString("description"))
+		if len(h.description) == 0 {
+			h.description = lua.LVAsString(v.RawGetString("help"))
+		}
+		// Get 'max_messages' number from table
+		if maxMessages, ok := v.RawGetString("max_messages").(lua.LNumber); ok && maxMessages >= 1 {
+			h.maxMessages = int(maxMessages)
+		}
+		// Get 'args' table from table
+		argsLV := v.RawGetString("args")
+		switch argsT := argsLV.(type) {
+		case *lua.LTable:
+			for i := 1; i <= argsT.MaxN(); i++ {
+				h.args = append(h.args, argsT.RawGetInt(i))
+			}
+		case *lua.LNilType:
+			break
+		default:
+			return nil, fmt.Errorf("unexpected args type: %s", argsLV.Type())
+		}
+		return h, nil
+	}
+	return nil, fmt.Errorf("unexpected type: %s", lv.Type())
+}
+
+// params returns parameters for the handler given parameters from a message
+func (h *luaHandler) params(luaParams []lua.LValue) []lua.LValue {
+	if len(h.args) == 0 {
+		return luaParams
+	}
+	params := make([]lua.LValue, 0, len(h.args)+len(luaParams))
+	params = append(params, h.args...)
+	return append(params, luaParams...)
+}
+
+// isNumeric returns true if command is a numeric reply
+func isNumeric(command string) bool {
+	if len(command) != 3 {
+		return false
+	}
+	for i := 0; i < len(command); i++ {
+		if command[i] < '0' || command[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// luaNumericParamsFromMessage returns parameters for a numeric reply as the numeric, trailing text and a table of
+// middle parameters (without our nick which numerics start with)
+func luaNumericParamsFromMessage(luaState *lua.LState, svrName string, msg *irc.Message) []lua.LValue {
+	luaParams := luaParamsFromMessage(svrName, &irc.Message{Prefix: msg.Prefix})
+	params := msg.Params
+	if len(params) > 0 {
+		params = params[1:]
+	}
+	var trailing lua.LValue = lua.LNil
+	if len(params) > 0 {
+		trailing = lua.LString(params[len(params)-1])
+		params = params[:len(params)-1]
+	}
+	args := luaState.CreateTable(len(params), 0)
+	for _, param := range params {
+		args.Append(lua.LString(param))
+	}
+	return append(luaParams, lua.LString(msg.Command), trailing, args)
+}
+
+// paramsForMessage returns parameters for the handler given a message
+func (h *luaHandler) paramsForMessage(luaState *lua.LState, svrName string, msg *irc.Message) []lua.LValue {
+	if h.numeric && isNumeric(msg.Command) {
+		return h.params(luaNumericParamsFromMessage(luaState, svrName, msg))
+	}
+	return h.params(luaParamsFromMessage(svrName, msg))
+}
+
+// handlerName returns the command a key of the handlers table registers a handler for
+// An error is returned for keys which can never match a command and a warning for keys which probably are mistakes
+func handlerName(key lua.LValue) (string, string, error) {
+	switch k := key.(type) {
+	case lua.LString:
+		name := string(k)
+		switch {
+		case len(strings.TrimSpace(name)) == 0:
+			return "", "", errors.New("empty command name")
+		case strings.ContainsAny(name, " \t\r\n"):
+			return "", "", fmt.Errorf("command name contains whitespace: %q", name)
+		case isNumeric(name):
+			return name, "", nil
+		case strings.ToUpper(name) != name:
+			return name, fmt.Sprintf("command name %q isn't upper case so it probably never matches", name), nil
+		}
+		return name, "", nil
+	case lua.LNumber:
+		// Functions listed in the table without a name get numeric indices
+		name := k.String()
+		return name, fmt.Sprintf("numeric key %s in handlers table (quote numerics such as '001'; functions listed without a command name get numeric keys)", name), nil
+	}
+	return "", "", fmt.Errorf("unexpected key type: %s", key.Type())
+}
+
+// findHandler returns a handler or command (given with prefix) by name
+// handlersMutex must be held by the caller
+func (b *BananaBoatBot) findHandler(name string) *luaHandler {
+	if handler, ok := b.handlers[name]; ok {
+		return handler
+	}
+	if b.commands != nil && len(name) > len(b.commands.prefix) && strings.HasPrefix(name, b.commands.prefix) {
+		return b.commands.commands[strings.ToLower(name[len(b.commands.prefix):])]
+	}
+	return nil
+}
+
+// setHandlerDisabled disables or enables a handler returning false if it doesn't exist
+func (b *BananaBoatBot) setHandlerDisabled(name string, disabled bool) bool {
+	b.handlersMutex.Lock()
+	defer b.handlersMutex.Unlock()
+	handler := b.findHandler(name)
+	if handler == nil {
+		return false
+	}
+	handler.disabled = disabled
+	return true
+}
+
+// luaLibDisableHandler disables a handler until it is enabled again or Lua is reloaded
+func (b *BananaBoatBot) luaLibDisableHandler(luaState *lua.LState) int {
+	name := luaState.CheckString(1)
+	luaState.Push(lua.LBool(b.setHandlerDisabled(name, true)))
+	return 1
+}
+
+// luaLibEnableHandler enables a disabled handler
+func (b *BananaBoatBot) luaLibEnableHandler(luaState *lua.LState) int {
+	name := luaState.CheckString(1)
+	luaState.Push(lua.LBool(b.setHandlerDisabled(name, false)))
+	return 1
+}
+
+// luaLibListHandlers returns a table mapping names of handlers and commands to whether they are enabled
+func (b *BananaBoatBot) luaLibListHandlers(luaState *lua.LState) int {
+	b.handlersMutex.RLock()
+	defer b.handlersMutex.RUnlock()
+	res := luaState.CreateTable(0, len(b.handlers))
+	for name, handler := range b.handlers {
+		res.RawSetString(name, lua.LBool(!handler.disabled))
+	}
+	if b.commands != nil {
+		for name, handler := range b.commands.commands {
+			res.RawSetString(b.commands.prefix+name, lua.LBool(!handler.disabled))
+		}
+	}
+	luaState.Push(res)
+	return 1
+}
+
+// luaLibTestHandler calls a handler with a synthetic message and returns the messages it would send without sending them
+func (b *BananaBoatBot) luaLibTestHandler(luaState *lua.LState) int {
+	name := luaState.CheckString(1)
+	paramsT := luaState.OptTable(2, luaState.NewTable())
+	// Handlers can only be called from the shared state they belong to
+	if luaState != b.luaState {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("not available in workers"))
+		return 2
+	}
+	svrName, msg := b.currentMessage(luaState)
+	b.handlersMutex.RLock()
+	admin := msg != nil && b.commands != nil && b.commands.isAdmin(msg.Prefix)
+	handler := b.findHandler(name)
+	_, isHandler := b.handlers[name]
+	maxMessages := b.maxMessages
+	b.handlersMutex.RUnlock()
+	if !admin {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("permission denied"))
+		return 2
+	}
+	if handler == nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(fmt.Sprintf("no such handler: %s", name)))
+		return 2
+	}
+	if handler.maxMessages > 0 {
+		maxMessages = handler.maxMessages
+	}
+	// Build synthetic message from the sender of the current message
+	testMsg := &irc.Message{
+		Prefix:  msg.Prefix,
+		Command: irc.PRIVMSG,
+	}
+	if isHandler {
+		testMsg.Command = name
+	}
+	paramsT.ForEach(func(_ lua.LValue, paramLV lua.LValue) {
+		testMsg.Params = append(testMsg.Params, lua.LVAsString(paramLV))
+	})
+	// Pretend to handle the synthetic message while the handler runs
+	b.curMessage = testMsg
+	defer func() {
+		b.curMessage = msg
+	}()
+	top := luaState.GetTop()
+	err := luaState.CallByParam(lua.P{
+		Fn:      handler.fn,
+		NRet:    1,
+		Protect: true,
+	}, handler.paramsForMessage(luaState, svrName, testMsg)...)
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	messages := b.messagesFromLua(svrName, luaState.Get(-1), maxMessages)
+	luaState.SetTop(top)
+	// Return messages instead of sending them
+	res := luaState.CreateTable(len(messages), 0)
+	for _, m := range messages {
+		messageT := luaState.CreateTable(0, 3)
+		messageT.RawSetString("command", lua.LString(m.msg.Command))
+		messageT.RawSetString("net", lua.LString(m.net))
+		paramsT := luaState.CreateTable(len(m.msg.Params), 0)
+		for _, p := range m.msg.Params {
+			paramsT.Append(lua.LString(p))
+		}
+		messageT.RawSetString("params", paramsT)
+		res.Append(messageT)
+	}
+	luaState.Push(res)
+	return 1
+}
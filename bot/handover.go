@@ -0,0 +1,189 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// handoverJoinTimeout is how long we wait for channels to be joined before handing over anyway
+const handoverJoinTimeout = 30 * time.Second
+
+// handover is a new connection which replaces the current one once it is ready (make-before-break)
+type handover struct {
+	// channels are the channels which should be joined before handing over
+	channels []channelSetting
+	// mutex protects welcomed & timer
+	mutex sync.Mutex
+	// svr is the new connection
+	svr client.IrcServerInterface
+	// timer hands over anyway if joining channels takes too long
+	timer *time.Timer
+	// welcomed is set once the new connection was registered
+	welcomed bool
+}
+
+// startHandover dials a new connection which replaces the current one once registered
+// It must be called with serversMutex held
+func (b *BananaBoatBot) startHandover(ctx context.Context, svrName string, settings *client.IrcServerSettings, channels []channelSetting, oldSvr client.IrcServerInterface) {
+	log.Printf("Handing over IRC server %s to new connection", svrName)
+	// Our nick is held by the current connection which mustn't be ghosted
+	svr, svrCtx := b.Config.NewIrcServer(client.ContextWithoutRegain(ctx), svrName, settings)
+	keepAway(oldSvr, svr)
+	// Channels joined by the old connection are joined again, including join-once channels
+	var joins []channelSetting
+	state := oldSvr.GetState()
+	for _, channel := range channels {
+		if !channel.once || (state != nil && state.InChannel(channel.name)) {
+			joins = append(joins, channel)
+		}
+	}
+	b.handovers.Store(svrName, &handover{
+		channels: joins,
+		svr:      svr,
+	})
+	go b.dialServer(svrCtx, svrName, svr, b.connectDelay(svrName))
+}
+
+// retryHandover replaces a failed new connection with another one, keeping the current connection meanwhile
+// It must be called with serversMutex held
+func (b *BananaBoatBot) retryHandover(ctx context.Context, svrName string, h *handover) (client.IrcServerInterface, context.Context) {
+	h.stop()
+	h.svr.Close(ctx)
+	svr, svrCtx := b.Config.NewIrcServer(client.ContextWithoutRegain(b.luaState.Context()), svrName, h.svr.GetSettings())
+	if exp := h.svr.GetReconnectExp(); exp != nil {
+		svr.SetReconnectExp(*exp)
+	}
+	keepAway(h.svr, svr)
+	b.handovers.Store(svrName, &handover{
+		channels: h.channels,
+		svr:      svr,
+	})
+	return svr, svrCtx
+}
+
+// cancelHandover closes a new connection which hasn't replaced the current one yet
+// It must be called with serversMutex held
+func (b *BananaBoatBot) cancelHandover(ctx context.Context, svrName string) {
+	h, ok := b.handovers.Load(svrName)
+	if !ok {
+		return
+	}
+	b.handovers.Delete(svrName)
+	log.Printf("Cancelling handover of IRC server: %s", svrName)
+	h.(*handover).stop()
+	go h.(*handover).svr.Close(ctx)
+}
+
+// pendingHandover returns the handover a connection belongs to, if any
+func (b *BananaBoatBot) pendingHandover(ctx context.Context, svrName string) (*handover, bool) {
+	h, ok := b.handovers.Load(svrName)
+	if !ok || ctx.Done() != h.(*handover).svr.Done() {
+		return nil, false
+	}
+	return h.(*handover), true
+}
+
+// stop stops the join timer of a handover
+func (h *handover) stop() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
+// send queues a message to the new connection
+func (h *handover) send(msg *irc.Message) {
+	select {
+	case h.svr.GetMessages() <- *msg:
+	default:
+		log.Printf("Channel full, message to server dropped: %s", msg)
+	}
+}
+
+// ready returns true if the new connection is registered and has joined its channels
+func (h *handover) ready() bool {
+	h.mutex.Lock()
+	welcomed := h.welcomed
+	h.mutex.Unlock()
+	if !welcomed {
+		return false
+	}
+	state := h.svr.GetState()
+	for _, channel := range h.channels {
+		if state == nil || !state.InChannel(channel.name) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleHandover handles a message received by a new connection which hasn't replaced the current one
+// Handlers aren't invoked so messages aren't handled twice
+func (b *BananaBoatBot) handleHandover(ctx context.Context, svrName string, h *handover, msg *irc.Message) {
+	switch msg.Command {
+	case irc.PING:
+		h.send(&irc.Message{
+			Command: irc.PONG,
+			Params:  msg.Params,
+		})
+	case irc.RPL_WELCOME:
+		h.mutex.Lock()
+		h.welcomed = true
+		h.timer = time.AfterFunc(handoverJoinTimeout, func() {
+			log.Printf("Timed out joining channels, handing over IRC server %s anyway", svrName)
+			b.completeHandover(ctx, svrName, h)
+		})
+		h.mutex.Unlock()
+		for _, channel := range h.channels {
+			params := []string{channel.name}
+			if len(channel.key) > 0 {
+				params = append(params, channel.key)
+			}
+			h.send(&irc.Message{
+				Command: irc.JOIN,
+				Params:  params,
+			})
+		}
+	}
+	if h.ready() {
+		b.completeHandover(ctx, svrName, h)
+	}
+}
+
+// completeHandover replaces the current connection with the new one and closes the old one
+// It returns false if the handover was cancelled or already completed
+func (b *BananaBoatBot) completeHandover(ctx context.Context, svrName string, h *handover) bool {
+	b.serversMutex.Lock()
+	if cur, ok := b.handovers.Load(svrName); !ok || cur != h {
+		b.serversMutex.Unlock()
+		return false
+	}
+	b.handovers.Delete(svrName)
+	h.stop()
+	// Queued messages are moved to the new connection
+	oldSvr, ok := b.swapServer(svrName, h.svr)
+	b.serversMutex.Unlock()
+	log.Printf("Handed over IRC server: %s", svrName)
+	if ok {
+		oldSvr.Close(ctx)
+	}
+	// Monitoring continues on the new connection (its MOTD wasn't handled)
+	b.startMonitor(svrName)
+	// Take back our nick if we had to use another one
+	if state := h.svr.GetState(); state != nil {
+		nick := h.svr.GetSettings().Nick
+		if state.Nick() != nick {
+			b.sendMessage(svrName, &irc.Message{
+				Command: irc.NICK,
+				Params:  []string{nick},
+			})
+		}
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package bot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// healthWindow is the period over which disconnects and dropped messages are counted
+	healthWindow = time.Hour
+	// maxDisconnectPenalty is the maximum score deducted for disconnects
+	maxDisconnectPenalty = 40
+	// maxDropPenalty is the maximum score deducted for dropped messages
+	maxDropPenalty = 20
+	// maxLagPenalty is the maximum score deducted for lag
+	maxLagPenalty = 40
+)
+
+// serverHealth holds statistics used to score health of a server
+type serverHealth struct {
+	// disconnects are times of disconnects within the window
+	disconnects []time.Time
+	// dropped is the number of messages dropped since windowStart
+	dropped int
+	// mutex protects serverHealth
+	mutex sync.Mutex
+	// sent is the number of messages queued since windowStart
+	sent int
+	// windowStart is when counting of messages started
+	windowStart time.Time
+}
+
+// HealthReport describes health of a server
+type HealthReport struct {
+	// ConnectCooldown is how long the connect governor delays the next connect
+	ConnectCooldown time.Duration
+	// Connects is the number of connects within the window of the connect governor
+	Connects int
+	// Disconnects is the number of disconnects in the last hour
+	Disconnects int
+	// DropRate is the fraction of messages dropped in the current hour
+	DropRate float64
+	// Lag is the last measured lag
+	Lag time.Duration
+	// Score is between 0 (unusable) and 100 (perfect)
+	Score int
+}
+
+// getHealth returns health statistics of a server
+func (b *BananaBoatBot) getHealth(svrName string) *serverHealth {
+	h, _ := b.health.LoadOrStore(svrName, &serverHealth{windowStart: time.Now()})
+	return h.(*serverHealth)
+}
+
+// prune forgets statistics older than the window (mutex must be held)
+func (h *serverHealth) prune(now time.Time) {
+	i := 0
+	for i < len(h.disconnects) && now.Sub(h.disconnects[i]) > healthWindow {
+		i++
+	}
+	h.disconnects = h.disconnects[i:]
+	if now.Sub(h.windowStart) > healthWindow {
+		h.dropped = 0
+		h.sent = 0
+		h.windowStart = now
+	}
+}
+
+// recordDisconnect counts a disconnect from a server
+func (b *BananaBoatBot) recordDisconnect(svrName string) {
+	h := b.getHealth(svrName)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := time.Now()
+	h.prune(now)
+	h.disconnects = append(h.disconnects, now)
+}
+
+// recordMessage counts a message queued (or dropped) for a server
+func (b *BananaBoatBot) recordMessage(svrName string, dropped bool) {
+	h := b.getHealth(svrName)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.prune(time.Now())
+	h.sent++
+	if dropped {
+		h.dropped++
+	}
+}
+
+// ServerHealth scores health of a server (see README for the algorithm)
+func (b *BananaBoatBot) ServerHealth(svrName string) *HealthReport {
+	report := &HealthReport{}
+	h := b.getHealth(svrName)
+	h.mutex.Lock()
+	h.prune(time.Now())
+	report.Disconnects = len(h.disconnects)
+	if h.sent > 0 {
+		report.DropRate = float64(h.dropped) / float64(h.sent)
+	}
+	h.mutex.Unlock()
+	report.Connects, report.ConnectCooldown = b.getConnectGovernor(svrName).stats()
+	if state := b.getServerState(svrName); state != nil {
+		report.Lag = state.Lag()
+	}
+	// Servers we aren't connected to are unusable
+	if _, ok := b.reconnecting.Load(svrName); ok {
+		return report
+	}
+	score := 100.0
+	// Lag above a second costs 10 points per second
+	if lag := report.Lag.Seconds(); lag > 1 {
+		score -= minFloat(maxLagPenalty, (lag-1)*10)
+	}
+	// Each disconnect costs 10 points
+	score -= minFloat(maxDisconnectPenalty, float64(report.Disconnects*10))
+	// Dropped messages cost up to 20 points
+	score -= report.DropRate * maxDropPenalty
+	report.Score = int(score)
+	return report
+}
+
+// minFloat returns the smaller of two numbers
+func minFloat(a float64, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// updateHealth updates health metrics of a server
+func (b *BananaBoatBot) updateHealth(svrName string) {
+	healthGauge.WithLabelValues(svrName).Set(float64(b.ServerHealth(svrName).Score))
+}
+
+// luaLibServerHealth returns health score of a server and a table with details
+func (b *BananaBoatBot) luaLibServerHealth(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	if _, ok := b.Servers.Load(svrName); !ok {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	report := b.ServerHealth(svrName)
+	details := luaState.CreateTable(0, 5)
+	details.RawSetString("connect_cooldown", lua.LNumber(report.ConnectCooldown.Seconds()))
+	details.RawSetString("connects", lua.LNumber(report.Connects))
+	details.RawSetString("disconnects", lua.LNumber(report.Disconnects))
+	details.RawSetString("drop_rate", lua.LNumber(report.DropRate))
+	details.RawSetString("lag", lua.LNumber(report.Lag.Milliseconds()))
+	luaState.Push(lua.LNumber(report.Score))
+	luaState.Push(details)
+	return 2
+}
@@ -0,0 +1,116 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// maxHTTPResponse is the largest response body returned by http_request
+const maxHTTPResponse = 1 << 20
+
+// errPrivateAddress is returned when scripts make requests to private addresses which aren't allowed
+var errPrivateAddress = errors.New("connecting to private addresses not allowed")
+
+// isPrivateIP returns true if an IP address is loopback, link-local, private or unspecified
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// newRequestClient returns a client for requests made by scripts which can't connect to private addresses
+// unless allowed (the resolved address is checked so names resolving to them don't help)
+func (b *BananaBoatBot) newRequestClient(allowPrivate bool) http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			if allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would make the connection instead of us
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return http.Client{
+		CheckRedirect: b.checkRedirect,
+		Timeout:       time.Second * 60,
+		Transport:     transport,
+	}
+}
+
+// luaLibHTTPRequest makes an HTTP request described by a table of method, url, headers, body & timeout
+// Status, headers and body of the response are returned or nil and an error if the request failed
+func (b *BananaBoatBot) luaLibHTTPRequest(luaState *lua.LState) int {
+	opts := luaState.CheckTable(1)
+	method := strings.ToUpper(lua.LVAsString(opts.RawGetString("method")))
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+	u := lua.LVAsString(opts.RawGetString("url"))
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		luaState.ArgError(1, "url must be http or https")
+	}
+	var body io.Reader
+	if lv := opts.RawGetString("body"); lv != lua.LNil {
+		body = strings.NewReader(lua.LVAsString(lv))
+	}
+	ctx := luaState.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// Requests are limited by the client's timeout unless a shorter one is given
+	if timeout, ok := opts.RawGetString("timeout").(lua.LNumber); ok && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(float64(timeout)*float64(time.Second)))
+		defer cancel()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	if headers, ok := opts.RawGetString("headers").(*lua.LTable); ok {
+		headers.ForEach(func(k lua.LValue, v lua.LValue) {
+			req.Header.Set(lua.LVAsString(k), lua.LVAsString(v))
+		})
+	}
+	resp, err := b.requestClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return pushError(luaState, errors.New(httpErrorMessage(err)))
+	}
+	defer resp.Body.Close()
+	// Read one byte more than allowed to tell if the body is too large
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPResponse+1))
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	if len(respBody) > maxHTTPResponse {
+		return pushError(luaState, fmt.Errorf("response larger than %d bytes", maxHTTPResponse))
+	}
+	// Header names are lower-cased and repeated headers joined
+	respHeaders := luaState.CreateTable(0, len(resp.Header))
+	for name, values := range resp.Header {
+		respHeaders.RawSetString(strings.ToLower(name), lua.LString(strings.Join(values, ", ")))
+	}
+	luaState.Push(lua.LNumber(resp.StatusCode))
+	luaState.Push(respHeaders)
+	luaState.Push(lua.LString(respBody))
+	return 3
+}
@@ -0,0 +1,158 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// maxJSONDepth is how deeply tables and JSON values may be nested
+const maxJSONDepth = 100
+
+// jsonFromLua converts a Lua value to a value encoded by encoding/json
+// Tables with keys 1 to n are arrays, others are objects (empty tables are objects)
+func jsonFromLua(lv lua.LValue, seen map[*lua.LTable]struct{}, depth int) (interface{}, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("unsupported number: %v", f)
+		}
+		return f, nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if _, ok := seen[v]; ok {
+			return nil, errors.New("table contains a cycle")
+		}
+		if depth >= maxJSONDepth {
+			return nil, errors.New("tables nested too deeply")
+		}
+		seen[v] = struct{}{}
+		defer delete(seen, v)
+		count := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { count++ })
+		if n := v.MaxN(); n > 0 && n == count {
+			arr := make([]interface{}, n)
+			for i := range arr {
+				var err error
+				arr[i], err = jsonFromLua(v.RawGetInt(i+1), seen, depth+1)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return arr, nil
+		}
+		obj := make(map[string]interface{}, count)
+		var err error
+		v.ForEach(func(key lua.LValue, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			switch key.Type() {
+			case lua.LTString, lua.LTNumber:
+				break
+			default:
+				err = fmt.Errorf("unsupported table key type: %s", key.Type())
+				return
+			}
+			obj[key.String()], err = jsonFromLua(value, seen, depth+1)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+	return nil, fmt.Errorf("unsupported type: %s", lv.Type())
+}
+
+// jsonToLua converts a value decoded by encoding/json to a Lua value
+func jsonToLua(luaState *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		arr := luaState.CreateTable(len(v), 0)
+		// Indices are kept so elements after null stay in place
+		for i, elem := range v {
+			arr.RawSetInt(i+1, jsonToLua(luaState, elem))
+		}
+		return arr
+	case map[string]interface{}:
+		obj := luaState.CreateTable(0, len(v))
+		for key, elem := range v {
+			obj.RawSetString(key, jsonToLua(luaState, elem))
+		}
+		return obj
+	}
+	return lua.LNil
+}
+
+// jsonDepth returns how deeply a JSON document is nested without decoding it
+func jsonDepth(data []byte) int {
+	depth, max := 0, 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '[' || c == '{':
+			depth++
+			if depth > max {
+				max = depth
+			}
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return max
+}
+
+// luaLibJSONEncode returns a value encoded as JSON or nil and an error
+func (b *BananaBoatBot) luaLibJSONEncode(luaState *lua.LState) int {
+	lv := luaState.CheckAny(1)
+	v, err := jsonFromLua(lv, make(map[*lua.LTable]struct{}), 0)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// Messages aren't embedded in HTML
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return pushError(luaState, err)
+	}
+	luaState.Push(lua.LString(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))))
+	return 1
+}
+
+// luaLibJSONDecode returns the value of a JSON document (null becomes nil) or nil and an error
+func (b *BananaBoatBot) luaLibJSONDecode(luaState *lua.LState) int {
+	data := []byte(luaState.CheckString(1))
+	if jsonDepth(data) > maxJSONDepth {
+		return pushError(luaState, errors.New("JSON nested too deeply"))
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return pushError(luaState, err)
+	}
+	luaState.Push(jsonToLua(luaState, v))
+	return 1
+}
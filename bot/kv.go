@@ -0,0 +1,140 @@
+package bot
+
+import (
+	"errors"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultKVResults is the default number of keys returned by scans
+	defaultKVResults = 100
+	// kvBucketPrefix is prepended to buckets used by scripts so they can't touch internal state
+	kvBucketPrefix = "lua/"
+	// maxKVResults is the maximum number of keys returned by scans
+	maxKVResults = 1000
+)
+
+// errNoStore is returned by store functions if no database is configured
+var errNoStore = errors.New("no database configured")
+
+// kvLimit returns the number of results requested by a scan function
+func kvLimit(luaState *lua.LState, n int) int {
+	limit := luaState.OptInt(n, defaultKVResults)
+	if limit < 1 || limit > maxKVResults {
+		return maxKVResults
+	}
+	return limit
+}
+
+// pushError pushes nil and an error message
+func pushError(luaState *lua.LState, err error) int {
+	luaState.Push(lua.LNil)
+	luaState.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// luaLibKVGet returns the value of a key or nil if it isn't set
+func (b *BananaBoatBot) luaLibKVGet(luaState *lua.LState) int {
+	bucket := luaState.CheckString(1)
+	key := luaState.CheckString(2)
+	if b.Config.Store == nil {
+		return pushError(luaState, errNoStore)
+	}
+	value, err := b.Config.Store.Get(kvBucketPrefix+bucket, key)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	if value == nil {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LString(value))
+	return 1
+}
+
+// luaLibKVSet sets the value of a key or removes it if value is nil
+func (b *BananaBoatBot) luaLibKVSet(luaState *lua.LState) int {
+	bucket := luaState.CheckString(1)
+	key := luaState.CheckString(2)
+	if b.Config.Store == nil {
+		return pushError(luaState, errNoStore)
+	}
+	var err error
+	if luaState.Get(3) == lua.LNil {
+		err = b.Config.Store.Delete(kvBucketPrefix+bucket, key)
+	} else {
+		err = b.Config.Store.Set(kvBucketPrefix+bucket, key, []byte(luaState.CheckString(3)))
+	}
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	luaState.Push(lua.LTrue)
+	return 1
+}
+
+// luaLibKVDelete removes a key
+func (b *BananaBoatBot) luaLibKVDelete(luaState *lua.LState) int {
+	bucket := luaState.CheckString(1)
+	key := luaState.CheckString(2)
+	if b.Config.Store == nil {
+		return pushError(luaState, errNoStore)
+	}
+	if err := b.Config.Store.Delete(kvBucketPrefix+bucket, key); err != nil {
+		return pushError(luaState, err)
+	}
+	luaState.Push(lua.LTrue)
+	return 1
+}
+
+// luaLibKVKeys returns keys starting with a prefix in order
+func (b *BananaBoatBot) luaLibKVKeys(luaState *lua.LState) int {
+	bucket := luaState.CheckString(1)
+	prefix := luaState.OptString(2, "")
+	limit := kvLimit(luaState, 3)
+	if b.Config.Store == nil {
+		return pushError(luaState, errNoStore)
+	}
+	pairs, err := b.Config.Store.Scan(kvBucketPrefix+bucket, prefix, limit)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	res := luaState.CreateTable(len(pairs), 0)
+	for _, pair := range pairs {
+		res.Append(lua.LString(pair.Key))
+	}
+	luaState.Push(res)
+	return 1
+}
+
+// luaLibKVScan calls a function with keys starting with a prefix and their values in order
+// Iteration stops if the function returns false; the number of pairs visited is returned
+func (b *BananaBoatBot) luaLibKVScan(luaState *lua.LState) int {
+	bucket := luaState.CheckString(1)
+	prefix := luaState.CheckString(2)
+	fn := luaState.CheckFunction(3)
+	limit := kvLimit(luaState, 4)
+	if b.Config.Store == nil {
+		return pushError(luaState, errNoStore)
+	}
+	// Read pairs first so the function may use the store itself
+	pairs, err := b.Config.Store.Scan(kvBucketPrefix+bucket, prefix, limit)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	count := 0
+	for _, pair := range pairs {
+		luaState.CallByParam(lua.P{
+			Fn:   fn,
+			NRet: 1,
+		}, lua.LString(pair.Key), lua.LString(pair.Value))
+		ret := luaState.Get(-1)
+		luaState.Pop(1)
+		count++
+		if ret == lua.LFalse {
+			break
+		}
+	}
+	luaState.Push(lua.LNumber(count))
+	return 1
+}
@@ -0,0 +1,111 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultLocale is used if no locale is configured
+	defaultLocale = "en"
+)
+
+// localeFormat describes how helpers format output for a language
+type localeFormat struct {
+	// decimal is the decimal separator
+	decimal string
+	// timeLayout is the layout used to format times
+	timeLayout string
+}
+
+// localeFormats maps languages to formats; unknown languages use ISO formats
+var localeFormats = map[string]localeFormat{
+	"de": {decimal: ",", timeLayout: "02.01.2006 15:04 MST"},
+	"en": {decimal: ".", timeLayout: "01/02/2006 3:04 PM MST"},
+	"es": {decimal: ",", timeLayout: "02/01/2006 15:04 MST"},
+	"fr": {decimal: ",", timeLayout: "02/01/2006 15:04 MST"},
+	"it": {decimal: ",", timeLayout: "02/01/2006 15:04 MST"},
+	"nl": {decimal: ",", timeLayout: "02-01-2006 15:04 MST"},
+	"pt": {decimal: ",", timeLayout: "02/01/2006 15:04 MST"},
+	"ru": {decimal: ",", timeLayout: "02.01.2006 15:04 MST"},
+}
+
+// isoFormat is used for languages not in localeFormats
+var isoFormat = localeFormat{decimal: ".", timeLayout: "2006-01-02 15:04 MST"}
+
+// localeLanguage returns the language part of a locale such as de_DE
+func localeLanguage(locale string) string {
+	fields := strings.FieldsFunc(locale, func(r rune) bool {
+		return r == '_' || r == '-' || r == '.'
+	})
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+// formatForLocale returns the format used for a locale
+func formatForLocale(locale string) localeFormat {
+	if format, ok := localeFormats[localeLanguage(locale)]; ok {
+		return format
+	}
+	return isoFormat
+}
+
+// formatBytes returns a human-readable size using binary prefixes
+func formatBytes(n float64, locale string) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := 0
+	for ; i < len(units)-1 && (n >= 1024 || n <= -1024); i++ {
+		n /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.f %s", n, units[i])
+	}
+	s := fmt.Sprintf("%.1f %s", n, units[i])
+	return strings.Replace(s, ".", formatForLocale(locale).decimal, 1)
+}
+
+// formatTime returns a time formatted for a locale
+func formatTime(t time.Time, locale string) string {
+	return t.Format(formatForLocale(locale).timeLayout)
+}
+
+// currentLocale returns the locale of the channel a Lua state is handling a message from or the global locale
+func (b *BananaBoatBot) currentLocale(luaState *lua.LState) string {
+	svrName, msg := b.currentMessage(luaState)
+	b.handlersMutex.RLock()
+	defer b.handlersMutex.RUnlock()
+	if msg != nil && len(msg.Params) > 0 {
+		for _, channel := range b.channels[svrName] {
+			if len(channel.locale) > 0 && strings.EqualFold(channel.name, msg.Params[0]) {
+				return channel.locale
+			}
+		}
+	}
+	return b.locale
+}
+
+// luaLibFormatBytes returns a human-readable size for a number of bytes
+func (b *BananaBoatBot) luaLibFormatBytes(luaState *lua.LState) int {
+	n := luaState.CheckNumber(1)
+	luaState.Push(lua.LString(formatBytes(float64(n), b.currentLocale(luaState))))
+	return 1
+}
+
+// luaLibFormatTime returns a Unix timestamp formatted for the current locale
+func (b *BananaBoatBot) luaLibFormatTime(luaState *lua.LState) int {
+	unix := luaState.CheckInt64(1)
+	t := time.Unix(unix, 0).UTC()
+	luaState.Push(lua.LString(formatTime(t, b.currentLocale(luaState))))
+	return 1
+}
+
+// luaLibLocale returns the locale of the current channel or the global locale
+func (b *BananaBoatBot) luaLibLocale(luaState *lua.LState) int {
+	luaState.Push(lua.LString(b.currentLocale(luaState)))
+	return 1
+}
@@ -0,0 +1,84 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// memoryCheckInterval is the minimum interval between checks of memory usage
+	memoryCheckInterval = time.Second
+	// memoryLoopInterval is the interval between periodic checks of memory usage
+	memoryLoopInterval = 10 * time.Second
+	// memoryShedRatio is the fraction of the memory limit above which cached state is shed
+	memoryShedRatio = 0.9
+)
+
+// memoryUsage returns the estimated memory usage in bytes (the size of live heap objects)
+func memoryUsage() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// checkMemory sheds cached state if memory usage approaches the limit (at most once per memoryCheckInterval)
+func (b *BananaBoatBot) checkMemory() {
+	if b.Config.MemoryLimit == 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&b.memoryChecked)
+	if now-last < int64(memoryCheckInterval) || !atomic.CompareAndSwapInt64(&b.memoryChecked, last, now) {
+		return
+	}
+	usage := memoryUsage()
+	if float64(usage) < float64(b.Config.MemoryLimit)*memoryShedRatio {
+		return
+	}
+	b.shedMemory(usage)
+}
+
+// shedMemory drops state which is cheap to recreate: idle Lua states and the oldest cooldowns
+func (b *BananaBoatBot) shedMemory(usage uint64) {
+	states := b.luaPool.reap(time.Now())
+	// Cooldowns set by scripts are trimmed but nonces must be kept until they expire to prevent replays
+	cooldowns := b.cooldowns.shed(maxCooldowns/2) + b.modeCooldowns.shed(-1) + b.ctcpCooldowns.shed(-1) + b.nonces.shed(-1)
+	atomic.AddUint64(&b.memorySheds, 1)
+	memorySheddingCounter.Inc()
+	log.Printf("Memory usage (%s) approaching limit (%s), closed %d idle Lua states and dropped %d cooldowns",
+		formatBytes(float64(usage), defaultLocale), formatBytes(float64(b.Config.MemoryLimit), defaultLocale), states, cooldowns)
+}
+
+// memoryLoop periodically checks memory usage until ctx is done
+func (b *BananaBoatBot) memoryLoop(ctx context.Context) {
+	ticker := time.NewTicker(memoryLoopInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.checkMemory()
+		}
+	}
+}
+
+// luaLibMemoryStats returns a table describing estimated memory usage and the state held by the bot
+func (b *BananaBoatBot) luaLibMemoryStats(luaState *lua.LState) int {
+	live, idle := b.luaPool.stats()
+	res := luaState.CreateTable(0, 7)
+	res.RawSetString("cooldowns", lua.LNumber(b.cooldowns.size()))
+	res.RawSetString("limit", lua.LNumber(b.Config.MemoryLimit))
+	res.RawSetString("lua_states", lua.LNumber(live))
+	res.RawSetString("lua_states_idle", lua.LNumber(idle))
+	res.RawSetString("max_lua_states", lua.LNumber(b.Config.MaxLuaStates))
+	res.RawSetString("sheds", lua.LNumber(atomic.LoadUint64(&b.memorySheds)))
+	res.RawSetString("usage", lua.LNumber(memoryUsage()))
+	luaState.Push(res)
+	return 1
+}
@@ -0,0 +1,104 @@
+package bot
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// messageContext is the message a Lua state is handling
+type messageContext struct {
+	// net is the friendly name of the server the message came from
+	net string
+	// msg is the message itself
+	msg *irc.Message
+	// tags are the allowed tags of the message
+	tags map[string]string
+	// time is when the message was sent according to the server or when it was received
+	time time.Time
+	// generation is the reload generation of the script which started the worker
+	generation uint64
+}
+
+// messageTime returns when the message being handled was sent or the current time if unknown
+func messageTime(ctx context.Context) time.Time {
+	if t, ok := client.TimeFromContext(ctx); ok {
+		return t
+	}
+	return time.Now()
+}
+
+// currentMessage returns the server name and message a Lua state is handling
+func (b *BananaBoatBot) currentMessage(luaState *lua.LState) (string, *irc.Message) {
+	// Shared state is only used while holding luaMutex
+	if luaState == b.luaState {
+		return b.curNet, b.curMessage
+	}
+	if mc, ok := b.luaContexts.Load(luaState); ok {
+		return mc.(*messageContext).net, mc.(*messageContext).msg
+	}
+	return "", nil
+}
+
+// currentTags returns the allowed tags of the message a Lua state is handling
+func (b *BananaBoatBot) currentTags(luaState *lua.LState) map[string]string {
+	// Shared state is only used while holding luaMutex
+	if luaState == b.luaState {
+		return b.curTags
+	}
+	if mc, ok := b.luaContexts.Load(luaState); ok {
+		return mc.(*messageContext).tags
+	}
+	return nil
+}
+
+// currentGeneration returns the reload generation of the script a Lua state is running
+func (b *BananaBoatBot) currentGeneration(luaState *lua.LState) uint64 {
+	if luaState != b.luaState {
+		if mc, ok := b.luaContexts.Load(luaState); ok {
+			return mc.(*messageContext).generation
+		}
+	}
+	return atomic.LoadUint64(&b.generation)
+}
+
+// currentTime returns when the message a Lua state is handling was sent (zero if none is handled)
+func (b *BananaBoatBot) currentTime(luaState *lua.LState) time.Time {
+	// Shared state is only used while holding luaMutex
+	if luaState == b.luaState {
+		return b.curTime
+	}
+	if mc, ok := b.luaContexts.Load(luaState); ok {
+		return mc.(*messageContext).time
+	}
+	return time.Time{}
+}
+
+// luaLibMessageTime returns when the message being handled was sent as a Unix timestamp or nil
+// Messages replayed from a bouncer backlog carry the time they were originally sent (server-time)
+func (b *BananaBoatBot) luaLibMessageTime(luaState *lua.LState) int {
+	t := b.currentTime(luaState)
+	if t.IsZero() {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LNumber(float64(t.UnixNano()) / float64(time.Second)))
+	return 1
+}
+
+// luaLibParam returns a parameter of the current message or empty string if it is missing
+func (b *BananaBoatBot) luaLibParam(luaState *lua.LState) int {
+	// Index of the parameter (1 is the first parameter after nick/user/host)
+	n := luaState.CheckInt(1)
+	_, msg := b.currentMessage(luaState)
+	if msg == nil || n < 1 || n > len(msg.Params) {
+		luaState.Push(lua.LString(""))
+		return 1
+	}
+	luaState.Push(lua.LString(msg.Params[n-1]))
+	return 1
+}
@@ -0,0 +1,62 @@
+package bot
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lagGauge exposes lag measured by keepalive PINGs
+var lagGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "bananaboat_lag_seconds",
+	Help: "Round-trip time of the last answered keepalive PING",
+}, []string{"net"})
+
+// healthGauge exposes health scores of servers
+var healthGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "bananaboat_health_score",
+	Help: "Health score of the server between 0 (unusable) and 100 (perfect)",
+}, []string{"net"})
+
+// connectsThrottledCounter counts connects delayed by the connect governor
+var connectsThrottledCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "bananaboat_connects_throttled_total",
+	Help: "Number of connects delayed because the server was connected to too often",
+}, []string{"net"})
+
+// luaStatesIdleGauge exposes the number of idle pooled Lua states
+var luaStatesIdleGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "bananaboat_lua_states_idle",
+	Help: "Number of idle Lua states in the pool used by workers",
+})
+
+// luaStatesGauge exposes the number of live pooled Lua states
+var luaStatesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "bananaboat_lua_states",
+	Help: "Number of Lua states created by the pool used by workers which weren't closed yet",
+})
+
+// memorySheddingCounter counts how often cached state was shed because memory usage approached the limit
+var memorySheddingCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "bananaboat_memory_shedding_total",
+	Help: "Number of times cached state was shed because memory usage approached the limit",
+})
+
+func init() {
+	prometheus.MustRegister(connectsThrottledCounter)
+	prometheus.MustRegister(healthGauge)
+	prometheus.MustRegister(lagGauge)
+	prometheus.MustRegister(luaStatesGauge)
+	prometheus.MustRegister(luaStatesIdleGauge)
+	prometheus.MustRegister(memorySheddingCounter)
+}
+
+// updateLag updates lag metrics of a server
+func (b *BananaBoatBot) updateLag(svrName string) {
+	state := b.getServerState(svrName)
+	if state == nil {
+		return
+	}
+	if lag := state.Lag(); lag > 0 {
+		lagGauge.WithLabelValues(svrName).Set(lag.Seconds())
+	}
+	b.updateHealth(svrName)
+}
@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// modeEnforceInterval is the minimum time between enforcing modes of a channel to avoid mode wars
+	modeEnforceInterval = 10 * time.Second
+	// modeBackoff is how long we stop enforcing modes of a channel after being refused
+	modeBackoff = 5 * time.Minute
+)
+
+// modeEnforceKey returns the key used to rate-limit enforcing modes of a channel
+func modeEnforceKey(svrName string, channel string) string {
+	return joinOnceKey(svrName, channel)
+}
+
+// desiredModes returns modes configured for a channel (empty if modes aren't enforced)
+func (b *BananaBoatBot) desiredModes(svrName string, channel string) string {
+	b.handlersMutex.RLock()
+	defer b.handlersMutex.RUnlock()
+	for _, setting := range b.channels[svrName] {
+		if strings.EqualFold(setting.name, channel) {
+			return setting.modes
+		}
+	}
+	return ""
+}
+
+// modeFixes returns a mode string restoring desired modes given current ones (empty if none are needed)
+func modeFixes(state *client.ServerState, desired string, current map[byte]bool) string {
+	var add, remove []byte
+	for _, change := range state.ParseModes(desired, nil) {
+		// Only modes without parameters are enforced
+		if !state.FlagMode(change.Mode) {
+			continue
+		}
+		set, known := current[change.Mode]
+		if !known {
+			continue
+		}
+		if change.Add && !set {
+			add = append(add, change.Mode)
+		} else if !change.Add && set {
+			remove = append(remove, change.Mode)
+		}
+	}
+	var fixes string
+	if len(add) > 0 {
+		fixes += "+" + string(add)
+	}
+	if len(remove) > 0 {
+		fixes += "-" + string(remove)
+	}
+	return fixes
+}
+
+// enforceModes sets modes of a channel if we are allowed to and haven't done so recently
+func (b *BananaBoatBot) enforceModes(svrName string, state *client.ServerState, channel string, fixes string) {
+	if len(fixes) == 0 || !state.IsOp(channel) {
+		return
+	}
+	key := modeEnforceKey(svrName, channel)
+	if remaining := b.modeCooldowns.remaining(key); remaining > 0 {
+		log.Printf("[%s] Not enforcing modes of %s for another %s", svrName, channel, remaining.Round(time.Second))
+		return
+	}
+	b.modeCooldowns.set(key, modeEnforceInterval)
+	log.Printf("[%s] Enforcing modes of %s: %s", svrName, channel, fixes)
+	b.sendMessage(svrName, &irc.Message{
+		Command: irc.MODE,
+		Params:  []string{channel, fixes},
+	})
+}
+
+// queryModes asks for current modes of a channel if we enforce them
+func (b *BananaBoatBot) queryModes(svrName string, state *client.ServerState, channel string) {
+	if len(b.desiredModes(svrName, channel)) == 0 || !state.IsOp(channel) {
+		return
+	}
+	b.sendMessage(svrName, &irc.Message{
+		Command: irc.MODE,
+		Params:  []string{channel},
+	})
+}
+
+// handleModes enforces configured channel modes
+func (b *BananaBoatBot) handleModes(svrName string, msg *irc.Message) {
+	state := b.getServerState(svrName)
+	if state == nil {
+		return
+	}
+	switch msg.Command {
+	case irc.MODE:
+		// Parameters are the channel, modes and their parameters
+		if len(msg.Params) < 2 || msg.Prefix == nil || msg.Prefix.Name == state.Nick() {
+			return
+		}
+		channel := msg.Params[0]
+		desired := b.desiredModes(svrName, channel)
+		if len(desired) == 0 {
+			return
+		}
+		current := make(map[byte]bool)
+		for _, change := range state.ParseModes(msg.Params[1], msg.Params[2:]) {
+			// We were given ops so check modes set while we couldn't enforce them
+			if change.Add && change.Param == state.Nick() && state.IsOp(channel) {
+				b.queryModes(svrName, state, channel)
+			}
+			current[change.Mode] = change.Add
+		}
+		b.enforceModes(svrName, state, channel, modeFixes(state, desired, current))
+	case irc.RPL_CHANNELMODEIS:
+		// Parameters are our nick, the channel, modes and their parameters
+		if len(msg.Params) < 3 {
+			return
+		}
+		channel := msg.Params[1]
+		desired := b.desiredModes(svrName, channel)
+		if len(desired) == 0 {
+			return
+		}
+		// Modes which aren't mentioned are unset
+		current := make(map[byte]bool)
+		for _, change := range state.ParseModes(desired, nil) {
+			current[change.Mode] = false
+		}
+		for _, change := range state.ParseModes(msg.Params[2], msg.Params[3:]) {
+			current[change.Mode] = change.Add
+		}
+		b.enforceModes(svrName, state, channel, modeFixes(state, desired, current))
+	case irc.RPL_ENDOFNAMES:
+		// We might have been opped on join
+		if len(msg.Params) > 1 {
+			b.queryModes(svrName, state, msg.Params[1])
+		}
+	case irc.ERR_CHANOPRIVSNEEDED:
+		// Parameters are our nick, the channel and a reason
+		if len(msg.Params) < 2 || len(b.desiredModes(svrName, msg.Params[1])) == 0 {
+			return
+		}
+		log.Printf("[%s] Not allowed to set modes of %s, backing off for %s", svrName, msg.Params[1], modeBackoff)
+		b.modeCooldowns.set(modeEnforceKey(svrName, msg.Params[1]), modeBackoff)
+	}
+}
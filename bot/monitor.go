@@ -0,0 +1,307 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// MonitorOnline is the command of the synthetic message telling handlers a monitored nick came online
+	// Its prefix is the nick (with user and host if the server told us) and its parameter is the nick
+	MonitorOnline = "ONLINE"
+	// MonitorOffline is the command of the synthetic message telling handlers a monitored nick went offline
+	MonitorOffline = "OFFLINE"
+	// monitorISONInterval is how often servers not supporting MONITOR are asked which nicks are online
+	monitorISONInterval = 60 * time.Second
+	// maxMonitorLine is the maximum length of the list of nicks sent in one MONITOR or ISON message
+	maxMonitorLine = 400
+	// rplMonOnline lists monitored nicks which are online
+	rplMonOnline = "730"
+	// rplMonOffline lists monitored nicks which are offline
+	rplMonOffline = "731"
+	// errMonListFull is sent if we monitor more nicks than the server allows
+	errMonListFull = "734"
+)
+
+// presence tracks which monitored nicks on a server are online
+type presence struct {
+	// ison is set if nicks are polled with ISON as the server doesn't support MONITOR
+	ison bool
+	// mutex protects the presence
+	mutex sync.Mutex
+	// online maps lower-cased nicks to whether they are online (nicks whose presence is unknown are missing)
+	online map[string]bool
+	// svr is the connection monitoring was started on (nil if none)
+	svr client.IrcServerInterface
+}
+
+// monitorFromLua reads the list of nicks to monitor from a server table
+func monitorFromLua(lv lua.LValue) []string {
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		if lv != lua.LNil {
+			log.Printf("Lua reload error: ignoring monitor of unexpected type: %s", lv.Type())
+		}
+		return nil
+	}
+	var nicks []string
+	tbl.ForEach(func(_ lua.LValue, nickLV lua.LValue) {
+		nick := lua.LVAsString(nickLV)
+		if len(nick) == 0 || strings.ContainsAny(nick, " ,!@*") || strings.HasPrefix(nick, ":") {
+			log.Printf("Lua reload error: ignoring invalid monitor nick: %q", nick)
+			return
+		}
+		nicks = append(nicks, nick)
+	})
+	return nicks
+}
+
+// monitoredNicks returns the nicks monitored on a server
+func (b *BananaBoatBot) monitoredNicks(svrName string) []string {
+	b.handlersMutex.RLock()
+	defer b.handlersMutex.RUnlock()
+	return b.monitors[svrName]
+}
+
+// isMonitored returns true if nick is monitored on a server
+func (b *BananaBoatBot) isMonitored(svrName string, nick string) bool {
+	for _, monitored := range b.monitoredNicks(svrName) {
+		if strings.EqualFold(monitored, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// getPresence returns the presence of monitored nicks on a server
+func (b *BananaBoatBot) getPresence(svrName string) *presence {
+	p, _ := b.presences.LoadOrStore(svrName, &presence{online: make(map[string]bool)})
+	return p.(*presence)
+}
+
+// nickLists joins nicks into lists separated by sep which fit in a message
+func nickLists(nicks []string, sep string) []string {
+	var lists []string
+	var list string
+	for _, nick := range nicks {
+		if len(list) > 0 && len(list)+len(sep)+len(nick) > maxMonitorLine {
+			lists = append(lists, list)
+			list = ""
+		}
+		if len(list) > 0 {
+			list += sep
+		}
+		list += nick
+	}
+	if len(list) > 0 {
+		lists = append(lists, list)
+	}
+	return lists
+}
+
+// sendMonitor adds (modifier '+') or removes (modifier '-') nicks from the MONITOR list of a server
+func (b *BananaBoatBot) sendMonitor(svrName string, modifier string, nicks []string) {
+	for _, list := range nickLists(nicks, ",") {
+		b.sendMessage(svrName, &irc.Message{
+			Command: "MONITOR",
+			Params:  []string{modifier, list},
+		})
+	}
+}
+
+// startMonitor starts monitoring nicks once a connection is registered and its features are known
+func (b *BananaBoatBot) startMonitor(svrName string) {
+	svrI, ok := b.Servers.Load(svrName)
+	if !ok || isDCCChat(svrName) {
+		return
+	}
+	svr := svrI.(client.IrcServerInterface)
+	state := svr.GetState()
+	if state == nil {
+		return
+	}
+	p := b.getPresence(svrName)
+	p.mutex.Lock()
+	// Monitoring was already started on this connection (the MOTD was requested again)
+	if p.svr == svr {
+		p.mutex.Unlock()
+		return
+	}
+	p.svr = svr
+	limit, ok := state.ISupport("MONITOR")
+	p.ison = !ok
+	p.mutex.Unlock()
+	if !ok {
+		go b.pollISON(svrName, svr)
+		return
+	}
+	nicks := b.monitoredNicks(svrName)
+	if max, err := strconv.Atoi(limit); err == nil && max > 0 && len(nicks) > max {
+		log.Printf("[%s] Server allows monitoring %d nicks, ignoring %d", svrName, max, len(nicks)-max)
+		nicks = nicks[:max]
+	}
+	b.sendMonitor(svrName, "+", nicks)
+}
+
+// pollISON periodically asks a server not supporting MONITOR which monitored nicks are online
+func (b *BananaBoatBot) pollISON(svrName string, svr client.IrcServerInterface) {
+	ticker := time.NewTicker(monitorISONInterval)
+	defer ticker.Stop()
+	for {
+		// Replies don't say which nicks were asked about so they must fit in one message
+		if lists := nickLists(b.monitoredNicks(svrName), " "); len(lists) > 0 {
+			if len(lists) > 1 {
+				log.Printf("[%s] Too many nicks to monitor with ISON, only asking about some", svrName)
+			}
+			b.sendMessage(svrName, &irc.Message{
+				Command: irc.ISON,
+				Params:  strings.Split(lists[0], " "),
+			})
+		}
+		select {
+		case <-svr.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshMonitor updates the MONITOR list of a server after the nicks to monitor changed on reload
+func (b *BananaBoatBot) refreshMonitor(svrName string, oldNicks []string, newNicks []string) {
+	added := missingNicks(newNicks, oldNicks)
+	removed := missingNicks(oldNicks, newNicks)
+	p := b.getPresence(svrName)
+	p.mutex.Lock()
+	for _, nick := range removed {
+		delete(p.online, strings.ToLower(nick))
+	}
+	svr := p.svr
+	ison := p.ison
+	p.mutex.Unlock()
+	// ISON polling picks up changes by itself
+	if svr == nil || ison {
+		return
+	}
+	if cur, ok := b.Servers.Load(svrName); !ok || cur != svr {
+		return
+	}
+	b.sendMonitor(svrName, "-", removed)
+	b.sendMonitor(svrName, "+", added)
+}
+
+// missingNicks returns nicks which are missing from others
+func missingNicks(nicks []string, others []string) []string {
+	var missing []string
+	for _, nick := range nicks {
+		found := false
+		for _, other := range others {
+			if strings.EqualFold(nick, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, nick)
+		}
+	}
+	return missing
+}
+
+// handleMonitor starts monitoring after registration and dispatches changes of presence to handlers
+func (b *BananaBoatBot) handleMonitor(ctx context.Context, svrName string, msg *irc.Message) {
+	switch msg.Command {
+	case irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD:
+		b.startMonitor(svrName)
+	case rplMonOnline, rplMonOffline:
+		// Parameters are our nick and a list of targets (nick!user@host if online)
+		if len(msg.Params) < 2 {
+			return
+		}
+		for _, target := range strings.Split(msg.Params[len(msg.Params)-1], ",") {
+			if len(target) > 0 {
+				b.setPresence(ctx, svrName, irc.ParsePrefix(target), msg.Command == rplMonOnline)
+			}
+		}
+	case irc.RPL_ISON:
+		// Parameters are our nick and the list of nicks asked about which are online
+		if len(msg.Params) < 2 {
+			return
+		}
+		p := b.getPresence(svrName)
+		p.mutex.Lock()
+		ison := p.ison
+		p.mutex.Unlock()
+		if !ison {
+			return
+		}
+		online := make(map[string]bool)
+		for _, nick := range strings.Fields(msg.Params[len(msg.Params)-1]) {
+			online[strings.ToLower(nick)] = true
+		}
+		// Only nicks asked about can be offline (all monitored ones are unless the reply is labeled)
+		asked := b.monitoredNicks(svrName)
+		if req := client.RequestFromContext(ctx); req != nil && req.Command == irc.ISON {
+			asked = req.Params
+		}
+		for _, nick := range asked {
+			b.setPresence(ctx, svrName, &irc.Prefix{Name: nick}, online[strings.ToLower(nick)])
+		}
+	case errMonListFull:
+		log.Printf("[%s] MONITOR list is full: %s", svrName, strings.Join(msg.Params, " "))
+	}
+}
+
+// setPresence records whether a monitored nick is online and tells handlers if that changed
+// Nicks first seen offline aren't reported as there was no change
+func (b *BananaBoatBot) setPresence(ctx context.Context, svrName string, prefix *irc.Prefix, online bool) {
+	if !b.isMonitored(svrName, prefix.Name) {
+		return
+	}
+	p := b.getPresence(svrName)
+	key := strings.ToLower(prefix.Name)
+	p.mutex.Lock()
+	wasOnline, known := p.online[key]
+	p.online[key] = online
+	p.mutex.Unlock()
+	if (known && wasOnline == online) || (!known && !online) {
+		return
+	}
+	command := MonitorOffline
+	if online {
+		command = MonitorOnline
+	}
+	log.Printf("[%s] %s is now %s", svrName, prefix.Name, strings.ToLower(command))
+	b.HandleHandlers(ctx, svrName, &irc.Message{
+		Prefix:  prefix,
+		Command: command,
+		Params:  []string{prefix.Name},
+	})
+}
+
+// luaLibIsOnline returns whether a monitored nick is online (nil if unknown)
+func (b *BananaBoatBot) luaLibIsOnline(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	nick := luaState.CheckString(2)
+	p, ok := b.presences.Load(svrName)
+	if !ok {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	p.(*presence).mutex.Lock()
+	online, known := p.(*presence).online[strings.ToLower(nick)]
+	p.(*presence).mutex.Unlock()
+	if !known {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LBool(online))
+	return 1
+}
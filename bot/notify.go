@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// defaultNotifyInterval is the default minimum interval between notifications
+	defaultNotifyInterval = 60 * time.Second
+	// maxNotifyLength is the maximum length of text in a single notification
+	maxNotifyLength = 400
+)
+
+// notification is an event waiting to be sent to the admin channel
+type notification struct {
+	// count is the number of times this event occurred consecutively
+	count int
+	// text describes the event
+	text string
+}
+
+// notifier sends rate-limited notifications about connection events to an admin channel
+type notifier struct {
+	// channel is the channel (or nick) notifications are sent to
+	channel string
+	// interval is the minimum interval between notifications
+	interval time.Duration
+	// lastSent is when we last sent a notification
+	lastSent time.Time
+	// mutex protects pending, lastSent and timer
+	mutex sync.Mutex
+	// net is the friendly name of the server notifications are sent to
+	net string
+	// pending holds events waiting to be sent
+	pending []notification
+	// timer is set if a flush is scheduled
+	timer *time.Timer
+}
+
+// notifierFromTable reads notification settings from Lua
+func notifierFromTable(tbl *lua.LTable) (*notifier, error) {
+	n := &notifier{
+		channel:  lua.LVAsString(tbl.RawGetString("channel")),
+		interval: defaultNotifyInterval,
+		net:      lua.LVAsString(tbl.RawGetString("net")),
+	}
+	if len(n.net) == 0 || len(n.channel) == 0 {
+		return nil, fmt.Errorf("net and channel must be set")
+	}
+	if interval, ok := tbl.RawGetString("interval").(lua.LNumber); ok && interval >= 0 {
+		n.interval = time.Duration(float64(interval) * float64(time.Second))
+	}
+	return n, nil
+}
+
+// notify queues a notification about an event on a server
+func (b *BananaBoatBot) notify(svrName string, format string, args ...interface{}) {
+	b.handlersMutex.RLock()
+	n := b.notifier
+	b.handlersMutex.RUnlock()
+	if n == nil {
+		return
+	}
+	text := fmt.Sprintf("[%s] %s", svrName, fmt.Sprintf(format, args...))
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	// Coalesce identical consecutive events
+	if last := len(n.pending) - 1; last >= 0 && n.pending[last].text == text {
+		n.pending[last].count++
+	} else {
+		n.pending = append(n.pending, notification{count: 1, text: text})
+	}
+	// Flush already scheduled
+	if n.timer != nil {
+		return
+	}
+	wait := n.interval - time.Since(n.lastSent)
+	if wait < 0 {
+		wait = 0
+	}
+	n.timer = time.AfterFunc(wait, func() {
+		b.flushNotifications(n)
+	})
+}
+
+// flushNotifications sends pending notifications as a single message
+func (b *BananaBoatBot) flushNotifications(n *notifier) {
+	n.mutex.Lock()
+	pending := n.pending
+	n.pending = nil
+	n.lastSent = time.Now()
+	n.timer = nil
+	n.mutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	entries := make([]string, 0, len(pending))
+	length := 0
+	for i, p := range pending {
+		entry := p.text
+		if p.count > 1 {
+			entry = fmt.Sprintf("%s (x%d)", entry, p.count)
+		}
+		if length+len(entry) > maxNotifyLength {
+			entries = append(entries, fmt.Sprintf("and %d more", len(pending)-i))
+			break
+		}
+		entries = append(entries, entry)
+		length += len(entry) + 2
+	}
+	text := strings.Join(entries, "; ")
+	b.sendMessage(n.net, &irc.Message{
+		Command: irc.PRIVMSG,
+		Params:  []string{n.channel, text},
+	})
+}
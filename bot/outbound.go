@@ -0,0 +1,147 @@
+package bot
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// maxLineLength is the maximum length of an IRC message including CRLF
+	maxLineLength = 512
+	// prefixReserve is space reserved for the prefix servers add when relaying our messages if its length is unknown
+	prefixReserve = 100
+	// NewlinesReject drops messages whose trailing parameter contains line breaks
+	NewlinesReject = "reject"
+	// NewlinesSpace replaces line breaks in the trailing parameter with spaces
+	NewlinesSpace = "space"
+	// NewlinesSplit sends each line of the trailing parameter as a separate message
+	NewlinesSplit = "split"
+)
+
+var (
+	// commandRegexp matches valid IRC commands
+	commandRegexp = regexp.MustCompile(`^([A-Za-z]+|[0-9]{3})$`)
+	// newlineRegexp matches line breaks
+	newlineRegexp = regexp.MustCompile(`[\r\n]+`)
+)
+
+// validNewlines returns true if mode is a known way of handling line breaks
+func validNewlines(mode string) bool {
+	return mode == NewlinesReject || mode == NewlinesSpace || mode == NewlinesSplit
+}
+
+// buildMessages creates messages to send making sure parameters are encoded as intended
+// Only the last parameter may contain spaces (it is sent as the trailing parameter) and
+// line breaks in it are handled according to newlines
+// Long text is split to fit in a line once servers add a prefix of prefixLength bytes (prefixReserve if 0)
+func buildMessages(command string, params []string, newlines string, prefixLength int) ([]*irc.Message, error) {
+	if !commandRegexp.MatchString(command) {
+		return nil, fmt.Errorf("invalid command: %q", command)
+	}
+	for i, param := range params {
+		// NUL is never allowed
+		if strings.ContainsRune(param, 0) {
+			return nil, fmt.Errorf("parameter %d contains NUL", i+1)
+		}
+		if i == len(params)-1 {
+			break
+		}
+		// Middle parameters would be split or mistaken for the trailing parameter
+		if strings.ContainsAny(param, " \r\n") || strings.HasPrefix(param, ":") {
+			return nil, fmt.Errorf("parameter %d isn't the last parameter but contains spaces, line breaks or a leading colon: %q", i+1, param)
+		}
+	}
+	if len(params) == 0 {
+		return []*irc.Message{{Command: command}}, nil
+	}
+	trailing := params[len(params)-1]
+	// CTCP messages can't be split so line breaks are always replaced
+	ctcp := isTextCommand(command) && strings.HasPrefix(trailing, ctcpDelimiter)
+	var lines []string
+	switch {
+	case !strings.ContainsAny(trailing, "\r\n"):
+		lines = []string{trailing}
+	case newlines == NewlinesReject:
+		return nil, fmt.Errorf("parameter %d contains line breaks", len(params))
+	case newlines == NewlinesSpace || ctcp:
+		lines = []string{newlineRegexp.ReplaceAllString(trailing, " ")}
+	default:
+		// Send each non-empty line separately
+		for _, line := range newlineRegexp.Split(trailing, -1) {
+			if len(line) > 0 {
+				lines = append(lines, line)
+			}
+		}
+	}
+	// Make sure text fits in a line once the server adds our prefix
+	if isTextCommand(command) {
+		limit := textLimit(command, params[:len(params)-1], prefixLength)
+		if ctcp {
+			lines = []string{quoteCTCP(lines[0], limit)}
+		} else {
+			var split []string
+			for _, line := range lines {
+				split = append(split, splitText(line, limit)...)
+			}
+			lines = split
+		}
+	}
+	messages := make([]*irc.Message, 0, len(lines))
+	for _, line := range lines {
+		lineParams := make([]string, len(params))
+		copy(lineParams, params)
+		lineParams[len(params)-1] = line
+		messages = append(messages, &irc.Message{Command: command, Params: lineParams})
+	}
+	return messages, nil
+}
+
+// isTextCommand returns true for commands sending text which may be split if too long
+func isTextCommand(command string) bool {
+	command = strings.ToUpper(command)
+	return command == irc.PRIVMSG || command == irc.NOTICE
+}
+
+// textLimit returns the maximum length of the trailing parameter of a message
+func textLimit(command string, middle []string, prefixLength int) int {
+	if prefixLength <= 0 {
+		prefixLength = prefixReserve
+	}
+	// Account for command, middle parameters and the colon introducing the trailing parameter
+	overhead := len(command) + 2
+	for _, param := range middle {
+		overhead += len(param) + 1
+	}
+	return maxLineLength - 2 - prefixLength - overhead
+}
+
+// splitText splits text into pieces no longer than limit bytes preferring to split at spaces
+func splitText(text string, limit int) []string {
+	if limit < 1 {
+		return []string{text}
+	}
+	var pieces []string
+	for len(text) > limit {
+		i := strings.LastIndex(text[:limit+1], " ")
+		if i > 0 {
+			pieces = append(pieces, text[:i])
+			text = text[i+1:]
+			continue
+		}
+		// No space to split at, don't split UTF-8 sequences
+		i = limit
+		for i > 0 && !utf8.RuneStart(text[i]) {
+			i--
+		}
+		if i == 0 {
+			i = limit
+		}
+		pieces = append(pieces, text[:i])
+		text = text[i:]
+	}
+	return append(pieces, text)
+}
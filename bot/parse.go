@@ -0,0 +1,62 @@
+package bot
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// maxSafeInteger is the largest integer exactly representable as a Lua number
+const maxSafeInteger = 1<<53 - 1
+
+// parseInt parses a decimal integer and checks it is between min and max
+func parseInt(s string, min int64, max int64) (int64, error) {
+	i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer: %s", s)
+	}
+	if i < min || i > max {
+		return 0, fmt.Errorf("out of range: %d (expected %d to %d)", i, min, max)
+	}
+	return i, nil
+}
+
+// parseNumber parses a finite decimal number
+func parseNumber(s string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid number: %s", s)
+	}
+	return f, nil
+}
+
+// luaLibParseInt parses an integer returning it or nil and an error
+func (b *BananaBoatBot) luaLibParseInt(luaState *lua.LState) int {
+	s := luaState.CheckString(1)
+	min := int64(luaState.OptNumber(2, -maxSafeInteger))
+	max := int64(luaState.OptNumber(3, maxSafeInteger))
+	i, err := parseInt(s, min, max)
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	luaState.Push(lua.LNumber(i))
+	return 1
+}
+
+// luaLibParseNumber parses a number returning it or nil and an error
+func (b *BananaBoatBot) luaLibParseNumber(luaState *lua.LState) int {
+	s := luaState.CheckString(1)
+	f, err := parseNumber(s)
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	luaState.Push(lua.LNumber(f))
+	return 1
+}
@@ -0,0 +1,165 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// minReapInterval is the minimum interval between checks for idle Lua states
+const minReapInterval = 500 * time.Millisecond
+
+// idleLuaState is a pooled Lua state which isn't in use
+type idleLuaState struct {
+	// lastUsed is when the state was returned to the pool
+	lastUsed time.Time
+	// state is the Lua state itself
+	state *lua.LState
+}
+
+// luaStatePool is a pool of Lua states closing states which are idle for too long
+type luaStatePool struct {
+	// available is signalled when a state is returned or closed
+	available *sync.Cond
+	// closed is set once the pool is closed
+	closed bool
+	// idle are states not in use ordered by when they were last used
+	idle []idleLuaState
+	// idleTimeout is how long states may be idle before being closed (0 keeps them forever)
+	idleTimeout time.Duration
+	// live is the number of states created by the pool and not closed yet
+	live int
+	// maxStates is the maximum number of live states (0 is unlimited)
+	maxStates int
+	// mutex protects closed, idle and live
+	mutex sync.Mutex
+	// newState creates a new Lua state
+	newState func() *lua.LState
+}
+
+// newLuaStatePool creates a pool of Lua states and starts closing idle states if idleTimeout is set
+func newLuaStatePool(ctx context.Context, idleTimeout time.Duration, maxStates int, newState func() *lua.LState) *luaStatePool {
+	p := &luaStatePool{
+		idleTimeout: idleTimeout,
+		maxStates:   maxStates,
+		newState:    newState,
+	}
+	p.available = sync.NewCond(&p.mutex)
+	if idleTimeout > 0 {
+		go p.reapLoop(ctx)
+	}
+	return p
+}
+
+// updateGauges updates metrics of the pool (mutex must be held)
+func (p *luaStatePool) updateGauges() {
+	luaStatesIdleGauge.Set(float64(len(p.idle)))
+	luaStatesGauge.Set(float64(p.live))
+}
+
+// Get returns the most recently used idle state or a new one waiting for a state if too many are in use
+func (p *luaStatePool) Get() *lua.LState {
+	p.mutex.Lock()
+	for {
+		if n := len(p.idle); n > 0 {
+			state := p.idle[n-1].state
+			p.idle = p.idle[:n-1]
+			p.updateGauges()
+			p.mutex.Unlock()
+			return state
+		}
+		if p.maxStates <= 0 || p.live < p.maxStates || p.closed {
+			break
+		}
+		p.available.Wait()
+	}
+	p.live++
+	p.updateGauges()
+	p.mutex.Unlock()
+	return p.newState()
+}
+
+// Put returns a state to the pool
+func (p *luaStatePool) Put(state *lua.LState) {
+	p.mutex.Lock()
+	defer p.available.Signal()
+	if p.closed {
+		p.live--
+		p.updateGauges()
+		p.mutex.Unlock()
+		state.Close()
+		return
+	}
+	p.idle = append(p.idle, idleLuaState{lastUsed: time.Now(), state: state})
+	p.updateGauges()
+	p.mutex.Unlock()
+}
+
+// stats returns the number of live and idle states
+func (p *luaStatePool) stats() (int, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.live, len(p.idle)
+}
+
+// reap closes states which were idle since before cutoff and returns how many were closed
+func (p *luaStatePool) reap(cutoff time.Time) int {
+	p.mutex.Lock()
+	// Metrics of a closed pool must not be touched as they are shared
+	if p.closed {
+		p.mutex.Unlock()
+		return 0
+	}
+	// Least recently used states are first
+	n := 0
+	for n < len(p.idle) && p.idle[n].lastUsed.Before(cutoff) {
+		n++
+	}
+	expired := make([]idleLuaState, n)
+	copy(expired, p.idle[:n])
+	p.idle = append(p.idle[:0], p.idle[n:]...)
+	p.live -= n
+	p.updateGauges()
+	p.mutex.Unlock()
+	for _, s := range expired {
+		s.state.Close()
+	}
+	p.available.Broadcast()
+	return n
+}
+
+// reapLoop periodically closes idle states until ctx is done
+func (p *luaStatePool) reapLoop(ctx context.Context) {
+	interval := p.idleTimeout / 2
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.reap(now.Add(-p.idleTimeout))
+		}
+	}
+}
+
+// Close closes all idle states; states in use are closed when they are returned
+func (p *luaStatePool) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.live -= len(idle)
+	p.updateGauges()
+	p.mutex.Unlock()
+	for _, s := range idle {
+		s.state.Close()
+	}
+	// Let waiting callers create states which are closed when returned
+	p.available.Broadcast()
+}
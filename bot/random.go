@@ -0,0 +1,71 @@
+package bot
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// randomFloat returns a cryptographically random number in [0, 1)
+func randomFloat() (float64, error) {
+	r, err := rand.Int(rand.Reader, big.NewInt(1<<53))
+	if err != nil {
+		return 0, err
+	}
+	return float64(r.Int64()) / (1 << 53), nil
+}
+
+// weightedChoice returns the index of a weight chosen with probability proportional to it
+func weightedChoice(weights []float64) (int, error) {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	if total <= 0 {
+		return 0, errors.New("no positive weights")
+	}
+	r, err := randomFloat()
+	if err != nil {
+		return 0, err
+	}
+	r *= total
+	for i, w := range weights {
+		if r < w {
+			return i, nil
+		}
+		r -= w
+	}
+	// Rounding errors could leave us here, return last candidate
+	for i := len(weights) - 1; i >= 0; i-- {
+		if weights[i] > 0 {
+			return i, nil
+		}
+	}
+	return 0, errors.New("no positive weights")
+}
+
+// luaLibWeightedChoice returns a key of a table with probability proportional to its value
+func (b *BananaBoatBot) luaLibWeightedChoice(luaState *lua.LState) int {
+	tbl := luaState.CheckTable(1)
+	var values []lua.LValue
+	var weights []float64
+	tbl.ForEach(func(value lua.LValue, weightL lua.LValue) {
+		// Values with zero, negative or non-numeric weights are never chosen
+		weight, ok := weightL.(lua.LNumber)
+		if !ok || weight <= 0 {
+			return
+		}
+		values = append(values, value)
+		weights = append(weights, float64(weight))
+	})
+	i, err := weightedChoice(weights)
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	luaState.Push(values[i])
+	return 1
+}
@@ -0,0 +1,154 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// ReconnectStateBucket is the store bucket holding reconnect state of servers
+const ReconnectStateBucket = "reconnect"
+
+// ReconnectState is persisted reconnect/backoff state of a server
+type ReconnectState struct {
+	// Exp is the reconnect exponent at time of failure
+	Exp uint64 `json:"exp"`
+	// LastFailure is the time of the last connection failure
+	LastFailure time.Time `json:"last_failure"`
+}
+
+// saveReconnectState persists reconnect state of a server if we have a store
+func (b *BananaBoatBot) saveReconnectState(svrName string, exp uint64) {
+	if b.Config.Store == nil {
+		return
+	}
+	state, err := json.Marshal(&ReconnectState{
+		Exp:         exp,
+		LastFailure: time.Now(),
+	})
+	if err != nil {
+		log.Printf("[%s] Failed to encode reconnect state: %s", svrName, err)
+		return
+	}
+	err = b.Config.Store.Set(ReconnectStateBucket, svrName, state)
+	if err != nil {
+		log.Printf("[%s] Failed to save reconnect state: %s", svrName, err)
+	}
+}
+
+// loadReconnectState returns persisted reconnect exponent of a server if it hasn't expired
+func (b *BananaBoatBot) loadReconnectState(svrName string) (uint64, bool) {
+	if b.Config.Store == nil {
+		return 0, false
+	}
+	v, err := b.Config.Store.Get(ReconnectStateBucket, svrName)
+	if err != nil {
+		log.Printf("[%s] Failed to load reconnect state: %s", svrName, err)
+		return 0, false
+	}
+	if v == nil {
+		return 0, false
+	}
+	state := &ReconnectState{}
+	err = json.Unmarshal(v, state)
+	if err != nil {
+		log.Printf("[%s] Failed to decode reconnect state: %s", svrName, err)
+		return 0, false
+	}
+	// Forget state which is too old to be relevant
+	ttl := time.Duration(b.Config.ReconnectStateTTL) * time.Second
+	if time.Since(state.LastFailure) > ttl {
+		b.clearReconnectState(svrName)
+		return 0, false
+	}
+	return state.Exp, true
+}
+
+// clearReconnectState removes persisted reconnect state of a server
+func (b *BananaBoatBot) clearReconnectState(svrName string) {
+	if b.Config.Store == nil {
+		return
+	}
+	err := b.Config.Store.Delete(ReconnectStateBucket, svrName)
+	if err != nil {
+		log.Printf("[%s] Failed to clear reconnect state: %s", svrName, err)
+	}
+}
+
+// ReconnectCommand is the command of the synthetic message telling handlers we are about to reconnect to a server
+// Its parameters are the number of the attempt and the seconds we wait before it
+const ReconnectCommand = "RECONNECT"
+
+// reconnectStrategyFromLua reads a reconnect strategy from a table, using defaults for missing fields
+// (nil if neither is configured so the built-in backoff is used)
+func (b *BananaBoatBot) reconnectStrategyFromLua(lv lua.LValue, defaults *client.ReconnectStrategy) *client.ReconnectStrategy {
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		if lv != lua.LNil {
+			log.Printf("Lua reload error: ignoring reconnect of unexpected type: %s", lv.Type())
+		}
+		return defaults
+	}
+	strategy := &client.ReconnectStrategy{
+		Base:       time.Second,
+		Max:        time.Duration(b.Config.MaxReconnect) * time.Second,
+		Multiplier: 2,
+	}
+	if defaults != nil {
+		*strategy = *defaults
+	}
+	var err error
+	seconds := func(key string, d *time.Duration) {
+		n, ok := tbl.RawGetString(key).(lua.LNumber)
+		if !ok || err != nil {
+			return
+		}
+		// Values are checked before converting as huge ones overflow
+		if max := client.MaxReconnectDelay.Seconds(); math.IsNaN(float64(n)) || float64(n) < 0 || float64(n) > max {
+			err = fmt.Errorf("%s must be between 0 and %d seconds", key, int(max))
+			return
+		}
+		*d = time.Duration(float64(n) * float64(time.Second))
+	}
+	seconds("base", &strategy.Base)
+	seconds("max", &strategy.Max)
+	seconds("reset_after", &strategy.ResetAfter)
+	if n, ok := tbl.RawGetString("multiplier").(lua.LNumber); ok {
+		strategy.Multiplier = float64(n)
+	}
+	if n, ok := tbl.RawGetString("jitter").(lua.LNumber); ok {
+		strategy.Jitter = float64(n)
+	}
+	if err == nil {
+		err = strategy.Validate()
+	}
+	if err != nil {
+		log.Printf("Lua reload error: ignoring invalid reconnect strategy: %s", err)
+		return defaults
+	}
+	return strategy
+}
+
+// sameReconnectStrategy returns true if strategies are the same
+func sameReconnectStrategy(a *client.ReconnectStrategy, b *client.ReconnectStrategy) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// handleReconnect tells handlers we are about to reconnect to a server
+func (b *BananaBoatBot) handleReconnect(ctx context.Context, svrName string, attempt uint64, delay time.Duration) {
+	b.HandleHandlers(ctx, svrName, &irc.Message{
+		Command: ReconnectCommand,
+		Params:  []string{strconv.FormatUint(attempt, 10), strconv.FormatFloat(delay.Seconds(), 'f', -1, 64)},
+	})
+}
@@ -0,0 +1,57 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// maxRedirects is the number of redirects HTTP helpers follow
+const maxRedirects = 10
+
+// redirectError is returned when HTTP helpers encounter a disallowed redirect
+type redirectError struct {
+	// reason explains why the redirect isn't allowed
+	reason string
+	// to is the URL we were redirected to
+	to string
+}
+
+func (e *redirectError) Error() string {
+	return fmt.Sprintf("redirect to %s not allowed: %s", e.to, e.reason)
+}
+
+// checkRedirect rejects redirects to schemes other than http(s) and optionally https to http downgrades
+func (b *BananaBoatBot) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return &redirectError{
+			reason: fmt.Sprintf("scheme %s isn't http or https", req.URL.Scheme),
+			to:     req.URL.String(),
+		}
+	}
+	b.handlersMutex.RLock()
+	forbidDowngrade := b.forbidDowngrade
+	b.handlersMutex.RUnlock()
+	if forbidDowngrade && via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme == "http" {
+		return &redirectError{
+			reason: "downgrade from https to http",
+			to:     req.URL.String(),
+		}
+	}
+	return nil
+}
+
+// httpErrorMessage returns a description of an error from an HTTP helper
+func httpErrorMessage(err error) string {
+	var redirectErr *redirectError
+	if errors.As(err, &redirectErr) {
+		return redirectErr.Error()
+	}
+	if errors.Is(err, errPrivateAddress) {
+		return errPrivateAddress.Error()
+	}
+	return err.Error()
+}
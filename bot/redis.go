@@ -0,0 +1,187 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// maxRedisSubscriptions is the maximum number of subscriptions made by scripts
+	maxRedisSubscriptions = 100
+	// redisResubscribeWait is how long we wait before subscribing again after a subscription failed
+	redisResubscribeWait = 5 * time.Second
+	// redisTimeout is how long a Redis command may take
+	redisTimeout = 10 * time.Second
+)
+
+// errNoRedis is returned by Redis functions if no Redis server is configured
+var errNoRedis = errors.New("no Redis server configured")
+
+// redisSubscription identifies a function subscribed to a channel
+type redisSubscription struct {
+	channel string
+	proto   *lua.FunctionProto
+}
+
+// redisDo runs a Redis command on behalf of a Lua state
+func (b *BananaBoatBot) redisDo(luaState *lua.LState, args ...string) (interface{}, error) {
+	if b.Config.Redis == nil {
+		return nil, errNoRedis
+	}
+	ctx := luaState.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	return b.Config.Redis.Do(ctx, args...)
+}
+
+// luaLibRedisGet returns the value of a key or nil if it isn't set
+func (b *BananaBoatBot) luaLibRedisGet(luaState *lua.LState) int {
+	key := luaState.CheckString(1)
+	reply, err := b.redisDo(luaState, "GET", key)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	if value, ok := reply.(string); ok {
+		luaState.Push(lua.LString(value))
+	} else {
+		luaState.Push(lua.LNil)
+	}
+	return 1
+}
+
+// luaLibRedisSet sets the value of a key, optionally expiring after a number of seconds
+func (b *BananaBoatBot) luaLibRedisSet(luaState *lua.LState) int {
+	key := luaState.CheckString(1)
+	value := luaState.CheckString(2)
+	args := []string{"SET", key, value}
+	if luaState.Get(3) != lua.LNil {
+		seconds := luaState.CheckInt(3)
+		if seconds < 1 {
+			luaState.ArgError(3, "expiry must be positive")
+		}
+		args = append(args, "EX", strconv.Itoa(seconds))
+	}
+	if _, err := b.redisDo(luaState, args...); err != nil {
+		return pushError(luaState, err)
+	}
+	luaState.Push(lua.LTrue)
+	return 1
+}
+
+// luaLibRedisIncr increments the value of a key returning the new value
+func (b *BananaBoatBot) luaLibRedisIncr(luaState *lua.LState) int {
+	key := luaState.CheckString(1)
+	reply, err := b.redisDo(luaState, "INCR", key)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	n, _ := reply.(int64)
+	luaState.Push(lua.LNumber(n))
+	return 1
+}
+
+// luaLibRedisExpire makes a key expire after a number of seconds, returning false if it doesn't exist
+func (b *BananaBoatBot) luaLibRedisExpire(luaState *lua.LState) int {
+	key := luaState.CheckString(1)
+	seconds := luaState.CheckInt(2)
+	if seconds < 1 {
+		luaState.ArgError(2, "expiry must be positive")
+	}
+	reply, err := b.redisDo(luaState, "EXPIRE", key, strconv.Itoa(seconds))
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	luaState.Push(lua.LBool(reply == int64(1)))
+	return 1
+}
+
+// luaLibRedisPublish publishes a message to a channel returning the number of subscribers which received it
+func (b *BananaBoatBot) luaLibRedisPublish(luaState *lua.LState) int {
+	channel := luaState.CheckString(1)
+	message := luaState.CheckString(2)
+	reply, err := b.redisDo(luaState, "PUBLISH", channel, message)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	n, _ := reply.(int64)
+	luaState.Push(lua.LNumber(n))
+	return 1
+}
+
+// luaLibRedisSubscribe calls a function in a pooled Lua state with messages published to a channel
+func (b *BananaBoatBot) luaLibRedisSubscribe(luaState *lua.LState) int {
+	channel := luaState.CheckString(1)
+	luaFunction := checkWorkerFunction(luaState, 2)
+	luaState.SetTop(0)
+	if b.Config.Redis == nil {
+		return pushError(luaState, errNoRedis)
+	}
+	key := redisSubscription{channel: channel, proto: luaFunction.Proto}
+	if _, ok := b.redisSubscriptions.Load(key); ok {
+		return pushError(luaState, fmt.Errorf("function already subscribed to %s", channel))
+	}
+	subscriptions := 0
+	b.redisSubscriptions.Range(func(_, _ interface{}) bool {
+		subscriptions++
+		return true
+	})
+	if subscriptions >= maxRedisSubscriptions {
+		return pushError(luaState, fmt.Errorf("too many Redis subscriptions (maximum is %d)", maxRedisSubscriptions))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, loaded := b.redisSubscriptions.LoadOrStore(key, cancel); loaded {
+		cancel()
+		return pushError(luaState, fmt.Errorf("function already subscribed to %s", channel))
+	}
+	go b.redisSubscribe(ctx, channel, luaFunction.Proto, b.currentGeneration(luaState))
+	luaState.Push(lua.LTrue)
+	return 1
+}
+
+// redisSubscribe runs a subscription until it is cancelled, subscribing again if it fails
+func (b *BananaBoatBot) redisSubscribe(ctx context.Context, channel string, proto *lua.FunctionProto, generation uint64) {
+	for {
+		err := b.Config.Redis.Subscribe(ctx, []string{channel}, func(channel string, message string) {
+			b.runWorker(&messageContext{generation: generation}, proto, []lua.LValue{lua.LString(channel), lua.LString(message)})
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Redis subscription to %s failed: %s", channel, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(redisResubscribeWait):
+		}
+	}
+}
+
+// stopRedisSubscriptions cancels subscriptions made by scripts
+func (b *BananaBoatBot) stopRedisSubscriptions() {
+	b.redisSubscriptions.Range(func(key, cancel interface{}) bool {
+		b.redisSubscriptions.Delete(key)
+		cancel.(context.CancelFunc)()
+		return true
+	})
+}
+
+// redisModule returns a table of Redis functions
+func (b *BananaBoatBot) redisModule(luaState *lua.LState) *lua.LTable {
+	return luaState.SetFuncs(luaState.NewTable(), map[string]lua.LGFunction{
+		"expire":    b.luaLibRedisExpire,
+		"get":       b.luaLibRedisGet,
+		"incr":      b.luaLibRedisIncr,
+		"publish":   b.luaLibRedisPublish,
+		"set":       b.luaLibRedisSet,
+		"subscribe": b.luaLibRedisSubscribe,
+	})
+}
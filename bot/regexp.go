@@ -0,0 +1,198 @@
+package bot
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// maxRegexpCache is the number of compiled patterns kept before the cache is cleared
+	maxRegexpCache = 256
+	// maxRegexpMatches is the maximum number of matches returned by find_all
+	maxRegexpMatches = 1000
+	// regexpType is the name of the metatable of compiled patterns
+	regexpType = "bananaboat.regexp"
+)
+
+// regexpCache maps patterns to compiled regular expressions so handlers don't compile them for every message
+type regexpCache struct {
+	mutex    sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+// compile returns a compiled pattern from the cache or compiles and caches it
+func (c *regexpCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if re, ok := c.patterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	// Patterns built from messages could fill the cache, start over once it's full
+	if c.patterns == nil || len(c.patterns) >= maxRegexpCache {
+		c.patterns = make(map[string]*regexp.Regexp)
+	}
+	c.patterns[pattern] = re
+	return re, nil
+}
+
+// checkRegexp returns the compiled pattern or pattern string at index 1
+func (b *BananaBoatBot) checkRegexp(luaState *lua.LState) *regexp.Regexp {
+	if ud, ok := luaState.Get(1).(*lua.LUserData); ok {
+		if re, ok := ud.Value.(*regexp.Regexp); ok {
+			return re
+		}
+	}
+	re, err := b.regexps.compile(luaState.CheckString(1))
+	if err != nil {
+		luaState.ArgError(1, err.Error())
+	}
+	return re
+}
+
+// regexpMatchTable returns a table of a match followed by its captures, also keyed by name for named groups
+func regexpMatchTable(luaState *lua.LState, re *regexp.Regexp, submatches []string) *lua.LTable {
+	t := luaState.CreateTable(len(submatches), 0)
+	for _, s := range submatches {
+		t.Append(lua.LString(s))
+	}
+	for i, name := range re.SubexpNames() {
+		if len(name) > 0 {
+			t.RawSetString(name, lua.LString(submatches[i]))
+		}
+	}
+	return t
+}
+
+// luaLibRegexpCompile returns a compiled pattern with match, find, find_all and replace methods or nil and an error
+func (b *BananaBoatBot) luaLibRegexpCompile(luaState *lua.LState) int {
+	re, err := b.regexps.compile(luaState.CheckString(1))
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	ud := luaState.NewUserData()
+	ud.Value = re
+	luaState.SetMetatable(ud, b.regexpMetatable(luaState))
+	luaState.Push(ud)
+	return 1
+}
+
+// regexpMetatable returns the metatable of compiled patterns in a Lua state
+func (b *BananaBoatBot) regexpMetatable(luaState *lua.LState) lua.LValue {
+	if mt := luaState.GetTypeMetatable(regexpType); mt != lua.LNil {
+		return mt
+	}
+	mt := luaState.NewTypeMetatable(regexpType)
+	luaState.SetField(mt, "__index", luaState.SetFuncs(luaState.NewTable(), map[string]lua.LGFunction{
+		"find":     b.luaLibRegexpFind,
+		"find_all": b.luaLibRegexpFindAll,
+		"match":    b.luaLibRegexpMatch,
+		"replace":  b.luaLibRegexpReplace,
+	}))
+	return mt
+}
+
+// luaLibRegexpMatch returns true if a pattern matches a string
+func (b *BananaBoatBot) luaLibRegexpMatch(luaState *lua.LState) int {
+	re := b.checkRegexp(luaState)
+	s := luaState.CheckString(2)
+	luaState.Push(lua.LBool(re.MatchString(s)))
+	return 1
+}
+
+// luaLibRegexpFind returns the first match of a pattern followed by its captures or nil
+func (b *BananaBoatBot) luaLibRegexpFind(luaState *lua.LState) int {
+	re := b.checkRegexp(luaState)
+	s := luaState.CheckString(2)
+	submatches := re.FindStringSubmatch(s)
+	if submatches == nil {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	for _, submatch := range submatches {
+		luaState.Push(lua.LString(submatch))
+	}
+	return len(submatches)
+}
+
+// luaLibRegexpFindAll returns a list of matches of a pattern as tables of the match and its captures
+func (b *BananaBoatBot) luaLibRegexpFindAll(luaState *lua.LState) int {
+	re := b.checkRegexp(luaState)
+	s := luaState.CheckString(2)
+	n := luaState.OptInt(3, maxRegexpMatches)
+	if n < 1 || n > maxRegexpMatches {
+		n = maxRegexpMatches
+	}
+	matches := re.FindAllStringSubmatch(s, n)
+	res := luaState.CreateTable(len(matches), 0)
+	for _, submatches := range matches {
+		res.Append(regexpMatchTable(luaState, re, submatches))
+	}
+	luaState.Push(res)
+	return 1
+}
+
+// luaLibRegexpReplace replaces matches of a pattern with a template (where $1 or ${name} are captures)
+// or the result of calling a function with the match and its captures
+func (b *BananaBoatBot) luaLibRegexpReplace(luaState *lua.LState) int {
+	re := b.checkRegexp(luaState)
+	s := luaState.CheckString(2)
+	switch repl := luaState.Get(3).(type) {
+	case lua.LString, lua.LNumber:
+		luaState.Push(lua.LString(re.ReplaceAllString(s, lua.LVAsString(repl))))
+	case *lua.LFunction:
+		// Captures are taken from the whole string so anchors and word boundaries work as they do for matching
+		var sb strings.Builder
+		last := 0
+		for _, loc := range re.FindAllStringSubmatchIndex(s, -1) {
+			args := make([]lua.LValue, len(loc)/2)
+			for i := range args {
+				if loc[2*i] >= 0 {
+					args[i] = lua.LString(s[loc[2*i]:loc[2*i+1]])
+				} else {
+					args[i] = lua.LString("")
+				}
+			}
+			luaState.CallByParam(lua.P{
+				Fn:   repl,
+				NRet: 1,
+			}, args...)
+			ret := luaState.Get(-1)
+			luaState.Pop(1)
+			sb.WriteString(s[last:loc[0]])
+			// Returning nil or false keeps the match
+			switch ret.(type) {
+			case lua.LString, lua.LNumber:
+				sb.WriteString(lua.LVAsString(ret))
+			default:
+				if ret != lua.LNil && ret != lua.LFalse {
+					luaState.RaiseError("invalid replacement value (a %s)", ret.Type())
+				}
+				sb.WriteString(s[loc[0]:loc[1]])
+			}
+			last = loc[1]
+		}
+		sb.WriteString(s[last:])
+		luaState.Push(lua.LString(sb.String()))
+	default:
+		luaState.TypeError(3, lua.LTString)
+	}
+	return 1
+}
+
+// regexpModule returns a table of regular expression functions
+func (b *BananaBoatBot) regexpModule(luaState *lua.LState) *lua.LTable {
+	return luaState.SetFuncs(luaState.NewTable(), map[string]lua.LGFunction{
+		"compile":  b.luaLibRegexpCompile,
+		"find":     b.luaLibRegexpFind,
+		"find_all": b.luaLibRegexpFindAll,
+		"match":    b.luaLibRegexpMatch,
+		"replace":  b.luaLibRegexpReplace,
+	})
+}
@@ -0,0 +1,201 @@
+package bot
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// defaultRejoinAttempts is the number of times we rejoin a channel if not configured
+	defaultRejoinAttempts = 3
+	// defaultRejoinDelay is the delay before first rejoining a channel if not configured (doubled on each attempt)
+	defaultRejoinDelay = 5 * time.Second
+	// rejoinResetInterval is how long we must have stayed in a channel for attempts to start over
+	rejoinResetInterval = 10 * time.Minute
+)
+
+// rejoinPolicy describes how we rejoin channels we were kicked from
+type rejoinPolicy struct {
+	// attempts is the maximum number of consecutive attempts to rejoin a channel
+	attempts int
+	// delay is the delay before the first attempt
+	delay time.Duration
+	// veto is a Lua function returning true if a channel shouldn't be rejoined
+	veto *lua.LFunction
+}
+
+// rejoinState tracks attempts to rejoin a channel
+type rejoinState struct {
+	// attempts is the number of consecutive attempts
+	attempts int
+	// last is when the last attempt was scheduled
+	last time.Time
+	// timer sends the pending JOIN
+	timer *time.Timer
+}
+
+// rejoinPolicyFromLua reads how channels are rejoined after a kick (nil if they aren't)
+// Settings may be true to use defaults or a table of 'delay' (seconds), 'attempts' and a 'veto' function
+func rejoinPolicyFromLua(lv lua.LValue) *rejoinPolicy {
+	switch lv := lv.(type) {
+	case lua.LBool:
+		if !bool(lv) {
+			return nil
+		}
+		return &rejoinPolicy{attempts: defaultRejoinAttempts, delay: defaultRejoinDelay}
+	case *lua.LTable:
+		policy := &rejoinPolicy{attempts: defaultRejoinAttempts, delay: defaultRejoinDelay}
+		if attempts, ok := lv.RawGetString("attempts").(lua.LNumber); ok && attempts >= 1 {
+			policy.attempts = int(attempts)
+		}
+		if delay, ok := lv.RawGetString("delay").(lua.LNumber); ok && delay >= 0 {
+			policy.delay = time.Duration(float64(delay) * float64(time.Second))
+		}
+		switch veto := lv.RawGetString("veto").(type) {
+		case *lua.LFunction:
+			policy.veto = veto
+		case *lua.LNilType:
+		default:
+			log.Printf("Lua reload error: ignoring rejoin veto of unexpected type: %s", veto.Type())
+		}
+		return policy
+	case *lua.LNilType:
+		return nil
+	}
+	log.Printf("Lua reload error: ignoring rejoin of unexpected type: %s", lv.Type())
+	return nil
+}
+
+// rejoinVetoed returns true if the veto function of a policy refuses to rejoin a channel
+func (b *BananaBoatBot) rejoinVetoed(svrName string, policy *rejoinPolicy, channel string, kicker string, reason string) bool {
+	if policy.veto == nil {
+		return false
+	}
+	b.luaMutex.Lock()
+	defer b.luaMutex.Unlock()
+	defer b.luaState.SetTop(0)
+	err := b.luaState.CallByParam(lua.P{
+		Fn:      policy.veto,
+		NRet:    1,
+		Protect: true,
+	}, lua.LString(svrName), lua.LString(channel), lua.LString(kicker), lua.LString(reason))
+	if err != nil {
+		// Don't rejoin if we can't tell whether we should
+		log.Printf("[%s] Rejoin veto failed: %s", svrName, err)
+		return true
+	}
+	return lua.LVAsBool(b.luaState.Get(-1))
+}
+
+// channelKey returns the configured key of a channel (empty if none)
+func (b *BananaBoatBot) channelKey(svrName string, channel string) string {
+	b.handlersMutex.RLock()
+	defer b.handlersMutex.RUnlock()
+	for _, setting := range b.channels[svrName] {
+		if strings.EqualFold(setting.name, channel) {
+			return setting.key
+		}
+	}
+	return ""
+}
+
+// scheduleRejoin rejoins a channel after a delay growing with each consecutive attempt
+func (b *BananaBoatBot) scheduleRejoin(svrName string, policy *rejoinPolicy, channel string) {
+	params := []string{channel}
+	if channelKey := b.channelKey(svrName, channel); len(channelKey) > 0 {
+		params = append(params, channelKey)
+	}
+	stateI, _ := b.rejoins.LoadOrStore(joinOnceKey(svrName, channel), &rejoinState{})
+	state := stateI.(*rejoinState)
+	b.rejoinMutex.Lock()
+	defer b.rejoinMutex.Unlock()
+	now := time.Now()
+	// Start over if we stayed in the channel for a while
+	if now.Sub(state.last) > rejoinResetInterval {
+		state.attempts = 0
+	}
+	if state.attempts >= policy.attempts {
+		log.Printf("[%s] Not rejoining %s after %d attempts", svrName, channel, state.attempts)
+		return
+	}
+	delay := policy.delay << uint(state.attempts)
+	state.attempts++
+	state.last = now
+	if state.timer != nil {
+		state.timer.Stop()
+	}
+	log.Printf("[%s] Rejoining %s in %s (attempt %d of %d)", svrName, channel, delay, state.attempts, policy.attempts)
+	state.timer = time.AfterFunc(delay, func() {
+		b.sendMessage(svrName, &irc.Message{
+			Command: irc.JOIN,
+			Params:  params,
+		})
+	})
+}
+
+// rejoining returns true if we recently tried to rejoin a channel
+func (b *BananaBoatBot) rejoining(svrName string, channel string) bool {
+	stateI, ok := b.rejoins.Load(joinOnceKey(svrName, channel))
+	if !ok {
+		return false
+	}
+	b.rejoinMutex.Lock()
+	defer b.rejoinMutex.Unlock()
+	return time.Since(stateI.(*rejoinState).last) <= rejoinResetInterval
+}
+
+// handleRejoin rejoins channels we were kicked from or failed to rejoin if configured
+func (b *BananaBoatBot) handleRejoin(svrName string, msg *irc.Message) {
+	b.handlersMutex.RLock()
+	policy := b.rejoinPolicies[svrName]
+	b.handlersMutex.RUnlock()
+	if policy == nil {
+		return
+	}
+	switch msg.Command {
+	case irc.KICK:
+		// Parameters are the channel, the nick kicked and a reason
+		state := b.getServerState(svrName)
+		if state == nil || len(msg.Params) < 2 || msg.Params[1] != state.Nick() {
+			return
+		}
+		var kicker, reason string
+		if msg.Prefix != nil {
+			kicker = msg.Prefix.Name
+		}
+		if len(msg.Params) > 2 {
+			reason = msg.Params[2]
+		}
+		channel := msg.Params[0]
+		if b.rejoinVetoed(svrName, policy, channel, kicker, reason) {
+			log.Printf("[%s] Not rejoining %s (vetoed)", svrName, channel)
+			return
+		}
+		b.scheduleRejoin(svrName, policy, channel)
+	case irc.ERR_CHANNELISFULL, irc.ERR_INVITEONLYCHAN, irc.ERR_BANNEDFROMCHAN, irc.ERR_BADCHANNELKEY:
+		// Parameters are our nick, the channel and a reason
+		// Only retry channels we are rejoining
+		if len(msg.Params) < 2 {
+			return
+		}
+		if b.rejoining(svrName, msg.Params[1]) {
+			b.scheduleRejoin(svrName, policy, msg.Params[1])
+		}
+	}
+}
+
+// stopRejoins cancels pending attempts to rejoin channels
+func (b *BananaBoatBot) stopRejoins() {
+	b.rejoinMutex.Lock()
+	defer b.rejoinMutex.Unlock()
+	b.rejoins.Range(func(_, value interface{}) bool {
+		if timer := value.(*rejoinState).timer; timer != nil {
+			timer.Stop()
+		}
+		return true
+	})
+}
@@ -0,0 +1,444 @@
+package bot
+
+import (
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+)
+
+// defaultPingInterval is the default interval between keepalive PINGs
+const defaultPingInterval = 60 * time.Second
+
+// tlsPinRegexp matches SHA-256 fingerprints in hex (after removing colons)
+var tlsPinRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// userModesRegexp matches valid user mode strings such as "+Bix" or "+i-w"
+var userModesRegexp = regexp.MustCompile(`^([+-][a-zA-Z]+)+$`)
+
+// serverSettingsFromTable reads settings for an IRC server from Lua
+func (b *BananaBoatBot) serverSettingsFromTable(serverSettings *lua.LTable) *client.IrcServerSettings {
+	// Get 'server' string from table
+	lv := serverSettings.RawGetString("server")
+	host := lua.LVAsString(lv)
+
+	// Get 'tls' bool from table (default false)
+	var tls bool
+	lv = serverSettings.RawGetString("tls")
+	if lv, ok := lv.(lua.LBool); ok {
+		tls = bool(lv)
+	}
+
+	// Get 'tls_verify' bool from table (default true)
+	verifyTLS := true
+	lv = serverSettings.RawGetString("tls_verify")
+	if lv == lua.LFalse {
+		verifyTLS = false
+	}
+
+	// Get 'tls_pin' fingerprint from table
+	tlsPin := strings.ToLower(strings.Replace(lua.LVAsString(serverSettings.RawGetString("tls_pin")), ":", "", -1))
+	if len(tlsPin) > 0 && !tlsPinRegexp.MatchString(tlsPin) {
+		log.Printf("Lua reload error: ignoring invalid tls_pin: %s", tlsPin)
+		tlsPin = ""
+	}
+
+	// Get 'tls_min_version' string from table (such as '1.2' which is the default)
+	tlsMinVersion := lua.LVAsString(serverSettings.RawGetString("tls_min_version"))
+	if err := client.ValidateTLSVersion(tlsMinVersion); err != nil {
+		log.Printf("Lua reload error: ignoring tls_min_version: %s", err)
+		tlsMinVersion = ""
+	}
+
+	// Get 'tls_ciphers' list of cipher suites from table (default is chosen by Go)
+	var tlsCipherSuites []string
+	if ciphersTbl, ok := serverSettings.RawGetString("tls_ciphers").(*lua.LTable); ok {
+		ciphersTbl.ForEach(func(_ lua.LValue, cipherLV lua.LValue) {
+			cipher := lua.LVAsString(cipherLV)
+			if err := client.ValidateCipherSuite(cipher); err != nil {
+				log.Printf("Lua reload error: ignoring tls_ciphers entry: %s", err)
+				return
+			}
+			tlsCipherSuites = append(tlsCipherSuites, cipher)
+		})
+	}
+
+	// Get 'tls_ca' path of CA certificates to verify the server with from table
+	tlsCA := lua.LVAsString(serverSettings.RawGetString("tls_ca"))
+	if len(tlsCA) > 0 {
+		if !tls {
+			log.Printf("Lua reload error: tls_ca requires tls")
+		} else if !verifyTLS {
+			log.Printf("Lua reload error: tls_ca has no effect with tls_verify disabled")
+		} else if err := client.ValidateCAFile(tlsCA); err != nil {
+			// Keep it anyway as it is loaded again when connecting
+			log.Printf("Lua reload error: tls_ca: %s", err)
+		}
+	}
+
+	// Get 'tls_cert' & 'tls_key' paths of our client certificate from table
+	tlsCert := lua.LVAsString(serverSettings.RawGetString("tls_cert"))
+	tlsKey := lua.LVAsString(serverSettings.RawGetString("tls_key"))
+	if len(tlsCert) > 0 {
+		if !tls {
+			log.Printf("Lua reload error: tls_cert requires tls")
+		} else if err := client.ValidateClientCertificate(tlsCert, tlsKey); err != nil {
+			// Keep it anyway as it is loaded again when connecting
+			log.Printf("Lua reload error: tls_cert: %s", err)
+		}
+	} else if len(tlsKey) > 0 {
+		log.Printf("Lua reload error: ignoring tls_key without tls_cert")
+	}
+
+	// Get 'port' from table (use default from so-called config)
+	portInt := b.Config.DefaultIrcPort
+	lv = serverSettings.RawGetString("port")
+	if port, ok := lv.(lua.LNumber); ok {
+		portInt = int(port)
+	}
+
+	// Get 'nick' from table - use default if unavailable
+	var nick string
+	lv = serverSettings.RawGetString("nick")
+	if lv, ok := lv.(lua.LString); ok {
+		nick = lua.LVAsString(lv)
+	} else {
+		nick = b.nick
+	}
+
+	// Get 'realname' from table - use default if unavailable
+	var realname string
+	lv = serverSettings.RawGetString("realname")
+	if lv, ok := lv.(lua.LString); ok {
+		realname = lua.LVAsString(lv)
+	} else {
+		realname = b.realname
+	}
+
+	// Get 'username' from table - use default if unavailable
+	var username string
+	lv = serverSettings.RawGetString("username")
+	if lv, ok := lv.(lua.LString); ok {
+		username = lua.LVAsString(lv)
+	} else {
+		username = b.username
+	}
+
+	// Get 'ping_interval' in seconds from table (0 disables keepalive PINGs)
+	pingInterval := defaultPingInterval
+	if interval, ok := serverSettings.RawGetString("ping_interval").(lua.LNumber); ok && interval >= 0 {
+		pingInterval = time.Duration(float64(interval) * float64(time.Second))
+	}
+
+	// Get 'ping_timeout' in seconds from table (the connection is considered dead if no PONG arrives in time)
+	var pingTimeout time.Duration
+	if timeout, ok := serverSettings.RawGetString("ping_timeout").(lua.LNumber); ok && timeout > 0 {
+		pingTimeout = time.Duration(float64(timeout) * float64(time.Second))
+	}
+
+	// Get 'registration_timeout' in seconds from table
+	var registrationTimeout time.Duration
+	if timeout, ok := serverSettings.RawGetString("registration_timeout").(lua.LNumber); ok && timeout > 0 {
+		registrationTimeout = time.Duration(float64(timeout) * float64(time.Second))
+	}
+
+	// Get 'oper_name', 'oper_password' & 'oper_modes' strings from table
+	operName := lua.LVAsString(serverSettings.RawGetString("oper_name"))
+	operPassword := lua.LVAsString(serverSettings.RawGetString("oper_password"))
+	operModes := lua.LVAsString(serverSettings.RawGetString("oper_modes"))
+
+	// Get 'perform' list of raw commands from table (sent after registration)
+	var perform []string
+	if performTbl, ok := serverSettings.RawGetString("perform").(*lua.LTable); ok {
+		performTbl.ForEach(func(key lua.LValue, lineLV lua.LValue) {
+			line := lua.LVAsString(lineLV)
+			if err := client.ValidatePerformCommand(line); err != nil {
+				log.Printf("Lua reload error: ignoring perform command %s: %s", key, err)
+				return
+			}
+			perform = append(perform, line)
+		})
+	}
+
+	// Get 'reconnect' strategy from table
+	reconnect := b.reconnectStrategyFromLua(serverSettings.RawGetString("reconnect"), b.reconnectStrategy)
+
+	// Get 'capabilities' list from table
+	var capabilities []string
+	if capsTbl, ok := serverSettings.RawGetString("capabilities").(*lua.LTable); ok {
+		capsTbl.ForEach(func(_ lua.LValue, capLV lua.LValue) {
+			capabilities = append(capabilities, lua.LVAsString(capLV))
+		})
+	}
+	// Negotiate 'server_time' unless disabled so handlers see when messages were sent
+	if serverSettings.RawGetString("server_time") != lua.LFalse && !containsString(capabilities, "server-time") {
+		capabilities = append(capabilities, "server-time")
+	}
+	// Negotiate capabilities telling accounts of users unless 'accounts' is disabled
+	if serverSettings.RawGetString("accounts") != lua.LFalse {
+		for _, capability := range accountCapabilities {
+			if !containsString(capabilities, capability) {
+				capabilities = append(capabilities, capability)
+			}
+		}
+	}
+	// Negotiate capabilities completing NAMES unless 'full_names' is disabled
+	if serverSettings.RawGetString("full_names") != lua.LFalse {
+		for _, capability := range namesCapabilities {
+			if !containsString(capabilities, capability) {
+				capabilities = append(capabilities, capability)
+			}
+		}
+	}
+	// Negotiate 'away-notify' unless 'away_notify' is disabled so away status of members is tracked
+	if serverSettings.RawGetString("away_notify") != lua.LFalse && !containsString(capabilities, awayCapability) {
+		capabilities = append(capabilities, awayCapability)
+	}
+	// Negotiate 'echo_message' if enabled so handlers for ECHO learn which of our messages were delivered
+	if serverSettings.RawGetString("echo_message") == lua.LTrue && !containsString(capabilities, echoCapability) {
+		capabilities = append(capabilities, echoCapability)
+	}
+
+	// Get 'alt_nicks' list from table (tried in turn if our nick is in use)
+	var altNicks []string
+	if altNicksTbl, ok := serverSettings.RawGetString("alt_nicks").(*lua.LTable); ok {
+		altNicksTbl.ForEach(func(_ lua.LValue, nickLV lua.LValue) {
+			altNicks = append(altNicks, lua.LVAsString(nickLV))
+		})
+	}
+
+	// Get 'password' string from table (sent as PASS)
+	password := lua.LVAsString(serverSettings.RawGetString("password"))
+
+	// Get 'registration_order' list from table
+	var registrationOrder []string
+	if orderTbl, ok := serverSettings.RawGetString("registration_order").(*lua.LTable); ok {
+		orderTbl.ForEach(func(_ lua.LValue, stepLV lua.LValue) {
+			registrationOrder = append(registrationOrder, lua.LVAsString(stepLV))
+		})
+		if err := client.ValidateRegistrationOrder(registrationOrder); err != nil {
+			log.Printf("Lua reload error: ignoring invalid registration_order: %s", err)
+			registrationOrder = nil
+		}
+	}
+
+	// Get 'sasl' table from table
+	var saslMechanism, saslUser, saslPassword string
+	var saslRetries int
+	var saslRetryDelay time.Duration
+	if saslTbl, ok := serverSettings.RawGetString("sasl").(*lua.LTable); ok {
+		switch mechanism := strings.ToUpper(lua.LVAsString(saslTbl.RawGetString("mechanism"))); mechanism {
+		case "", client.SASLPlain:
+		case client.SASLExternal:
+			saslMechanism = mechanism
+			if !tls || len(tlsCert) == 0 {
+				log.Printf("Lua reload error: SASL %s requires tls and tls_cert", mechanism)
+			}
+		default:
+			log.Printf("Lua reload error: ignoring unsupported SASL mechanism: %s", mechanism)
+		}
+		saslUser = lua.LVAsString(saslTbl.RawGetString("user"))
+		saslPassword = lua.LVAsString(saslTbl.RawGetString("password"))
+		if retries, ok := saslTbl.RawGetString("retries").(lua.LNumber); ok && retries > 0 {
+			saslRetries = int(retries)
+		}
+		if delay, ok := saslTbl.RawGetString("retry_delay").(lua.LNumber); ok && delay > 0 {
+			saslRetryDelay = time.Duration(float64(delay) * float64(time.Second))
+		}
+	}
+
+	// Get 'webirc' table from table (password, gateway, host and ip of the user we relay for)
+	var webircPassword, webircGateway, webircHost, webircIP string
+	if webircTbl, ok := serverSettings.RawGetString("webirc").(*lua.LTable); ok {
+		webircPassword = lua.LVAsString(webircTbl.RawGetString("password"))
+		webircGateway = lua.LVAsString(webircTbl.RawGetString("gateway"))
+		webircIP = lua.LVAsString(webircTbl.RawGetString("ip"))
+		webircHost = lua.LVAsString(webircTbl.RawGetString("host"))
+		// Host defaults to the IP address
+		if len(webircHost) == 0 {
+			webircHost = webircIP
+		}
+		// Parameters can't contain spaces and only addresses may start with a colon
+		if len(webircPassword) == 0 || len(webircGateway) == 0 || net.ParseIP(webircIP) == nil ||
+			strings.Contains(webircPassword+webircGateway+webircHost, " ") ||
+			strings.HasPrefix(webircPassword, ":") || strings.HasPrefix(webircGateway, ":") {
+			log.Printf("Lua reload error: ignoring webirc which requires password, gateway and ip")
+			webircPassword, webircGateway, webircHost, webircIP = "", "", "", ""
+		}
+	}
+
+	// Get 'nickserv_password' and 'nickserv_regain' from table
+	nickServPassword := lua.LVAsString(serverSettings.RawGetString("nickserv_password"))
+	nickServRegain := strings.ToUpper(lua.LVAsString(serverSettings.RawGetString("nickserv_regain")))
+	if err := client.ValidateNickServRegain(nickServRegain); err != nil {
+		log.Printf("Lua reload error: %s", err)
+		nickServRegain = ""
+	}
+
+	// Get 'encoding' string from table
+	encoding := lua.LVAsString(serverSettings.RawGetString("encoding"))
+	if _, err := client.LookupEncoding(encoding); err != nil {
+		log.Printf("Lua reload error: ignoring %s", err)
+		encoding = ""
+	}
+
+	// Get 'bind_address' string from table
+	bindAddress := lua.LVAsString(serverSettings.RawGetString("bind_address"))
+	if err := client.ValidateBindAddress(bindAddress); err != nil {
+		log.Printf("Lua reload error: ignoring %s", err)
+		bindAddress = ""
+	}
+
+	// Get 'family' string from table
+	family := strings.ToLower(lua.LVAsString(serverSettings.RawGetString("family")))
+	if err := client.ValidateFamily(family); err != nil {
+		log.Printf("Lua reload error: ignoring %s", err)
+		family = ""
+	}
+
+	// Get 'proxy_url' string from table
+	proxyURL := lua.LVAsString(serverSettings.RawGetString("proxy_url"))
+	if len(proxyURL) > 0 {
+		if err := client.ValidateProxyURL(proxyURL); err != nil {
+			log.Printf("Lua reload error: ignoring proxy_url: %s", err)
+			proxyURL = ""
+		}
+	}
+
+	// Get 'usermodes' string from table
+	userModes := lua.LVAsString(serverSettings.RawGetString("usermodes"))
+	if len(userModes) > 0 && !userModesRegexp.MatchString(userModes) {
+		log.Printf("Lua reload error: ignoring invalid usermodes: %s", userModes)
+		userModes = ""
+	}
+
+	return &client.IrcServerSettings{
+		AltNicks:            altNicks,
+		BindAddress:         bindAddress,
+		Capabilities:        capabilities,
+		Encoding:            encoding,
+		Family:              family,
+		Host:                host,
+		Port:                portInt,
+		TLS:                 tls,
+		TLSCA:               tlsCA,
+		TLSCert:             tlsCert,
+		TLSCipherSuites:     tlsCipherSuites,
+		TLSKey:              tlsKey,
+		TLSMinVersion:       tlsMinVersion,
+		TLSPin:              tlsPin,
+		VerifyTLS:           verifyTLS,
+		Nick:                nick,
+		MaxReconnect:        float64(b.Config.MaxReconnect),
+		NickServPassword:    nickServPassword,
+		NickServRegain:      nickServRegain,
+		OperModes:           operModes,
+		OperName:            operName,
+		OperPassword:        operPassword,
+		Password:            password,
+		Perform:             perform,
+		PingInterval:        pingInterval,
+		PingTimeout:         pingTimeout,
+		ProxyURL:            proxyURL,
+		Realname:            realname,
+		Reconnect:           reconnect,
+		RegistrationOrder:   registrationOrder,
+		RegistrationTimeout: registrationTimeout,
+		SASLMechanism:       saslMechanism,
+		SASLPassword:        saslPassword,
+		SASLRetries:         saslRetries,
+		SASLRetryDelay:      saslRetryDelay,
+		SASLUser:            saslUser,
+		UserModes:           userModes,
+		Username:            username,
+		WebIRCGateway:       webircGateway,
+		WebIRCHost:          webircHost,
+		WebIRCIP:            webircIP,
+		WebIRCPassword:      webircPassword,
+		BatchCallback:       b.HandleBatch,
+		ErrorCallback:       b.HandleErrors,
+		InputCallback:       b.HandleHandlers,
+		ReconnectCallback:   b.handleReconnect,
+		STSCallback:         b.handleSTSPolicy,
+		STSLookup:           b.lookupSTSPolicy,
+	}
+}
+
+// sameServerSettings returns true if servers with these settings don't need to be recreated
+func sameServerSettings(oldSettings *client.IrcServerSettings, newSettings *client.IrcServerSettings) bool {
+	return sameStrings(oldSettings.AltNicks, newSettings.AltNicks) &&
+		oldSettings.BindAddress == newSettings.BindAddress &&
+		sameStrings(oldSettings.Capabilities, newSettings.Capabilities) &&
+		oldSettings.Encoding == newSettings.Encoding &&
+		oldSettings.Family == newSettings.Family &&
+		oldSettings.Host == newSettings.Host &&
+		oldSettings.Port == newSettings.Port &&
+		oldSettings.TLS == newSettings.TLS &&
+		oldSettings.TLSCA == newSettings.TLSCA &&
+		oldSettings.TLSCert == newSettings.TLSCert &&
+		sameStrings(oldSettings.TLSCipherSuites, newSettings.TLSCipherSuites) &&
+		oldSettings.TLSKey == newSettings.TLSKey &&
+		oldSettings.TLSMinVersion == newSettings.TLSMinVersion &&
+		oldSettings.TLSPin == newSettings.TLSPin &&
+		oldSettings.VerifyTLS == newSettings.VerifyTLS &&
+		oldSettings.Nick == newSettings.Nick &&
+		oldSettings.NickServPassword == newSettings.NickServPassword &&
+		oldSettings.NickServRegain == newSettings.NickServRegain &&
+		oldSettings.OperModes == newSettings.OperModes &&
+		oldSettings.OperName == newSettings.OperName &&
+		oldSettings.OperPassword == newSettings.OperPassword &&
+		oldSettings.Password == newSettings.Password &&
+		sameStrings(oldSettings.Perform, newSettings.Perform) &&
+		oldSettings.PingInterval == newSettings.PingInterval &&
+		oldSettings.PingTimeout == newSettings.PingTimeout &&
+		oldSettings.ProxyURL == newSettings.ProxyURL &&
+		oldSettings.Realname == newSettings.Realname &&
+		sameReconnectStrategy(oldSettings.Reconnect, newSettings.Reconnect) &&
+		sameStrings(oldSettings.RegistrationOrder, newSettings.RegistrationOrder) &&
+		oldSettings.RegistrationTimeout == newSettings.RegistrationTimeout &&
+		oldSettings.SASLMechanism == newSettings.SASLMechanism &&
+		oldSettings.SASLPassword == newSettings.SASLPassword &&
+		oldSettings.SASLRetries == newSettings.SASLRetries &&
+		oldSettings.SASLRetryDelay == newSettings.SASLRetryDelay &&
+		oldSettings.SASLUser == newSettings.SASLUser &&
+		oldSettings.UserModes == newSettings.UserModes &&
+		oldSettings.Username == newSettings.Username &&
+		oldSettings.WebIRCGateway == newSettings.WebIRCGateway &&
+		oldSettings.WebIRCHost == newSettings.WebIRCHost &&
+		oldSettings.WebIRCIP == newSettings.WebIRCIP &&
+		oldSettings.WebIRCPassword == newSettings.WebIRCPassword
+}
+
+// sameStrings returns true if both slices contain the same strings in the same order
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// containsString returns true if list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// quitMessage returns the reason sent in QUIT when disconnecting from a server (empty for the default)
+func (b *BananaBoatBot) quitMessage(svrName string) string {
+	b.handlersMutex.RLock()
+	defer b.handlersMutex.RUnlock()
+	return b.quitMessages[svrName]
+}
@@ -0,0 +1,136 @@
+package bot
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// defaultServicesPackage is used if no services package is configured for a server
+	defaultServicesPackage = "atheme"
+)
+
+// servicesPackages maps names of services packages to templates of commands sent to services
+// Templates consist of the name of the service followed by the command; {N} is replaced with the Nth argument after net
+var servicesPackages = map[string]map[string]string{
+	"anope": {
+		"chanserv_deop":     "ChanServ DEOP {1} {2}",
+		"chanserv_devoice":  "ChanServ DEVOICE {1} {2}",
+		"chanserv_invite":   "ChanServ INVITE {1}",
+		"chanserv_op":       "ChanServ OP {1} {2}",
+		"chanserv_unban":    "ChanServ UNBAN {1}",
+		"chanserv_voice":    "ChanServ VOICE {1} {2}",
+		"memoserv_send":     "MemoServ SEND {1} {2}",
+		"nickserv_identify": "NickServ IDENTIFY {1}",
+		"nickserv_regain":   "NickServ RECOVER {1} {2}",
+	},
+	"atheme": {
+		"chanserv_deop":     "ChanServ DEOP {1} {2}",
+		"chanserv_devoice":  "ChanServ DEVOICE {1} {2}",
+		"chanserv_invite":   "ChanServ INVITE {1}",
+		"chanserv_op":       "ChanServ OP {1} {2}",
+		"chanserv_unban":    "ChanServ UNBAN {1}",
+		"chanserv_voice":    "ChanServ VOICE {1} {2}",
+		"memoserv_send":     "MemoServ SEND {1} {2}",
+		"nickserv_identify": "NickServ IDENTIFY {1}",
+		"nickserv_regain":   "NickServ REGAIN {1} {2}",
+	},
+}
+
+// servicesPlaceholderRegexp matches placeholders for arguments in services templates
+var servicesPlaceholderRegexp = regexp.MustCompile(`\{([0-9]+)\}`)
+
+// servicesFromLua reads services templates for a server from Lua
+// Settings may be the name of a services package or a table with 'package' and templates overriding it
+func servicesFromLua(lv lua.LValue) map[string]string {
+	pkgName := defaultServicesPackage
+	var overrides *lua.LTable
+	switch lv := lv.(type) {
+	case lua.LString:
+		pkgName = string(lv)
+	case *lua.LTable:
+		if pkgLV, ok := lv.RawGetString("package").(lua.LString); ok {
+			pkgName = string(pkgLV)
+		}
+		overrides = lv
+	}
+	pkg, ok := servicesPackages[pkgName]
+	if !ok {
+		log.Printf("Lua reload error: unknown services package: %s", pkgName)
+		pkg = servicesPackages[defaultServicesPackage]
+	}
+	templates := make(map[string]string, len(pkg))
+	for name, template := range pkg {
+		templates[name] = template
+	}
+	if overrides != nil {
+		overrides.ForEach(func(name lua.LValue, template lua.LValue) {
+			if _, ok := pkg[lua.LVAsString(name)]; !ok {
+				return
+			}
+			templates[lua.LVAsString(name)] = lua.LVAsString(template)
+		})
+	}
+	return templates
+}
+
+// servicesTemplate returns the template of a services command for a server
+func (b *BananaBoatBot) servicesTemplate(svrName string, name string) string {
+	b.handlersMutex.RLock()
+	defer b.handlersMutex.RUnlock()
+	if templates, ok := b.services[svrName]; ok {
+		return templates[name]
+	}
+	return servicesPackages[defaultServicesPackage][name]
+}
+
+// expandServicesTemplate returns the target and text of a message to services
+func expandServicesTemplate(template string, args []string) (string, string) {
+	expanded := servicesPlaceholderRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		i, _ := strconv.Atoi(placeholder[1 : len(placeholder)-1])
+		if i < 1 || i > len(args) {
+			return ""
+		}
+		return args[i-1]
+	})
+	expanded = strings.TrimSpace(expanded)
+	fields := strings.SplitN(expanded, " ", 2)
+	if len(fields) < 2 {
+		return fields[0], ""
+	}
+	return fields[0], strings.TrimSpace(fields[1])
+}
+
+// luaLibServices returns a Lua function returning a message to services for a template
+func (b *BananaBoatBot) luaLibServices(name string) lua.LGFunction {
+	// Number of arguments after net is that of the highest placeholder in the default template
+	numArgs := 0
+	for _, m := range servicesPlaceholderRegexp.FindAllStringSubmatch(servicesPackages[defaultServicesPackage][name], -1) {
+		if i, _ := strconv.Atoi(m[1]); i > numArgs {
+			numArgs = i
+		}
+	}
+	return func(luaState *lua.LState) int {
+		svrName := luaState.CheckString(1)
+		args := make([]string, numArgs)
+		for i := range args {
+			args[i] = luaState.CheckString(i + 2)
+		}
+		target, text := expandServicesTemplate(b.servicesTemplate(svrName, name), args)
+		// Return message in the form returned by handlers
+		messageT := luaState.CreateTable(0, 3)
+		messageT.RawSetString("command", lua.LString(irc.PRIVMSG))
+		messageT.RawSetString("net", lua.LString(svrName))
+		paramsT := luaState.CreateTable(2, 0)
+		paramsT.Append(lua.LString(target))
+		paramsT.Append(lua.LString(text))
+		messageT.RawSetString("params", paramsT)
+		luaState.Push(messageT)
+		return 1
+	}
+}
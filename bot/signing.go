@@ -0,0 +1,120 @@
+package bot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultSignatureMaxAge is how long signed messages are accepted for if not specified
+	defaultSignatureMaxAge = 5 * time.Minute
+	// signaturePrefix marks the signature appended to signed messages
+	signaturePrefix = "bbsig:"
+)
+
+// hmacSHA256 returns the hex-encoded HMAC-SHA256 of data
+func hmacSHA256(key string, data string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedData returns the data covered by the signature of a message
+func signedData(timestamp string, nonce string, payload string) string {
+	return fmt.Sprintf("%s:%s:%s", timestamp, nonce, payload)
+}
+
+// signMessage appends a signature consisting of timestamp, nonce and HMAC to a payload
+func signMessage(secret string, payload string, now time.Time) (string, error) {
+	nonceBytes := make([]byte, 8)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmacSHA256(secret, signedData(timestamp, nonce, payload))
+	return fmt.Sprintf("%s %s%s:%s:%s", payload, signaturePrefix, timestamp, nonce, mac), nil
+}
+
+// verifyMessage checks the signature of a signed message and returns its payload
+// Nonces of accepted messages are remembered in seen so messages can't be replayed
+func verifyMessage(secret string, signed string, maxAge time.Duration, now time.Time, seen *cooldowns) (string, error) {
+	i := strings.LastIndex(signed, " ")
+	if i < 0 || !strings.HasPrefix(signed[i+1:], signaturePrefix) {
+		return "", errors.New("missing signature")
+	}
+	payload := signed[:i]
+	fields := strings.Split(signed[i+1+len(signaturePrefix):], ":")
+	if len(fields) != 3 {
+		return "", errors.New("malformed signature")
+	}
+	timestamp, nonce, mac := fields[0], fields[1], fields[2]
+	expected := hmacSHA256(secret, signedData(timestamp, nonce, payload))
+	if !hmac.Equal([]byte(mac), []byte(expected)) {
+		return "", errors.New("bad signature")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+	// Allow for clock skew in both directions
+	age := now.Sub(time.Unix(unix, 0))
+	if age > maxAge || age < -maxAge {
+		return "", errors.New("signature expired")
+	}
+	// Remember nonce for as long as the message could still be accepted
+	if seen.remaining(nonce) > 0 {
+		return "", errors.New("replayed signature")
+	}
+	seen.set(nonce, 2*maxAge)
+	return payload, nil
+}
+
+// luaLibHMACSHA256 returns the hex-encoded HMAC-SHA256 of a string
+func (b *BananaBoatBot) luaLibHMACSHA256(luaState *lua.LState) int {
+	key := luaState.CheckString(1)
+	data := luaState.CheckString(2)
+	luaState.Push(lua.LString(hmacSHA256(key, data)))
+	return 1
+}
+
+// luaLibSignMessage returns a payload with a signature appended
+func (b *BananaBoatBot) luaLibSignMessage(luaState *lua.LState) int {
+	secret := luaState.CheckString(1)
+	payload := luaState.CheckString(2)
+	signed, err := signMessage(secret, payload, time.Now())
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	luaState.Push(lua.LString(signed))
+	return 1
+}
+
+// luaLibVerifyMessage returns the payload of a signed message or nil and an error
+func (b *BananaBoatBot) luaLibVerifyMessage(luaState *lua.LState) int {
+	secret := luaState.CheckString(1)
+	signed := luaState.CheckString(2)
+	maxAge := defaultSignatureMaxAge
+	if seconds := luaState.OptNumber(3, 0); seconds > 0 {
+		maxAge = time.Duration(float64(seconds) * float64(time.Second))
+	}
+	payload, err := verifyMessage(secret, signed, maxAge, time.Now(), b.nonces)
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	luaState.Push(lua.LString(payload))
+	return 1
+}
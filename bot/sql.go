@@ -0,0 +1,269 @@
+package bot
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// maxSQLRows is the maximum number of rows returned by a query
+	maxSQLRows = 1000
+	// sqlStatementType is the name of the metatable of prepared statements
+	sqlStatementType = "bananaboat.sql.statement"
+	// sqlTimeout is how long a statement may run
+	sqlTimeout = 10 * time.Second
+)
+
+// errNoSQL is returned by SQL functions if no SQL database is configured
+var errNoSQL = errors.New("no SQL database configured")
+
+// sqlStatement is a prepared statement used by scripts
+type sqlStatement struct {
+	stmt *sql.Stmt
+}
+
+// sqlContext returns a context limiting how long a statement run by a Lua state may take
+func sqlContext(luaState *lua.LState) (context.Context, context.CancelFunc) {
+	ctx := luaState.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithTimeout(ctx, sqlTimeout)
+}
+
+// sqlArgs converts parameters from index n onwards to values bound to placeholders
+func sqlArgs(luaState *lua.LState, n int) []interface{} {
+	var args []interface{}
+	for i := n; i <= luaState.GetTop(); i++ {
+		switch v := luaState.Get(i).(type) {
+		case *lua.LNilType:
+			args = append(args, nil)
+		case lua.LBool:
+			args = append(args, bool(v))
+		case lua.LNumber:
+			f := float64(v)
+			if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+				args = append(args, int64(f))
+			} else {
+				args = append(args, f)
+			}
+		case lua.LString:
+			args = append(args, string(v))
+		default:
+			luaState.ArgError(i, fmt.Sprintf("unsupported type: %s", v.Type()))
+		}
+	}
+	return args
+}
+
+// sqlValue converts a column value to a Lua value
+func sqlValue(v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case []byte:
+		return lua.LString(v)
+	case string:
+		return lua.LString(v)
+	case time.Time:
+		return lua.LNumber(float64(v.UnixNano()) / float64(time.Second))
+	}
+	return lua.LString(fmt.Sprint(v))
+}
+
+// pushSQLRows pushes a list of rows as tables mapping column names to values
+func pushSQLRows(luaState *lua.LState, rows *sql.Rows) int {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	res := luaState.NewTable()
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for count := 0; rows.Next(); count++ {
+		if count == maxSQLRows {
+			return pushError(luaState, fmt.Errorf("too many rows (maximum is %d)", maxSQLRows))
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return pushError(luaState, err)
+		}
+		row := luaState.CreateTable(0, len(columns))
+		for i, column := range columns {
+			row.RawSetString(column, sqlValue(values[i]))
+		}
+		res.Append(row)
+	}
+	if err := rows.Err(); err != nil {
+		return pushError(luaState, err)
+	}
+	luaState.Push(res)
+	return 1
+}
+
+// pushSQLResult pushes the number of rows affected and the id of the last inserted row
+func pushSQLResult(luaState *lua.LState, res sql.Result) int {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	// Not every statement inserts a row
+	id, _ := res.LastInsertId()
+	luaState.Push(lua.LNumber(affected))
+	luaState.Push(lua.LNumber(id))
+	return 2
+}
+
+// luaLibSQLExec runs a statement returning the number of rows affected and the id of the last inserted row
+func (b *BananaBoatBot) luaLibSQLExec(luaState *lua.LState) int {
+	query := luaState.CheckString(1)
+	args := sqlArgs(luaState, 2)
+	luaState.SetTop(0)
+	if b.Config.SQL == nil {
+		return pushError(luaState, errNoSQL)
+	}
+	ctx, cancel := sqlContext(luaState)
+	defer cancel()
+	res, err := b.Config.SQL.ExecContext(ctx, query, args...)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	return pushSQLResult(luaState, res)
+}
+
+// luaLibSQLQuery runs a query returning a list of rows
+func (b *BananaBoatBot) luaLibSQLQuery(luaState *lua.LState) int {
+	query := luaState.CheckString(1)
+	args := sqlArgs(luaState, 2)
+	luaState.SetTop(0)
+	if b.Config.SQL == nil {
+		return pushError(luaState, errNoSQL)
+	}
+	ctx, cancel := sqlContext(luaState)
+	defer cancel()
+	rows, err := b.Config.SQL.QueryContext(ctx, query, args...)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	return pushSQLRows(luaState, rows)
+}
+
+// luaLibSQLPrepare returns a prepared statement with exec, query and close methods
+func (b *BananaBoatBot) luaLibSQLPrepare(luaState *lua.LState) int {
+	query := luaState.CheckString(1)
+	luaState.SetTop(0)
+	if b.Config.SQL == nil {
+		return pushError(luaState, errNoSQL)
+	}
+	ctx, cancel := sqlContext(luaState)
+	defer cancel()
+	stmt, err := b.Config.SQL.PrepareContext(ctx, query)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	s := &sqlStatement{stmt: stmt}
+	// Statements are closed on reload in case scripts don't close them
+	b.sqlStatements.Store(s, struct{}{})
+	ud := luaState.NewUserData()
+	ud.Value = s
+	luaState.SetMetatable(ud, b.sqlStatementMetatable(luaState))
+	luaState.Push(ud)
+	return 1
+}
+
+// sqlStatementMetatable returns the metatable of prepared statements in a Lua state
+func (b *BananaBoatBot) sqlStatementMetatable(luaState *lua.LState) lua.LValue {
+	if mt := luaState.GetTypeMetatable(sqlStatementType); mt != lua.LNil {
+		return mt
+	}
+	mt := luaState.NewTypeMetatable(sqlStatementType)
+	luaState.SetField(mt, "__index", luaState.SetFuncs(luaState.NewTable(), map[string]lua.LGFunction{
+		"close": b.luaLibSQLStatementClose,
+		"exec":  luaLibSQLStatementExec,
+		"query": luaLibSQLStatementQuery,
+	}))
+	return mt
+}
+
+// checkSQLStatement returns the prepared statement which is the first parameter
+func checkSQLStatement(luaState *lua.LState) *sqlStatement {
+	ud := luaState.CheckUserData(1)
+	if s, ok := ud.Value.(*sqlStatement); ok {
+		return s
+	}
+	luaState.ArgError(1, "prepared statement expected")
+	return nil
+}
+
+// luaLibSQLStatementExec runs a prepared statement like exec
+func luaLibSQLStatementExec(luaState *lua.LState) int {
+	s := checkSQLStatement(luaState)
+	args := sqlArgs(luaState, 2)
+	luaState.SetTop(0)
+	ctx, cancel := sqlContext(luaState)
+	defer cancel()
+	res, err := s.stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	return pushSQLResult(luaState, res)
+}
+
+// luaLibSQLStatementQuery runs a prepared query like query
+func luaLibSQLStatementQuery(luaState *lua.LState) int {
+	s := checkSQLStatement(luaState)
+	args := sqlArgs(luaState, 2)
+	luaState.SetTop(0)
+	ctx, cancel := sqlContext(luaState)
+	defer cancel()
+	rows, err := s.stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return pushError(luaState, err)
+	}
+	return pushSQLRows(luaState, rows)
+}
+
+// luaLibSQLStatementClose closes a prepared statement
+func (b *BananaBoatBot) luaLibSQLStatementClose(luaState *lua.LState) int {
+	s := checkSQLStatement(luaState)
+	luaState.SetTop(0)
+	b.sqlStatements.Delete(s)
+	if err := s.stmt.Close(); err != nil {
+		return pushError(luaState, err)
+	}
+	luaState.Push(lua.LTrue)
+	return 1
+}
+
+// closeSQLStatements closes prepared statements left open by scripts
+func (b *BananaBoatBot) closeSQLStatements() {
+	b.sqlStatements.Range(func(key, _ interface{}) bool {
+		b.sqlStatements.Delete(key)
+		key.(*sqlStatement).stmt.Close()
+		return true
+	})
+}
+
+// sqlModule returns a table of SQL functions
+func (b *BananaBoatBot) sqlModule(luaState *lua.LState) *lua.LTable {
+	return luaState.SetFuncs(luaState.NewTable(), map[string]lua.LGFunction{
+		"exec":    b.luaLibSQLExec,
+		"prepare": b.luaLibSQLPrepare,
+		"query":   b.luaLibSQLQuery,
+	})
+}
@@ -0,0 +1,288 @@
+package bot
+
+import (
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+)
+
+// getServerState returns state of the named server or nil if it isn't configured
+func (b *BananaBoatBot) getServerState(svrName string) *client.ServerState {
+	svr, ok := b.Servers.Load(svrName)
+	if !ok {
+		return nil
+	}
+	return svr.(client.IrcServerInterface).GetState()
+}
+
+// prefixLength returns the length of the prefix servers add when relaying our messages (0 if unknown)
+func (b *BananaBoatBot) prefixLength(svrName string) int {
+	state := b.getServerState(svrName)
+	if state == nil {
+		return 0
+	}
+	return state.PrefixLength()
+}
+
+// luaLibInChannel returns true if we have joined a channel on a server
+func (b *BananaBoatBot) luaLibInChannel(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	channel := luaState.CheckString(2)
+	state := b.getServerState(svrName)
+	luaState.Push(lua.LBool(state != nil && state.InChannel(channel)))
+	return 1
+}
+
+// luaLibCapabilities returns a list of IRCv3 capabilities enabled on a server or nil if it isn't configured
+func (b *BananaBoatBot) luaLibCapabilities(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	state := b.getServerState(svrName)
+	if state == nil {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	caps := state.Capabilities()
+	res := luaState.CreateTable(len(caps), 0)
+	for _, capability := range caps {
+		res.Append(lua.LString(capability))
+	}
+	luaState.Push(res)
+	return 1
+}
+
+// luaLibChannelForward returns the channel we were forwarded to when joining a channel or nil
+func (b *BananaBoatBot) luaLibChannelForward(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	channel := luaState.CheckString(2)
+	state := b.getServerState(svrName)
+	if state == nil {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	to, ok := state.Forwarded(channel)
+	if !ok {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LString(to))
+	return 1
+}
+
+// luaLibLag returns lag to a server in milliseconds or nil if unknown
+func (b *BananaBoatBot) luaLibLag(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	state := b.getServerState(svrName)
+	if state == nil || state.Lag() == 0 {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LNumber(state.Lag().Milliseconds()))
+	return 1
+}
+
+// luaLibMOTD returns the message of the day of a server or nil if it wasn't received yet
+func (b *BananaBoatBot) luaLibMOTD(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	state := b.getServerState(svrName)
+	if state == nil {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	motd, ok := state.MOTD()
+	if !ok {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LString(motd))
+	return 1
+}
+
+// luaLibMembers returns a list of members of a channel we have joined as tables of nick and prefix
+// (such as "@") ordered by nick or nil if we haven't joined it
+func (b *BananaBoatBot) luaLibMembers(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	channel := luaState.CheckString(2)
+	state := b.getServerState(svrName)
+	if state == nil || !state.InChannel(channel) {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	members := state.Members(channel)
+	res := luaState.CreateTable(len(members), 0)
+	for _, member := range members {
+		memberT := luaState.CreateTable(0, 7)
+		memberT.RawSetString("nick", lua.LString(member.Nick))
+		memberT.RawSetString("prefix", lua.LString(member.Prefix))
+		if len(member.Host) > 0 {
+			memberT.RawSetString("user", lua.LString(member.User))
+			memberT.RawSetString("host", lua.LString(member.Host))
+		}
+		if len(member.Account) > 0 {
+			memberT.RawSetString("account", lua.LString(member.Account))
+		}
+		if len(member.Away) > 0 {
+			memberT.RawSetString("away", lua.LString(member.Away))
+		}
+		if len(member.Realname) > 0 {
+			memberT.RawSetString("realname", lua.LString(member.Realname))
+		}
+		res.Append(memberT)
+	}
+	luaState.Push(res)
+	return 1
+}
+
+// luaLibTopic returns the topic of a channel we have joined, who set it and when (nil if unknown)
+func (b *BananaBoatBot) luaLibTopic(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	channel := luaState.CheckString(2)
+	state := b.getServerState(svrName)
+	if state == nil {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	topic, ok := state.ChannelTopic(channel)
+	if !ok || len(topic.Text) == 0 {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LString(topic.Text))
+	if len(topic.SetBy) == 0 {
+		luaState.Push(lua.LNil)
+	} else {
+		luaState.Push(lua.LString(topic.SetBy))
+	}
+	if topic.SetAt.IsZero() {
+		luaState.Push(lua.LNil)
+	} else {
+		luaState.Push(lua.LNumber(topic.SetAt.Unix()))
+	}
+	return 3
+}
+
+// luaLibHasOp returns true if nick is an operator (or higher) of a channel we have joined
+func (b *BananaBoatBot) luaLibHasOp(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	channel := luaState.CheckString(2)
+	nick := luaState.CheckString(3)
+	state := b.getServerState(svrName)
+	luaState.Push(lua.LBool(state != nil && state.HasOp(channel, nick)))
+	return 1
+}
+
+// luaLibChannelModes returns the modes set on a channel we have joined such as "+kl key 10" (nil if unknown)
+func (b *BananaBoatBot) luaLibChannelModes(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	channel := luaState.CheckString(2)
+	state := b.getServerState(svrName)
+	if state == nil {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	modes := state.ChannelModes(channel)
+	if len(modes) == 0 {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LString(modes))
+	return 1
+}
+
+// isupportValue converts the value of a feature for Lua (true if it was advertised without a value)
+func isupportValue(value string) lua.LValue {
+	if len(value) == 0 {
+		return lua.LTrue
+	}
+	return lua.LString(value)
+}
+
+// luaLibISupport returns the value of a feature advertised by a server in RPL_ISUPPORT (nil if it wasn't)
+// or a table of all features if no key is given
+func (b *BananaBoatBot) luaLibISupport(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	key := luaState.OptString(2, "")
+	state := b.getServerState(svrName)
+	if state == nil {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	if len(key) > 0 {
+		value, ok := state.ISupport(key)
+		if !ok {
+			luaState.Push(lua.LNil)
+			return 1
+		}
+		luaState.Push(isupportValue(value))
+		return 1
+	}
+	features := state.ISupportAll()
+	res := luaState.CreateTable(0, len(features))
+	for key, value := range features {
+		res.RawSetString(key, isupportValue(value))
+	}
+	luaState.Push(res)
+	return 1
+}
+
+// foldCase normalises a nick or channel name using the CASEMAPPING of a server (rfc1459 if unknown)
+func (b *BananaBoatBot) foldCase(svrName string, s string) string {
+	state := b.getServerState(svrName)
+	if state == nil {
+		return client.FoldCase(client.CaseMappingRFC1459, s)
+	}
+	return state.FoldCase(s)
+}
+
+// luaLibCaseFold returns a nick or channel name normalised using the CASEMAPPING of a server
+func (b *BananaBoatBot) luaLibCaseFold(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	s := luaState.CheckString(2)
+	luaState.Push(lua.LString(b.foldCase(svrName, s)))
+	return 1
+}
+
+// luaLibNamesEqual returns true if two nicks or channel names are equal under the CASEMAPPING of a server
+func (b *BananaBoatBot) luaLibNamesEqual(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	a := luaState.CheckString(2)
+	other := luaState.CheckString(3)
+	luaState.Push(lua.LBool(b.foldCase(svrName, a) == b.foldCase(svrName, other)))
+	return 1
+}
+
+// namesCapabilities make NAMES list all membership prefixes and the user and host of members
+var namesCapabilities = []string{"multi-prefix", "userhost-in-names"}
+
+// accountCapabilities tell which services accounts users are logged in to
+var accountCapabilities = []string{"account-notify", "account-tag", "extended-join"}
+
+// luaLibAccount returns the services account a nick (the sender of the current message by default) is logged
+// in to or nil if they aren't or it is unknown
+func (b *BananaBoatBot) luaLibAccount(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	nick := luaState.OptString(2, "")
+	if len(nick) == 0 {
+		curNet, msg := b.currentMessage(luaState)
+		if msg == nil || msg.Prefix == nil || curNet != svrName {
+			luaState.Push(lua.LNil)
+			return 1
+		}
+		nick = msg.Prefix.Name
+		// The account tag of the message is the most recent information
+		if account, ok := b.currentTags(luaState)["account"]; ok {
+			luaState.Push(lua.LString(account))
+			return 1
+		}
+	}
+	state := b.getServerState(svrName)
+	if state == nil {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	account, ok := state.Account(nick)
+	if !ok {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LString(account))
+	return 1
+}
@@ -0,0 +1,71 @@
+package bot
+
+import (
+	"github.com/yuin/gopher-lua"
+)
+
+// levenshtein returns the edit distance between two strings
+func levenshtein(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+	// Keep only two rows of the distance matrix
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			// Minimum of deletion, insertion & substitution
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// luaLibLevenshtein returns the edit distance between two strings
+func (b *BananaBoatBot) luaLibLevenshtein(luaState *lua.LState) int {
+	first := luaState.CheckString(1)
+	second := luaState.CheckString(2)
+	luaState.Push(lua.LNumber(levenshtein(first, second)))
+	return 1
+}
+
+// luaLibClosest returns the candidate closest to input and its distance
+func (b *BananaBoatBot) luaLibClosest(luaState *lua.LState) int {
+	input := luaState.CheckString(1)
+	candidates := luaState.CheckTable(2)
+	var best string
+	bestDistance := -1
+	candidates.ForEach(func(index lua.LValue, candidateL lua.LValue) {
+		candidate, ok := candidateL.(lua.LString)
+		if !ok {
+			return
+		}
+		distance := levenshtein(input, string(candidate))
+		if bestDistance == -1 || distance < bestDistance {
+			best = string(candidate)
+			bestDistance = distance
+		}
+	})
+	// No candidates were found
+	if bestDistance == -1 {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	luaState.Push(lua.LString(best))
+	luaState.Push(lua.LNumber(bestDistance))
+	return 2
+}
@@ -0,0 +1,93 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+)
+
+// STSBucket is the store bucket holding strict transport security policies of hosts
+const STSBucket = "sts"
+
+// stsKey returns the key of the policy of a host
+func stsKey(host string) string {
+	return strings.ToLower(host)
+}
+
+// lookupSTSPolicy returns the policy of a host if it hasn't expired, loading persisted ones
+func (b *BananaBoatBot) lookupSTSPolicy(host string) (client.STSPolicy, bool) {
+	key := stsKey(host)
+	if p, ok := b.stsPolicies.Load(key); ok {
+		policy := p.(client.STSPolicy)
+		// Policies received over insecure connections last until we are restarted
+		if policy.Expires.IsZero() || time.Now().Before(policy.Expires) {
+			return policy, true
+		}
+		b.forgetSTSPolicy(host)
+		return client.STSPolicy{}, false
+	}
+	if b.Config.Store == nil {
+		return client.STSPolicy{}, false
+	}
+	v, err := b.Config.Store.Get(STSBucket, key)
+	if err != nil {
+		log.Printf("Failed to load STS policy of %s: %s", host, err)
+		return client.STSPolicy{}, false
+	}
+	if v == nil {
+		return client.STSPolicy{}, false
+	}
+	var policy client.STSPolicy
+	if err := json.Unmarshal(v, &policy); err != nil {
+		log.Printf("Failed to decode STS policy of %s: %s", host, err)
+		return client.STSPolicy{}, false
+	}
+	if !time.Now().Before(policy.Expires) {
+		b.forgetSTSPolicy(host)
+		return client.STSPolicy{}, false
+	}
+	b.stsPolicies.Store(key, policy)
+	return policy, true
+}
+
+// handleSTSPolicy records a policy advertised by a host over a secure connection, persisting it if we have a store
+func (b *BananaBoatBot) handleSTSPolicy(ctx context.Context, svrName string, host string, policy client.STSPolicy) {
+	if policy.Expires.IsZero() {
+		log.Printf("[%s] Removing STS policy of %s", svrName, host)
+		b.forgetSTSPolicy(host)
+		return
+	}
+	b.stsPolicies.Store(stsKey(host), policy)
+	if b.Config.Store == nil {
+		return
+	}
+	v, err := json.Marshal(&policy)
+	if err != nil {
+		log.Printf("[%s] Failed to encode STS policy: %s", svrName, err)
+		return
+	}
+	if err := b.Config.Store.Set(STSBucket, stsKey(host), v); err != nil {
+		log.Printf("[%s] Failed to save STS policy: %s", svrName, err)
+	}
+}
+
+// upgradeSTS makes future connections to a host use TLS on the port advertised over an insecure connection
+func (b *BananaBoatBot) upgradeSTS(svrName string, host string, port int) {
+	log.Printf("[%s] Upgrading connections to %s to TLS on port %d", svrName, host, port)
+	b.stsPolicies.Store(stsKey(host), client.STSPolicy{Port: port})
+}
+
+// forgetSTSPolicy removes the policy of a host
+func (b *BananaBoatBot) forgetSTSPolicy(host string) {
+	b.stsPolicies.Delete(stsKey(host))
+	if b.Config.Store == nil {
+		return
+	}
+	if err := b.Config.Store.Delete(STSBucket, stsKey(host)); err != nil {
+		log.Printf("Failed to remove STS policy of %s: %s", host, err)
+	}
+}
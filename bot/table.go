@@ -0,0 +1,220 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultTableLineLength is the default maximum length of lines produced by format_table
+	defaultTableLineLength = 400
+	// defaultTableMaxLines is the default maximum number of lines produced by format_table (as many as can
+	// be queued for a server at once)
+	defaultTableMaxLines = client.MessageQueueSize
+	// ellipsis marks truncated text
+	ellipsis = "…"
+)
+
+// tableOptions describe how format_table lays out a table
+type tableOptions struct {
+	// align maps column indexes to "left" (default) or "right"
+	align map[int]string
+	// box draws borders using box-drawing characters
+	box bool
+	// header is set if the first row is a header which is separated from other rows
+	header bool
+	// maxLine is the maximum length of a line in bytes
+	maxLine int
+	// maxLines is the maximum number of lines including borders and the note about omitted rows
+	maxLines int
+	// maxWidth is the maximum width of a column in characters (0 is unlimited)
+	maxWidth int
+	// separator separates columns if borders aren't drawn
+	separator string
+}
+
+// tableOptionsFromLua reads options for format_table from Lua
+func tableOptionsFromLua(tbl *lua.LTable) *tableOptions {
+	opts := &tableOptions{
+		align:     make(map[int]string),
+		maxLine:   defaultTableLineLength,
+		maxLines:  defaultTableMaxLines,
+		separator: "  ",
+	}
+	if tbl == nil {
+		return opts
+	}
+	opts.box = lua.LVAsString(tbl.RawGetString("style")) == "box"
+	opts.header = lua.LVAsBool(tbl.RawGetString("header"))
+	if n, ok := tbl.RawGetString("max_line").(lua.LNumber); ok && n > 0 {
+		opts.maxLine = int(n)
+	}
+	if n, ok := tbl.RawGetString("max_lines").(lua.LNumber); ok && n > 0 {
+		opts.maxLines = int(n)
+	}
+	if n, ok := tbl.RawGetString("max_width").(lua.LNumber); ok && n > 0 {
+		opts.maxWidth = int(n)
+	}
+	if sep, ok := tbl.RawGetString("separator").(lua.LString); ok {
+		opts.separator = string(sep)
+	}
+	if alignTbl, ok := tbl.RawGetString("align").(*lua.LTable); ok {
+		alignTbl.ForEach(func(k lua.LValue, v lua.LValue) {
+			if n, ok := k.(lua.LNumber); ok {
+				opts.align[int(n)-1] = lua.LVAsString(v)
+			}
+		})
+	}
+	return opts
+}
+
+// truncateText shortens text to at most width characters marking it as truncated
+func truncateText(text string, width int) string {
+	if utf8.RuneCountInString(text) <= width {
+		return text
+	}
+	if width < 1 {
+		return ""
+	}
+	runes := []rune(text)
+	return string(runes[:width-1]) + ellipsis
+}
+
+// truncateBytes shortens text to at most limit bytes without splitting characters
+func truncateBytes(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	limit -= len(ellipsis)
+	for limit > 0 && !utf8.RuneStart(text[limit]) {
+		limit--
+	}
+	if limit < 0 {
+		return ""
+	}
+	return text[:limit] + ellipsis
+}
+
+// padText pads text with spaces to width characters
+func padText(text string, width int, align string) string {
+	padding := strings.Repeat(" ", width-utf8.RuneCountInString(text))
+	if align == "right" {
+		return padding + text
+	}
+	return text + padding
+}
+
+// formatTable lays out rows of cells as aligned lines of text, omitting rows which don't fit in maxLines
+// (at least one row is kept, so with borders and the note about omitted rows there may be more lines)
+func formatTable(rows [][]string, opts *tableOptions) []string {
+	// Borders and the header separator take lines too
+	overhead := 0
+	if opts.box {
+		overhead += 2
+	}
+	if opts.header && len(rows) > 1 {
+		overhead++
+	}
+	omitted := 0
+	if overhead+len(rows) > opts.maxLines {
+		// Keep a line to tell how many rows were omitted
+		keep := opts.maxLines - overhead - 1
+		if keep < 1 {
+			keep = 1
+		}
+		omitted = len(rows) - keep
+		rows = rows[:keep]
+	}
+	// Calculate width of columns
+	var widths []int
+	for i, row := range rows {
+		for j, cell := range row {
+			if opts.maxWidth > 0 {
+				cell = truncateText(cell, opts.maxWidth)
+				rows[i][j] = cell
+			}
+			if j >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(cell); n > widths[j] {
+				widths[j] = n
+			}
+		}
+	}
+	// rule draws a horizontal border using the given characters
+	rule := func(left string, middle string, right string) string {
+		parts := make([]string, len(widths))
+		for j, width := range widths {
+			parts[j] = strings.Repeat("─", width+2)
+		}
+		return left + strings.Join(parts, middle) + right
+	}
+	var lines []string
+	if opts.box {
+		lines = append(lines, rule("┌", "┬", "┐"))
+	}
+	for i, row := range rows {
+		cells := make([]string, len(widths))
+		for j, width := range widths {
+			var cell string
+			if j < len(row) {
+				cell = row[j]
+			}
+			cells[j] = padText(cell, width, opts.align[j])
+		}
+		if opts.box {
+			lines = append(lines, "│ "+strings.Join(cells, " │ ")+" │")
+		} else {
+			lines = append(lines, strings.TrimRight(strings.Join(cells, opts.separator), " "))
+		}
+		if i == 0 && opts.header && len(rows) > 1 {
+			if opts.box {
+				lines = append(lines, rule("├", "┼", "┤"))
+			} else {
+				lines = append(lines, strings.Repeat("-", utf8.RuneCountInString(strings.Join(cells, opts.separator))))
+			}
+		}
+	}
+	if opts.box {
+		lines = append(lines, rule("└", "┴", "┘"))
+	}
+	if omitted > 0 {
+		lines = append(lines, fmt.Sprintf("%s %d more rows", ellipsis, omitted))
+	}
+	for i, line := range lines {
+		lines[i] = truncateBytes(line, opts.maxLine)
+	}
+	return lines
+}
+
+// luaLibFormatTable lays out a table of rows as aligned lines of text
+func (b *BananaBoatBot) luaLibFormatTable(luaState *lua.LState) int {
+	rowsTbl := luaState.CheckTable(1)
+	opts := tableOptionsFromLua(luaState.OptTable(2, nil))
+	var rows [][]string
+	for i := 1; i <= rowsTbl.MaxN(); i++ {
+		var row []string
+		if rowTbl, ok := rowsTbl.RawGetInt(i).(*lua.LTable); ok {
+			for j := 1; j <= rowTbl.MaxN(); j++ {
+				// Cells are converted like tostring would do (but nil is empty)
+				cell := rowTbl.RawGetInt(j)
+				if cell == lua.LNil {
+					row = append(row, "")
+				} else {
+					row = append(row, cell.String())
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+	lines := luaState.CreateTable(len(rows), 0)
+	for _, line := range formatTable(rows, opts) {
+		lines.Append(lua.LString(line))
+	}
+	luaState.Push(lines)
+	return 1
+}
@@ -0,0 +1,118 @@
+package bot
+
+import (
+	"log"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// defaultTags are the tags of inbound messages exposed to Lua unless configured otherwise
+var defaultTags = tagAllowlist{
+	"account": {},
+	"batch":   {},
+	"label":   {},
+	"msgid":   {},
+	"time":    {},
+}
+
+// tagAllowlist is a set of tags exposed to Lua (nil allows all tags)
+type tagAllowlist map[string]struct{}
+
+// tagAllowlistFromLua reads a tag allowlist from Lua: a list of tags or '*' for all tags
+func tagAllowlistFromLua(lv lua.LValue) tagAllowlist {
+	switch lv := lv.(type) {
+	case *lua.LNilType:
+		return defaultTags
+	case lua.LString:
+		if lv == "*" {
+			return nil
+		}
+	case *lua.LTable:
+		allowlist := make(tagAllowlist)
+		lv.ForEach(func(_ lua.LValue, tagLV lua.LValue) {
+			allowlist[lua.LVAsString(tagLV)] = struct{}{}
+		})
+		return allowlist
+	}
+	log.Printf("Lua reload error: ignoring invalid tags allowlist: %s", lv)
+	return defaultTags
+}
+
+// allowedTags returns the tags of a message from a server which are exposed to Lua
+func (b *BananaBoatBot) allowedTags(svrName string, tags map[string]string) map[string]string {
+	b.handlersMutex.RLock()
+	allowlist, ok := b.tagAllowlists[svrName]
+	b.handlersMutex.RUnlock()
+	if !ok {
+		allowlist = defaultTags
+	}
+	if allowlist == nil {
+		return tags
+	}
+	allowed := make(map[string]string)
+	for k, v := range tags {
+		if _, ok := allowlist[k]; ok {
+			allowed[k] = v
+		}
+	}
+	return allowed
+}
+
+// luaLibTags returns a table of allowed tags of the current message
+func (b *BananaBoatBot) luaLibTags(luaState *lua.LState) int {
+	tags := b.currentTags(luaState)
+	tagsT := luaState.CreateTable(0, len(tags))
+	for k, v := range tags {
+		tagsT.RawSetString(k, lua.LString(v))
+	}
+	luaState.Push(tagsT)
+	return 1
+}
+
+// luaLibBatch returns the type and a list of parameters of an open batch given its reference tag
+// (the batch of the current message by default) or nil if there is no such batch
+func (b *BananaBoatBot) luaLibBatch(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	ref := luaState.OptString(2, b.currentTags(luaState)["batch"])
+	state := b.getServerState(svrName)
+	if state == nil || len(ref) == 0 {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	batch, ok := state.OpenBatch(ref)
+	if !ok {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	paramsT := luaState.CreateTable(len(batch.Params), 0)
+	for _, param := range batch.Params {
+		paramsT.Append(lua.LString(param))
+	}
+	luaState.Push(lua.LString(batch.Type))
+	luaState.Push(paramsT)
+	return 2
+}
+
+// luaLibRequest returns the command and a list of parameters of a labeled request we sent given its label
+// (the label of the current message by default) or nil if it is unknown
+func (b *BananaBoatBot) luaLibRequest(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	label := luaState.OptString(2, b.currentTags(luaState)["label"])
+	state := b.getServerState(svrName)
+	if state == nil || len(label) == 0 {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	req, ok := state.LabeledRequest(label)
+	if !ok {
+		luaState.Push(lua.LNil)
+		return 1
+	}
+	paramsT := luaState.CreateTable(len(req.Params), 0)
+	for _, param := range req.Params {
+		paramsT.Append(lua.LString(param))
+	}
+	luaState.Push(lua.LString(req.Command))
+	luaState.Push(paramsT)
+	return 2
+}
@@ -0,0 +1,310 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// maxTimers is the maximum number of pending timers
+	maxTimers = 1000
+	// maxTimerDelay is the longest a timer may wait
+	maxTimerDelay = 366 * 24 * time.Hour
+)
+
+// scheduledTimer is a function scheduled by timer or cron
+type scheduledTimer struct {
+	// mutex protects stopped & timer
+	mutex sync.Mutex
+	// stopped is set once the timer was cancelled
+	stopped bool
+	// timer fires when the function is next due
+	timer *time.Timer
+	// cron is the schedule of a periodic function (nil if it runs once)
+	cron *cronSchedule
+	// net is the server replies are sent to unless they specify one
+	net string
+	// proto is the function to run
+	proto *lua.FunctionProto
+	// params are copies of parameters passed to the function
+	params []lua.LValue
+	// generation is the reload generation of the script which started the timer
+	generation uint64
+}
+
+// stop cancels the timer, returning false if it was already stopped
+func (t *scheduledTimer) stop() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return true
+}
+
+// cronField is the set of values matched by one field of a cron schedule
+type cronField struct {
+	// values has bit n set if n is matched
+	values uint64
+	// any is set if the field was "*" (possibly with a step)
+	any bool
+}
+
+func (f cronField) matches(n int) bool {
+	return f.values&(1<<uint(n)) != 0
+}
+
+// cronSchedule is a parsed "minute hour day-of-month month day-of-week" schedule
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+}
+
+// cronBounds are the minimum and maximum values of each field of a cron schedule
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCronField parses a comma-separated list of "*", numbers or ranges each optionally followed by "/step"
+func parseCronField(s string, min, max int) (cronField, error) {
+	var f cronField
+	for _, part := range strings.Split(s, ",") {
+		rangeStr, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return f, fmt.Errorf("invalid step: %s", part)
+			}
+			rangeStr = part[:i]
+		}
+		lo, hi := min, max
+		switch {
+		case rangeStr == "*":
+			f.any = true
+		case strings.Contains(rangeStr, "-"):
+			bounds := strings.SplitN(rangeStr, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil || lo > hi {
+				return f, fmt.Errorf("invalid range: %s", part)
+			}
+		default:
+			n, err := strconv.Atoi(rangeStr)
+			if err != nil {
+				return f, fmt.Errorf("invalid value: %s", part)
+			}
+			lo = n
+			// "n/step" means from n to the maximum
+			if step == 1 {
+				hi = n
+			}
+		}
+		if lo < min || hi > max {
+			return f, fmt.Errorf("value out of range (%d-%d): %s", min, max, part)
+		}
+		for n := lo; n <= hi; n += step {
+			f.values |= 1 << uint(n)
+		}
+	}
+	return f, nil
+}
+
+// parseCron parses a schedule of five fields: minute, hour, day of month, month and day of week (0 or 7 is Sunday)
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("expected 5 fields (minute hour day-of-month month day-of-week)")
+	}
+	var parsed [5]cronField
+	for i, field := range fields {
+		var err error
+		parsed[i], err = parseCronField(field, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Sunday can be written as 7
+	if parsed[4].matches(7) {
+		parsed[4].values |= 1
+	}
+	return &cronSchedule{minute: parsed[0], hour: parsed[1], dom: parsed[2], month: parsed[3], dow: parsed[4]}, nil
+}
+
+// matchesDay returns true if the schedule runs on the day of t
+// As in cron if both day of month and day of week are restricted either may match
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom, dow := c.dom.matches(t.Day()), c.dow.matches(int(t.Weekday()))
+	if c.dom.any || c.dow.any {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t the schedule runs or the zero time if it never does
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Schedules such as February 30th never run, give up after a few years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !c.month.matches(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !c.hour.matches(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !c.minute.matches(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// scheduleTimer starts calling a function from a pooled Lua state after delay and returns its id
+func (b *BananaBoatBot) scheduleTimer(luaState *lua.LState, delay time.Duration, cron *cronSchedule, proto *lua.FunctionProto, params []lua.LValue) (uint64, error) {
+	generation := b.currentGeneration(luaState)
+	if generation != atomic.LoadUint64(&b.generation) {
+		return 0, errors.New("script was reloaded")
+	}
+	// Slot is reserved first so concurrent callers can't exceed the limit
+	if atomic.AddInt32(&b.timersPending, 1) > maxTimers {
+		atomic.AddInt32(&b.timersPending, -1)
+		return 0, fmt.Errorf("too many timers (maximum is %d)", maxTimers)
+	}
+	curNet, _ := b.currentMessage(luaState)
+	t := &scheduledTimer{cron: cron, net: curNet, proto: proto, params: params, generation: generation}
+	id := atomic.AddUint64(&b.timerID, 1)
+	// Timer is set before it can be stopped and stored before it can fire
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.timer = time.AfterFunc(delay, func() { b.fireTimer(id, t) })
+	b.timers.Store(id, t)
+	return id, nil
+}
+
+// fireTimer runs a scheduled function, rescheduling it if it is periodic
+func (b *BananaBoatBot) fireTimer(id uint64, t *scheduledTimer) {
+	t.mutex.Lock()
+	if t.stopped {
+		t.mutex.Unlock()
+		return
+	}
+	// Timers started by workers of a script which was since reloaded are dropped
+	if t.generation != atomic.LoadUint64(&b.generation) {
+		t.stopped = true
+		t.mutex.Unlock()
+		b.forgetTimer(id)
+		return
+	}
+	var next time.Time
+	if t.cron != nil {
+		next = t.cron.next(time.Now())
+	}
+	// Schedule next run before this one so slow functions don't delay it
+	if next.IsZero() {
+		t.stopped = true
+	} else {
+		t.timer = time.AfterFunc(time.Until(next), func() { b.fireTimer(id, t) })
+	}
+	t.mutex.Unlock()
+	if next.IsZero() {
+		b.forgetTimer(id)
+	}
+	// Parameters are copied again for each run so runs don't share tables
+	params := t.params
+	if t.cron != nil {
+		seen := make(map[*lua.LTable]*lua.LTable)
+		params = make([]lua.LValue, len(t.params))
+		for i, v := range t.params {
+			params[i], _ = copyWorkerValue(b.luaState, v, seen, 0)
+		}
+	}
+	b.runWorker(&messageContext{net: t.net, generation: t.generation}, t.proto, params)
+}
+
+// forgetTimer removes a timer which won't run again
+func (b *BananaBoatBot) forgetTimer(id uint64) {
+	if _, ok := b.timers.LoadAndDelete(id); ok {
+		atomic.AddInt32(&b.timersPending, -1)
+	}
+}
+
+// cancelTimer cancels a timer, returning false if there is no such timer
+func (b *BananaBoatBot) cancelTimer(id uint64) bool {
+	t, ok := b.timers.Load(id)
+	if !ok || !t.(*scheduledTimer).stop() {
+		return false
+	}
+	b.forgetTimer(id)
+	return true
+}
+
+// stopTimers cancels all timers
+func (b *BananaBoatBot) stopTimers() {
+	b.timers.Range(func(key, _ interface{}) bool {
+		b.cancelTimer(key.(uint64))
+		return true
+	})
+}
+
+// luaLibTimer runs a function with the given parameters once after a number of seconds
+func (b *BananaBoatBot) luaLibTimer(luaState *lua.LState) int {
+	seconds := float64(luaState.CheckNumber(1))
+	if seconds < 0 || seconds > maxTimerDelay.Seconds() {
+		luaState.ArgError(1, "invalid number of seconds")
+	}
+	luaFunction := checkWorkerFunction(luaState, 2)
+	luaParams := copyWorkerParams(luaState, 3, make(map[*lua.LTable]*lua.LTable))
+	id, err := b.scheduleTimer(luaState, time.Duration(seconds*float64(time.Second)), nil, luaFunction.Proto, luaParams)
+	luaState.SetTop(0)
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	luaState.Push(lua.LNumber(id))
+	return 1
+}
+
+// luaLibCron runs a function with the given parameters periodically according to a cron schedule
+func (b *BananaBoatBot) luaLibCron(luaState *lua.LState) int {
+	cron, err := parseCron(luaState.CheckString(1))
+	if err != nil {
+		luaState.ArgError(1, err.Error())
+	}
+	luaFunction := checkWorkerFunction(luaState, 2)
+	luaParams := copyWorkerParams(luaState, 3, make(map[*lua.LTable]*lua.LTable))
+	next := cron.next(time.Now())
+	if next.IsZero() {
+		luaState.ArgError(1, "schedule never runs")
+	}
+	id, err := b.scheduleTimer(luaState, time.Until(next), cron, luaFunction.Proto, luaParams)
+	luaState.SetTop(0)
+	if err != nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString(err.Error()))
+		return 2
+	}
+	luaState.Push(lua.LNumber(id))
+	return 1
+}
+
+// luaLibCancelTimer cancels a timer started by timer or cron, returning false if there is no such timer
+func (b *BananaBoatBot) luaLibCancelTimer(luaState *lua.LState) int {
+	id := luaState.CheckInt64(1)
+	luaState.SetTop(0)
+	luaState.Push(lua.LBool(id > 0 && b.cancelTimer(uint64(id))))
+	return 1
+}
@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	// defaultChanTypes is used if the server didn't advertise CHANTYPES
+	defaultChanTypes = "#&"
+)
+
+// nickRegexp matches nicknames allowed by RFC 2812
+var nickRegexp = regexp.MustCompile(`^[A-Za-z\[\]\\` + "`" + `_^{|}][A-Za-z0-9\[\]\\` + "`" + `_^{|}-]*$`)
+
+// isupportInt returns an integer feature advertised by the server or 0 if it wasn't
+func isupportInt(state *client.ServerState, key string) int {
+	if state == nil {
+		return 0
+	}
+	value, ok := state.ISupport(key)
+	if !ok {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+// isValidNick returns true if s is a valid nickname no longer than nickLen (if set)
+func isValidNick(s string, nickLen int) bool {
+	if nickLen > 0 && len(s) > nickLen {
+		return false
+	}
+	return nickRegexp.MatchString(s)
+}
+
+// isValidChannel returns true if s is a valid channel name given the server's channel types and length limit (if set)
+func isValidChannel(s string, chanTypes string, chanLen int) bool {
+	if len(s) < 2 || !strings.ContainsAny(s[:1], chanTypes) {
+		return false
+	}
+	if chanLen > 0 && len(s) > chanLen {
+		return false
+	}
+	// Space, comma, BEL, NUL and line breaks are never allowed
+	return !strings.ContainsAny(s, " ,\x07\x00\r\n")
+}
+
+// luaLibIsValidNick returns true if a string is a valid nickname on a server
+func (b *BananaBoatBot) luaLibIsValidNick(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	s := luaState.CheckString(2)
+	state := b.getServerState(svrName)
+	luaState.Push(lua.LBool(isValidNick(s, isupportInt(state, "NICKLEN"))))
+	return 1
+}
+
+// luaLibIsValidChannel returns true if a string is a valid channel name on a server
+func (b *BananaBoatBot) luaLibIsValidChannel(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	s := luaState.CheckString(2)
+	state := b.getServerState(svrName)
+	chanTypes := defaultChanTypes
+	if state != nil {
+		if value, ok := state.ISupport("CHANTYPES"); ok {
+			chanTypes = value
+		}
+	}
+	luaState.Push(lua.LBool(isValidChannel(s, chanTypes, isupportInt(state, "CHANLEN"))))
+	return 1
+}
@@ -0,0 +1,327 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/client"
+	"github.com/yuin/gopher-lua"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// whoisTimeout is how long we wait for the server to finish replying to WHOIS
+	whoisTimeout = 30 * time.Second
+	// maxWhoisRequests is the number of WHOIS requests waiting for replies at once
+	maxWhoisRequests = 20
+	// rplWhoisAccount tells the account a user is logged in to
+	rplWhoisAccount = "330"
+	// rplWhoisActually tells the real host or IP address of a user
+	rplWhoisActually = "338"
+	// rplWhoisHost tells the real host or IP address of a user (on other servers)
+	rplWhoisHost = "378"
+	// rplWhoisSecure tells that a user is connected using TLS
+	rplWhoisSecure = "671"
+)
+
+// errWhoisTimeout is passed to WHOIS callbacks if the server didn't reply in time
+var errWhoisTimeout = errors.New("timed out")
+
+// whoisRequest collects replies to WHOIS for callbacks
+type whoisRequest struct {
+	// callbacks are called with the result (several scripts may ask about the same nick)
+	callbacks []*lua.LFunction
+	// finished is set once the request is removed and its callbacks are called
+	finished bool
+	// mutex protects the request
+	mutex sync.Mutex
+	// result holds the fields collected so far
+	result whoisResult
+	// timer reports a timeout if the server doesn't finish replying
+	timer *time.Timer
+}
+
+// addCallback adds a callback to a request unless it has finished
+func (req *whoisRequest) addCallback(callback *lua.LFunction) bool {
+	req.mutex.Lock()
+	defer req.mutex.Unlock()
+	if req.finished {
+		return false
+	}
+	req.callbacks = append(req.callbacks, callback)
+	return true
+}
+
+// whoisResult is what WHOIS told us about a user
+type whoisResult struct {
+	account    string
+	actualHost string
+	away       string
+	channels   []string
+	host       string
+	idle       int64
+	nick       string
+	operator   bool
+	realname   string
+	secure     bool
+	server     string
+	serverInfo string
+	signon     int64
+	user       string
+}
+
+// whoisKey returns the key of WHOIS requests about nick on a server
+func whoisKey(svrName string, nick string) string {
+	return svrName + " " + strings.ToLower(nick)
+}
+
+// table describes the result for Lua
+func (r *whoisResult) table(luaState *lua.LState) *lua.LTable {
+	resultT := luaState.CreateTable(0, 14)
+	resultT.RawSetString("nick", lua.LString(r.nick))
+	resultT.RawSetString("user", lua.LString(r.user))
+	resultT.RawSetString("host", lua.LString(r.host))
+	resultT.RawSetString("realname", lua.LString(r.realname))
+	resultT.RawSetString("server", lua.LString(r.server))
+	resultT.RawSetString("server_info", lua.LString(r.serverInfo))
+	resultT.RawSetString("operator", lua.LBool(r.operator))
+	resultT.RawSetString("secure", lua.LBool(r.secure))
+	channelsT := luaState.CreateTable(len(r.channels), 0)
+	for _, channel := range r.channels {
+		channelsT.Append(lua.LString(channel))
+	}
+	resultT.RawSetString("channels", channelsT)
+	// Fields the server didn't tell us about are nil
+	if len(r.account) > 0 {
+		resultT.RawSetString("account", lua.LString(r.account))
+	}
+	if len(r.actualHost) > 0 {
+		resultT.RawSetString("actual_host", lua.LString(r.actualHost))
+	}
+	if len(r.away) > 0 {
+		resultT.RawSetString("away", lua.LString(r.away))
+	}
+	if r.signon > 0 {
+		resultT.RawSetString("idle", lua.LNumber(r.idle))
+		resultT.RawSetString("signon", lua.LNumber(r.signon))
+	}
+	return resultT
+}
+
+// handleWhois collects replies to WHOIS requested by scripts and calls their callbacks once complete
+func (b *BananaBoatBot) handleWhois(ctx context.Context, svrName string, msg *irc.Message) {
+	// Replies to labeled requests tell which nick was asked about (or that they reply to something else)
+	labeled := client.RequestFromContext(ctx)
+	if labeled != nil && (labeled.Command != irc.WHOIS || len(labeled.Params) == 0) {
+		return
+	}
+	// The labeled-response batch ended without the server finishing replying
+	if msg.Command == client.BatchCommand {
+		if labeled == nil || len(msg.Params) == 0 || !strings.HasPrefix(msg.Params[0], "-") {
+			return
+		}
+		nick := labeled.Params[len(labeled.Params)-1]
+		key := whoisKey(svrName, nick)
+		if reqI, ok := b.whoisRequests.Load(key); ok {
+			b.finishWhois(ctx, svrName, nick, key, reqI.(*whoisRequest), errors.New("no reply"))
+		}
+		return
+	}
+	// Parameters are our nick, the nick asked about and the information
+	if len(msg.Params) < 2 {
+		return
+	}
+	nick := msg.Params[1]
+	if labeled != nil {
+		nick = labeled.Params[len(labeled.Params)-1]
+	}
+	key := whoisKey(svrName, nick)
+	reqI, ok := b.whoisRequests.Load(key)
+	if !ok {
+		return
+	}
+	req := reqI.(*whoisRequest)
+	params := msg.Params[2:]
+	req.mutex.Lock()
+	r := &req.result
+	switch msg.Command {
+	case irc.RPL_WHOISUSER:
+		// Parameters are the nick, user, host, '*' and real name
+		r.nick = msg.Params[1]
+		if len(params) >= 3 {
+			r.user = params[0]
+			r.host = params[1]
+			r.realname = params[len(params)-1]
+		}
+	case irc.RPL_WHOISSERVER:
+		if len(params) >= 2 {
+			r.server = params[0]
+			r.serverInfo = params[1]
+		}
+	case irc.RPL_WHOISOPERATOR:
+		r.operator = true
+	case irc.RPL_WHOISIDLE:
+		// Parameters are seconds idle and (on most servers) when the user connected
+		if len(params) >= 2 {
+			r.idle, _ = strconv.ParseInt(params[0], 10, 64)
+			r.signon, _ = strconv.ParseInt(params[1], 10, 64)
+		}
+	case irc.RPL_WHOISCHANNELS:
+		// Channels may be prefixed by the user's status and span several replies
+		if len(params) >= 1 {
+			r.channels = append(r.channels, strings.Fields(params[len(params)-1])...)
+		}
+	case rplWhoisAccount:
+		if len(params) >= 2 {
+			r.account = params[0]
+		}
+	case rplWhoisActually, rplWhoisHost:
+		if len(params) >= 1 {
+			r.actualHost = whoisActualHost(params)
+		}
+	case rplWhoisSecure:
+		r.secure = true
+	case irc.RPL_AWAY:
+		if len(params) >= 1 {
+			r.away = params[len(params)-1]
+		}
+	case irc.ERR_NOSUCHNICK:
+		req.mutex.Unlock()
+		b.finishWhois(ctx, svrName, nick, key, req, errors.New("no such nick"))
+		return
+	case irc.RPL_ENDOFWHOIS:
+		req.mutex.Unlock()
+		b.finishWhois(ctx, svrName, nick, key, req, nil)
+		return
+	}
+	req.mutex.Unlock()
+}
+
+// whoisActualHost returns the host or IP address from the parameters of RPL_WHOISACTUALLY or RPL_WHOISHOST
+func whoisActualHost(params []string) string {
+	// RPL_WHOISACTUALLY has the address as parameter, RPL_WHOISHOST only has text ending in it
+	if len(params) > 1 {
+		return params[0]
+	}
+	fields := strings.Fields(params[0])
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
+// finishWhois removes a WHOIS request and passes its result (or err) to its callbacks
+func (b *BananaBoatBot) finishWhois(ctx context.Context, svrName string, nick string, key string, req *whoisRequest, err error) {
+	req.mutex.Lock()
+	// Request might have been finished by another reply or timed out
+	if req.finished {
+		req.mutex.Unlock()
+		return
+	}
+	req.finished = true
+	// Requests are only removed here while locked so the entry is still this request
+	b.whoisRequests.Delete(key)
+	req.timer.Stop()
+	callbacks := req.callbacks
+	result := req.result
+	req.mutex.Unlock()
+	b.handlersMutex.RLock()
+	maxMessages := b.maxMessages
+	b.handlersMutex.RUnlock()
+	b.luaMutex.Lock()
+	defer b.luaMutex.Unlock()
+	for _, callback := range callbacks {
+		// Replies go to the user asked about
+		b.curMessage = &irc.Message{
+			Command: irc.WHOIS,
+			Params:  []string{nick},
+		}
+		b.curNet = svrName
+		b.curTags = nil
+		b.curTime = time.Now()
+		args := []lua.LValue{lua.LString(svrName), lua.LString(nick)}
+		if err != nil {
+			args = append(args, lua.LNil, lua.LString(err.Error()))
+		} else {
+			args = append(args, result.table(b.luaState))
+		}
+		callErr := b.luaState.CallByParam(lua.P{
+			Fn:      callback,
+			NRet:    1,
+			Protect: true,
+		}, args...)
+		if callErr != nil {
+			log.Printf("[%s] WHOIS callback failed: %s", svrName, callErr)
+			b.luaState.SetTop(0)
+			continue
+		}
+		b.handleLuaReturnValues(ctx, svrName, b.luaState, maxMessages)
+		b.luaState.SetTop(0)
+	}
+}
+
+// luaLibWhois sends WHOIS and calls callback(net, nick, result) with the replies collected into a table
+// (or callback(net, nick, nil, err) if the nick doesn't exist or the server didn't reply in time)
+func (b *BananaBoatBot) luaLibWhois(luaState *lua.LState) int {
+	svrName := luaState.CheckString(1)
+	nick := luaState.CheckString(2)
+	callback := luaState.CheckFunction(3)
+	if len(nick) == 0 || strings.ContainsAny(nick, " ,*?") {
+		luaState.ArgError(2, "invalid nick")
+	}
+	if isDCCChat(svrName) || b.getServerState(svrName) == nil {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("invalid server"))
+		return 2
+	}
+	key := whoisKey(svrName, nick)
+	// Ask only once if several scripts ask about the same nick
+	if reqI, ok := b.whoisRequests.Load(key); ok && reqI.(*whoisRequest).addCallback(callback) {
+		luaState.Push(lua.LTrue)
+		return 1
+	}
+	pending := 0
+	b.whoisRequests.Range(func(_, _ interface{}) bool {
+		pending++
+		return true
+	})
+	if pending >= maxWhoisRequests {
+		luaState.Push(lua.LNil)
+		luaState.Push(lua.LString("too many WHOIS requests"))
+		return 2
+	}
+	req := &whoisRequest{callbacks: []*lua.LFunction{callback}}
+	ctx := b.luaState.Context()
+	// Replies and the timeout wait for the lock so the request isn't finished before it is stored
+	req.mutex.Lock()
+	req.timer = time.AfterFunc(whoisTimeout, func() {
+		b.finishWhois(ctx, svrName, nick, key, req, errWhoisTimeout)
+	})
+	for {
+		reqI, loaded := b.whoisRequests.LoadOrStore(key, req)
+		if !loaded {
+			break
+		}
+		// Another request was made meanwhile (finished ones are already removed)
+		if reqI.(*whoisRequest).addCallback(callback) {
+			// Our request was never stored so its timeout must not finish it
+			req.finished = true
+			req.timer.Stop()
+			req.mutex.Unlock()
+			luaState.Push(lua.LTrue)
+			return 1
+		}
+	}
+	req.mutex.Unlock()
+	b.sendMessage(svrName, &irc.Message{
+		Command: irc.WHOIS,
+		Params:  []string{nick},
+	})
+	luaState.Push(lua.LTrue)
+	return 1
+}
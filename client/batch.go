@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// BatchCommand starts or ends a batch
+	BatchCommand = "BATCH"
+	// BatchChatHistory is the type of batches replying to CHATHISTORY
+	BatchChatHistory = "chathistory"
+	// ChatHistory is the command requesting message history
+	ChatHistory = "CHATHISTORY"
+	// ChatHistoryAfter requests messages after a reference
+	ChatHistoryAfter = "AFTER"
+	// ChatHistoryBefore requests messages before a reference
+	ChatHistoryBefore = "BEFORE"
+	// ChatHistoryLatest requests the latest messages (after a reference if given)
+	ChatHistoryLatest = "LATEST"
+	// maxBatchMessages is the number of messages collected per batch, later ones are dropped
+	maxBatchMessages = 1000
+	// maxBatches is the number of batches collected at once, further ones aren't collected
+	maxBatches = 10
+	// maxOpenBatches is the number of open batches tracked at once, further ones aren't tracked
+	maxOpenBatches = 100
+)
+
+// chatHistoryCapabilities are capabilities which enable CHATHISTORY (the draft is still widely deployed)
+var chatHistoryCapabilities = []string{"chathistory", "draft/chathistory"}
+
+// BatchMessage is a message which was part of a batch
+type BatchMessage struct {
+	Message *irc.Message
+	// Tags of the message (nil if it had none)
+	Tags map[string]string
+	// Time the message was sent according to the server or when it was received
+	Time time.Time
+}
+
+// Batch is a batch of messages collected until it ended
+type Batch struct {
+	// Ref is the reference tag of the batch
+	Ref string
+	// Type of the batch
+	Type string
+	// Params are further parameters of the batch (the target for chathistory)
+	Params   []string
+	Messages []BatchMessage
+	// Dropped is the number of messages which exceeded maxBatchMessages
+	Dropped int
+}
+
+// ChatHistoryTimestamp returns a CHATHISTORY reference to a point in time
+func ChatHistoryTimestamp(t time.Time) string {
+	return "timestamp=" + t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// NewChatHistory returns a CHATHISTORY request for up to limit messages of target
+// Reference is "*" (only for LATEST), "timestamp=..." or "msgid=..."
+func NewChatHistory(subcommand string, target string, reference string, limit int) (*irc.Message, error) {
+	subcommand = strings.ToUpper(subcommand)
+	switch subcommand {
+	case ChatHistoryAfter, ChatHistoryBefore:
+		if reference == "*" {
+			return nil, fmt.Errorf("%s requires a reference", subcommand)
+		}
+	case ChatHistoryLatest:
+		if len(reference) == 0 {
+			reference = "*"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported subcommand: %s", subcommand)
+	}
+	if len(target) == 0 || strings.ContainsAny(target, " \r\n") {
+		return nil, fmt.Errorf("invalid target: %q", target)
+	}
+	if reference != "*" && !strings.HasPrefix(reference, "timestamp=") && !strings.HasPrefix(reference, "msgid=") {
+		return nil, fmt.Errorf("invalid reference: %q", reference)
+	}
+	if strings.ContainsAny(reference, " \r\n") {
+		return nil, fmt.Errorf("invalid reference: %q", reference)
+	}
+	if limit < 1 {
+		return nil, fmt.Errorf("invalid limit: %d", limit)
+	}
+	return &irc.Message{
+		Command: ChatHistory,
+		Params:  []string{subcommand, target, reference, fmt.Sprint(limit)},
+	}, nil
+}
+
+// SupportsChatHistory returns true if CHATHISTORY was enabled on the connection
+func (s *ServerState) SupportsChatHistory() bool {
+	if !s.HasCapability("batch") {
+		return false
+	}
+	for _, name := range chatHistoryCapabilities {
+		if s.HasCapability(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleBatch collects messages of chathistory batches returning true if msg was consumed
+// Replayed messages aren't handled like live ones (they would change state and trigger handlers) but are
+// delivered together by BatchCallback when the batch ends
+func (s *IrcServer) handleBatch(ctx context.Context, msg *irc.Message, tags map[string]string, t time.Time) bool {
+	if msg.Command == BatchCommand && len(msg.Params) > 0 && len(msg.Params[0]) > 1 {
+		ref := msg.Params[0][1:]
+		switch msg.Params[0][0] {
+		case '+':
+			// Parameters are the reference tag, type and type-specific parameters
+			if len(msg.Params) < 2 || msg.Params[1] != BatchChatHistory || s.Settings.BatchCallback == nil {
+				return false
+			}
+			if len(s.batches) >= maxBatches {
+				return false
+			}
+			if s.batches == nil {
+				s.batches = make(map[string]*Batch)
+			}
+			s.batches[ref] = &Batch{
+				Ref:    ref,
+				Type:   msg.Params[1],
+				Params: msg.Params[2:],
+			}
+			return true
+		case '-':
+			batch, ok := s.batches[ref]
+			if !ok {
+				return false
+			}
+			delete(s.batches, ref)
+			s.Settings.BatchCallback(ctx, s.name, batch)
+			return true
+		}
+		return false
+	}
+	batch, ok := s.batches[tags["batch"]]
+	if !ok {
+		return false
+	}
+	if len(batch.Messages) >= maxBatchMessages {
+		batch.Dropped++
+		return true
+	}
+	batch.Messages = append(batch.Messages, BatchMessage{
+		Message: msg,
+		Tags:    tags,
+		Time:    t,
+	})
+	return true
+}
+
+// trackBatch tracks batches which are open so handlers can tell which batch a message belongs to
+// (mutex must be held)
+func (st *ServerState) trackBatch(msg *irc.Message) {
+	if len(msg.Params) == 0 || len(msg.Params[0]) < 2 {
+		return
+	}
+	ref := msg.Params[0][1:]
+	switch msg.Params[0][0] {
+	case '+':
+		// Parameters are the reference tag, type and type-specific parameters
+		if len(msg.Params) < 2 || len(st.batches) >= maxOpenBatches {
+			return
+		}
+		st.batches[ref] = &Batch{
+			Ref:    ref,
+			Type:   msg.Params[1],
+			Params: msg.Params[2:],
+		}
+	case '-':
+		delete(st.batches, ref)
+	}
+}
+
+// OpenBatch returns the type and parameters (but no messages) of a batch which was started but didn't end yet
+func (st *ServerState) OpenBatch(ref string) (Batch, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	batch, ok := st.batches[ref]
+	if !ok {
+		return Batch{}, false
+	}
+	return Batch{Ref: batch.Ref, Type: batch.Type, Params: append([]string(nil), batch.Params...)}, true
+}
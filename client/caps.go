@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// Subcommands of CAP sent by servers supporting cap-notify (implied by CAP LS 302)
+const (
+	// capDEL announces capabilities which are no longer available
+	capDEL = "DEL"
+	// capNEW announces capabilities which became available
+	capNEW = "NEW"
+)
+
+// requestedCapabilities returns capabilities to request in the order they are requested
+// SASL is requested last so other capabilities are negotiated once authentication starts
+func (s *IrcServer) requestedCapabilities() []string {
+	var caps []string
+	for _, capability := range s.Settings.Capabilities {
+		if capability != "sasl" {
+			caps = append(caps, capability)
+		}
+	}
+	if s.usesSASL() {
+		caps = append(caps, "sasl")
+	}
+	return caps
+}
+
+// capRequests returns CAP REQ messages for requested capabilities supported by the server
+// Capabilities are requested separately as servers reject a request entirely if any is unsupported
+func (s *IrcServer) capRequests() []*irc.Message {
+	var messages []*irc.Message
+	for _, capability := range s.requestedCapabilities() {
+		if _, ok := s.capSupported[capability]; !ok {
+			log.Printf("[%s] Server doesn't support capability: %s", s.name, capability)
+			continue
+		}
+		messages = append(messages, &irc.Message{
+			Command: irc.CAP,
+			Params:  []string{irc.CAP_REQ, capability},
+		})
+	}
+	s.capPending = len(messages)
+	return messages
+}
+
+// handleCAPLS collects capabilities supported by the server and requests ours once the list is complete
+func (s *IrcServer) handleCAPLS(ctx context.Context, msg *irc.Message) {
+	if s.capSupported == nil {
+		s.capSupported = make(map[string]string)
+	}
+	// Lists spanning several messages have "*" before all but the last part
+	for _, token := range strings.Fields(msg.Params[len(msg.Params)-1]) {
+		kv := strings.SplitN(token, "=", 2)
+		value := ""
+		if len(kv) > 1 {
+			value = kv[1]
+		}
+		s.capSupported[kv[0]] = value
+	}
+	if len(msg.Params) > 3 && msg.Params[2] == "*" {
+		return
+	}
+	if value, ok := s.capSupported[stsCapability]; ok && s.handleSTS(ctx, value) {
+		return
+	}
+	requests := s.capRequests()
+	if len(requests) == 0 {
+		s.endNegotiation(ctx, true)
+		return
+	}
+	s.regState = regCapReq
+	for _, m := range requests {
+		s.sendNow(ctx, m)
+	}
+}
+
+// handleCAP reacts to replies to our capability negotiation
+func (s *IrcServer) handleCAP(ctx context.Context, msg *irc.Message) {
+	if len(msg.Params) < 3 {
+		return
+	}
+	switch {
+	case msg.Params[1] == irc.CAP_LS && s.regState == regCapLS:
+		s.handleCAPLS(ctx, msg)
+		return
+	case msg.Params[1] == capNEW:
+		s.handleCAPNew(ctx, msg)
+		return
+	case msg.Params[1] == capDEL:
+		log.Printf("[%s] Server no longer supports capabilities: %s", s.name, msg.Params[len(msg.Params)-1])
+		return
+	case s.regState != regCapReq || s.capPending == 0:
+		// Replies to requests made after registration are tracked by ServerState
+		if msg.Params[1] == irc.CAP_NAK {
+			log.Printf("[%s] Server refused capability: %s", s.name, msg.Params[len(msg.Params)-1])
+		}
+		return
+	}
+	capability := strings.TrimSpace(msg.Params[len(msg.Params)-1])
+	switch msg.Params[1] {
+	case irc.CAP_ACK:
+		s.capPending--
+		if capability == "sasl" {
+			// Negotiation ends once authentication is done
+			s.regState = regSASL
+			s.newSASLAttempt()
+			s.startSASL(ctx)
+			return
+		}
+	case irc.CAP_NAK:
+		s.capPending--
+		log.Printf("[%s] Server refused capability: %s", s.name, capability)
+	default:
+		return
+	}
+	if s.capPending == 0 {
+		s.endNegotiation(ctx, true)
+	}
+}
+
+// handleCAPNew requests capabilities we want which became available after registration
+func (s *IrcServer) handleCAPNew(ctx context.Context, msg *irc.Message) {
+	if s.regState != regNegotiated {
+		return
+	}
+	available := make(map[string]struct{})
+	for _, token := range strings.Fields(msg.Params[len(msg.Params)-1]) {
+		available[strings.SplitN(token, "=", 2)[0]] = struct{}{}
+	}
+	for _, capability := range s.Settings.Capabilities {
+		if _, ok := available[capability]; !ok || s.state.HasCapability(capability) {
+			continue
+		}
+		log.Printf("[%s] Requesting capability which became available: %s", s.name, capability)
+		s.sendNow(ctx, &irc.Message{
+			Command: irc.CAP,
+			Params:  []string{irc.CAP_REQ, capability},
+		})
+	}
+}
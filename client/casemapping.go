@@ -0,0 +1,66 @@
+package client
+
+import (
+	"strings"
+)
+
+const (
+	// CaseMappingASCII only folds the letters A to Z
+	CaseMappingASCII = "ascii"
+	// CaseMappingRFC1459 also folds []\~ to {}|^ (assumed if the server doesn't advertise CASEMAPPING)
+	CaseMappingRFC1459 = "rfc1459"
+	// CaseMappingStrictRFC1459 also folds []\ to {}|
+	CaseMappingStrictRFC1459 = "strict-rfc1459"
+	// CaseMappingRFC7613 folds Unicode (approximated by lower-casing)
+	CaseMappingRFC7613 = "rfc7613"
+)
+
+// FoldCase normalises a nick or channel name for comparison using a CASEMAPPING advertised by a server
+// Unknown case mappings are treated like rfc1459
+func FoldCase(caseMapping string, s string) string {
+	switch strings.ToLower(caseMapping) {
+	case CaseMappingRFC7613:
+		return strings.ToLower(s)
+	case CaseMappingASCII:
+		return foldBytes(s, 'Z')
+	case CaseMappingStrictRFC1459:
+		return foldBytes(s, ']')
+	default:
+		return foldBytes(s, '^')
+	}
+}
+
+// foldBytes lower-cases bytes from 'A' to last ('[' to '^' are the upper-case forms of '{' to '~')
+func foldBytes(s string, last byte) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= last {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// caseMapping returns the CASEMAPPING advertised by the server (mutex must be held)
+func (st *ServerState) caseMapping() string {
+	caseMapping, ok := st.isupport["CASEMAPPING"]
+	if !ok {
+		return CaseMappingRFC1459
+	}
+	return caseMapping
+}
+
+// FoldCase normalises a nick or channel name for comparison using the CASEMAPPING of the server
+func (st *ServerState) FoldCase(s string) string {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return FoldCase(st.caseMapping(), s)
+}
+
+// EqualFold returns true if two nicks or channel names are equal under the CASEMAPPING of the server
+func (st *ServerState) EqualFold(a string, b string) bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	caseMapping := st.caseMapping()
+	return FoldCase(caseMapping, a) == FoldCase(caseMapping, b)
+}
@@ -0,0 +1,419 @@
+package client
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// accountCommand tells that a user logged in to or out of a services account (IRCv3 account-notify)
+	accountCommand = "ACCOUNT"
+	// accountTag is the tag carrying the services account of the sender of a message (IRCv3 account-tag)
+	accountTag = "account"
+	// accountTagCapability makes the server tag messages with the account of their sender
+	accountTagCapability = "account-tag"
+)
+
+// Member is a member of a channel
+type Member struct {
+	// Nick is the nick of the member
+	Nick string
+	// Prefix holds the membership prefixes of the member such as "@+" (highest first)
+	Prefix string
+	// User is the user name of the member (empty if unknown)
+	User string
+	// Host is the host of the member (empty if unknown)
+	Host string
+	// Account is the services account the member is logged in to (empty if none or unknown)
+	Account string
+	// Away is the reason the member is marked away for (empty if they aren't or it is unknown)
+	Away string
+	// Realname is the real name of the member (empty if unknown)
+	Realname string
+}
+
+// Topic is the topic of a channel
+type Topic struct {
+	// Text is the topic (empty if none is set)
+	Text string
+	// SetBy is who set the topic (empty if unknown)
+	SetBy string
+	// SetAt is when the topic was set (zero if unknown)
+	SetAt time.Time
+}
+
+// channelState tracks a channel we have joined
+type channelState struct {
+	// members maps lower-cased nicks to members (modes holds membership mode letters instead of prefixes)
+	members map[string]*Member
+	// modes maps channel modes which are set to their parameter (empty if none)
+	modes map[byte]string
+	// names collects members from RPL_NAMREPLY until RPL_ENDOFNAMES (nil if none are being received)
+	names map[string]*Member
+	// topic is the topic of the channel
+	topic Topic
+}
+
+// newChannelState creates state of a channel we joined
+func newChannelState() *channelState {
+	return &channelState{
+		members: make(map[string]*Member),
+		modes:   make(map[byte]string),
+	}
+}
+
+// nickKey normalises a nick for use as a map key (mutex must be held)
+func (st *ServerState) nickKey(nick string) string {
+	return FoldCase(st.caseMapping(), nick)
+}
+
+// isUs returns true if nick is our nick according to the CASEMAPPING of the server (mutex must be held)
+func (st *ServerState) isUs(nick string) bool {
+	return st.nickKey(nick) == st.nickKey(st.nick)
+}
+
+// trackChannels updates state of channels we have joined from a message (mutex must be held)
+func (st *ServerState) trackChannels(msg *irc.Message, fromUs bool) {
+	var nick string
+	if msg.Prefix != nil {
+		nick = msg.Prefix.Name
+	}
+	switch msg.Command {
+	case irc.JOIN:
+		if len(msg.Params) == 0 {
+			return
+		}
+		if fromUs {
+			st.channelStates[st.channelKey(msg.Params[0])] = newChannelState()
+		}
+		if cs, ok := st.channelStates[st.channelKey(msg.Params[0])]; ok && len(nick) > 0 {
+			m := &Member{Nick: nick, User: msg.Prefix.User, Host: msg.Prefix.Host}
+			// Parameters are the channel, account ('*' if none) and real name with IRCv3 extended-join
+			if len(msg.Params) > 2 {
+				if msg.Params[1] != "*" {
+					m.Account = msg.Params[1]
+				}
+				m.Realname = msg.Params[2]
+			}
+			cs.members[st.nickKey(nick)] = m
+		}
+	case irc.PART:
+		if len(msg.Params) > 0 {
+			st.removeMember(msg.Params[0], nick, fromUs)
+		}
+	case irc.KICK:
+		if len(msg.Params) > 1 {
+			st.removeMember(msg.Params[0], msg.Params[1], st.isUs(msg.Params[1]))
+		}
+	case irc.QUIT:
+		for _, cs := range st.channelStates {
+			delete(cs.members, st.nickKey(nick))
+		}
+	case irc.NICK:
+		if len(msg.Params) == 0 {
+			return
+		}
+		for _, cs := range st.channelStates {
+			if m, ok := cs.members[st.nickKey(nick)]; ok {
+				delete(cs.members, st.nickKey(nick))
+				m.Nick = msg.Params[0]
+				cs.members[st.nickKey(m.Nick)] = m
+			}
+		}
+	case accountCommand:
+		// Parameter is the account the sender logged in to or '*' if they logged out (IRCv3 account-notify)
+		if len(msg.Params) > 0 {
+			st.setAccount(nick, msg.Params[0])
+		}
+	case irc.AWAY:
+		// Parameter is the reason the sender is away for or missing if they are back (IRCv3 away-notify)
+		reason := ""
+		if len(msg.Params) > 0 {
+			reason = msg.Params[len(msg.Params)-1]
+		}
+		for _, cs := range st.channelStates {
+			if m, ok := cs.members[st.nickKey(nick)]; ok {
+				m.Away = reason
+			}
+		}
+	case irc.RPL_NAMREPLY:
+		// Parameters are our nick, the channel type, the channel and names
+		if len(msg.Params) > 3 {
+			st.collectNames(msg.Params[2], msg.Params[3])
+		}
+	case irc.RPL_ENDOFNAMES:
+		// Parameters are our nick and the channel
+		if len(msg.Params) > 1 {
+			if cs, ok := st.channelStates[st.channelKey(msg.Params[1])]; ok && cs.names != nil {
+				// Names don't tell accounts, away status and real names (nor user and host without
+				// userhost-in-names)
+				for key, m := range cs.names {
+					if old, ok := cs.members[key]; ok {
+						m.Account = old.Account
+						m.Away = old.Away
+						m.Realname = old.Realname
+						if len(m.Host) == 0 {
+							m.User = old.User
+							m.Host = old.Host
+						}
+					}
+				}
+				cs.members = cs.names
+				cs.names = nil
+			}
+		}
+	case irc.MODE:
+		if len(msg.Params) > 1 {
+			if cs, ok := st.channelStates[st.channelKey(msg.Params[0])]; ok {
+				st.applyModes(cs, msg.Params[1], msg.Params[2:])
+			}
+		}
+	case irc.RPL_CHANNELMODEIS:
+		// Parameters are our nick, the channel, modes and their parameters
+		if len(msg.Params) > 2 {
+			if cs, ok := st.channelStates[st.channelKey(msg.Params[1])]; ok {
+				cs.modes = make(map[byte]string)
+				st.applyModes(cs, msg.Params[2], msg.Params[3:])
+			}
+		}
+	case irc.TOPIC:
+		if len(msg.Params) > 1 {
+			if cs, ok := st.channelStates[st.channelKey(msg.Params[0])]; ok {
+				cs.topic = Topic{Text: msg.Params[1], SetBy: nick, SetAt: time.Now()}
+			}
+		}
+	case irc.RPL_TOPIC:
+		// Parameters are our nick, the channel and the topic
+		if len(msg.Params) > 2 {
+			if cs, ok := st.channelStates[st.channelKey(msg.Params[1])]; ok {
+				cs.topic.Text = msg.Params[2]
+			}
+		}
+	case irc.RPL_NOTOPIC:
+		if len(msg.Params) > 1 {
+			if cs, ok := st.channelStates[st.channelKey(msg.Params[1])]; ok {
+				cs.topic = Topic{}
+			}
+		}
+	case irc.RPL_TOPICWHOTIME:
+		// Parameters are our nick, the channel, who set the topic and when
+		if len(msg.Params) > 3 {
+			if cs, ok := st.channelStates[st.channelKey(msg.Params[1])]; ok {
+				cs.topic.SetBy = msg.Params[2]
+				if ts, err := strconv.ParseInt(msg.Params[3], 10, 64); err == nil {
+					cs.topic.SetAt = time.Unix(ts, 0)
+				}
+			}
+		}
+	}
+}
+
+// setAccount records the services account a user is logged in to ('*' or empty if none) (mutex must be held)
+func (st *ServerState) setAccount(nick string, account string) {
+	if account == "*" {
+		account = ""
+	}
+	for _, cs := range st.channelStates {
+		if m, ok := cs.members[st.nickKey(nick)]; ok {
+			m.Account = account
+		}
+	}
+}
+
+// trackAccountTag records the account of the sender of a message from its account tag (IRCv3 account-tag)
+func (st *ServerState) trackAccountTag(msg *irc.Message, tags map[string]string) {
+	if msg.Prefix == nil || len(msg.Prefix.User) == 0 || !st.HasCapability(accountTagCapability) {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	// Messages from users who aren't logged in don't have the tag
+	st.setAccount(msg.Prefix.Name, tags[accountTag])
+}
+
+// Account returns the services account a member of a channel we have joined is logged in to and whether it is known
+func (st *ServerState) Account(nick string) (string, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	for _, cs := range st.channelStates {
+		if m, ok := cs.members[st.nickKey(nick)]; ok && len(m.Account) > 0 {
+			return m.Account, true
+		}
+	}
+	return "", false
+}
+
+// AwayReason returns the reason a member of a channel we have joined is marked away for (false if they
+// aren't or it is unknown)
+func (st *ServerState) AwayReason(nick string) (string, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	for _, cs := range st.channelStates {
+		if m, ok := cs.members[st.nickKey(nick)]; ok && len(m.Away) > 0 {
+			return m.Away, true
+		}
+	}
+	return "", false
+}
+
+// removeMember removes nick from a channel, forgetting the channel if it is us (mutex must be held)
+func (st *ServerState) removeMember(channel string, nick string, us bool) {
+	if us {
+		delete(st.channelStates, st.channelKey(channel))
+		return
+	}
+	if cs, ok := st.channelStates[st.channelKey(channel)]; ok {
+		delete(cs.members, st.nickKey(nick))
+	}
+}
+
+// collectNames adds members listed in a RPL_NAMREPLY (mutex must be held)
+func (st *ServerState) collectNames(channel string, names string) {
+	cs, ok := st.channelStates[st.channelKey(channel)]
+	if !ok {
+		return
+	}
+	if cs.names == nil {
+		cs.names = make(map[string]*Member)
+	}
+	modes, prefixes := st.prefixModes()
+	for _, name := range strings.Fields(names) {
+		// Names may be nick!user@host (IRCv3 userhost-in-names)
+		prefix := irc.ParsePrefix(strings.TrimLeft(name, prefixes))
+		if prefix == nil || len(prefix.Name) == 0 {
+			continue
+		}
+		nick := prefix.Name
+		// Several prefixes are only listed with IRCv3 multi-prefix
+		m := &Member{Nick: nick, User: prefix.User, Host: prefix.Host}
+		for _, prefix := range []byte(name[:len(name)-len(strings.TrimLeft(name, prefixes))]) {
+			if i := strings.IndexByte(prefixes, prefix); i >= 0 {
+				m.Prefix += string(modes[i])
+			}
+		}
+		cs.names[st.nickKey(nick)] = m
+	}
+}
+
+// applyModes records changes of channel and membership modes (mutex must be held)
+func (st *ServerState) applyModes(cs *channelState, modes string, params []string) {
+	memberModes, _ := st.prefixModes()
+	chanModes, ok := st.isupport["CHANMODES"]
+	if !ok {
+		chanModes = defaultChanModes
+	}
+	listModes := strings.Split(chanModes, ",")[0]
+	for _, change := range st.parseModes(modes, params) {
+		switch {
+		case strings.IndexByte(memberModes, change.Mode) >= 0:
+			m, ok := cs.members[st.nickKey(change.Param)]
+			if !ok {
+				continue
+			}
+			m.Prefix = strings.Replace(m.Prefix, string(change.Mode), "", -1)
+			if change.Add {
+				m.Prefix += string(change.Mode)
+			}
+		case strings.IndexByte(listModes, change.Mode) >= 0:
+			// Lists such as bans aren't tracked
+		case change.Add:
+			cs.modes[change.Mode] = change.Param
+		default:
+			delete(cs.modes, change.Mode)
+		}
+	}
+}
+
+// memberPrefix returns the prefixes of membership modes ordered from highest to lowest (mutex must be held)
+func (st *ServerState) memberPrefix(memberModes string) string {
+	modes, prefixes := st.prefixModes()
+	var prefix []byte
+	for i := range modes {
+		if strings.IndexByte(memberModes, modes[i]) >= 0 {
+			prefix = append(prefix, prefixes[i])
+		}
+	}
+	return string(prefix)
+}
+
+// Members returns members of a channel we have joined ordered by nick (nil if we haven't joined it)
+func (st *ServerState) Members(channel string) []Member {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	cs, ok := st.channelStates[st.channelKey(channel)]
+	if !ok {
+		return nil
+	}
+	members := make([]Member, 0, len(cs.members))
+	for _, m := range cs.members {
+		member := *m
+		member.Prefix = st.memberPrefix(m.Prefix)
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return st.nickKey(members[i].Nick) < st.nickKey(members[j].Nick)
+	})
+	return members
+}
+
+// Member returns a member of a channel we have joined and whether they are in it
+func (st *ServerState) Member(channel string, nick string) (Member, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	cs, ok := st.channelStates[st.channelKey(channel)]
+	if !ok {
+		return Member{}, false
+	}
+	m, ok := cs.members[st.nickKey(nick)]
+	if !ok {
+		return Member{}, false
+	}
+	member := *m
+	member.Prefix = st.memberPrefix(m.Prefix)
+	return member, true
+}
+
+// HasOp returns true if nick may change modes of a channel we have joined
+func (st *ServerState) HasOp(channel string, nick string) bool {
+	m, ok := st.Member(channel, nick)
+	return ok && strings.ContainsAny(m.Prefix, opPrefixes)
+}
+
+// ChannelTopic returns the topic of a channel we have joined and whether we know it
+func (st *ServerState) ChannelTopic(channel string) (Topic, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	cs, ok := st.channelStates[st.channelKey(channel)]
+	if !ok {
+		return Topic{}, false
+	}
+	return cs.topic, true
+}
+
+// ChannelModes returns the modes set on a channel we have joined such as "+kl key 10" (empty if unknown)
+func (st *ServerState) ChannelModes(channel string) string {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	cs, ok := st.channelStates[st.channelKey(channel)]
+	if !ok || len(cs.modes) == 0 {
+		return ""
+	}
+	modes := make([]byte, 0, len(cs.modes))
+	for mode := range cs.modes {
+		modes = append(modes, mode)
+	}
+	sort.Slice(modes, func(i, j int) bool {
+		return modes[i] < modes[j]
+	})
+	var params []string
+	for _, mode := range modes {
+		if param := cs.modes[mode]; len(param) > 0 {
+			params = append(params, param)
+		}
+	}
+	return strings.Join(append([]string{"+" + string(modes)}, params...), " ")
+}
@@ -3,43 +3,75 @@ package client
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
 	"log"
-	"math"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/text/encoding"
 	"golang.org/x/time/rate"
 	irc "gopkg.in/sorcix/irc.v2"
 )
 
+// DefaultRegistrationTimeout is how long we wait for the server to welcome us if not configured
+const DefaultRegistrationTimeout = 60 * time.Second
+
+// DefaultPingTimeout is how long we wait for the PONG to a keepalive PING if not configured
+const DefaultPingTimeout = 120 * time.Second
+
+// MessageQueueSize is how many outgoing messages can be queued for a server
+const MessageQueueSize = 10
+
 type IrcServerInterface interface {
 	Dial(ctx context.Context)
 	Close(ctx context.Context)
 	GetSettings() *IrcServerSettings
+	GetState() *ServerState
 	GetMessages() chan irc.Message
 	GetReconnectExp() *uint64
 	SetReconnectExp(val uint64)
+	SetReconnectDelay(delay time.Duration)
 	ReconnectWait(ctx context.Context)
 	Done() <-chan struct{}
 }
 
 // IrcServer contains everything related to a given IRC server
 type IrcServer struct {
-	Cancel       context.CancelFunc
-	done         <-chan struct{}
-	messages     chan irc.Message
-	addr         string
-	conn         net.Conn
-	decoder      *irc.Decoder
-	encoder      *irc.Encoder
-	limitOutput  *rate.Limiter
-	name         string
-	reconnectExp *uint64
-	Settings     *IrcServerSettings
-	tlsConfig    *tls.Config
+	Cancel             context.CancelFunc
+	batches            map[string]*Batch
+	done               <-chan struct{}
+	messages           chan irc.Message
+	conn               net.Conn
+	capPending         int
+	capSupported       map[string]string
+	decoder            *tagDecoder
+	encoder            *irc.Encoder
+	encoding           encoding.Encoding
+	labelBatches       map[string]string
+	limitOutput        *rate.Limiter
+	name               string
+	nickAttempts       int
+	nickServGhosting   bool
+	nickServIdentified time.Time
+	nickServLoggedIn   bool
+	port               int
+	quitOnce           sync.Once
+	quitting           chan struct{}
+	readDone           chan struct{}
+	reconnectDelay     time.Duration
+	reconnectExp       *uint64
+	regDeferred        []*irc.Message
+	regState           registrationState
+	registered         chan struct{}
+	registeredOnce     sync.Once
+	saslAttempts       int
+	saslChallenged     bool
+	secure             bool
+	Settings           *IrcServerSettings
+	state              *ServerState
+	tlsConfig          *tls.Config
 }
 
 // IrcServerError is used to supplement errors with the friendly server name
@@ -53,6 +85,11 @@ func (s *IrcServer) GetSettings() *IrcServerSettings {
 	return s.Settings
 }
 
+// GetState returns state of the connection
+func (s *IrcServer) GetState() *ServerState {
+	return s.state
+}
+
 // GetMessages returns pointer to IrcServerSettings
 func (s *IrcServer) GetMessages() chan irc.Message {
 	return s.messages
@@ -68,26 +105,49 @@ func (s *IrcServer) SetReconnectExp(val uint64) {
 	s.reconnectExp = &val
 }
 
+// SetReconnectDelay sets minimum delay before reconnecting
+func (s *IrcServer) SetReconnectDelay(delay time.Duration) {
+	s.reconnectDelay = delay
+}
+
 // Done returns Done channel for the server
 func (s *IrcServer) Done() <-chan struct{} {
 	return s.done
 }
 
-// Close closes the connection to the server
+// Close sends QUIT and closes the connection to the server
+// If ctx has a deadline we wait until then for the server to close the connection so QUIT isn't lost
 func (s *IrcServer) Close(ctx context.Context) {
+	s.quitOnce.Do(func() {
+		close(s.quitting)
+	})
 	// Send QUIT
 	if s.encoder != nil && s.conn != nil {
-		s.conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
-		err := s.encoder.Encode(&irc.Message{
+		deadline := time.Now().Add(time.Second * 30)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		s.conn.SetWriteDeadline(deadline)
+		err := s.encode(&irc.Message{
 			Command: irc.QUIT,
-			Params:  []string{"Leaving"},
+			Params:  []string{quitMessage(ctx)},
 		})
 		if err != nil {
 			log.Printf("Failed to send QUIT: %s", err)
+		} else if _, ok := ctx.Deadline(); ok && s.readDone != nil {
+			select {
+			case <-s.readDone:
+			case <-ctx.Done():
+				log.Printf("[%s] Server didn't close the connection in time after QUIT", s.name)
+			}
 		}
 	}
 	// Cancel server context
 	s.Cancel()
+	// Close connection so the read loop doesn't linger
+	if s.conn != nil {
+		s.conn.Close()
+	}
 }
 
 // SendCommand tries to send a message to the server and returns true on success
@@ -112,134 +172,245 @@ func (s *IrcServer) sendMessages(ctx context.Context) {
 		// Require message to be sent in 30s
 		s.conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
 		// Send message to socket
-		err := s.encoder.Encode(&msg)
+		err := s.encodeRequest(&msg)
 		// Handle error
 		if err != nil {
 			// Call error callback
 			go s.Settings.ErrorCallback(ctx, s.name, err)
 			return
 		}
+		// Remember being away so we can be marked away again after reconnecting
+		s.state.trackAway(&msg)
 	}
 }
 
 // ReconnectWait waits / backs off
 func (s *IrcServer) ReconnectWait(ctx context.Context) {
-	atomic.AddUint64(s.reconnectExp, 1)
-	p := s.Settings.MaxReconnect * math.Tanh(float64(*s.reconnectExp)/1000.0)
-	log.Printf("Sleeping for %.1f seconds before attempting reconnect", p)
-	<-time.After(time.Duration(p) * time.Second)
+	attempt := atomic.AddUint64(s.reconnectExp, 1)
+	delay := s.reconnectDelayFor(attempt)
+	// Wait longer if the server asked us to
+	if s.reconnectDelay > delay {
+		delay = s.reconnectDelay
+	}
+	if s.Settings.ReconnectCallback != nil {
+		s.Settings.ReconnectCallback(ctx, s.name, attempt, delay)
+	}
+	log.Printf("Sleeping for %.1f seconds before attempting reconnect", delay.Seconds())
+	<-time.After(delay)
 }
 
 // Dial tries to connect to the server and start processing
 func (s *IrcServer) Dial(ctx context.Context) {
 
-	// Create dialer and dial
-	dialer := net.Dialer{Timeout: 30 * time.Second}
-	var err error
-	s.conn, err = dialer.DialContext(ctx, "tcp", s.addr)
-	if s.Settings.TLS {
-		s.conn = tls.Client(s.conn, s.tlsConfig)
-	}
+	// Resolve host and dial
+	conn, err := s.dial(ctx)
 	// Handle Dial error
 	if err != nil {
 		go s.Settings.ErrorCallback(ctx, s.name, err)
 		return
 	}
-	atomic.StoreUint64(s.reconnectExp, 0)
+	s.conn = conn
+	if s.secure {
+		s.conn = tls.Client(s.conn, s.tlsConfig)
+	}
 	s.encoder = irc.NewEncoder(s.conn)
-	s.decoder = irc.NewDecoder(s.conn)
+	s.decoder = newTagDecoder(s.conn)
+	// Send registration commands before the read loop handles replies
+	for _, cmd := range s.registrationCommands() {
+		err := s.encode(cmd)
+		if err != nil {
+			// Call error callback
+			go s.Settings.ErrorCallback(ctx, s.name, err)
+			return
+		}
+	}
 	// Read loop
+	s.readDone = make(chan struct{})
 	go func() {
+		defer close(s.readDone)
 		for {
 			// Read input from server and invoke callback
 			s.conn.SetReadDeadline(time.Now().Add(time.Second * 300))
 			// Try decode message
-			msg, err := s.decoder.Decode()
+			msg, tags, err := s.decoder.Decode()
+			received := time.Now()
 			// Handle error
-			if err != nil || msg.Command == irc.ERROR {
+			if err != nil || msg.Command == irc.ERROR || s.tryAgain(msg) {
 				// Set error if needed
 				if err == nil && msg != nil && msg.Command == irc.ERROR {
-					err = fmt.Errorf("[%s] server error: %s", s.name, strings.Join(msg.Params, ", "))
+					err = newServerError(s.name, strings.Join(msg.Params, ", "))
+				} else if err == nil {
+					// Parameters following our nick are the command refused and the reason
+					err = newTryAgainError(s.name, strings.Join(msg.Params[1:], ", "))
+				}
+				// The connection ending is expected once we quit
+				select {
+				case <-s.quitting:
+					return
+				default:
 				}
 				// Call error callback
 				go s.Settings.ErrorCallback(ctx, s.name, err)
 				return
 			}
-			// Invoke callback to handle input
-			s.Settings.InputCallback(ctx, s.name, msg)
+			// Scripts always see UTF-8
+			s.decodeMessage(msg)
+			// Collect replayed messages instead of handling them
+			t := messageTime(tags, received)
+			if s.handleBatch(ctx, msg, tags, t) {
+				continue
+			}
+			// Update state of the connection
+			s.state.Handle(msg)
+			s.state.trackAccountTag(msg, tags)
+			// Handle messages we react to ourselves
+			s.handleMessage(ctx, msg)
+			// Invoke callback to handle input (passing tags if any, when the message was sent and the
+			// labeled request it replies to)
+			msgCtx := ContextWithTime(ctx, t)
+			tags = s.labelReply(msg, tags)
+			if tags != nil {
+				msgCtx = ContextWithTags(msgCtx, tags)
+			}
+			if req, ok := s.state.LabeledRequest(tags[labelTag]); ok {
+				msgCtx = ContextWithRequest(msgCtx, req)
+			}
+			s.Settings.InputCallback(msgCtx, s.name, msg)
+			// Tell handlers if we had to register with another nick
+			if msg.Command == irc.RPL_WELCOME {
+				if fallback := s.nickFallbackMessage(); fallback != nil {
+					s.Settings.InputCallback(msgCtx, s.name, fallback)
+				}
+			}
 		}
 	}()
-	// Write loop
+	// Write loop (started after registration commands so queued messages can't precede them)
 	go s.sendMessages(ctx)
-	var connectCommands []*irc.Message
-	index := 0
-	// Send password if configured
-	if len(s.Settings.Password) > 0 {
-		connectCommands = make([]*irc.Message, 3)
-		connectCommands[0] = &irc.Message{
-			Command: irc.PASS,
-			Params:  []string{s.Settings.Password},
-		}
-		index = 1
-	} else {
-		connectCommands = make([]*irc.Message, 2)
+	// Give up if the server doesn't welcome us
+	go s.registrationTimeout(ctx)
+}
+
+// tryAgain returns true if the server refused our registration telling us to try again later (RPL_TRYAGAIN)
+func (s *IrcServer) tryAgain(msg *irc.Message) bool {
+	if msg == nil || msg.Command != irc.RPL_TRYAGAIN || len(msg.Params) < 2 {
+		return false
 	}
-	connectCommands[index] = &irc.Message{
-		Command: irc.NICK,
-		Params:  []string{s.Settings.Nick},
+	select {
+	case <-s.registered:
+		return false
+	default:
+		return true
 	}
-	index += 1
-	connectCommands[index] = &irc.Message{
-		Command: irc.USER,
-		Params:  []string{s.Settings.Username, "0", "*", s.Settings.Realname},
+}
+
+// registrationTimeout reports an error if the server doesn't welcome us in time
+func (s *IrcServer) registrationTimeout(ctx context.Context) {
+	timeout := s.Settings.RegistrationTimeout
+	if timeout <= 0 {
+		timeout = DefaultRegistrationTimeout
 	}
-	for _, cmd := range connectCommands {
-		err := s.encoder.Encode(cmd)
-		if err != nil {
-			// Call error callback
-			go s.Settings.ErrorCallback(ctx, s.name, err)
-			return
-		}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-s.registered:
+	case <-timer.C:
+		s.Settings.ErrorCallback(ctx, s.name, ErrRegistrationTimeout)
 	}
 }
 
+// setRegistered records that the server welcomed us
+func (s *IrcServer) setRegistered(ctx context.Context) {
+	s.registeredOnce.Do(func() {
+		// Only reset backoff once registration succeeded so silent servers don't make us reconnect quickly
+		if s.Settings.Reconnect != nil && s.Settings.Reconnect.ResetAfter > 0 {
+			go s.resetBackoff(ctx)
+		} else {
+			atomic.StoreUint64(s.reconnectExp, 0)
+		}
+		close(s.registered)
+	})
+}
+
 // IrcServerSettings contains all configuration for an IRC server
 type IrcServerSettings struct {
-	Host          string
-	Nick          string
-	MaxReconnect  float64
-	Password      string
-	Port          int
-	Realname      string
-	TLS           bool
-	VerifyTLS     bool
-	Username      string
-	ErrorCallback func(ctx context.Context, svrName string, err error)
-	InputCallback func(ctx context.Context, svrName string, msg *irc.Message)
+	AltNicks            []string
+	BindAddress         string
+	Capabilities        []string
+	Encoding            string
+	Family              string
+	Host                string
+	Nick                string
+	MaxReconnect        float64
+	NickServPassword    string
+	NickServRegain      string
+	OperModes           string
+	OperName            string
+	OperPassword        string
+	Password            string
+	Perform             []string
+	PingInterval        time.Duration
+	PingTimeout         time.Duration
+	Reconnect           *ReconnectStrategy
+	Port                int
+	ProxyURL            string
+	RegistrationOrder   []string
+	RegistrationTimeout time.Duration
+	Realname            string
+	Resolver            Resolver
+	SASLMechanism       string
+	SASLPassword        string
+	SASLRetries         int
+	SASLRetryDelay      time.Duration
+	SASLUser            string
+	TLS                 bool
+	TLSCA               string
+	TLSCert             string
+	TLSCipherSuites     []string
+	TLSKey              string
+	TLSMinVersion       string
+	TLSPin              string
+	VerifyTLS           bool
+	UserModes           string
+	Username            string
+	WebIRCGateway       string
+	WebIRCHost          string
+	WebIRCIP            string
+	WebIRCPassword      string
+	BatchCallback       func(ctx context.Context, svrName string, batch *Batch)
+	ErrorCallback       func(ctx context.Context, svrName string, err error)
+	InputCallback       func(ctx context.Context, svrName string, msg *irc.Message)
+	ReconnectCallback   func(ctx context.Context, svrName string, attempt uint64, delay time.Duration)
+	STSCallback         func(ctx context.Context, svrName string, host string, policy STSPolicy)
+	STSLookup           func(host string) (STSPolicy, bool)
 }
 
 // NewIrcServer creates an IRC server
 func NewIrcServer(parentCtx context.Context, name string, settings *IrcServerSettings) (IrcServerInterface, context.Context) {
 	var reconnectExp uint64
 	ctx, cancel := context.WithCancel(parentCtx)
-	insecure := false
-	if !settings.VerifyTLS {
-		insecure = true
+	// Settings were validated already, fall back to UTF-8
+	enc, err := LookupEncoding(settings.Encoding)
+	if err != nil {
+		log.Printf("[%s] %s", name, err)
 	}
 	// Return new IrcServer
 	s := &IrcServer{
 		Cancel:       cancel,
 		done:         ctx.Done(),
+		encoding:     enc,
 		limitOutput:  rate.NewLimiter(1, 10),
-		addr:         fmt.Sprintf("%s:%d", settings.Host, settings.Port),
-		messages:     make(chan irc.Message, 10),
+		messages:     make(chan irc.Message, MessageQueueSize),
 		name:         name,
+		quitting:     make(chan struct{}),
 		reconnectExp: &reconnectExp,
+		registered:   make(chan struct{}),
 		Settings:     settings,
-		tlsConfig: &tls.Config{
-			InsecureSkipVerify: insecure,
-			ServerName:         settings.Host,
-		},
+		state:        NewServerState(settings.Nick),
+		port:         settings.Port,
+		secure:       settings.TLS,
+		tlsConfig:    newTLSConfig(settings),
 	}
+	s.applySTSPolicy()
 	return s, ctx
 }
@@ -1,7 +1,29 @@
 package client_test
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -161,3 +183,3006 @@ func TestSendAndQuit(t *testing.T) {
 		break
 	}
 }
+
+func TestServerState(t *testing.T) {
+	state := client.NewServerState("testbot1")
+	for _, msg := range []*irc.Message{
+		// Server tells us our real nick
+		&irc.Message{Command: irc.RPL_WELCOME, Params: []string{"testbot2", "Welcome"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot2"}, Command: irc.JOIN, Params: []string{"#one"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot2"}, Command: irc.JOIN, Params: []string{"#two"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot2"}, Command: irc.JOIN, Params: []string{"#three"}},
+		// Someone else joining doesn't matter
+		&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.JOIN, Params: []string{"#four"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot2"}, Command: irc.PART, Params: []string{"#two"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot2"}, Command: irc.NICK, Params: []string{"testbot3"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.KICK, Params: []string{"#three", "testbot3"}},
+		&irc.Message{Command: irc.RPL_ISUPPORT, Params: []string{"testbot3", "NICKLEN=30", "SAFELIST", "chantypes=#", `NETWORK=Banana\x20Boat\x3D`, "are supported by this server"}},
+		&irc.Message{Command: irc.RPL_ISUPPORT, Params: []string{"testbot3", "-SAFELIST", "are supported by this server"}},
+		// Joining #old and #five forwards us elsewhere but we join #five directly later
+		&irc.Message{Command: client.ErrLinkChannel, Params: []string{"testbot3", "#old", "#new", "Forwarding to another channel"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot3"}, Command: irc.JOIN, Params: []string{"#new"}},
+		&irc.Message{Command: client.ErrLinkChannel, Params: []string{"testbot3", "#five", "#overflow", "Forwarding to another channel"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "testbot3"}, Command: irc.JOIN, Params: []string{"#five"}},
+	} {
+		state.Handle(msg)
+	}
+	if to, ok := state.Forwarded("#OLD"); !ok || to != "#new" {
+		t.Fatalf("Wrong forward: %s", to)
+	}
+	if _, ok := state.Forwarded("#five"); ok {
+		t.Fatal("Forward wasn't forgotten after joining")
+	}
+	if value, ok := state.ISupport("nicklen"); !ok || value != "30" {
+		t.Fatalf("Wrong NICKLEN: %s", value)
+	}
+	if value, ok := state.ISupport("CHANTYPES"); !ok || value != "#" {
+		t.Fatalf("Wrong CHANTYPES: %s", value)
+	}
+	if _, ok := state.ISupport("SAFELIST"); ok {
+		t.Fatal("Negated feature wasn't removed")
+	}
+	if value, ok := state.ISupport("NETWORK"); !ok || value != "Banana Boat=" {
+		t.Fatalf("Escapes in NETWORK weren't decoded: %s", value)
+	}
+	if features := state.ISupportAll(); len(features) != 3 {
+		t.Fatalf("Wrong features: %v", features)
+	}
+	if state.Nick() != "testbot3" {
+		t.Fatalf("Wrong nick: %s", state.Nick())
+	}
+	// Our prefix is learnt from our own messages and host changes
+	if n := state.PrefixLength(); n != 0 {
+		t.Fatalf("Prefix length known too early: %d", n)
+	}
+	state.Handle(&irc.Message{Prefix: &irc.Prefix{Name: "testbot3", User: "bot", Host: "example.com"}, Command: irc.JOIN, Params: []string{"#six"}})
+	if n := state.PrefixLength(); n != len(":testbot3!bot@example.com ") {
+		t.Fatalf("Wrong prefix length: %d", n)
+	}
+	state.Handle(&irc.Message{Command: client.RplHostHidden, Params: []string{"testbot3", "banana/boat", "is now your displayed host"}})
+	if n := state.PrefixLength(); n != len(":testbot3!bot@banana/boat ") {
+		t.Fatalf("Wrong prefix length after host change: %d", n)
+	}
+	// Message of the day is collected between RPL_MOTDSTART and RPL_ENDOFMOTD
+	if _, ok := state.MOTD(); ok {
+		t.Fatal("MOTD received too early")
+	}
+	for _, msg := range []*irc.Message{
+		&irc.Message{Command: irc.RPL_MOTDSTART, Params: []string{"testbot3", "- irc.example.com Message of the day - "}},
+		&irc.Message{Command: irc.RPL_MOTD, Params: []string{"testbot3", "- Maintenance tonight"}},
+		&irc.Message{Command: irc.RPL_MOTD, Params: []string{"testbot3", "- Be nice"}},
+		&irc.Message{Command: irc.RPL_ENDOFMOTD, Params: []string{"testbot3", "End of /MOTD command."}},
+	} {
+		state.Handle(msg)
+	}
+	if motd, ok := state.MOTD(); !ok || motd != "Maintenance tonight\nBe nice" {
+		t.Fatalf("Wrong MOTD: %q", motd)
+	}
+	state.Handle(&irc.Message{Command: irc.ERR_NOMOTD, Params: []string{"testbot3", "MOTD File is missing"}})
+	if motd, ok := state.MOTD(); !ok || motd != "" {
+		t.Fatalf("Wrong MOTD: %q", motd)
+	}
+	for channel, expected := range map[string]bool{
+		"#ONE":   true,
+		"#two":   false,
+		"#three": false,
+		"#four":  false,
+		"#old":   false,
+		"#new":   true,
+	} {
+		if state.InChannel(channel) != expected {
+			t.Fatalf("InChannel(%s) != %v", channel, expected)
+		}
+	}
+}
+
+func TestChannelModes(t *testing.T) {
+	state := client.NewServerState("testbot")
+	for _, msg := range []*irc.Message{
+		&irc.Message{Command: irc.RPL_ISUPPORT, Params: []string{"testbot", "CHANMODES=beI,k,l,imnpstcg", "PREFIX=(qaohv)~&@%+", "are supported by this server"}},
+		&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"testbot", "=", "#one", "other @testbot"}},
+		&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"testbot", "=", "#two", "@other +testbot"}},
+		&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"testbot", "=", "#three", "@%testbot"}},
+		&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"testbot", "=", "#four", "testbot"}},
+		// IRCv3 userhost-in-names
+		&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"testbot", "=", "#five", "other!o@example.com @testbot!bot@example.com"}},
+		&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"testbot", "=", "#six", "@other!o@example.com +testbot!bot@example.com"}},
+		// Halfops can't change modes
+		&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.MODE, Params: []string{"#two", "+h", "testbot"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.MODE, Params: []string{"#three", "-o+b", "testbot", "*!*@example.com"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.MODE, Params: []string{"#four", "+lko", "10", "secret", "testbot"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "other"}, Command: irc.MODE, Params: []string{"#four", "-lo+n", "other"}},
+	} {
+		state.Handle(msg)
+	}
+	for channel, expected := range map[string]bool{
+		"#ONE":   true,
+		"#two":   false,
+		"#three": false,
+		"#four":  true,
+		"#five":  true,
+		"#six":   false,
+	} {
+		if state.IsOp(channel) != expected {
+			t.Errorf("IsOp(%s) != %v", channel, expected)
+		}
+	}
+	changes := state.ParseModes("+lk-lb+nt", []string{"10", "secret", "*!*@example.com"})
+	expected := []client.ModeChange{
+		{Add: true, Mode: 'l', Param: "10"},
+		{Add: true, Mode: 'k', Param: "secret"},
+		{Add: false, Mode: 'l'},
+		{Add: false, Mode: 'b', Param: "*!*@example.com"},
+		{Add: true, Mode: 'n'},
+		{Add: true, Mode: 't'},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("Wrong mode changes: %v", changes)
+	}
+	if !state.FlagMode('g') || state.FlagMode('k') {
+		t.Fatal("Wrong flag modes")
+	}
+}
+
+func TestChannelState(t *testing.T) {
+	state := client.NewServerState("testbot")
+	us := &irc.Prefix{Name: "testbot", User: "bot", Host: "example.com"}
+	other := &irc.Prefix{Name: "other", User: "o", Host: "example.com"}
+	for _, msg := range []*irc.Message{
+		&irc.Message{Command: irc.RPL_ISUPPORT, Params: []string{"testbot", "PREFIX=(qaohv)~&@%+", "are supported by this server"}},
+		&irc.Message{Prefix: us, Command: irc.JOIN, Params: []string{"#chan"}},
+		&irc.Message{Command: irc.RPL_TOPIC, Params: []string{"testbot", "#chan", "hello world"}},
+		&irc.Message{Command: irc.RPL_TOPICWHOTIME, Params: []string{"testbot", "#chan", "other!o@example.com", "1500000000"}},
+		// Names may have several prefixes (multi-prefix) and hosts (userhost-in-names)
+		&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"testbot", "=", "#chan", "testbot @+other!o@example.com"}},
+		&irc.Message{Command: irc.RPL_NAMREPLY, Params: []string{"testbot", "=", "#chan", "%third quitter"}},
+		&irc.Message{Command: irc.RPL_ENDOFNAMES, Params: []string{"testbot", "#chan", "End of /NAMES list"}},
+		&irc.Message{Command: irc.RPL_CHANNELMODEIS, Params: []string{"testbot", "#chan", "+ntk", "secret"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "newbie"}, Command: irc.JOIN, Params: []string{"#chan"}},
+		&irc.Message{Prefix: other, Command: irc.MODE, Params: []string{"#chan", "+vl-k+b", "newbie", "10", "secret", "*!*@example.org"}},
+		&irc.Message{Prefix: other, Command: irc.MODE, Params: []string{"#chan", "-v+o", "other", "third"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "quitter"}, Command: irc.QUIT, Params: []string{"bye"}},
+		&irc.Message{Prefix: &irc.Prefix{Name: "newbie"}, Command: irc.NICK, Params: []string{"Renamed"}},
+		// Channels we haven't joined aren't tracked
+		&irc.Message{Prefix: other, Command: irc.JOIN, Params: []string{"#elsewhere"}},
+		&irc.Message{Prefix: us, Command: irc.JOIN, Params: []string{"#gone"}},
+		&irc.Message{Prefix: other, Command: irc.KICK, Params: []string{"#gone", "testbot", "out"}},
+	} {
+		state.Handle(msg)
+	}
+	expected := []client.Member{
+		{Nick: "other", Prefix: "@", User: "o", Host: "example.com"},
+		{Nick: "Renamed", Prefix: "+"},
+		// Hosts are kept from JOIN if names don't tell them
+		{Nick: "testbot", User: "bot", Host: "example.com"},
+		{Nick: "third", Prefix: "@%"},
+	}
+	if members := state.Members("#CHAN"); !reflect.DeepEqual(members, expected) {
+		t.Fatalf("Wrong members: %v", members)
+	}
+	if state.Members("#elsewhere") != nil || state.Members("#gone") != nil {
+		t.Fatal("Got members of channel we aren't in")
+	}
+	if !state.HasOp("#chan", "OTHER") || !state.HasOp("#chan", "third") || state.HasOp("#chan", "renamed") || state.HasOp("#chan", "quitter") {
+		t.Fatal("Wrong operators")
+	}
+	if modes := state.ChannelModes("#chan"); modes != "+lnt 10" {
+		t.Fatalf("Wrong modes: %q", modes)
+	}
+	topic, ok := state.ChannelTopic("#chan")
+	if !ok || topic.Text != "hello world" || topic.SetBy != "other!o@example.com" || topic.SetAt.Unix() != 1500000000 {
+		t.Fatalf("Wrong topic: %v", topic)
+	}
+	state.Handle(&irc.Message{Prefix: other, Command: irc.TOPIC, Params: []string{"#chan", "new topic"}})
+	if topic, _ := state.ChannelTopic("#chan"); topic.Text != "new topic" || topic.SetBy != "other" {
+		t.Fatalf("Topic wasn't changed: %v", topic)
+	}
+	state.Handle(&irc.Message{Prefix: us, Command: irc.PART, Params: []string{"#chan"}})
+	if _, ok := state.ChannelTopic("#chan"); ok {
+		t.Fatal("Channel was kept after leaving")
+	}
+}
+
+func TestCaseMapping(t *testing.T) {
+	for _, tc := range []struct {
+		caseMapping string
+		in          string
+		expected    string
+	}{
+		{client.CaseMappingRFC1459, "Nick[A]\\~^", "nick{a}|~~"},
+		{client.CaseMappingStrictRFC1459, "Nick[A]\\~^", "nick{a}|~^"},
+		{client.CaseMappingASCII, "Nick[A]\\~^", "nick[a]\\~^"},
+		{client.CaseMappingRFC7613, "ÄNICK", "änick"},
+		{"unknown", "[X]", "{x}"},
+	} {
+		if folded := client.FoldCase(tc.caseMapping, tc.in); folded != tc.expected {
+			t.Errorf("FoldCase(%s, %q) = %q, expected %q", tc.caseMapping, tc.in, folded, tc.expected)
+		}
+	}
+	// Channels are tracked using the case mapping of the server
+	state := client.NewServerState("test[bot]")
+	state.Handle(&irc.Message{Prefix: &irc.Prefix{Name: "test[bot]"}, Command: irc.JOIN, Params: []string{"#Chan[1]"}})
+	if !state.InChannel("#chan{1}") || !state.EqualFold("Test{Bot}", "test[bot]") {
+		t.Fatal("rfc1459 case mapping wasn't applied")
+	}
+	// Our nick is recognised whatever its case
+	state.Handle(&irc.Message{Prefix: &irc.Prefix{Name: "Test{Bot}"}, Command: irc.JOIN, Params: []string{"#other"}})
+	state.Handle(&irc.Message{Prefix: &irc.Prefix{Name: "op"}, Command: irc.KICK, Params: []string{"#chan[1]", "TEST{BOT}"}})
+	if !state.InChannel("#other") || state.InChannel("#chan[1]") {
+		t.Fatal("rfc1459 case mapping wasn't applied to our nick")
+	}
+	state.Handle(&irc.Message{Command: irc.RPL_ISUPPORT, Params: []string{"test[bot]", "CASEMAPPING=ascii", "are supported by this server"}})
+	if state.EqualFold("test{bot}", "test[bot]") || !state.EqualFold("TEST[BOT]", "test[bot]") {
+		t.Fatal("ascii case mapping wasn't applied")
+	}
+}
+
+func TestCapabilityTracking(t *testing.T) {
+	state := client.NewServerState("testbot")
+	for _, msg := range []*irc.Message{
+		&irc.Message{Command: irc.CAP, Params: []string{"testbot", irc.CAP_ACK, "multi-prefix message-tags "}},
+		&irc.Message{Command: irc.CAP, Params: []string{"testbot", irc.CAP_ACK, "-multi-prefix"}},
+		&irc.Message{Command: irc.CAP, Params: []string{"testbot", irc.CAP_ACK, "sasl"}},
+		&irc.Message{Command: irc.CAP, Params: []string{"testbot", "DEL", "message-tags"}},
+		// Refused capabilities aren't enabled
+		&irc.Message{Command: irc.CAP, Params: []string{"testbot", irc.CAP_NAK, "server-time"}},
+	} {
+		state.Handle(msg)
+	}
+	if caps := state.Capabilities(); !reflect.DeepEqual(caps, []string{"sasl"}) {
+		t.Fatalf("Got wrong capabilities: %v", caps)
+	}
+	if !state.HasCapability("sasl") || state.HasCapability("multi-prefix") {
+		t.Fatal("Wrong capability enabled")
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	for err, expected := range map[error]string{
+		&client.ServerError{Name: "test", Message: "Closing link"}:    client.ErrorClassServer,
+		fmt.Errorf("read: %w", io.EOF):                                client.ErrorClassClosed,
+		&net.DNSError{Err: "no such host", Name: "irc.invalid"}:       client.ErrorClassDNS,
+		&net.OpError{Op: "dial", Err: &net.DNSError{IsTimeout: true}}: client.ErrorClassDNS,
+		errors.New("something else"):                                  client.ErrorClassOther,
+		client.ErrRegistrationTimeout:                                 client.ErrorClassRegistration,
+	} {
+		if class := client.ClassifyError(err); class != expected {
+			t.Errorf("%s: %s != %s", err, class, expected)
+		}
+	}
+}
+
+func TestTryAgain(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		irc.NewEncoder(conn).Encode(&irc.Message{
+			Command: irc.RPL_TRYAGAIN,
+			Params:  []string{"*", "NICK", "Please wait a while and try again."},
+		})
+	}()
+	errs := make(chan error, 1)
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", &client.IrcServerSettings{
+		Host:     "localhost",
+		Port:     serverPort,
+		Nick:     "testbot1",
+		Realname: "testbotr",
+		Username: "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			errs <- err
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+		},
+	})
+	svr.Dial(svrCtx)
+	err := <-errs
+	svr.Close(ctx)
+	// Registration refused by RPL_TRYAGAIN is throttling
+	if class := client.ClassifyError(err); class != client.ErrorClassThrottled {
+		t.Fatalf("Wrong error class: %s (%s)", class, err)
+	}
+	if retryAfter := err.(*client.ServerError).RetryAfter; retryAfter != client.DefaultThrottleDelay {
+		t.Fatalf("Wrong retry delay: %s", retryAfter)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	// Start fake IRC server on ephermal port
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		enc := irc.NewEncoder(conn)
+		enc.Encode(&irc.Message{
+			Command: irc.ERROR,
+			Params:  []string{"Closing Link: (Throttled: Reconnecting too fast) please wait 30 seconds"},
+		})
+	}()
+
+	errs := make(chan error, 1)
+	settings := &client.IrcServerSettings{
+		Host:     "localhost",
+		Port:     serverPort,
+		Nick:     "testbot1",
+		Realname: "testbotr",
+		Username: "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			errs <- err
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	err := <-errs
+	svr.Close(ctx)
+	if class := client.ClassifyError(err); class != client.ErrorClassThrottled {
+		t.Fatalf("Wrong error class: %s", class)
+	}
+	serverError := err.(*client.ServerError)
+	if serverError.RetryAfter != 30*time.Second {
+		t.Fatalf("Wrong retry delay: %s", serverError.RetryAfter)
+	}
+
+	// Reconnect should wait at least as long as we were asked to
+	svr, svrCtx = client.NewIrcServer(ctx, "test", settings)
+	svr.SetReconnectDelay(50 * time.Millisecond)
+	start := time.Now()
+	svr.ReconnectWait(svrCtx)
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("Reconnect didn't wait long enough: %s", waited)
+	}
+}
+
+func TestRegistrationTimeout(t *testing.T) {
+	// Start fake IRC server on ephermal port
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+
+	// Accept connection and read registration but never welcome the client
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	errs := make(chan error, 1)
+	settings := &client.IrcServerSettings{
+		Host:                "localhost",
+		Port:                serverPort,
+		Nick:                "testbot1",
+		Realname:            "testbotr",
+		Username:            "testbotu",
+		RegistrationTimeout: 100 * time.Millisecond,
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			errs <- err
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	// Pretend earlier attempts failed
+	svr.SetReconnectExp(5)
+	svr.Dial(svrCtx)
+	select {
+	case err := <-errs:
+		if !errors.Is(err, client.ErrRegistrationTimeout) {
+			t.Fatalf("Got wrong error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Registration didn't time out")
+	}
+	svr.Close(ctx)
+	// Backoff must not be reset by connecting without being welcomed
+	if exp := *svr.GetReconnectExp(); exp != 5 {
+		t.Fatalf("Reconnect exponent was reset: %d", exp)
+	}
+}
+
+func TestOperAndUserModes(t *testing.T) {
+	// Start fake IRC server on ephermal port
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+
+	done := make(chan struct{}, 1)
+	errors := make(chan error, 2)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errors <- err
+			return
+		}
+		dec := irc.NewDecoder(conn)
+		enc := irc.NewEncoder(conn)
+		userModesSet := false
+		for {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			msg, err := dec.Decode()
+			if err != nil {
+				errors <- err
+				return
+			}
+			switch msg.Command {
+			case irc.USER:
+				enc.Encode(&irc.Message{
+					Command: irc.RPL_WELCOME,
+					Params:  []string{"testbot1", "Welcome"},
+				})
+			case irc.OPER:
+				if !userModesSet {
+					errors <- fmt.Errorf("OPER sent before user modes")
+					return
+				}
+				if msg.Params[0] != "opername" || msg.Params[1] != "operpass" {
+					errors <- fmt.Errorf("Bad OPER parameters: %s", msg)
+					return
+				}
+				enc.Encode(&irc.Message{
+					Command: irc.RPL_YOUREOPER,
+					Params:  []string{"testbot1", "You are now an IRC operator"},
+				})
+			case irc.MODE:
+				if msg.Params[0] == "testbot1" && msg.Params[1] == "+Bi" {
+					userModesSet = true
+					continue
+				}
+				if msg.Params[0] != "testbot1" || msg.Params[1] != "+s" {
+					errors <- fmt.Errorf("Bad MODE parameters: %s", msg)
+					return
+				}
+				done <- struct{}{}
+				return
+			}
+		}
+	}()
+
+	settings := &client.IrcServerSettings{
+		Host:         "localhost",
+		Port:         serverPort,
+		Nick:         "testbot1",
+		OperModes:    "+s",
+		OperName:     "opername",
+		OperPassword: "operpass",
+		Realname:     "testbotr",
+		UserModes:    "+Bi",
+		Username:     "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	select {
+	case err := <-errors:
+		t.Fatal(err)
+	case <-done:
+		break
+	}
+}
+
+func TestPerform(t *testing.T) {
+	if err := client.ValidatePerformCommand("MODE $nick +B"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"", "PRIVMSG Q :AUTH\r\nQUIT"} {
+		if err := client.ValidatePerformCommand(line); err == nil {
+			t.Fatalf("Invalid command wasn't rejected: %q", line)
+		}
+	}
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	received := make(chan string, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			switch msg.Command {
+			case irc.USER:
+				// We were given another nick than the configured one
+				fmt.Fprint(conn, ":irc.example.com 001 other :Welcome\r\n")
+			case irc.MODE, irc.PRIVMSG:
+				received <- msg.String()
+			}
+		}
+	}()
+	settings := &client.IrcServerSettings{
+		Host:     "localhost",
+		Port:     serverPort,
+		Nick:     "testbot1",
+		Perform:  []string{"MODE $nick +B", "PRIVMSG Q :AUTH testbot secret"},
+		Realname: "testbotr",
+		Username: "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	for _, expected := range []string{"MODE other +B", "PRIVMSG Q :AUTH testbot secret"} {
+		select {
+		case line := <-received:
+			if line != expected {
+				t.Fatalf("Got wrong command: %q != %q", line, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+}
+
+func TestReconnectStrategy(t *testing.T) {
+	strategy := &client.ReconnectStrategy{Base: time.Second, Max: 5 * time.Second, Multiplier: 2}
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if delay := strategy.Delay(uint64(attempt + 1)); delay != expected {
+			t.Fatalf("Wrong delay of attempt %d: %s != %s", attempt+1, delay, expected)
+		}
+	}
+	strategy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := strategy.Delay(1); delay < 500*time.Millisecond || delay > 1500*time.Millisecond {
+			t.Fatalf("Delay out of jitter range: %s", delay)
+		}
+	}
+	// Delays without a maximum don't overflow
+	unlimited := &client.ReconnectStrategy{Base: time.Second, Multiplier: 2}
+	for _, attempt := range []uint64{64, 1000, math.MaxUint64} {
+		if delay := unlimited.Delay(attempt); delay != 24*time.Hour {
+			t.Fatalf("Wrong delay of attempt %d without maximum: %s", attempt, delay)
+		}
+	}
+	for _, invalid := range []client.ReconnectStrategy{
+		{Base: -time.Second, Multiplier: 2},
+		{Multiplier: 2},
+		{Base: time.Second, Multiplier: 0.5},
+		{Base: time.Second, Multiplier: 2, Jitter: 2},
+		{Base: time.Second, Multiplier: math.NaN()},
+		{Base: time.Second, Multiplier: math.Inf(1)},
+		{Base: time.Second, Multiplier: 2, Jitter: math.NaN()},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("Invalid strategy wasn't rejected: %+v", invalid)
+		}
+	}
+	// Backoff is only reset once the connection stayed up long enough
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if msg.Command == irc.USER {
+				fmt.Fprint(conn, ":irc.example.com 001 testbot1 :Welcome\r\n")
+			}
+		}
+	}()
+	welcomed := make(chan struct{})
+	var attempts []uint64
+	settings := &client.IrcServerSettings{
+		Host:      "localhost",
+		Port:      serverPort,
+		Nick:      "testbot1",
+		Realname:  "testbotr",
+		Reconnect: &client.ReconnectStrategy{Base: 10 * time.Millisecond, Multiplier: 2, ResetAfter: 100 * time.Millisecond},
+		Username:  "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			if msg.Command == irc.RPL_WELCOME {
+				close(welcomed)
+			}
+		},
+		ReconnectCallback: func(ctx context.Context, svrName string, attempt uint64, delay time.Duration) {
+			if delay != time.Duration(attempt)*10*time.Millisecond {
+				t.Errorf("Wrong delay of attempt %d: %s", attempt, delay)
+			}
+			attempts = append(attempts, attempt)
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.ReconnectWait(svrCtx)
+	svr.ReconnectWait(svrCtx)
+	if len(attempts) != 2 || attempts[1] != 2 {
+		t.Fatalf("Wrong attempts: %v", attempts)
+	}
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	select {
+	case <-welcomed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	if exp := atomic.LoadUint64(svr.GetReconnectExp()); exp != 2 {
+		t.Fatalf("Backoff was reset too early: %d", exp)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(svr.GetReconnectExp()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Backoff wasn't reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	for _, tc := range []struct {
+		closes bool
+		reason string
+	}{
+		// Close waits for the server to close the connection
+		{true, "See you later"},
+		// but not for longer than the deadline
+		{false, ""},
+	} {
+		l, serverPort := test.FakeServer(t)
+		quit := make(chan string, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			dec := irc.NewDecoder(conn)
+			for {
+				msg, err := dec.Decode()
+				if err != nil {
+					return
+				}
+				switch msg.Command {
+				case irc.USER:
+					fmt.Fprint(conn, ":irc.example.com 001 testbot1 :Welcome\r\n")
+				case irc.QUIT:
+					quit <- msg.Params[0]
+					if !tc.closes {
+						continue
+					}
+					time.Sleep(100 * time.Millisecond)
+					fmt.Fprint(conn, "ERROR :Closing link\r\n")
+					return
+				}
+			}
+		}()
+		welcomed := make(chan struct{})
+		errs := make(chan error, 1)
+		settings := &client.IrcServerSettings{
+			Host:     "localhost",
+			Port:     serverPort,
+			Nick:     "testbot1",
+			Realname: "testbotr",
+			Username: "testbotu",
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+				errs <- err
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+				if msg.Command == irc.RPL_WELCOME {
+					close(welcomed)
+				}
+			},
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case <-welcomed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out")
+		}
+		closeCtx, cancel := context.WithTimeout(client.ContextWithQuitMessage(ctx, tc.reason), time.Second)
+		start := time.Now()
+		svr.Close(closeCtx)
+		elapsed := time.Since(start)
+		cancel()
+		expected := tc.reason
+		if len(expected) == 0 {
+			expected = client.DefaultQuitMessage
+		}
+		select {
+		case reason := <-quit:
+			if reason != expected {
+				t.Fatalf("Got wrong QUIT reason: %q != %q", reason, expected)
+			}
+		default:
+			t.Fatal("Close returned before QUIT was received")
+		}
+		if tc.closes && (elapsed < 100*time.Millisecond || elapsed >= time.Second) {
+			t.Fatalf("Close didn't wait for the server: %s", elapsed)
+		}
+		if !tc.closes && elapsed < time.Second {
+			t.Fatalf("Close returned before the deadline: %s", elapsed)
+		}
+		// The connection ending isn't an error after quitting
+		select {
+		case err := <-errs:
+			t.Fatalf("Got error: %s", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		l.Close()
+	}
+}
+
+// selfSignedCert creates a certificate for localhost which isn't trusted by system CAs
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func TestTLSPin(t *testing.T) {
+	cert := selfSignedCert(t)
+	for _, tc := range []struct {
+		pin     string
+		success bool
+	}{
+		// Matching pin allows connecting to self-signed server
+		{client.Fingerprint(cert.Certificate[0]), true},
+		// Mismatch fails the connection
+		{strings.Repeat("0", 64), false},
+	} {
+		l, err := tls.Listen("tcp", "localhost:0", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			enc := irc.NewEncoder(conn)
+			enc.Encode(&irc.Message{
+				Command: irc.RPL_WELCOME,
+				Params:  []string{"testbot1", "Welcome"},
+			})
+		}()
+		errs := make(chan error, 1)
+		input := make(chan *irc.Message, 1)
+		settings := &client.IrcServerSettings{
+			Host:      "localhost",
+			Port:      l.Addr().(*net.TCPAddr).Port,
+			Nick:      "testbot1",
+			Realname:  "testbotr",
+			Username:  "testbotu",
+			TLS:       true,
+			TLSPin:    tc.pin,
+			VerifyTLS: true,
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+				input <- msg
+			},
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case msg := <-input:
+			if !tc.success {
+				t.Fatalf("Got message despite pin mismatch: %s", msg)
+			}
+		case err := <-errs:
+			if tc.success {
+				t.Fatalf("Got error despite matching pin: %s", err)
+			}
+			var pinError *client.PinError
+			if !errors.As(err, &pinError) {
+				t.Fatalf("Got wrong error: %s", err)
+			}
+			if class := client.ClassifyError(err); class != client.ErrorClassTLS {
+				t.Fatalf("Wrong error class: %s", class)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out")
+		}
+		svr.Close(ctx)
+		l.Close()
+	}
+}
+
+func TestTLSCA(t *testing.T) {
+	cert := selfSignedCert(t)
+	otherCert := selfSignedCert(t)
+	dir, err := ioutil.TempDir("", "bananaboat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Self-signed certificates are their own CA
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	otherCAFile := filepath.Join(dir, "other.pem")
+	if err := ioutil.WriteFile(otherCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ValidateCAFile(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatal("Missing CA file wasn't rejected")
+	}
+	if err := client.ValidateCAFile(caFile); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ca      string
+		pin     string
+		success bool
+	}{
+		// Server signed by our CA is accepted
+		{caFile, "", true},
+		// Server signed by another CA is refused
+		{otherCAFile, "", false},
+		// Pin is still a fallback
+		{otherCAFile, client.Fingerprint(cert.Certificate[0]), true},
+	} {
+		l, err := tls.Listen("tcp", "localhost:0", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			enc := irc.NewEncoder(conn)
+			enc.Encode(&irc.Message{
+				Command: irc.RPL_WELCOME,
+				Params:  []string{"testbot1", "Welcome"},
+			})
+		}()
+		errs := make(chan error, 1)
+		input := make(chan *irc.Message, 1)
+		settings := &client.IrcServerSettings{
+			Host:      "localhost",
+			Port:      l.Addr().(*net.TCPAddr).Port,
+			Nick:      "testbot1",
+			Realname:  "testbotr",
+			Username:  "testbotu",
+			TLS:       true,
+			TLSCA:     tc.ca,
+			TLSPin:    tc.pin,
+			VerifyTLS: true,
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+				input <- msg
+			},
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case msg := <-input:
+			if !tc.success {
+				t.Fatalf("Got message despite untrusted CA: %s", msg)
+			}
+		case err := <-errs:
+			if tc.success {
+				t.Fatalf("Got error despite trusted certificate: %s", err)
+			}
+			if class := client.ClassifyError(err); class != client.ErrorClassTLS {
+				t.Fatalf("Wrong error class: %s (%s)", class, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out")
+		}
+		svr.Close(ctx)
+		l.Close()
+	}
+}
+
+func TestSTS(t *testing.T) {
+	cert := selfSignedCert(t)
+	secure, err := tls.Listen("tcp", "localhost:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secure.Close()
+	securePort := secure.Addr().(*net.TCPAddr).Port
+	insecure, insecurePort := test.FakeServer(t)
+	defer insecure.Close()
+	// Both servers advertise a policy, only the secure one tells how long it lasts
+	serve := func(l net.Listener, sts string) {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if msg.Command == irc.CAP && msg.Params[0] == irc.CAP_LS {
+				fmt.Fprintf(conn, ":irc.example.com CAP * LS :server-time sts=%s\r\n", sts)
+			}
+		}
+	}
+	go serve(insecure, fmt.Sprintf("port=%d", securePort))
+	go serve(secure, fmt.Sprintf("duration=300,port=%d", securePort))
+	errs := make(chan error, 1)
+	policies := make(chan client.STSPolicy, 1)
+	var known *client.STSPolicy
+	settings := &client.IrcServerSettings{
+		Capabilities: []string{"server-time"},
+		Host:         "localhost",
+		Port:         insecurePort,
+		Nick:         "testbot1",
+		Realname:     "testbotr",
+		Username:     "testbotu",
+		TLSPin:       client.Fingerprint(cert.Certificate[0]),
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			// Errors of closed connections are expected
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+		},
+		STSCallback: func(ctx context.Context, svrName string, host string, policy client.STSPolicy) {
+			policies <- policy
+		},
+		STSLookup: func(host string) (client.STSPolicy, bool) {
+			if known == nil {
+				return client.STSPolicy{}, false
+			}
+			return *known, true
+		},
+	}
+	ctx := context.TODO()
+	// Insecure connections advertising a policy are dropped so we can upgrade
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	select {
+	case err := <-errs:
+		var stsError *client.STSUpgradeError
+		if !errors.As(err, &stsError) || stsError.Port != securePort || client.ClassifyError(err) != client.ErrorClassSTS {
+			t.Fatalf("Wrong error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	svr.Close(ctx)
+	// Known policies make us connect using TLS on their port
+	known = &client.STSPolicy{Port: securePort}
+	svr, svrCtx = client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	select {
+	case policy := <-policies:
+		if policy.Port != securePort || policy.Expires.Before(time.Now().Add(299*time.Second)) {
+			t.Fatalf("Wrong policy: %v", policy)
+		}
+	case err := <-errs:
+		t.Fatalf("Got error: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+func TestTLSVersion(t *testing.T) {
+	cert := selfSignedCert(t)
+	if err := client.ValidateTLSVersion("1.4"); err == nil {
+		t.Fatal("Unknown TLS version wasn't rejected")
+	}
+	if err := client.ValidateCipherSuite("TLS_BOGUS"); err == nil {
+		t.Fatal("Unknown cipher suite wasn't rejected")
+	}
+	for _, tc := range []struct {
+		minVersion string
+		ciphers    []string
+		success    bool
+	}{
+		// Default accepts TLS 1.2
+		{"", nil, true},
+		// Server is too old
+		{"1.3", nil, false},
+		// Cipher suite offered by the server
+		{"", []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}, true},
+		// No cipher suite in common
+		{"", []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}, false},
+	} {
+		for _, cipher := range tc.ciphers {
+			if err := client.ValidateCipherSuite(cipher); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l, err := tls.Listen("tcp", "localhost:0", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			MaxVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			enc := irc.NewEncoder(conn)
+			enc.Encode(&irc.Message{
+				Command: irc.RPL_WELCOME,
+				Params:  []string{"testbot1", "Welcome"},
+			})
+		}()
+		errs := make(chan error, 1)
+		input := make(chan *irc.Message, 1)
+		settings := &client.IrcServerSettings{
+			Host:            "localhost",
+			Port:            l.Addr().(*net.TCPAddr).Port,
+			Nick:            "testbot1",
+			Realname:        "testbotr",
+			Username:        "testbotu",
+			TLS:             true,
+			TLSCipherSuites: tc.ciphers,
+			TLSMinVersion:   tc.minVersion,
+			TLSPin:          client.Fingerprint(cert.Certificate[0]),
+			VerifyTLS:       true,
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+				input <- msg
+			},
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case msg := <-input:
+			if !tc.success {
+				t.Fatalf("Got message despite unacceptable TLS (%q %v): %s", tc.minVersion, tc.ciphers, msg)
+			}
+		case err := <-errs:
+			if tc.success {
+				t.Fatalf("Got error (%q %v): %s", tc.minVersion, tc.ciphers, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out")
+		}
+		svr.Close(ctx)
+		l.Close()
+	}
+}
+
+func TestLag(t *testing.T) {
+	// Start fake IRC server on ephermal port
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		dec := irc.NewDecoder(conn)
+		enc := irc.NewEncoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			switch msg.Command {
+			case irc.USER:
+				enc.Encode(&irc.Message{
+					Command: irc.RPL_WELCOME,
+					Params:  []string{"testbot1", "Welcome"},
+				})
+			case irc.PING:
+				enc.Encode(&irc.Message{
+					Prefix:  &irc.Prefix{Name: "irc.example.com"},
+					Command: irc.PONG,
+					Params:  []string{"irc.example.com", msg.Params[0]},
+				})
+			}
+		}
+	}()
+
+	settings := &client.IrcServerSettings{
+		Host:         "localhost",
+		Port:         serverPort,
+		Nick:         "testbot1",
+		PingInterval: 10 * time.Millisecond,
+		Realname:     "testbotr",
+		Username:     "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for svr.GetState().Lag() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Lag wasn't measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	// Start fake IRC server on ephermal port which never answers PINGs
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+
+	pings := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		enc := irc.NewEncoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			switch msg.Command {
+			case irc.USER:
+				enc.Encode(&irc.Message{
+					Command: irc.RPL_WELCOME,
+					Params:  []string{"testbot1", "Welcome"},
+				})
+			case irc.PING:
+				pings <- msg.Params[0]
+			}
+		}
+	}()
+
+	errs := make(chan error, 1)
+	settings := &client.IrcServerSettings{
+		Host:         "localhost",
+		Port:         serverPort,
+		Nick:         "testbot1",
+		PingInterval: 10 * time.Millisecond,
+		PingTimeout:  100 * time.Millisecond,
+		Realname:     "testbotr",
+		Username:     "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	select {
+	case err := <-errs:
+		if err != client.ErrPingTimeout {
+			t.Fatalf("Got wrong error: %s", err)
+		}
+		if class := client.ClassifyError(err); class != client.ErrorClassTimeout {
+			t.Fatalf("Wrong error class: %s", class)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stalled connection wasn't detected")
+	}
+	// No further PINGs are sent while waiting for a PONG
+	if len(pings) != 1 {
+		t.Fatalf("Sent %d PINGs instead of 1", len(pings))
+	}
+}
+
+func TestAway(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	away := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		enc := irc.NewEncoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			switch msg.Command {
+			case irc.USER:
+				enc.Encode(&irc.Message{
+					Command: irc.RPL_WELCOME,
+					Params:  []string{"testbot1", "Welcome"},
+				})
+			case irc.AWAY:
+				reason := ""
+				if len(msg.Params) > 0 {
+					reason = msg.Params[0]
+				}
+				away <- reason
+			}
+		}
+	}()
+	settings := &client.IrcServerSettings{
+		Host:     "localhost",
+		Port:     serverPort,
+		Nick:     "testbot1",
+		Realname: "testbotr",
+		Username: "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	// We were away before reconnecting
+	svr.GetState().SetAway("gone fishing")
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	select {
+	case reason := <-away:
+		if reason != "gone fishing" {
+			t.Fatalf("Marked away for %q", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wasn't marked away after registering")
+	}
+	// Coming back is tracked from messages we send and confirmed by the server
+	svr.GetMessages() <- irc.Message{Command: irc.AWAY}
+	select {
+	case reason := <-away:
+		if len(reason) > 0 {
+			t.Fatalf("Marked away for %q instead of back", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AWAY wasn't sent")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(svr.GetState().Away()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Still away after sending AWAY")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	svr.GetState().SetAway("gone fishing")
+	svr.GetState().Handle(&irc.Message{Command: irc.RPL_UNAWAY, Params: []string{"testbot1", "You are no longer marked as being away"}})
+	if reason := svr.GetState().Away(); len(reason) > 0 {
+		t.Fatalf("Still away for %q", reason)
+	}
+}
+
+func TestSASL(t *testing.T) {
+	credentials := base64.StdEncoding.EncodeToString([]byte("acct\x00acct\x00secret"))
+	for _, tc := range []struct {
+		// failures is the number of attempts failing before services respond
+		failures int
+		password string
+		retries  int
+		// attempts is the number of attempts expected if authentication fails
+		attempts  int
+		transient bool
+		success   bool
+	}{
+		{failures: 1, password: "secret", retries: 1, success: true},
+		{failures: 5, password: "secret", retries: 1, attempts: 2, transient: true},
+		{failures: 0, password: "wrong", retries: 3, attempts: 1},
+	} {
+		l, serverPort := test.FakeServer(t)
+		go func(failures int) {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			dec := irc.NewDecoder(conn)
+			enc := irc.NewEncoder(conn)
+			for {
+				msg, err := dec.Decode()
+				if err != nil {
+					return
+				}
+				switch msg.Command {
+				case irc.CAP:
+					if msg.Params[0] == irc.CAP_LS {
+						enc.Encode(&irc.Message{
+							Command: irc.CAP,
+							Params:  []string{"*", irc.CAP_LS, "sasl=PLAIN"},
+						})
+					} else if msg.Params[0] == irc.CAP_REQ {
+						enc.Encode(&irc.Message{
+							Command: irc.CAP,
+							Params:  []string{"*", irc.CAP_ACK, "sasl"},
+						})
+					} else if msg.Params[0] == irc.CAP_END {
+						enc.Encode(&irc.Message{
+							Command: irc.RPL_WELCOME,
+							Params:  []string{"testbot1", "Welcome"},
+						})
+					}
+				case irc.AUTHENTICATE:
+					switch {
+					case msg.Params[0] == "PLAIN" && failures > 0:
+						// Services are lagging
+						failures--
+						enc.Encode(&irc.Message{
+							Command: irc.ERR_SASLFAIL,
+							Params:  []string{"testbot1", "SASL authentication failed"},
+						})
+					case msg.Params[0] == "PLAIN":
+						enc.Encode(&irc.Message{
+							Command: irc.AUTHENTICATE,
+							Params:  []string{"+"},
+						})
+					case msg.Params[0] == credentials:
+						enc.Encode(&irc.Message{
+							Command: irc.RPL_SASLSUCCESS,
+							Params:  []string{"testbot1", "SASL authentication successful"},
+						})
+					default:
+						enc.Encode(&irc.Message{
+							Command: irc.ERR_SASLFAIL,
+							Params:  []string{"testbot1", "SASL authentication failed"},
+						})
+					}
+				}
+			}
+		}(tc.failures)
+		errs := make(chan error, 1)
+		welcome := make(chan struct{}, 1)
+		settings := &client.IrcServerSettings{
+			Host:           "localhost",
+			Port:           serverPort,
+			Nick:           "testbot1",
+			Realname:       "testbotr",
+			Username:       "testbotu",
+			SASLPassword:   tc.password,
+			SASLRetries:    tc.retries,
+			SASLRetryDelay: 10 * time.Millisecond,
+			SASLUser:       "acct",
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+				if msg.Command == irc.RPL_WELCOME {
+					welcome <- struct{}{}
+				}
+			},
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case <-welcome:
+			if !tc.success {
+				t.Fatalf("Registered despite SASL failure: %+v", tc)
+			}
+		case err := <-errs:
+			if tc.success {
+				t.Fatalf("Got error despite SASL success: %s", err)
+			}
+			var saslError *client.SASLError
+			if !errors.As(err, &saslError) {
+				t.Fatalf("Got wrong error: %s", err)
+			}
+			if saslError.Attempts != tc.attempts || saslError.Transient != tc.transient {
+				t.Fatalf("Got wrong SASL error: %+v", saslError)
+			}
+			if class := client.ClassifyError(err); class != client.ErrorClassSASL {
+				t.Fatalf("Wrong error class: %s", class)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out")
+		}
+		svr.Close(ctx)
+		l.Close()
+	}
+}
+
+func TestRegistrationOrder(t *testing.T) {
+	credentials := base64.StdEncoding.EncodeToString([]byte("acct\x00acct\x00secret"))
+	for _, tc := range []struct {
+		name     string
+		order    []string
+		password string
+		sasl     bool
+		// noCAP is set if the server doesn't support capability negotiation
+		noCAP    bool
+		webirc   bool
+		expected []string
+	}{
+		{
+			name:   "webirc",
+			order:  []string{client.RegisterNick, client.RegisterPass},
+			webirc: true,
+			expected: []string{
+				"WEBIRC secret webchat 0::1 0::1", "NICK testbot1", "USER testbotu 0 * testbotr",
+			},
+		},
+		{
+			name:     "plain",
+			expected: []string{"NICK testbot1", "USER testbotu 0 * testbotr"},
+		},
+		{
+			name:     "pass",
+			password: "hunter2",
+			expected: []string{"PASS hunter2", "NICK testbot1", "USER testbotu 0 * testbotr"},
+		},
+		{
+			name:     "sasl",
+			password: "hunter2",
+			sasl:     true,
+			expected: []string{
+				"CAP LS 302", "PASS hunter2", "NICK testbot1", "USER testbotu 0 * testbotr",
+				"CAP REQ sasl", "AUTHENTICATE PLAIN", "AUTHENTICATE " + credentials, "CAP END",
+			},
+		},
+		{
+			name:     "sasl before nick",
+			order:    []string{client.RegisterPass, client.RegisterCap, client.RegisterNegotiate},
+			password: "hunter2",
+			sasl:     true,
+			expected: []string{
+				"PASS hunter2", "CAP LS 302", "CAP REQ sasl", "AUTHENTICATE PLAIN", "AUTHENTICATE " + credentials,
+				"CAP END", "NICK testbot1", "USER testbotu 0 * testbotr",
+			},
+		},
+		{
+			name:     "no CAP support",
+			order:    []string{client.RegisterCap, client.RegisterNegotiate},
+			sasl:     true,
+			noCAP:    true,
+			expected: []string{"CAP LS 302", "NICK testbot1", "USER testbotu 0 * testbotr"},
+		},
+	} {
+		l, serverPort := test.FakeServer(t)
+		received := make(chan []string, 1)
+		go func(noCAP bool) {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			dec := irc.NewDecoder(conn)
+			enc := irc.NewEncoder(conn)
+			var commands []string
+			negotiating := false
+			gotUser := false
+			for {
+				msg, err := dec.Decode()
+				if err != nil {
+					return
+				}
+				commands = append(commands, msg.String())
+				switch {
+				case msg.Command == irc.CAP && noCAP:
+					enc.Encode(&irc.Message{
+						Command: irc.ERR_UNKNOWNCOMMAND,
+						Params:  []string{"*", irc.CAP, "Unknown command"},
+					})
+				case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_LS:
+					negotiating = true
+					enc.Encode(&irc.Message{
+						Command: irc.CAP,
+						Params:  []string{"*", irc.CAP_LS, "multi-prefix sasl"},
+					})
+				case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_REQ:
+					enc.Encode(&irc.Message{
+						Command: irc.CAP,
+						Params:  []string{"*", irc.CAP_ACK, msg.Params[1]},
+					})
+				case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_END:
+					negotiating = false
+				case msg.Command == irc.AUTHENTICATE && msg.Params[0] == "PLAIN":
+					enc.Encode(&irc.Message{
+						Command: irc.AUTHENTICATE,
+						Params:  []string{"+"},
+					})
+				case msg.Command == irc.AUTHENTICATE:
+					enc.Encode(&irc.Message{
+						Command: irc.RPL_SASLSUCCESS,
+						Params:  []string{"testbot1", "SASL authentication successful"},
+					})
+				case msg.Command == irc.USER:
+					gotUser = true
+				}
+				// Registration is suspended while capabilities are negotiated
+				if gotUser && !negotiating {
+					received <- commands
+					enc.Encode(&irc.Message{
+						Command: irc.RPL_WELCOME,
+						Params:  []string{"testbot1", "Welcome"},
+					})
+					return
+				}
+			}
+		}(tc.noCAP)
+		settings := &client.IrcServerSettings{
+			Host:              "localhost",
+			Port:              serverPort,
+			Nick:              "testbot1",
+			Password:          tc.password,
+			Realname:          "testbotr",
+			RegistrationOrder: tc.order,
+			Username:          "testbotu",
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			},
+		}
+		if tc.webirc {
+			settings.WebIRCGateway = "webchat"
+			settings.WebIRCHost = "::1"
+			settings.WebIRCIP = "::1"
+			settings.WebIRCPassword = "secret"
+		}
+		if tc.sasl {
+			settings.SASLUser = "acct"
+			settings.SASLPassword = "secret"
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case commands := <-received:
+			if !reflect.DeepEqual(commands, tc.expected) {
+				t.Errorf("%s: got wrong registration commands: %q", tc.name, commands)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out", tc.name)
+		}
+		svr.Close(ctx)
+		l.Close()
+	}
+	if err := client.ValidateRegistrationOrder([]string{client.RegisterNick, "bogus"}); err == nil {
+		t.Fatal("Invalid registration order wasn't rejected")
+	}
+	if err := client.ValidateRegistrationOrder([]string{client.RegisterNick, client.RegisterNick}); err == nil {
+		t.Fatal("Repeated registration step wasn't rejected")
+	}
+}
+
+func TestSASLExternal(t *testing.T) {
+	serverCert := selfSignedCert(t)
+	clientCert := selfSignedCert(t)
+	// Write client certificate and key to a single file
+	dir, err := ioutil.TempDir("", "bananaboat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyDER, err := x509.MarshalECPrivateKey(clientCert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "client.pem")
+	pemData := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	if err := ioutil.WriteFile(certFile, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "localhost:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fingerprints := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		enc := irc.NewEncoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			switch {
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_LS:
+				enc.Encode(&irc.Message{Command: irc.CAP, Params: []string{"*", irc.CAP_LS, "sasl=EXTERNAL"}})
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_REQ:
+				enc.Encode(&irc.Message{Command: irc.CAP, Params: []string{"*", irc.CAP_ACK, msg.Params[1]}})
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_END:
+				enc.Encode(&irc.Message{Command: irc.RPL_WELCOME, Params: []string{"testbot1", "Welcome"}})
+			case msg.Command == irc.AUTHENTICATE && msg.Params[0] == client.SASLExternal:
+				enc.Encode(&irc.Message{Command: irc.AUTHENTICATE, Params: []string{"+"}})
+			case msg.Command == irc.AUTHENTICATE && msg.Params[0] == "+":
+				// Services identify us by the fingerprint of our certificate
+				certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+				if len(certs) > 0 {
+					fingerprints <- client.Fingerprint(certs[0].Raw)
+				}
+				enc.Encode(&irc.Message{Command: irc.RPL_SASLSUCCESS, Params: []string{"testbot1", "SASL authentication successful"}})
+			}
+		}
+	}()
+	errs := make(chan error, 1)
+	welcome := make(chan struct{}, 1)
+	settings := &client.IrcServerSettings{
+		Host:          "localhost",
+		Port:          l.Addr().(*net.TCPAddr).Port,
+		Nick:          "testbot1",
+		Realname:      "testbotr",
+		Username:      "testbotu",
+		SASLMechanism: client.SASLExternal,
+		TLS:           true,
+		TLSCert:       certFile,
+		TLSPin:        client.Fingerprint(serverCert.Certificate[0]),
+		VerifyTLS:     true,
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			if msg.Command == irc.RPL_WELCOME {
+				welcome <- struct{}{}
+			}
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	select {
+	case fingerprint := <-fingerprints:
+		if fingerprint != client.Fingerprint(clientCert.Certificate[0]) {
+			t.Fatalf("Server got wrong certificate: %s", fingerprint)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	select {
+	case <-welcome:
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	serverCert := selfSignedCert(t)
+	clientCert := selfSignedCert(t)
+	// Write client certificate and key to separate files
+	dir, err := ioutil.TempDir("", "bananaboat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyDER, err := x509.MarshalECPrivateKey(clientCert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ValidateClientCertificate(certFile, keyFile); err == nil {
+		t.Fatal("Missing key wasn't rejected")
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ValidateClientCertificate(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "localhost:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fingerprints := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The certificate is required by the transport without SASL being involved
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) > 0 {
+			fingerprints <- client.Fingerprint(certs[0].Raw)
+		}
+		dec := irc.NewDecoder(conn)
+		enc := irc.NewEncoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if msg.Command == irc.USER {
+				enc.Encode(&irc.Message{Command: irc.RPL_WELCOME, Params: []string{"testbot1", "Welcome"}})
+			}
+		}
+	}()
+	errs := make(chan error, 1)
+	welcome := make(chan struct{}, 1)
+	settings := &client.IrcServerSettings{
+		Host:      "localhost",
+		Port:      l.Addr().(*net.TCPAddr).Port,
+		Nick:      "testbot1",
+		Realname:  "testbotr",
+		Username:  "testbotu",
+		TLS:       true,
+		TLSCert:   certFile,
+		TLSKey:    keyFile,
+		TLSPin:    client.Fingerprint(serverCert.Certificate[0]),
+		VerifyTLS: true,
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			if msg.Command == irc.RPL_WELCOME {
+				welcome <- struct{}{}
+			}
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	select {
+	case fingerprint := <-fingerprints:
+		if fingerprint != client.Fingerprint(clientCert.Certificate[0]) {
+			t.Fatalf("Server got wrong certificate: %s", fingerprint)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	select {
+	case <-welcome:
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+func TestTags(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		ended := false
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if msg.Command != irc.CAP {
+				continue
+			}
+			switch {
+			case msg.Params[0] == irc.CAP_LS:
+				// List is split over two messages
+				fmt.Fprint(conn, ":irc.example.com CAP * LS * :multi-prefix\r\n")
+				fmt.Fprint(conn, ":irc.example.com CAP * LS :message-tags\r\n")
+			case msg.Params[0] == irc.CAP_REQ && msg.Params[1] == "message-tags":
+				fmt.Fprint(conn, ":irc.example.com CAP * ACK :message-tags\r\n")
+			case msg.Params[0] == irc.CAP_REQ && ended:
+				// Capability announced after registration is requested
+				fmt.Fprintf(conn, ":irc.example.com CAP testbot1 ACK :%s\r\n", msg.Params[1])
+			case msg.Params[0] == irc.CAP_REQ:
+				fmt.Fprintf(conn, ":irc.example.com CAP * NAK :%s\r\n", msg.Params[1])
+			case msg.Params[0] == irc.CAP_END:
+				ended = true
+				// Registration completes only after capability negotiation ended
+				fmt.Fprint(conn, ":irc.example.com 001 testbot1 :Welcome\r\n")
+				fmt.Fprint(conn, "@msgid=abc;+example.com/x=a\\sb\\:c;flag;time=2020-01-01T00:00:00.250Z :nick1!u@h PRIVMSG testbot1 :hello\r\n")
+				fmt.Fprint(conn, ":irc.example.com CAP testbot1 NEW :unsupported\r\n")
+			}
+		}
+	}()
+	tags := make(chan map[string]string, 1)
+	times := make(chan time.Time, 2)
+	settings := &client.IrcServerSettings{
+		Capabilities: []string{"message-tags", "unsupported"},
+		Host:         "localhost",
+		Port:         serverPort,
+		Nick:         "testbot1",
+		Realname:     "testbotr",
+		Username:     "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			if t, ok := client.TimeFromContext(ctx); ok && (msg.Command == irc.RPL_WELCOME || msg.Command == irc.PRIVMSG) {
+				times <- t
+			}
+			if msg.Command == irc.PRIVMSG {
+				tags <- client.TagsFromContext(ctx)
+			}
+		},
+	}
+	ctx := context.TODO()
+	start := time.Now()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	select {
+	case got := <-tags:
+		expected := map[string]string{
+			"msgid":          "abc",
+			"+example.com/x": "a b;c",
+			"flag":           "",
+			"time":           "2020-01-01T00:00:00.250Z",
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("Got wrong tags: %v", got)
+		}
+		for k, v := range expected {
+			if got[k] != v {
+				t.Fatalf("Got wrong tags: %v", got)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	// Messages without a time tag are timestamped when received
+	if received := <-times; received.Before(start) || received.After(time.Now()) {
+		t.Fatalf("Got wrong receipt time: %v", received)
+	}
+	if sent := <-times; !sent.Equal(time.Date(2020, 1, 1, 0, 0, 0, 250000000, time.UTC)) {
+		t.Fatalf("Got wrong server time: %v", sent)
+	}
+	// Capabilities becoming available later are requested
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(svr.GetState().Capabilities(), []string{"message-tags", "unsupported"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Got wrong capabilities: %v", svr.GetState().Capabilities())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			switch {
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_LS:
+				fmt.Fprint(conn, ":irc.example.com CAP * LS :account-notify account-tag extended-join\r\n")
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_REQ:
+				fmt.Fprintf(conn, ":irc.example.com CAP * ACK :%s\r\n", msg.Params[1])
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_END:
+				fmt.Fprint(conn, ":irc.example.com 001 testbot1 :Welcome\r\n")
+				fmt.Fprint(conn, ":testbot1!u@h JOIN #chan * :Bot\r\n")
+				fmt.Fprint(conn, ":alice!a@h JOIN #chan alice_acct :Alice\r\n")
+				fmt.Fprint(conn, ":bob!b@h JOIN #chan * :Bob\r\n")
+				fmt.Fprint(conn, ":carol!c@h JOIN #chan carol_acct :Carol\r\n")
+				// Accounts are kept when names are listed
+				fmt.Fprint(conn, ":irc.example.com 353 testbot1 = #chan :@testbot1 alice bob carol\r\n")
+				fmt.Fprint(conn, ":irc.example.com 366 testbot1 #chan :End of /NAMES list.\r\n")
+				fmt.Fprint(conn, "@account=bob_acct :bob!b@h PRIVMSG #chan :hi\r\n")
+				fmt.Fprint(conn, ":alice!a@h ACCOUNT *\r\n")
+				fmt.Fprint(conn, "@account=bob_acct :bob!b@h AWAY :Gone fishing\r\n")
+				fmt.Fprint(conn, ":carol!c@h AWAY :Lunch\r\n")
+				fmt.Fprint(conn, ":carol!c@h AWAY\r\n")
+				// Messages without the tag are from users who aren't logged in
+				fmt.Fprint(conn, ":carol!c@h PRIVMSG #chan :done\r\n")
+			}
+		}
+	}()
+	done := make(chan struct{})
+	settings := &client.IrcServerSettings{
+		Capabilities: []string{"account-notify", "account-tag", "extended-join"},
+		Host:         "localhost",
+		Port:         serverPort,
+		Nick:         "testbot1",
+		Realname:     "testbotr",
+		Username:     "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			if msg.Command == irc.PRIVMSG && msg.Params[1] == "done" {
+				close(done)
+			}
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	state := svr.GetState()
+	for nick, expected := range map[string]string{
+		"alice": "",
+		"BOB":   "bob_acct",
+		"carol": "",
+		"dave":  "",
+	} {
+		if account, ok := state.Account(nick); account != expected || ok != (len(expected) > 0) {
+			t.Errorf("Wrong account of %s: %q", nick, account)
+		}
+	}
+	if m, ok := state.Member("#chan", "bob"); !ok || m.Account != "bob_acct" || m.Realname != "Bob" || m.Away != "Gone fishing" {
+		t.Fatalf("Wrong member: %v", m)
+	}
+	if reason, ok := state.AwayReason("carol"); ok {
+		t.Errorf("Carol should be back: %q", reason)
+	}
+}
+
+func TestChatHistory(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			switch {
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_LS:
+				fmt.Fprint(conn, ":irc.example.com CAP * LS :batch draft/chathistory server-time\r\n")
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_REQ:
+				fmt.Fprintf(conn, ":irc.example.com CAP * ACK :%s\r\n", msg.Params[1])
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_END:
+				fmt.Fprint(conn, ":irc.example.com 001 testbot1 :Welcome\r\n")
+			case msg.Command == client.ChatHistory:
+				fmt.Fprintf(conn, ":irc.example.com BATCH +h1 chathistory %s\r\n", msg.Params[1])
+				fmt.Fprint(conn, "@batch=h1;time=2020-01-01T00:00:00.000Z :nick1!u@h PRIVMSG #test :old\r\n")
+				fmt.Fprint(conn, "@batch=h1;time=2020-01-01T00:01:00.000Z :nick1!u@h PART #test\r\n")
+				fmt.Fprint(conn, ":irc.example.com BATCH -h1\r\n")
+				fmt.Fprint(conn, ":nick1!u@h PRIVMSG #test :new\r\n")
+				// Other batches are handled like live messages
+				fmt.Fprint(conn, ":irc.example.com BATCH +s1 netsplit irc.example.com irc2.example.com\r\n")
+				fmt.Fprint(conn, "@batch=s1 :nick2!u@h QUIT :irc.example.com irc2.example.com\r\n")
+				fmt.Fprint(conn, ":irc.example.com BATCH -s1\r\n")
+			}
+		}
+	}()
+	batches := make(chan *client.Batch, 1)
+	texts := make(chan string, 10)
+	splits := make(chan string, 1)
+	var state *client.ServerState
+	settings := &client.IrcServerSettings{
+		Capabilities: []string{"batch", "draft/chathistory", "server-time"},
+		Host:         "localhost",
+		Port:         serverPort,
+		Nick:         "testbot1",
+		Realname:     "testbotr",
+		Username:     "testbotu",
+		BatchCallback: func(ctx context.Context, svrName string, batch *client.Batch) {
+			batches <- batch
+		},
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			if msg.Command == irc.PRIVMSG {
+				texts <- msg.Params[1]
+			}
+			if msg.Command == irc.QUIT {
+				batch, _ := state.OpenBatch(client.TagsFromContext(ctx)["batch"])
+				splits <- batch.Type + " " + strings.Join(batch.Params, " ")
+			}
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	state = svr.GetState()
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for !svr.GetState().SupportsChatHistory() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Got wrong capabilities: %v", svr.GetState().Capabilities())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	msg, err := client.NewChatHistory("latest", "#test", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.GetMessages() <- *msg
+	select {
+	case batch := <-batches:
+		if batch.Type != client.BatchChatHistory || len(batch.Params) != 1 || batch.Params[0] != "#test" {
+			t.Fatalf("Got wrong batch: %v", batch)
+		}
+		if len(batch.Messages) != 2 || batch.Messages[0].Message.Params[1] != "old" || batch.Messages[1].Message.Command != irc.PART {
+			t.Fatalf("Got wrong messages: %v", batch.Messages)
+		}
+		if !batch.Messages[1].Time.Equal(time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC)) {
+			t.Fatalf("Got wrong time: %v", batch.Messages[1].Time)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	// Replayed messages aren't handled like live ones
+	select {
+	case text := <-texts:
+		if text != "new" {
+			t.Fatalf("Got wrong message: %s", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	select {
+	case split := <-splits:
+		if split != "netsplit irc.example.com irc2.example.com" {
+			t.Fatalf("Got wrong batch: %s", split)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for _, ok := state.OpenBatch("s1"); ok; _, ok = state.OpenBatch("s1") {
+		if time.Now().After(deadline) {
+			t.Fatal("Batch wasn't forgotten after it ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLabeledResponse(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			var label string
+			if strings.HasPrefix(line, "@label=") {
+				i := strings.IndexByte(line, ' ')
+				label = line[len("@label="):i]
+				line = line[i+1:]
+			}
+			msg := irc.ParseMessage(line)
+			switch {
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_LS:
+				fmt.Fprint(conn, ":irc.example.com CAP * LS :batch labeled-response\r\n")
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_REQ:
+				fmt.Fprintf(conn, ":irc.example.com CAP * ACK :%s\r\n", msg.Params[1])
+			case msg.Command == irc.CAP && msg.Params[0] == irc.CAP_END:
+				fmt.Fprint(conn, ":irc.example.com 001 testbot1 :Welcome\r\n")
+			case msg.Command == irc.WHOIS:
+				lines <- label + " " + line
+				fmt.Fprintf(conn, "@label=%s :irc.example.com BATCH +w1 labeled-response\r\n", label)
+				fmt.Fprint(conn, "@batch=w1 :irc.example.com 311 testbot1 Nick1 u h * :Real\r\n")
+				fmt.Fprint(conn, "@batch=w1 :irc.example.com 318 testbot1 Nick1 :End of /WHOIS list.\r\n")
+				fmt.Fprint(conn, ":irc.example.com BATCH -w1\r\n")
+			case msg.Command == irc.ISON:
+				lines <- label + " " + line
+				fmt.Fprintf(conn, "@label=%s :irc.example.com 303 testbot1 :nick2\r\n", label)
+			case msg.Command == irc.PRIVMSG:
+				lines <- label + " " + line
+			}
+		}
+	}()
+	replies := make(chan string, 10)
+	settings := &client.IrcServerSettings{
+		Capabilities: []string{"batch", "labeled-response"},
+		Host:         "localhost",
+		Port:         serverPort,
+		Nick:         "testbot1",
+		Realname:     "testbotr",
+		Username:     "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			if req := client.RequestFromContext(ctx); req != nil {
+				replies <- fmt.Sprintf("%s %s %s", client.TagsFromContext(ctx)["label"], msg.Command, req)
+			}
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for !svr.GetState().HasCapability("labeled-response") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Got wrong capabilities: %v", svr.GetState().Capabilities())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect := func(c chan string, expected string) {
+		select {
+		case got := <-c:
+			if got != expected {
+				t.Fatalf("Expected %q, got %q", expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %q, got nothing", expected)
+		}
+	}
+	// Only requests whose replies are correlated are labelled
+	svr.GetMessages() <- irc.Message{Command: irc.PRIVMSG, Params: []string{"#chan", "hello"}}
+	expect(lines, " PRIVMSG #chan hello")
+	svr.GetMessages() <- irc.Message{Command: irc.WHOIS, Params: []string{"nick1"}}
+	expect(lines, "bb1 WHOIS nick1")
+	// All replies in the batch (including its start and end) are tied to the request
+	expect(replies, "bb1 BATCH WHOIS nick1")
+	expect(replies, "bb1 311 WHOIS nick1")
+	expect(replies, "bb1 318 WHOIS nick1")
+	expect(replies, "bb1 BATCH WHOIS nick1")
+	svr.GetMessages() <- irc.Message{Command: irc.ISON, Params: []string{"nick2", "nick3"}}
+	expect(lines, "bb2 ISON nick2 nick3")
+	expect(replies, "bb2 303 ISON nick2 nick3")
+	if req, ok := svr.GetState().LabeledRequest("bb1"); !ok || req.Command != irc.WHOIS {
+		t.Fatalf("Request wasn't remembered: %v", req)
+	}
+}
+
+func TestNewChatHistory(t *testing.T) {
+	for _, tc := range []struct {
+		subcommand string
+		target     string
+		reference  string
+		limit      int
+		expected   string
+	}{
+		{"latest", "#test", "", 10, "CHATHISTORY LATEST #test * 10"},
+		{"BEFORE", "#test", "msgid=abc", 5, "CHATHISTORY BEFORE #test msgid=abc 5"},
+		{"after", "nick1", client.ChatHistoryTimestamp(time.Unix(1577836800, 0)), 1, "CHATHISTORY AFTER nick1 timestamp=2020-01-01T00:00:00.000Z 1"},
+		{"before", "#test", "*", 10, ""},
+		{"around", "#test", "msgid=abc", 10, ""},
+		{"latest", "#test", "abc", 10, ""},
+		{"latest", "#te st", "", 10, ""},
+		{"latest", "#test", "", 0, ""},
+	} {
+		msg, err := client.NewChatHistory(tc.subcommand, tc.target, tc.reference, tc.limit)
+		if len(tc.expected) == 0 {
+			if err == nil {
+				t.Fatalf("Expected error for %v", tc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.String() != tc.expected {
+			t.Fatalf("Got %q, expected %q", msg.String(), tc.expected)
+		}
+	}
+}
+
+func TestAltNicks(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	received := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			if msg.Command != irc.NICK {
+				continue
+			}
+			received <- msg.Params[0]
+			switch msg.Params[0] {
+			case "testbot1", "altbot":
+				fmt.Fprintf(conn, ":irc.example.com 433 * %s :Nickname is already in use\r\n", msg.Params[0])
+			default:
+				fmt.Fprintf(conn, ":irc.example.com 001 %s :Welcome\r\n", msg.Params[0])
+			}
+		}
+	}()
+	fallbacks := make(chan *irc.Message, 1)
+	settings := &client.IrcServerSettings{
+		AltNicks: []string{"altbot"},
+		Host:     "localhost",
+		Port:     serverPort,
+		Nick:     "testbot1",
+		Realname: "testbotr",
+		Username: "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			if msg.Command == client.NickFallback {
+				fallbacks <- msg
+			}
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	// Configured alternate nicks are tried before appending underscores
+	for _, expected := range []string{"testbot1", "altbot", "altbot_"} {
+		select {
+		case nick := <-received:
+			if nick != expected {
+				t.Fatalf("Expected %q, got %q", expected, nick)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+	// Handlers are told which nick we ended up with
+	select {
+	case msg := <-fallbacks:
+		if msg.String() != "NICK_FALLBACK testbot1 altbot_" {
+			t.Fatalf("Got wrong fallback event: %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+func TestNickServ(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		regain string
+		// inUse is set if our nick is used by someone else
+		inUse    bool
+		expected []string
+	}{
+		{
+			name:     "identify",
+			regain:   client.NickServRegain,
+			expected: []string{"NICK testbot1", "USER testbotu 0 * testbotr", "PRIVMSG NickServ :IDENTIFY testbot1 hunter2"},
+		},
+		{
+			name:   "regain",
+			regain: client.NickServRegain,
+			inUse:  true,
+			expected: []string{
+				"NICK testbot1", "USER testbotu 0 * testbotr", "NICK testbot1_",
+				"PRIVMSG NickServ :IDENTIFY testbot1 hunter2", "PRIVMSG NickServ :REGAIN testbot1 hunter2",
+			},
+		},
+		{
+			name:   "ghost",
+			regain: client.NickServGhost,
+			inUse:  true,
+			expected: []string{
+				"NICK testbot1", "USER testbotu 0 * testbotr", "NICK testbot1_",
+				"PRIVMSG NickServ :IDENTIFY testbot1 hunter2", "PRIVMSG NickServ :GHOST testbot1 hunter2", "NICK testbot1",
+			},
+		},
+	} {
+		l, serverPort := test.FakeServer(t)
+		received := make(chan string, 10)
+		go func(inUse bool) {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			dec := irc.NewDecoder(conn)
+			var nick string
+			gotUser := false
+			for {
+				msg, err := dec.Decode()
+				if err != nil {
+					return
+				}
+				received <- msg.String()
+				switch msg.Command {
+				case irc.NICK:
+					if inUse && msg.Params[0] == "testbot1" && len(nick) == 0 {
+						fmt.Fprint(conn, ":irc.example.com 433 * testbot1 :Nickname is already in use\r\n")
+						continue
+					}
+					nick = msg.Params[0]
+				case irc.USER:
+					gotUser = true
+				case irc.PRIVMSG:
+					if strings.HasPrefix(msg.Params[1], client.NickServGhost) {
+						fmt.Fprintf(conn, ":NickServ!NickServ@services. NOTICE %s :testbot1 has been ghosted.\r\n", nick)
+					}
+					continue
+				}
+				if gotUser && len(nick) > 0 && msg.Command != irc.PRIVMSG {
+					fmt.Fprintf(conn, ":irc.example.com 001 %s :Welcome\r\n", nick)
+					gotUser = false
+				}
+			}
+		}(tc.inUse)
+		settings := &client.IrcServerSettings{
+			Host:             "localhost",
+			Port:             serverPort,
+			Nick:             "testbot1",
+			NickServPassword: "hunter2",
+			NickServRegain:   tc.regain,
+			Realname:         "testbotr",
+			Username:         "testbotu",
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			},
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		for _, expected := range tc.expected {
+			select {
+			case got := <-received:
+				if got != expected {
+					t.Fatalf("%s: expected %q, got %q", tc.name, expected, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: timed out waiting for %q", tc.name, expected)
+			}
+		}
+		svr.Close(ctx)
+		l.Close()
+	}
+}
+
+// changingResolver resolves to a different list of addresses on each lookup
+type changingResolver struct {
+	answers [][]string
+	lookups int32
+}
+
+func (r *changingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	n := int(atomic.AddInt32(&r.lookups, 1)) - 1
+	if n >= len(r.answers) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return r.answers[n], nil
+}
+
+func TestDNSReresolution(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		enc := irc.NewEncoder(conn)
+		enc.Encode(&irc.Message{
+			Command: irc.RPL_WELCOME,
+			Params:  []string{"testbot1", "Welcome"},
+		})
+		ioutil.ReadAll(conn)
+	}()
+	// Server moves from an address nobody listens on to the fake server, then vanishes
+	resolver := &changingResolver{answers: [][]string{
+		{"127.0.0.2"},
+		{"127.0.0.1"},
+	}}
+	ctx := context.TODO()
+	for i, expected := range []string{client.ErrorClassRefused, "", client.ErrorClassDNS} {
+		errs := make(chan error, 1)
+		welcome := make(chan struct{}, 1)
+		settings := &client.IrcServerSettings{
+			Host:     "irc.example.com",
+			Port:     serverPort,
+			Nick:     "testbot1",
+			Realname: "testbotr",
+			Resolver: resolver,
+			Username: "testbotu",
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+				if msg.Command == irc.RPL_WELCOME {
+					welcome <- struct{}{}
+				}
+			},
+		}
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case <-welcome:
+			if expected != "" {
+				t.Fatalf("Attempt %d: connected to stale address", i)
+			}
+		case err := <-errs:
+			if class := client.ClassifyError(err); class != expected {
+				t.Fatalf("Attempt %d: got wrong error class %s: %s", i, class, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Attempt %d: timed out", i)
+		}
+		svr.Close(ctx)
+	}
+	if resolver.lookups != 3 {
+		t.Fatalf("Expected 3 lookups, got %d", resolver.lookups)
+	}
+}
+
+func TestParseDCCSend(t *testing.T) {
+	for _, tc := range []struct {
+		text     string
+		expected *client.DCCOffer
+	}{
+		{"SEND file.txt 2130706433 5000 123", &client.DCCOffer{Filename: "file.txt", Addr: "127.0.0.1:5000", Size: 123}},
+		{`SEND "my file.txt" ::1 5000 123`, &client.DCCOffer{Filename: "my file.txt", Addr: "[::1]:5000", Size: 123}},
+		{"send file.txt 2130706433 5000", &client.DCCOffer{Filename: "file.txt", Addr: "127.0.0.1:5000", Size: -1}},
+		// Passive offers, unspecified addresses and other DCC requests aren't supported
+		{"SEND file.txt 2130706433 0 123 42", nil},
+		{"SEND file.txt 0 5000 123", nil},
+		{"SEND file.txt example.com 5000 123", nil},
+		{"SEND file.txt 2130706433 5000 -1", nil},
+		{"CHAT chat 2130706433 5000", nil},
+	} {
+		offer, err := client.ParseDCCSend(tc.text)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("Expected error parsing %q, got %#v", tc.text, offer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parsing %q failed: %s", tc.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(offer, tc.expected) {
+			t.Errorf("Parsing %q: expected %#v, got %#v", tc.text, tc.expected, offer)
+		}
+	}
+}
+
+func TestDCCReceive(t *testing.T) {
+	ctx := context.TODO()
+	dir, err := ioutil.TempDir("", "dcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// send offers data by DCC, checking acknowledgements
+	send := func(filename string, data []byte, size int64) *client.DCCOffer {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			defer l.Close()
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.Write(data)
+			ack := make([]byte, 4)
+			var acked uint32
+			for int(acked) < len(data) {
+				if _, err := io.ReadFull(conn, ack); err != nil {
+					return
+				}
+				acked = uint32(ack[0])<<24 | uint32(ack[1])<<16 | uint32(ack[2])<<8 | uint32(ack[3])
+			}
+		}()
+		return &client.DCCOffer{Filename: filename, Addr: l.Addr().String(), Size: size}
+	}
+	data := []byte("banana boat")
+	path, size, err := send("../../banana.txt", data, int64(len(data))).Receive(ctx, dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Files are saved in dir with their base name
+	if path != filepath.Join(dir, "banana.txt") || size != int64(len(data)) {
+		t.Fatalf("Unexpected result: %s (%d bytes)", path, size)
+	}
+	if received, _ := ioutil.ReadFile(path); string(received) != string(data) {
+		t.Fatalf("Unexpected content: %q", received)
+	}
+	// Existing files aren't overwritten
+	path, _, err = send("banana.txt", data, int64(len(data))).Receive(ctx, dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "banana.1.txt") {
+		t.Fatalf("Unexpected path: %s", path)
+	}
+	// Files exceeding the limit are refused or removed
+	offer := &client.DCCOffer{Filename: "big.txt", Addr: "127.0.0.1:1", Size: int64(len(data))}
+	if _, _, err = offer.Receive(ctx, dir, 5); err != client.ErrDCCTooLarge {
+		t.Fatalf("Expected error for offer over limit, got %v", err)
+	}
+	if _, _, err = send("big.txt", data, -1).Receive(ctx, dir, 5); err != client.ErrDCCTooLarge {
+		t.Fatalf("Expected error for transfer over limit, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Expected partial file to be removed: %v", err)
+	}
+	// Hidden files aren't created
+	offer = &client.DCCOffer{Filename: ".bashrc", Addr: "127.0.0.1:1", Size: int64(len(data))}
+	if _, _, err = offer.Receive(ctx, dir, 100); err == nil || err == client.ErrDCCTooLarge {
+		t.Fatal("Expected error for hidden file")
+	}
+}
+
+func TestDCCChat(t *testing.T) {
+	ctx := context.TODO()
+	offer, accept, err := client.ListenDCCChat("127.0.0.1:0", net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(offer, "CHAT chat 2130706433 ") {
+		t.Fatalf("Unexpected offer: %s", offer)
+	}
+	addr, err := client.ParseDCCChat(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := make(chan *irc.Message, 1)
+	errs := make(chan error, 1)
+	settings := &client.IrcServerSettings{
+		Nick: "testbot1",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+			errs <- err
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			input <- msg
+		},
+	}
+	chat, chatCtx := client.NewDCCChat(ctx, "dcc:test:friend", &irc.Prefix{Name: "friend"}, settings, accept)
+	defer chat.Close(ctx)
+	go chat.Dial(chatCtx)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lines received are PRIVMSG from the peer
+	conn.Write([]byte("hello there\r\n"))
+	select {
+	case msg := <-input:
+		if msg.String() != ":friend PRIVMSG testbot1 :hello there" {
+			t.Fatalf("Unexpected message: %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for input")
+	}
+	// Text of PRIVMSG and NOTICE is sent, other messages are ignored
+	chat.GetMessages() <- irc.Message{Command: irc.JOIN, Params: []string{"#chan"}}
+	chat.GetMessages() <- irc.Message{Command: irc.PRIVMSG, Params: []string{"friend", "hi\nthere"}}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hi there\n" {
+		t.Fatalf("Unexpected line: %q", line)
+	}
+	// Closing the chat is reported as an error
+	conn.Close()
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for error")
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	received := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := irc.NewDecoder(conn)
+		for {
+			msg, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			switch msg.Command {
+			case irc.NICK:
+				fmt.Fprintf(conn, ":irc.example.com 001 %s :Welcome\r\n", msg.Params[0])
+				// Latin-1 text from legacy clients and UTF-8 text from others
+				fmt.Fprint(conn, ":j\xfcrgen!u@example.com PRIVMSG #chan :gr\xfc\xdfe\r\n")
+				fmt.Fprint(conn, ":other!u@example.com PRIVMSG #chan :gr\xc3\xbc\xc3\x9fe\r\n")
+			case irc.PRIVMSG:
+				received <- msg.Params[1]
+			}
+		}
+	}()
+	input := make(chan *irc.Message, 10)
+	settings := &client.IrcServerSettings{
+		Encoding: "ISO-8859-1",
+		Host:     "localhost",
+		Port:     serverPort,
+		Nick:     "testbot1",
+		Realname: "testbotr",
+		Username: "testbotu",
+		ErrorCallback: func(ctx context.Context, svrName string, err error) {
+		},
+		InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			if msg.Command == irc.PRIVMSG {
+				input <- msg
+			}
+		},
+	}
+	ctx := context.TODO()
+	svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+	svr.Dial(svrCtx)
+	defer svr.Close(ctx)
+	// Input is converted to UTF-8
+	for _, expected := range []string{":jürgen!u@example.com PRIVMSG #chan grüße", ":other!u@example.com PRIVMSG #chan grüße"} {
+		select {
+		case msg := <-input:
+			if msg.String() != expected {
+				t.Fatalf("Expected %q, got %q", expected, msg.String())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out")
+		}
+	}
+	// Output is converted to the encoding of the server, unsupported characters are replaced
+	svr.GetMessages() <- irc.Message{Command: irc.PRIVMSG, Params: []string{"#chan", "grüße 🍌"}}
+	select {
+	case text := <-received:
+		if text != "gr\xfc\xdfe ?" {
+			t.Fatalf("Got wrong text: %q", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+	if _, err := client.LookupEncoding("no-such-encoding"); err == nil {
+		t.Fatal("Expected error for unknown encoding")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	for _, scheme := range []string{"http", "socks5"} {
+		l, proxyPort := test.FakeServer(t)
+		targets := make(chan string, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			if scheme == "http" {
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				targets <- req.Host + " " + req.Header.Get("Proxy-Authorization")
+				fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			} else {
+				// Greeting is version, number of methods and methods
+				greeting := make([]byte, 2)
+				io.ReadFull(reader, greeting)
+				io.ReadFull(reader, make([]byte, greeting[1]))
+				conn.Write([]byte{5, 0})
+				// Request is version, command, reserved, address type (3 for names), name and port
+				header := make([]byte, 5)
+				io.ReadFull(reader, header)
+				name := make([]byte, header[4]+2)
+				io.ReadFull(reader, name)
+				targets <- fmt.Sprintf("%s:%d", name[:header[4]], int(name[header[4]])<<8|int(name[header[4]+1]))
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+			}
+			// Proxy leads to an IRC server
+			dec := irc.NewDecoder(reader)
+			for {
+				msg, err := dec.Decode()
+				if err != nil {
+					return
+				}
+				if msg.Command == irc.NICK {
+					fmt.Fprintf(conn, ":irc.example.com 001 %s :Welcome\r\n", msg.Params[0])
+				}
+			}
+		}()
+		welcome := make(chan struct{}, 1)
+		errs := make(chan error, 1)
+		settings := &client.IrcServerSettings{
+			Host:     "irc.example.com",
+			Port:     6667,
+			ProxyURL: fmt.Sprintf("%s://user:secret@127.0.0.1:%d", scheme, proxyPort),
+			Nick:     "testbot1",
+			Realname: "testbotr",
+			Username: "testbotu",
+			// Names are resolved by the proxy
+			Resolver: &changingResolver{},
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+				if msg.Command == irc.RPL_WELCOME {
+					welcome <- struct{}{}
+				}
+			},
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case target := <-targets:
+			expected := "irc.example.com:6667"
+			if scheme == "http" {
+				expected += " Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+			}
+			if target != expected {
+				t.Fatalf("%s: expected %q, got %q", scheme, expected, target)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for proxy", scheme)
+		}
+		select {
+		case <-welcome:
+		case err := <-errs:
+			t.Fatalf("%s: %s", scheme, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for welcome", scheme)
+		}
+		svr.Close(ctx)
+		l.Close()
+	}
+	if err := client.ValidateProxyURL("ftp://127.0.0.1:21"); err == nil {
+		t.Fatal("Expected error for unsupported scheme")
+	}
+	if err := client.ValidateProxyURL("socks5://127.0.0.1"); err == nil {
+		t.Fatal("Expected error for missing port")
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	remotes := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			remotes <- host
+			conn.Close()
+		}
+	}()
+	for _, tc := range []struct {
+		bind     string
+		expected string
+	}{
+		// Any address of the loopback network can be bound to
+		{"127.0.0.2", "127.0.0.2"},
+		// Addresses of another family can't connect
+		{"::1", ""},
+	} {
+		errs := make(chan error, 1)
+		settings := &client.IrcServerSettings{
+			BindAddress: tc.bind,
+			Host:        "127.0.0.1",
+			Port:        serverPort,
+			Nick:        "testbot1",
+			Realname:    "testbotr",
+			Username:    "testbotu",
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			},
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case remote := <-remotes:
+			if remote != tc.expected {
+				t.Fatalf("Bound to %s: expected connection from %q, got %q", tc.bind, tc.expected, remote)
+			}
+		case err := <-errs:
+			if len(tc.expected) > 0 {
+				t.Fatalf("Bound to %s: %s", tc.bind, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Bound to %s: timed out", tc.bind)
+		}
+		svr.Close(ctx)
+	}
+	if err := client.ValidateBindAddress("no-such-interface0"); err == nil {
+		t.Fatal("Expected error for unknown interface")
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	l, serverPort := test.FakeServer(t)
+	defer l.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+	for _, tc := range []struct {
+		family  string
+		answers []string
+		success bool
+	}{
+		// Addresses of other families aren't tried (the IPv6 address would be refused)
+		{client.FamilyIPv4, []string{"::1", "127.0.0.1"}, true},
+		{client.FamilyAny, []string{"127.0.0.1"}, true},
+		{client.FamilyIPv6, []string{"127.0.0.1"}, false},
+	} {
+		errs := make(chan error, 1)
+		settings := &client.IrcServerSettings{
+			Family:   tc.family,
+			Host:     "irc.example.com",
+			Port:     serverPort,
+			Nick:     "testbot1",
+			Realname: "testbotr",
+			Resolver: &changingResolver{answers: [][]string{tc.answers}},
+			Username: "testbotu",
+			ErrorCallback: func(ctx context.Context, svrName string, err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+			InputCallback: func(ctx context.Context, svrName string, msg *irc.Message) {
+			},
+		}
+		ctx := context.TODO()
+		svr, svrCtx := client.NewIrcServer(ctx, "test", settings)
+		svr.Dial(svrCtx)
+		select {
+		case <-accepted:
+			if !tc.success {
+				t.Fatalf("%s: connected unexpectedly", tc.family)
+			}
+		case err := <-errs:
+			if tc.success {
+				t.Fatalf("%s: %s", tc.family, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out", tc.family)
+		}
+		svr.Close(ctx)
+	}
+	if err := client.ValidateFamily("ipv5"); err == nil {
+		t.Fatal("Expected error for unknown family")
+	}
+}
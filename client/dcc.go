@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// dccDialTimeout is how long we wait to connect to a sender
+	dccDialTimeout = 30 * time.Second
+	// dccReadTimeout is how long a transfer may stall
+	dccReadTimeout = 60 * time.Second
+	// maxDCCRenames is the number of alternative names tried if a file already exists
+	maxDCCRenames = 100
+)
+
+// ErrDCCTooLarge is returned if a file offered by DCC SEND exceeds the size limit
+var ErrDCCTooLarge = errors.New("file too large")
+
+// DCCOffer is a file offered by DCC SEND
+type DCCOffer struct {
+	// Filename is the name suggested by the sender (not safe to use as a path)
+	Filename string
+	// Addr is the address to connect to for receiving the file
+	Addr string
+	// Size is the size of the file in bytes (-1 if unknown)
+	Size int64
+}
+
+// dccFields splits parameters of a DCC request keeping quoted filenames together
+func dccFields(text string) []string {
+	text = strings.TrimSpace(text)
+	var fields []string
+	for len(text) > 0 {
+		var field string
+		if text[0] == '"' {
+			end := strings.IndexByte(text[1:], '"')
+			if end < 0 {
+				field, text = text[1:], ""
+			} else {
+				field, text = text[1:end+1], text[end+2:]
+			}
+		} else if i := strings.IndexByte(text, ' '); i >= 0 {
+			field, text = text[:i], text[i:]
+		} else {
+			field, text = text, ""
+		}
+		fields = append(fields, field)
+		text = strings.TrimLeft(text, " ")
+	}
+	return fields
+}
+
+// parseDCCHost parses the address of a DCC sender which is an IPv4 address as a number or an IP address
+func parseDCCHost(host string) (net.IP, error) {
+	if n, err := strconv.ParseUint(host, 10, 32); err == nil {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(n))
+		return ip, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	return nil, fmt.Errorf("invalid address: %s", host)
+}
+
+// ParseDCCSend parses the parameters of a DCC request (the text following DCC in the CTCP message)
+// Only active DCC SEND is supported as passive DCC requires us to accept connections
+func ParseDCCSend(text string) (*DCCOffer, error) {
+	fields := dccFields(text)
+	if len(fields) < 4 || !strings.EqualFold(fields[0], "SEND") {
+		return nil, errors.New("not a DCC SEND offer")
+	}
+	ip, err := parseDCCHost(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return nil, fmt.Errorf("invalid address: %s", ip)
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("unsupported port (passive DCC isn't supported): %s", fields[3])
+	}
+	offer := &DCCOffer{
+		Filename: fields[1],
+		Addr:     net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10)),
+		Size:     -1,
+	}
+	if len(fields) > 4 {
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid size: %s", fields[4])
+		}
+		offer.Size = size
+	}
+	return offer, nil
+}
+
+// dccFilename returns a safe name for a file offered by DCC
+func dccFilename(name string) (string, error) {
+	name = filepath.Base(strings.Replace(name, `\`, "/", -1))
+	if name == "." || name == "/" || name == ".." || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid filename: %q", name)
+	}
+	return name, nil
+}
+
+// createDCCFile creates a new file in dir, adding a number to the name if it already exists
+func createDCCFile(dir string, name string) (*os.File, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; i <= maxDCCRenames; i++ {
+		path := filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s.%d%s", base, i, ext))
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("too many files named %s", name)
+}
+
+// Receive downloads the offered file into dir returning its path and size
+// Files larger than maxSize bytes (if positive) are refused or aborted and partial files are removed
+func (o *DCCOffer) Receive(ctx context.Context, dir string, maxSize int64) (string, int64, error) {
+	if maxSize > 0 && o.Size > maxSize {
+		return "", 0, ErrDCCTooLarge
+	}
+	name, err := dccFilename(o.Filename)
+	if err != nil {
+		return "", 0, err
+	}
+	dialer := net.Dialer{Timeout: dccDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", o.Addr)
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+	// Abort the transfer if ctx is done before it finishes
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	f, err := createDCCFile(dir, name)
+	if err != nil {
+		return "", 0, err
+	}
+	path := f.Name()
+	received, err := o.copy(conn, f, maxSize)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", received, err
+	}
+	return path, received, nil
+}
+
+// copy reads the file from conn into w acknowledging received bytes as senders expect
+func (o *DCCOffer) copy(conn net.Conn, w io.Writer, maxSize int64) (int64, error) {
+	var received int64
+	buf := make([]byte, 32*1024)
+	ack := make([]byte, 4)
+	for o.Size < 0 || received < o.Size {
+		conn.SetReadDeadline(time.Now().Add(dccReadTimeout))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			received += int64(n)
+			if maxSize > 0 && received > maxSize {
+				return received, ErrDCCTooLarge
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return received, err
+			}
+			// Acknowledgements are the number of bytes received so far (modulo 2^32)
+			binary.BigEndian.PutUint32(ack, uint32(received))
+			conn.SetWriteDeadline(time.Now().Add(dccReadTimeout))
+			if _, err := conn.Write(ack); err != nil {
+				return received, err
+			}
+		}
+		if err == io.EOF {
+			if o.Size >= 0 && received < o.Size {
+				return received, io.ErrUnexpectedEOF
+			}
+			return received, nil
+		}
+		if err != nil {
+			return received, err
+		}
+	}
+	return received, nil
+}
@@ -0,0 +1,233 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// dccAcceptTimeout is how long we wait for the peer to connect to a chat we offered
+	dccAcceptTimeout = 2 * time.Minute
+	// maxDCCChatLine is the maximum length of a line received in a chat
+	maxDCCChatLine = 4096
+)
+
+// DCCChat is a direct chat with a user which is handled like a connection to a server
+// Lines received are passed to InputCallback as PRIVMSG from the peer and the text of PRIVMSG and NOTICE
+// messages sent is written to the peer
+type DCCChat struct {
+	cancel       context.CancelFunc
+	conn         net.Conn
+	connect      func(ctx context.Context) (net.Conn, error)
+	connMutex    sync.Mutex
+	done         <-chan struct{}
+	messages     chan irc.Message
+	name         string
+	peer         *irc.Prefix
+	reconnectExp *uint64
+	settings     *IrcServerSettings
+	state        *ServerState
+}
+
+// NewDCCChat creates a chat with peer which is established by connect
+func NewDCCChat(parentCtx context.Context, name string, peer *irc.Prefix, settings *IrcServerSettings, connect func(ctx context.Context) (net.Conn, error)) (IrcServerInterface, context.Context) {
+	var reconnectExp uint64
+	ctx, cancel := context.WithCancel(parentCtx)
+	c := &DCCChat{
+		cancel:       cancel,
+		connect:      connect,
+		done:         ctx.Done(),
+		messages:     make(chan irc.Message, MessageQueueSize),
+		name:         name,
+		peer:         peer,
+		reconnectExp: &reconnectExp,
+		settings:     settings,
+		state:        NewServerState(settings.Nick),
+	}
+	return c, ctx
+}
+
+// ParseDCCChat parses the parameters of a DCC CHAT offer returning the address to connect to
+func ParseDCCChat(text string) (string, error) {
+	fields := dccFields(text)
+	if len(fields) < 4 || !strings.EqualFold(fields[0], "CHAT") {
+		return "", errors.New("not a DCC CHAT offer")
+	}
+	ip, err := parseDCCHost(fields[2])
+	if err != nil {
+		return "", err
+	}
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return "", fmt.Errorf("invalid address: %s", ip)
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("unsupported port (passive DCC isn't supported): %s", fields[3])
+	}
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10)), nil
+}
+
+// DialDCCChat returns a function connecting to a chat offered at addr
+func DialDCCChat(addr string) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		dialer := net.Dialer{Timeout: dccDialTimeout}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+}
+
+// ListenDCCChat listens on addr for a chat returning the offer advertising it at the given IP address and a
+// function accepting the connection
+func ListenDCCChat(addr string, advertise net.IP) (string, func(ctx context.Context) (net.Conn, error), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", nil, err
+	}
+	host := advertise.String()
+	// IPv4 addresses are advertised as a number
+	if ip4 := advertise.To4(); ip4 != nil {
+		host = strconv.FormatUint(uint64(binary.BigEndian.Uint32(ip4)), 10)
+	}
+	offer := fmt.Sprintf("CHAT chat %s %d", host, l.Addr().(*net.TCPAddr).Port)
+	accept := func(ctx context.Context) (net.Conn, error) {
+		defer l.Close()
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(dccAcceptTimeout))
+		accepted := make(chan struct{})
+		defer close(accepted)
+		go func() {
+			select {
+			case <-ctx.Done():
+				l.Close()
+			case <-accepted:
+			}
+		}()
+		return l.Accept()
+	}
+	return offer, accept, nil
+}
+
+// GetSettings returns pointer to IrcServerSettings
+func (c *DCCChat) GetSettings() *IrcServerSettings {
+	return c.settings
+}
+
+// GetState returns state of the chat
+func (c *DCCChat) GetState() *ServerState {
+	return c.state
+}
+
+// GetMessages returns the channel of messages sent to the peer
+func (c *DCCChat) GetMessages() chan irc.Message {
+	return c.messages
+}
+
+// GetReconnectExp returns current reconnectExp (chats are never reconnected)
+func (c *DCCChat) GetReconnectExp() *uint64 {
+	return c.reconnectExp
+}
+
+// SetReconnectExp sets current reconnectExp
+func (c *DCCChat) SetReconnectExp(val uint64) {
+	c.reconnectExp = &val
+}
+
+// SetReconnectDelay does nothing as chats are never reconnected
+func (c *DCCChat) SetReconnectDelay(delay time.Duration) {
+}
+
+// ReconnectWait does nothing as chats are never reconnected
+func (c *DCCChat) ReconnectWait(ctx context.Context) {
+}
+
+// Done returns Done channel for the chat
+func (c *DCCChat) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close ends the chat
+func (c *DCCChat) Close(ctx context.Context) {
+	c.cancel()
+	c.connMutex.Lock()
+	defer c.connMutex.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// Dial establishes the chat and starts processing
+func (c *DCCChat) Dial(ctx context.Context) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		c.settings.ErrorCallback(ctx, c.name, err)
+		return
+	}
+	c.connMutex.Lock()
+	c.conn = conn
+	c.connMutex.Unlock()
+	// Chat might have been closed while connecting
+	if ctx.Err() != nil {
+		conn.Close()
+		return
+	}
+	log.Printf("[%s] DCC CHAT with %s established", c.name, c.peer.Name)
+	go c.writeLoop(ctx, conn)
+	go c.readLoop(ctx, conn)
+}
+
+// readLoop passes lines received from the peer to InputCallback
+func (c *DCCChat) readLoop(ctx context.Context, conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 512), maxDCCChatLine)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		c.settings.InputCallback(ContextWithTime(ctx, time.Now()), c.name, &irc.Message{
+			Prefix:  c.peer,
+			Command: irc.PRIVMSG,
+			Params:  []string{c.state.Nick(), line},
+		})
+	}
+	// Don't report errors caused by closing the chat ourselves
+	if ctx.Err() != nil {
+		return
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = errors.New("DCC CHAT closed by peer")
+	}
+	c.settings.ErrorCallback(ctx, c.name, err)
+}
+
+// writeLoop writes the text of messages sent to the peer
+func (c *DCCChat) writeLoop(ctx context.Context, conn net.Conn) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-c.messages:
+			// Only messages carrying text make sense in a chat
+			if (msg.Command != irc.PRIVMSG && msg.Command != irc.NOTICE) || len(msg.Params) < 2 {
+				continue
+			}
+			line := strings.NewReplacer("\r", " ", "\n", " ").Replace(msg.Params[len(msg.Params)-1])
+			conn.SetWriteDeadline(time.Now().Add(dccReadTimeout))
+			if _, err := conn.Write([]byte(line + "\n")); err != nil {
+				// The read loop reports the error
+				conn.Close()
+				return
+			}
+		}
+	}
+}
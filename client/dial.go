@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FamilyAny connects using IPv4 or IPv6
+	FamilyAny = "any"
+	// FamilyIPv4 connects using IPv4 only
+	FamilyIPv4 = "ipv4"
+	// FamilyIPv6 connects using IPv6 only
+	FamilyIPv6 = "ipv6"
+)
+
+// Resolver looks up addresses of hosts (implemented by net.Resolver)
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dial resolves the host afresh and connects to the first of its addresses accepting connections
+// Addresses aren't cached across attempts so DNS-based failover is honoured when reconnecting
+// Servers with a proxy are dialled through it instead
+func (s *IrcServer) dial(ctx context.Context) (net.Conn, error) {
+	if len(s.Settings.ProxyURL) > 0 {
+		return s.dialProxy(ctx)
+	}
+	resolver := s.Settings.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupHost(ctx, s.Settings.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: s.Settings.Host, IsNotFound: true}
+	}
+	log.Printf("[%s] Resolved %s to %s", s.name, s.Settings.Host, strings.Join(addrs, ", "))
+	addrs = familyAddrs(addrs, s.Settings.Family)
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no " + s.Settings.Family + " addresses", Name: s.Settings.Host, IsNotFound: true}
+	}
+	localIPs, err := bindIPs(s.Settings.BindAddress)
+	if err != nil {
+		return nil, err
+	}
+	port := strconv.Itoa(s.port)
+	var firstErr error
+	for _, addr := range addrs {
+		dialer := net.Dialer{Timeout: 30 * time.Second}
+		if localIPs != nil {
+			localIP := sameFamilyIP(localIPs, net.ParseIP(addr))
+			// Addresses we can't reach from the bind address are skipped
+			if localIP == nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("no local address of %s can connect to %s", s.Settings.BindAddress, addr)
+				}
+				continue
+			}
+			dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+		}
+		conn, err := dialer.DialContext(ctx, familyNetwork(s.Settings.Family), net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// ValidateFamily returns an error if family isn't a known address family
+func ValidateFamily(family string) error {
+	switch family {
+	case "", FamilyAny, FamilyIPv4, FamilyIPv6:
+		return nil
+	}
+	return fmt.Errorf("unsupported address family: %s", family)
+}
+
+// familyNetwork returns the network to dial for an address family
+func familyNetwork(family string) string {
+	switch family {
+	case FamilyIPv4:
+		return "tcp4"
+	case FamilyIPv6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// familyAddrs returns the addresses of a family keeping their order
+func familyAddrs(addrs []string, family string) []string {
+	if family != FamilyIPv4 && family != FamilyIPv6 {
+		return addrs
+	}
+	var filtered []string
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip != nil && (ip.To4() != nil) == (family == FamilyIPv4) {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
+
+// ValidateBindAddress returns an error if a local address to bind to is neither an IP address nor an interface
+func ValidateBindAddress(bind string) error {
+	_, err := bindIPs(bind)
+	return err
+}
+
+// bindIPs returns the local IP addresses named by an IP address or network interface (nil if bind is empty)
+// Addresses of interfaces are looked up on each dial as they may change
+func bindIPs(bind string) ([]net.IP, error) {
+	if len(bind) == 0 {
+		return nil, nil
+	}
+	if ip := net.ParseIP(bind); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	iface, err := net.InterfaceByName(bind)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address %s: %s", bind, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface %s has no usable addresses", bind)
+	}
+	return ips, nil
+}
+
+// sameFamilyIP returns the first of ips which is of the same family (IPv4 or IPv6) as remote (nil if none)
+func sameFamilyIP(ips []net.IP, remote net.IP) net.IP {
+	if remote == nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (remote.To4() == nil) {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// encodingReplacement replaces characters which can't be encoded
+const encodingReplacement = "?"
+
+// LookupEncoding returns the encoding named by an IANA name such as ISO-8859-1 or windows-1252
+// (nil for UTF-8 which needs no conversion)
+func LookupEncoding(name string) (encoding.Encoding, error) {
+	if len(name) == 0 {
+		return nil, nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported encoding: %s", name)
+	}
+	if enc == unicode.UTF8 {
+		return nil, nil
+	}
+	return enc, nil
+}
+
+// decodeText converts text received from the server to UTF-8
+// Text which already is valid UTF-8 is kept as some clients on legacy networks use it anyway
+func decodeText(enc encoding.Encoding, text string) string {
+	if utf8.ValidString(text) {
+		return text
+	}
+	decoded, err := enc.NewDecoder().String(text)
+	if err != nil {
+		return strings.ToValidUTF8(text, string(utf8.RuneError))
+	}
+	return decoded
+}
+
+// encodeText converts text to be sent to the server from UTF-8 replacing characters which can't be encoded
+func encodeText(enc encoding.Encoding, text string) string {
+	encoder := enc.NewEncoder()
+	if encoded, err := encoder.String(text); err == nil {
+		return encoded
+	}
+	var sb strings.Builder
+	for _, r := range text {
+		encoded, err := encoder.String(string(r))
+		if err != nil {
+			encoded = encodingReplacement
+		}
+		sb.WriteString(encoded)
+	}
+	return sb.String()
+}
+
+// decodeMessage converts the prefix and parameters of a message received from the server to UTF-8
+func (s *IrcServer) decodeMessage(msg *irc.Message) {
+	if s.encoding == nil {
+		return
+	}
+	if msg.Prefix != nil {
+		msg.Prefix.Name = decodeText(s.encoding, msg.Prefix.Name)
+		msg.Prefix.User = decodeText(s.encoding, msg.Prefix.User)
+		msg.Prefix.Host = decodeText(s.encoding, msg.Prefix.Host)
+	}
+	for i, param := range msg.Params {
+		msg.Params[i] = decodeText(s.encoding, param)
+	}
+}
+
+// encodeMessage returns a copy of a message with parameters converted to the encoding of the server
+func (s *IrcServer) encodeMessage(msg *irc.Message) *irc.Message {
+	if s.encoding == nil {
+		return msg
+	}
+	encoded := *msg
+	encoded.Params = make([]string, len(msg.Params))
+	for i, param := range msg.Params {
+		encoded.Params[i] = encodeText(s.encoding, param)
+	}
+	return &encoded
+}
+
+// encode sends a message in the encoding of the server
+func (s *IrcServer) encode(msg *irc.Message) error {
+	return s.encoder.Encode(s.encodeMessage(msg))
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Classes of connection errors
+const (
+	ErrorClassClosed       = "closed"
+	ErrorClassDNS          = "dns"
+	ErrorClassOther        = "other"
+	ErrorClassRefused      = "refused"
+	ErrorClassRegistration = "registration"
+	ErrorClassSASL         = "sasl"
+	ErrorClassServer       = "server"
+	ErrorClassSTS          = "sts"
+	ErrorClassThrottled    = "throttled"
+	ErrorClassTimeout      = "timeout"
+	ErrorClassTLS          = "tls"
+)
+
+// DefaultThrottleDelay is how long we wait after being throttled if the server doesn't tell us
+const DefaultThrottleDelay = 60 * time.Second
+
+var (
+	// throttleRegexp matches server errors caused by reconnecting too fast
+	throttleRegexp = regexp.MustCompile(`(?i)throttl|too fast|too many connections|wait \d+ sec`)
+	// throttleWaitRegexp matches the time servers tell us to wait
+	throttleWaitRegexp = regexp.MustCompile(`(?i)(\d+)\s*sec`)
+)
+
+// ErrRegistrationTimeout is reported if the server doesn't welcome us in time
+var ErrRegistrationTimeout = errors.New("registration timed out")
+
+// ErrPingTimeout is reported if the server doesn't answer our PING in time
+var ErrPingTimeout = errors.New("ping timeout")
+
+// PinError is returned when a certificate fails verification and doesn't match the pinned fingerprint
+type PinError struct {
+	// Expected is the pinned fingerprint
+	Expected string
+	// Fingerprint is the fingerprint of the certificate presented by the server
+	Fingerprint string
+	// VerifyError is the error from verification against system (or configured) CAs
+	VerifyError error
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("tls: certificate fingerprint %s doesn't match pin %s (%s)", e.Fingerprint, e.Expected, e.VerifyError)
+}
+
+// SASLError is reported if SASL authentication failed
+type SASLError struct {
+	// Attempts is the number of authentication attempts made
+	Attempts int
+	// Message is the reason given by the server
+	Message string
+	Name    string
+	// Transient is set if services didn't respond rather than rejecting our credentials
+	Transient bool
+}
+
+func (e *SASLError) Error() string {
+	cause := "credentials rejected"
+	if e.Transient {
+		cause = "services unavailable"
+	}
+	return fmt.Sprintf("[%s] SASL authentication failed after %d attempt(s), %s: %s", e.Name, e.Attempts, cause, e.Message)
+}
+
+// ServerError is an ERROR message received from a server
+type ServerError struct {
+	Name    string
+	Message string
+	// RetryAfter is how long we should wait before reconnecting if Throttled is set
+	RetryAfter time.Duration
+	// Throttled is set if the server refused us for reconnecting too fast
+	Throttled bool
+}
+
+// newServerError creates a ServerError, detecting registration throttling
+func newServerError(name string, message string) *ServerError {
+	e := &ServerError{
+		Name:    name,
+		Message: message,
+	}
+	if throttleRegexp.MatchString(message) {
+		e.Throttled = true
+		e.RetryAfter = DefaultThrottleDelay
+		// Honour wait time suggested by the server
+		if m := throttleWaitRegexp.FindStringSubmatch(message); m != nil {
+			if secs, err := strconv.Atoi(m[1]); err == nil && secs > 0 {
+				e.RetryAfter = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return e
+}
+
+// newTryAgainError creates a throttled ServerError from RPL_TRYAGAIN refusing our registration
+func newTryAgainError(name string, message string) *ServerError {
+	e := newServerError(name, message)
+	if !e.Throttled {
+		e.Throttled = true
+		e.RetryAfter = DefaultThrottleDelay
+	}
+	return e
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("[%s] server error: %s", e.Name, e.Message)
+}
+
+// ClassifyError returns the class of a connection error
+func ClassifyError(err error) string {
+	var saslError *SASLError
+	var serverError *ServerError
+	var pinError *PinError
+	var stsError *STSUpgradeError
+	var dnsError *net.DNSError
+	var netError net.Error
+	var certError x509.CertificateInvalidError
+	var authorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	switch {
+	case errors.Is(err, ErrRegistrationTimeout):
+		return ErrorClassRegistration
+	case errors.As(err, &saslError):
+		return ErrorClassSASL
+	case errors.As(err, &serverError):
+		if serverError.Throttled {
+			return ErrorClassThrottled
+		}
+		return ErrorClassServer
+	case errors.As(err, &stsError):
+		return ErrorClassSTS
+	case errors.As(err, &dnsError):
+		return ErrorClassDNS
+	case errors.As(err, &pinError), errors.As(err, &certError), errors.As(err, &authorityError), errors.As(err, &hostnameError):
+		return ErrorClassTLS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorClassRefused
+	case errors.Is(err, io.EOF), errors.Is(err, syscall.ECONNRESET):
+		return ErrorClassClosed
+	case errors.Is(err, ErrPingTimeout), errors.As(err, &netError) && netError.Timeout():
+		return ErrorClassTimeout
+	}
+	return ErrorClassOther
+}
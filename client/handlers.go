@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// sendNow sends a message immediately, bypassing the queue and rate limiting
+func (s *IrcServer) sendNow(ctx context.Context, msg *irc.Message) {
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second * 30))
+	err := s.encode(msg)
+	if err != nil {
+		// Call error callback
+		go s.Settings.ErrorCallback(ctx, s.name, err)
+	}
+}
+
+// handleMessage reacts to messages the client handles by itself
+func (s *IrcServer) handleMessage(ctx context.Context, msg *irc.Message) {
+	switch msg.Command {
+	case irc.CAP, irc.ERR_UNKNOWNCOMMAND:
+		s.handleRegistration(ctx, msg)
+	case irc.AUTHENTICATE, irc.RPL_SASLSUCCESS, irc.ERR_SASLFAIL, irc.ERR_SASLABORTED, irc.RPL_NICKLOCKED:
+		if s.usesSASL() {
+			s.handleSASL(ctx, msg)
+		}
+	case irc.RPL_WELCOME:
+		s.handleRegistration(ctx, msg)
+		s.onWelcome(ctx)
+		s.handleNickServ(ctx, msg)
+	case irc.ERR_NICKNAMEINUSE, irc.ERR_UNAVAILRESOURCE:
+		s.handleNickInUse(ctx, msg)
+	case irc.NOTICE, irc.RPL_LOGGEDIN:
+		s.handleNickServ(ctx, msg)
+	case irc.RPL_YOUREOPER:
+		log.Printf("[%s] Now an IRC operator", s.name)
+		if len(s.Settings.OperModes) > 0 {
+			s.sendNow(ctx, &irc.Message{
+				Command: irc.MODE,
+				Params:  []string{s.state.Nick(), s.Settings.OperModes},
+			})
+		}
+	case irc.ERR_NOOPERHOST:
+		log.Printf("[%s] OPER failed: no operator block for our host", s.name)
+	case irc.ERR_PASSWDMISMATCH:
+		log.Printf("[%s] Password rejected by server", s.name)
+	}
+}
+
+// onWelcome performs tasks needed after registration
+func (s *IrcServer) onWelcome(ctx context.Context) {
+	s.setRegistered(ctx)
+	// Set user modes if configured
+	if len(s.Settings.UserModes) > 0 {
+		s.sendNow(ctx, &irc.Message{
+			Command: irc.MODE,
+			Params:  []string{s.state.Nick(), s.Settings.UserModes},
+		})
+	}
+	// Become an IRC operator if configured (don't log credentials)
+	if len(s.Settings.OperName) > 0 {
+		log.Printf("[%s] Sending OPER as %s", s.name, s.Settings.OperName)
+		s.sendNow(ctx, &irc.Message{
+			Command: irc.OPER,
+			Params:  []string{s.Settings.OperName, s.Settings.OperPassword},
+		})
+	}
+	// Mark us away again if we were before reconnecting
+	if reason := s.state.Away(); len(reason) > 0 {
+		s.sendNow(ctx, &irc.Message{
+			Command: irc.AWAY,
+			Params:  []string{reason},
+		})
+	}
+	// Send configured commands (not logged as they may contain credentials)
+	if len(s.Settings.Perform) > 0 {
+		log.Printf("[%s] Sending %d perform command(s)", s.name, len(s.Settings.Perform))
+	}
+	for _, line := range s.Settings.Perform {
+		if msg := performMessage(line, s.state.Nick()); msg != nil {
+			s.sendNow(ctx, msg)
+		}
+	}
+	// Send keepalive PINGs to measure lag
+	if s.Settings.PingInterval > 0 {
+		go s.keepalive(ctx)
+	}
+}
+
+// performMessage parses a raw perform command, replacing $nick with our nick (nil if it is invalid)
+func performMessage(line string, nick string) *irc.Message {
+	if strings.ContainsAny(line, "\r\n") {
+		return nil
+	}
+	return irc.ParseMessage(strings.Replace(line, "$nick", nick, -1))
+}
+
+// ValidatePerformCommand returns an error if a raw command to send after registration can't be parsed
+// The command isn't included in the error as it may contain credentials
+func ValidatePerformCommand(line string) error {
+	if performMessage(line, "nick") == nil {
+		return errors.New("invalid command")
+	}
+	return nil
+}
+
+// keepalive periodically sends PINGs whose PONGs are used to measure lag
+// A PONG not arriving in time means the connection stalled which is reported as an error
+func (s *IrcServer) keepalive(ctx context.Context) {
+	timeout := s.Settings.PingTimeout
+	if timeout <= 0 {
+		timeout = DefaultPingTimeout
+	}
+	ticker := time.NewTicker(s.Settings.PingInterval)
+	defer ticker.Stop()
+	var token string
+	var timer *time.Timer
+	var expired <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-expired:
+			if s.state.PingPending(token) {
+				s.Settings.ErrorCallback(ctx, s.name, ErrPingTimeout)
+				return
+			}
+			expired = nil
+		case now := <-ticker.C:
+			// Wait for the PONG to the previous PING
+			if s.state.PingPending(token) {
+				continue
+			}
+			token = fmt.Sprintf("bananaboat-%d", now.UnixNano())
+			s.state.SetPingSent(token)
+			s.sendNow(ctx, &irc.Message{
+				Command: irc.PING,
+				Params:  []string{token},
+			})
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(timeout)
+			expired = timer.C
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"strconv"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// labeledResponseCapability makes the server copy labels of our requests to their replies (IRCv3 labeled-response)
+	labeledResponseCapability = "labeled-response"
+	// BatchLabeledResponse is the type of batches holding several replies to a labeled request
+	BatchLabeledResponse = "labeled-response"
+	// labelTag is the tag carrying the label of a request or reply
+	labelTag = "label"
+	// maxLabels is the number of labeled requests remembered, older ones are forgotten
+	maxLabels = 100
+)
+
+// labeledCommands are commands whose replies are correlated with them by label
+var labeledCommands = map[string]bool{
+	irc.ISON:   true,
+	irc.JOIN:   true,
+	irc.LIST:   true,
+	irc.NAMES:  true,
+	irc.TOPIC:  true,
+	irc.WHO:    true,
+	irc.WHOIS:  true,
+	irc.WHOWAS: true,
+}
+
+// requestKey is the context key of the labeled request a message replies to
+type requestKey struct{}
+
+// ContextWithRequest returns a context carrying the labeled request a message replies to
+func ContextWithRequest(ctx context.Context, req *irc.Message) context.Context {
+	return context.WithValue(ctx, requestKey{}, req)
+}
+
+// RequestFromContext returns the labeled request the message being handled replies to (nil if unknown)
+func RequestFromContext(ctx context.Context) *irc.Message {
+	req, _ := ctx.Value(requestKey{}).(*irc.Message)
+	return req
+}
+
+// labelRequest assigns a label to a request and remembers it
+func (st *ServerState) labelRequest(msg *irc.Message) string {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.labelCount++
+	label := "bb" + strconv.FormatUint(st.labelCount, 36)
+	if len(st.labelOrder) >= maxLabels {
+		delete(st.labels, st.labelOrder[0])
+		st.labelOrder = st.labelOrder[1:]
+	}
+	req := *msg
+	req.Params = append([]string(nil), msg.Params...)
+	st.labels[label] = &req
+	st.labelOrder = append(st.labelOrder, label)
+	return label
+}
+
+// LabeledRequest returns the request we sent with a label (if it is one of the last ones sent)
+func (st *ServerState) LabeledRequest(label string) (*irc.Message, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	req, ok := st.labels[label]
+	return req, ok
+}
+
+// encodeRequest sends a message, labelling it if its replies should be correlated with it
+func (s *IrcServer) encodeRequest(msg *irc.Message) error {
+	if !labeledCommands[msg.Command] || !s.state.HasCapability(labeledResponseCapability) {
+		return s.encode(msg)
+	}
+	label := s.state.labelRequest(msg)
+	_, err := s.encoder.Write(append([]byte("@"+labelTag+"="+label+" "), s.encodeMessage(msg).Bytes()...))
+	return err
+}
+
+// labelReply returns tags of a message carrying the label of the request it replies to
+// Replies in a labeled-response batch are labelled like the batch (including its end)
+func (s *IrcServer) labelReply(msg *irc.Message, tags map[string]string) map[string]string {
+	label, ok := tags[labelTag]
+	if msg.Command == BatchCommand && len(msg.Params) > 0 && len(msg.Params[0]) > 1 {
+		ref := msg.Params[0][1:]
+		switch msg.Params[0][0] {
+		case '+':
+			if ok && len(msg.Params) > 1 && msg.Params[1] == BatchLabeledResponse {
+				if s.labelBatches == nil {
+					s.labelBatches = make(map[string]string)
+				}
+				s.labelBatches[ref] = label
+			}
+			return tags
+		case '-':
+			label, ok = s.labelBatches[ref]
+			delete(s.labelBatches, ref)
+		}
+	} else if !ok {
+		label, ok = s.labelBatches[tags["batch"]]
+	}
+	if !ok {
+		return tags
+	}
+	labeled := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		labeled[k] = v
+	}
+	labeled[labelTag] = label
+	return labeled
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"strings"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// defaultChanModes is assumed if the server doesn't advertise CHANMODES
+	defaultChanModes = "beI,k,l,imnpst"
+	// defaultPrefix is assumed if the server doesn't advertise PREFIX
+	defaultPrefix = "(ov)@+"
+	// opPrefixes are membership prefixes allowing channel modes to be changed
+	opPrefixes = "~&@"
+)
+
+// ModeChange is a single change of a channel mode
+type ModeChange struct {
+	// Add is set if the mode was set rather than unset
+	Add bool
+	// Mode is the mode letter
+	Mode byte
+	// Param is the parameter of the mode if it takes one
+	Param string
+}
+
+// parsePrefix splits a PREFIX feature such as "(ov)@+" into modes and prefixes
+func parsePrefix(prefix string) (string, string) {
+	if !strings.HasPrefix(prefix, "(") {
+		return "", ""
+	}
+	i := strings.IndexByte(prefix, ')')
+	if i < 0 || len(prefix)-i-1 != i-1 {
+		return "", ""
+	}
+	return prefix[1:i], prefix[i+1:]
+}
+
+// prefixModes returns modes and prefixes of channel membership (mutex must be held)
+func (st *ServerState) prefixModes() (string, string) {
+	prefix, ok := st.isupport["PREFIX"]
+	if !ok {
+		prefix = defaultPrefix
+	}
+	return parsePrefix(prefix)
+}
+
+// opModes returns membership modes allowing channel modes to be changed (mutex must be held)
+func (st *ServerState) opModes() string {
+	modes, prefixes := st.prefixModes()
+	var opModes []byte
+	for i := range prefixes {
+		if strings.IndexByte(opPrefixes, prefixes[i]) >= 0 {
+			opModes = append(opModes, modes[i])
+		}
+	}
+	return string(opModes)
+}
+
+// parseModes parses a mode string and its parameters (mutex must be held)
+func (st *ServerState) parseModes(modes string, params []string) []ModeChange {
+	chanModes, ok := st.isupport["CHANMODES"]
+	if !ok {
+		chanModes = defaultChanModes
+	}
+	types := strings.Split(chanModes, ",")
+	for len(types) < 4 {
+		types = append(types, "")
+	}
+	memberModes, _ := st.prefixModes()
+	var changes []ModeChange
+	add := true
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+		switch mode {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+		change := ModeChange{Add: add, Mode: mode}
+		// Lists, membership & keys always take a parameter, limits only when set
+		takesParam := strings.IndexByte(types[0]+types[1]+memberModes, mode) >= 0 ||
+			(add && strings.IndexByte(types[2], mode) >= 0)
+		if takesParam && len(params) > 0 {
+			change.Param = params[0]
+			params = params[1:]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// ParseModes parses a mode string and its parameters using modes advertised by the server
+func (st *ServerState) ParseModes(modes string, params []string) []ModeChange {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.parseModes(modes, params)
+}
+
+// FlagMode returns true if a channel mode never takes a parameter
+func (st *ServerState) FlagMode(mode byte) bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	chanModes, ok := st.isupport["CHANMODES"]
+	if !ok {
+		chanModes = defaultChanModes
+	}
+	types := strings.Split(chanModes, ",")
+	return len(types) > 3 && strings.IndexByte(types[3], mode) >= 0
+}
+
+// IsOp returns true if we may change modes of channel
+func (st *ServerState) IsOp(channel string) bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	_, ok := st.ops[st.channelKey(channel)]
+	return ok
+}
+
+// handleNames records whether we are an operator of a channel from a RPL_NAMREPLY (mutex must be held)
+func (st *ServerState) handleNames(channel string, names string) {
+	_, prefixes := st.prefixModes()
+	for _, name := range strings.Fields(names) {
+		// Names may be nick!user@host (IRCv3 userhost-in-names)
+		trimmed := strings.TrimLeft(name, prefixes)
+		prefix := irc.ParsePrefix(trimmed)
+		if prefix == nil || prefix.Name != st.nick {
+			continue
+		}
+		if strings.ContainsAny(name[:len(name)-len(trimmed)], opPrefixes) {
+			st.ops[st.channelKey(channel)] = struct{}{}
+		} else {
+			delete(st.ops, st.channelKey(channel))
+		}
+	}
+}
+
+// handleMode records whether we are an operator of a channel from a MODE message (mutex must be held)
+func (st *ServerState) handleMode(channel string, modes string, params []string) {
+	opModes := st.opModes()
+	for _, change := range st.parseModes(modes, params) {
+		if change.Param != st.nick || strings.IndexByte(opModes, change.Mode) < 0 {
+			continue
+		}
+		if change.Add {
+			st.ops[st.channelKey(channel)] = struct{}{}
+		} else {
+			delete(st.ops, st.channelKey(channel))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"log"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// NickFallback is the command of the synthetic message telling handlers we registered with another nick
+	// Its parameters are the configured nick and the one we are using
+	NickFallback = "NICK_FALLBACK"
+	// maxNickAttempts is the number of other nicks tried before giving up on registering
+	maxNickAttempts = 10
+)
+
+// isRegistered returns true if the server welcomed us
+func (s *IrcServer) isRegistered() bool {
+	select {
+	case <-s.registered:
+		return true
+	default:
+		return false
+	}
+}
+
+// nextNick returns the nick to try after tried was refused: configured alternate nicks are used in turn
+// followed by appending underscores
+func (s *IrcServer) nextNick(tried string) string {
+	if s.nickAttempts < len(s.Settings.AltNicks) {
+		return s.Settings.AltNicks[s.nickAttempts]
+	}
+	return tried + "_"
+}
+
+// handleNickInUse tries another nick if the one we registered with is unavailable
+func (s *IrcServer) handleNickInUse(ctx context.Context, msg *irc.Message) {
+	// Parameters are our current nick, the nick we tried and a reason
+	// Once registered the server keeps our nick so there is nothing to do
+	if s.isRegistered() || len(msg.Params) < 2 {
+		return
+	}
+	if s.nickAttempts >= maxNickAttempts {
+		log.Printf("[%s] Nick %s is unavailable, giving up after %d other nicks", s.name, msg.Params[1], s.nickAttempts)
+		return
+	}
+	nick := s.nextNick(msg.Params[1])
+	s.nickAttempts++
+	log.Printf("[%s] Nick %s is unavailable, trying %s", s.name, msg.Params[1], nick)
+	s.sendNow(ctx, &irc.Message{
+		Command: irc.NICK,
+		Params:  []string{nick},
+	})
+}
+
+// nickFallbackMessage returns a synthetic message telling handlers we registered with another nick (nil if we didn't)
+func (s *IrcServer) nickFallbackMessage() *irc.Message {
+	nick := s.state.Nick()
+	if nick == s.Settings.Nick {
+		return nil
+	}
+	return &irc.Message{
+		Command: NickFallback,
+		Params:  []string{s.Settings.Nick, nick},
+	}
+}
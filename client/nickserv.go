@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// NickServ is the nick of the nickname service
+	NickServ = "NickServ"
+	// NickServGhost disconnects whoever uses our nick so we can change to it
+	NickServGhost = "GHOST"
+	// NickServRecover takes back our nick (Anope)
+	NickServRecover = "RECOVER"
+	// NickServRegain takes back our nick (Atheme)
+	NickServRegain = "REGAIN"
+	// nickServIdentifyInterval is the minimum time between identifying in reply to prompts
+	nickServIdentifyInterval = 30 * time.Second
+)
+
+// noRegainKey is the context key marking connections which must not regain our nick
+type noRegainKey struct{}
+
+// ContextWithoutRegain returns a context for connections which must not take our nick back from whoever uses it
+// (such as a new connection which replaces one of ours holding the nick)
+func ContextWithoutRegain(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRegainKey{}, true)
+}
+
+// mayRegain returns true if the connection may take our nick back
+func mayRegain(ctx context.Context) bool {
+	noRegain, _ := ctx.Value(noRegainKey{}).(bool)
+	return !noRegain
+}
+
+// ValidateNickServRegain returns an error if command isn't a supported way of regaining our nick
+func ValidateNickServRegain(command string) error {
+	switch command {
+	case "", NickServGhost, NickServRecover, NickServRegain:
+		return nil
+	}
+	return fmt.Errorf("unsupported NickServ regain command: %s", command)
+}
+
+// sendNickServ sends a command to NickServ
+func (s *IrcServer) sendNickServ(ctx context.Context, text string) {
+	s.sendNow(ctx, &irc.Message{
+		Command: irc.PRIVMSG,
+		Params:  []string{NickServ, text},
+	})
+}
+
+// nickServIdentify identifies to NickServ for our configured nick (which works while using another one)
+func (s *IrcServer) nickServIdentify(ctx context.Context) {
+	// Don't log the password
+	log.Printf("[%s] Identifying to %s as %s", s.name, NickServ, s.Settings.Nick)
+	s.nickServIdentified = time.Now()
+	s.sendNickServ(ctx, fmt.Sprintf("IDENTIFY %s %s", s.Settings.Nick, s.Settings.NickServPassword))
+}
+
+// nickServRegain takes back our configured nick if we had to use another one
+func (s *IrcServer) nickServRegain(ctx context.Context) {
+	if len(s.Settings.NickServRegain) == 0 || !mayRegain(ctx) || s.state.Nick() == s.Settings.Nick {
+		return
+	}
+	log.Printf("[%s] Regaining nick %s using %s", s.name, s.Settings.Nick, s.Settings.NickServRegain)
+	s.sendNickServ(ctx, fmt.Sprintf("%s %s %s", s.Settings.NickServRegain, s.Settings.Nick, s.Settings.NickServPassword))
+	// Ghosting only disconnects whoever uses the nick, we change to it once NickServ replies
+	s.nickServGhosting = s.Settings.NickServRegain == NickServGhost
+}
+
+// handleNickServ identifies to NickServ and takes back our nick if a NickServ password is configured
+func (s *IrcServer) handleNickServ(ctx context.Context, msg *irc.Message) {
+	if len(s.Settings.NickServPassword) == 0 {
+		return
+	}
+	switch msg.Command {
+	case irc.RPL_WELCOME:
+		s.nickServLoggedIn = false
+		s.nickServGhosting = false
+		// SASL already identified us
+		if !s.usesSASL() {
+			s.nickServIdentify(ctx)
+		}
+		s.nickServRegain(ctx)
+	case irc.RPL_LOGGEDIN:
+		s.nickServLoggedIn = true
+	case irc.NOTICE:
+		if msg.Prefix == nil || !strings.EqualFold(msg.Prefix.Name, NickServ) || len(msg.Params) == 0 {
+			return
+		}
+		if s.nickServGhosting {
+			s.nickServGhosting = false
+			s.sendNow(ctx, &irc.Message{
+				Command: irc.NICK,
+				Params:  []string{s.Settings.Nick},
+			})
+			return
+		}
+		// Services ask us to identify when we change to a registered nick
+		text := strings.ToLower(msg.Params[len(msg.Params)-1])
+		if s.nickServLoggedIn || s.state.Nick() != s.Settings.Nick || time.Since(s.nickServIdentified) < nickServIdentifyInterval {
+			return
+		}
+		if strings.Contains(text, "registered") || strings.Contains(text, "identify") {
+			s.nickServIdentify(ctx)
+		}
+	}
+}
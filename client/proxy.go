@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyTimeout is how long connecting through a proxy may take
+const proxyTimeout = 30 * time.Second
+
+// contextDialer is a dialer which can be cancelled (implemented by SOCKS5 dialers)
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// parseProxyURL parses the URL of a SOCKS5 (socks5:// or socks5h://) or HTTP CONNECT (http://) proxy
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Errors would include credentials
+		return nil, errors.New("invalid proxy URL")
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+	if len(u.Hostname()) == 0 || len(u.Port()) == 0 {
+		return nil, fmt.Errorf("proxy URL requires host and port: %s", u.Redacted())
+	}
+	return u, nil
+}
+
+// ValidateProxyURL returns an error if a proxy URL isn't supported
+func ValidateProxyURL(rawURL string) error {
+	_, err := parseProxyURL(rawURL)
+	return err
+}
+
+// dialProxy connects to the server through the configured proxy
+// The proxy resolves the host so it isn't leaked to local DNS (as is wanted for Tor), the address family
+// only applies to connecting to the proxy
+func (s *IrcServer) dialProxy(ctx context.Context) (net.Conn, error) {
+	u, err := parseProxyURL(s.Settings.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, proxyTimeout)
+	defer cancel()
+	target := net.JoinHostPort(s.Settings.Host, strconv.Itoa(s.port))
+	log.Printf("[%s] Connecting to %s through proxy %s", s.name, target, u.Redacted())
+	dialer, err := proxyDialer(s.Settings.BindAddress, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "http" {
+		return dialHTTPConnect(ctx, dialer, familyNetwork(s.Settings.Family), u, target)
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	socks, err := proxy.SOCKS5(familyNetwork(s.Settings.Family), u.Host, auth, dialer)
+	if err != nil {
+		return nil, err
+	}
+	return socks.(contextDialer).DialContext(ctx, "tcp", target)
+}
+
+// bufferedConn is a connection whose first bytes were already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads from the buffer before reading from the connection
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// proxyDialer returns a dialer connecting to a proxy from the local address to bind to (if any)
+func proxyDialer(bind string, proxyHost string) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: proxyTimeout}
+	localIPs, err := bindIPs(bind)
+	if err != nil || localIPs == nil {
+		return dialer, err
+	}
+	localIP := localIPs[0]
+	// Prefer an address of the same family if the proxy is given by address
+	if remote := net.ParseIP(proxyHost); remote != nil {
+		if ip := sameFamilyIP(localIPs, remote); ip != nil {
+			localIP = ip
+		}
+	}
+	dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+	return dialer, nil
+}
+
+// dialHTTPConnect connects to target through an HTTP proxy using CONNECT
+func dialHTTPConnect(ctx context.Context, dialer *net.Dialer, network string, u *url.URL, target string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The body of a successful reply is the tunnel so it must not be read
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", target, resp.Status)
+	}
+	// Deadlines are managed by the caller from now on
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
@@ -0,0 +1,22 @@
+package client
+
+import "context"
+
+// DefaultQuitMessage is the reason sent in QUIT unless another one is given
+const DefaultQuitMessage = "Leaving"
+
+// quitMessageKey is the context key of the reason sent in QUIT
+type quitMessageKey struct{}
+
+// ContextWithQuitMessage returns a context making Close send reason in QUIT (the default if empty)
+func ContextWithQuitMessage(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, quitMessageKey{}, reason)
+}
+
+// quitMessage returns the reason to send in QUIT
+func quitMessage(ctx context.Context) string {
+	if reason, _ := ctx.Value(quitMessageKey{}).(string); len(reason) > 0 {
+		return reason
+	}
+	return DefaultQuitMessage
+}
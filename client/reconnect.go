@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// MaxReconnectDelay is the longest delay before reconnecting whatever the strategy
+const MaxReconnectDelay = 24 * time.Hour
+
+// ReconnectStrategy configures how long we wait before reconnecting after a connection failed
+type ReconnectStrategy struct {
+	// Base is the delay before the first reconnect attempt
+	Base time.Duration
+	// Jitter randomises delays by up to this fraction (0 to 1) so many bots don't reconnect at once
+	Jitter float64
+	// Max is the longest delay (at most a day, which is also used if zero)
+	Max time.Duration
+	// Multiplier is what the delay is multiplied by after each failed attempt (at least 1)
+	Multiplier float64
+	// ResetAfter is how long a connection must stay up after registration before backoff is reset
+	// (backoff is reset on registration if zero)
+	ResetAfter time.Duration
+}
+
+// Validate returns an error if the strategy can't be used
+func (r *ReconnectStrategy) Validate() error {
+	switch {
+	case r.Base <= 0:
+		return errors.New("base must be positive")
+	case r.Max < 0 || r.ResetAfter < 0:
+		return errors.New("durations must not be negative")
+	case math.IsNaN(r.Multiplier) || math.IsInf(r.Multiplier, 0) || r.Multiplier < 1:
+		return errors.New("multiplier must be at least 1")
+	case math.IsNaN(r.Jitter) || r.Jitter < 0 || r.Jitter > 1:
+		return errors.New("jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// Delay returns how long to wait before reconnect attempt number attempt (starting at 1)
+func (r *ReconnectStrategy) Delay(attempt uint64) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	max := float64(MaxReconnectDelay)
+	if r.Max > 0 && r.Max < MaxReconnectDelay {
+		max = float64(r.Max)
+	}
+	// Delays are capped before converting as they overflow after enough attempts
+	delay := math.Min(float64(r.Base)*math.Pow(r.Multiplier, float64(attempt-1)), max)
+	if r.Jitter > 0 {
+		delay *= 1 + r.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(math.Min(delay, float64(MaxReconnectDelay)))
+}
+
+// reconnectDelayFor returns how long to wait before reconnect attempt number attempt
+func (s *IrcServer) reconnectDelayFor(attempt uint64) time.Duration {
+	if s.Settings.Reconnect != nil {
+		return s.Settings.Reconnect.Delay(attempt)
+	}
+	return time.Duration(s.Settings.MaxReconnect * math.Tanh(float64(attempt)/1000.0) * float64(time.Second))
+}
+
+// resetBackoff resets backoff once the connection has stayed up for ResetAfter after registration
+func (s *IrcServer) resetBackoff(ctx context.Context) {
+	timer := time.NewTimer(s.Settings.Reconnect.ResetAfter)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+		atomic.StoreUint64(s.reconnectExp, 0)
+	}
+}
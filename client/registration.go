@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// Steps of registration which may be reordered using IrcServerSettings.RegistrationOrder
+const (
+	// RegisterCap starts capability negotiation by sending CAP LS (skipped if no capabilities are requested)
+	RegisterCap = "cap"
+	// RegisterNegotiate holds back following steps until capability negotiation (including SASL) ended
+	RegisterNegotiate = "negotiate"
+	// RegisterNick sends NICK
+	RegisterNick = "nick"
+	// RegisterPass sends PASS (skipped if no password is configured)
+	RegisterPass = "pass"
+	// RegisterUser sends USER
+	RegisterUser = "user"
+)
+
+// DefaultRegistrationOrder is the order of registration steps if none is configured
+// Capability negotiation continues after NICK and USER are sent as registration is suspended until CAP END
+var DefaultRegistrationOrder = []string{RegisterCap, RegisterPass, RegisterNick, RegisterUser}
+
+// registrationState is the progress of registration
+type registrationState int
+
+const (
+	// regNegotiated means capability negotiation ended or wasn't started
+	regNegotiated registrationState = iota
+	// regCapLS means we are waiting for the list of capabilities supported by the server
+	regCapLS
+	// regCapReq means we are waiting for replies to our capability requests
+	regCapReq
+	// regSASL means we are authenticating
+	regSASL
+)
+
+// ValidateRegistrationOrder returns an error if order contains unknown or repeated steps
+func ValidateRegistrationOrder(order []string) error {
+	seen := make(map[string]bool)
+	for _, step := range order {
+		switch step {
+		case RegisterCap, RegisterNegotiate, RegisterNick, RegisterPass, RegisterUser:
+		default:
+			return fmt.Errorf("unknown registration step: %s", step)
+		}
+		if seen[step] {
+			return fmt.Errorf("repeated registration step: %s", step)
+		}
+		seen[step] = true
+	}
+	return nil
+}
+
+// registrationOrder returns configured registration steps followed by missing ones in default order
+func registrationOrder(order []string) []string {
+	seen := make(map[string]bool)
+	var steps []string
+	for _, step := range append(append([]string{}, order...), DefaultRegistrationOrder...) {
+		if !seen[step] {
+			seen[step] = true
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// registrationCommands prepares registration and returns commands to send after connecting
+// Commands following the negotiate step are held back until capability negotiation ends
+func (s *IrcServer) registrationCommands() []*irc.Message {
+	negotiate := len(s.requestedCapabilities()) > 0
+	s.state.resetCapabilities()
+	s.batches = nil
+	s.nickAttempts = 0
+	s.nickServGhosting = false
+	s.nickServLoggedIn = false
+	s.capPending = 0
+	s.capSupported = nil
+	s.regDeferred = nil
+	s.regState = regNegotiated
+	if negotiate {
+		s.regState = regCapLS
+	}
+	var commands []*irc.Message
+	// Gateways identify the user they relay for before anything else
+	if len(s.Settings.WebIRCPassword) > 0 {
+		commands = append(commands, &irc.Message{
+			Command: "WEBIRC",
+			Params:  []string{s.Settings.WebIRCPassword, s.Settings.WebIRCGateway, webircAddress(s.Settings.WebIRCHost), webircAddress(s.Settings.WebIRCIP)},
+		})
+	}
+	deferring := false
+	for _, step := range registrationOrder(s.Settings.RegistrationOrder) {
+		var cmd *irc.Message
+		switch step {
+		case RegisterCap:
+			if negotiate {
+				cmd = &irc.Message{
+					Command: irc.CAP,
+					Params:  []string{irc.CAP_LS, "302"},
+				}
+			}
+		case RegisterNegotiate:
+			deferring = negotiate
+		case RegisterNick:
+			cmd = &irc.Message{
+				Command: irc.NICK,
+				Params:  []string{s.Settings.Nick},
+			}
+		case RegisterPass:
+			if len(s.Settings.Password) > 0 {
+				cmd = &irc.Message{
+					Command: irc.PASS,
+					Params:  []string{s.Settings.Password},
+				}
+			}
+		case RegisterUser:
+			cmd = &irc.Message{
+				Command: irc.USER,
+				Params:  []string{s.Settings.Username, "0", "*", s.Settings.Realname},
+			}
+		}
+		if cmd == nil {
+			continue
+		}
+		if deferring {
+			s.regDeferred = append(s.regDeferred, cmd)
+		} else {
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
+
+// webircAddress returns a host or IP address for WEBIRC which can't be mistaken for a trailing parameter
+func webircAddress(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "0" + addr
+	}
+	return addr
+}
+
+// endNegotiation ends capability negotiation (sending CAP END if the server supports it) and continues registration
+func (s *IrcServer) endNegotiation(ctx context.Context, capEnd bool) {
+	if s.regState == regNegotiated {
+		return
+	}
+	s.regState = regNegotiated
+	if capEnd {
+		s.sendNow(ctx, &irc.Message{
+			Command: irc.CAP,
+			Params:  []string{irc.CAP_END},
+		})
+	}
+	deferred := s.regDeferred
+	s.regDeferred = nil
+	for _, cmd := range deferred {
+		s.sendNow(ctx, cmd)
+	}
+}
+
+// handleRegistration reacts to messages which are part of registration
+func (s *IrcServer) handleRegistration(ctx context.Context, msg *irc.Message) {
+	switch msg.Command {
+	case irc.CAP:
+		s.handleCAP(ctx, msg)
+	case irc.ERR_UNKNOWNCOMMAND:
+		// Servers which don't support capability negotiation register us right away
+		if s.regState == regCapLS && len(msg.Params) > 1 && msg.Params[1] == irc.CAP {
+			log.Printf("[%s] Server doesn't support capability negotiation", s.name)
+			s.endNegotiation(ctx, false)
+		}
+	case irc.RPL_WELCOME:
+		// Registration is complete whatever state we thought it was in
+		s.regState = regNegotiated
+		s.regDeferred = nil
+	}
+}
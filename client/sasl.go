@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"time"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// SASL mechanisms which may be configured
+const (
+	// SASLExternal authenticates using the TLS client certificate (CertFP)
+	SASLExternal = "EXTERNAL"
+	// SASLPlain authenticates using an account name and password
+	SASLPlain = "PLAIN"
+)
+
+const (
+	// DefaultSASLRetryDelay is how long we wait before retrying SASL authentication if no delay is configured
+	DefaultSASLRetryDelay = 5 * time.Second
+	// saslChunkSize is the maximum length of an AUTHENTICATE payload
+	saslChunkSize = 400
+)
+
+// saslPlainPayload returns AUTHENTICATE messages carrying PLAIN credentials
+func saslPlainPayload(user string, password string) []*irc.Message {
+	encoded := base64.StdEncoding.EncodeToString([]byte(user + "\x00" + user + "\x00" + password))
+	var messages []*irc.Message
+	for len(encoded) >= saslChunkSize {
+		messages = append(messages, &irc.Message{
+			Command: irc.AUTHENTICATE,
+			Params:  []string{encoded[:saslChunkSize]},
+		})
+		encoded = encoded[saslChunkSize:]
+	}
+	// A final chunk of exactly 400 bytes is followed by an empty one
+	if len(encoded) == 0 {
+		encoded = "+"
+	}
+	return append(messages, &irc.Message{
+		Command: irc.AUTHENTICATE,
+		Params:  []string{encoded},
+	})
+}
+
+// newSASLAttempt resets SASL state for another authentication attempt
+func (s *IrcServer) newSASLAttempt() {
+	s.saslAttempts++
+	s.saslChallenged = false
+}
+
+// usesSASL returns true if SASL authentication is configured
+func (s *IrcServer) usesSASL() bool {
+	return len(s.Settings.SASLUser) > 0 || s.saslMechanism() == SASLExternal
+}
+
+// saslMechanism returns the configured SASL mechanism
+func (s *IrcServer) saslMechanism() string {
+	if s.Settings.SASLMechanism == SASLExternal {
+		return SASLExternal
+	}
+	return SASLPlain
+}
+
+// startSASL requests the configured mechanism
+func (s *IrcServer) startSASL(ctx context.Context) {
+	s.sendNow(ctx, &irc.Message{
+		Command: irc.AUTHENTICATE,
+		Params:  []string{s.saslMechanism()},
+	})
+}
+
+// handleSASL reacts to messages which are part of SASL authentication
+func (s *IrcServer) handleSASL(ctx context.Context, msg *irc.Message) {
+	switch msg.Command {
+	case irc.AUTHENTICATE:
+		// Services are responding so a failure from now on means our credentials were rejected
+		s.saslChallenged = true
+		if s.saslMechanism() == SASLExternal {
+			// The identity is taken from our certificate
+			s.sendNow(ctx, &irc.Message{
+				Command: irc.AUTHENTICATE,
+				Params:  []string{"+"},
+			})
+			return
+		}
+		for _, m := range saslPlainPayload(s.Settings.SASLUser, s.Settings.SASLPassword) {
+			s.sendNow(ctx, m)
+		}
+	case irc.RPL_SASLSUCCESS:
+		log.Printf("[%s] SASL authentication succeeded", s.name)
+		s.endNegotiation(ctx, true)
+	case irc.ERR_SASLFAIL, irc.ERR_SASLABORTED, irc.RPL_NICKLOCKED:
+		reason := msg.Command
+		if len(msg.Params) > 0 {
+			reason = msg.Params[len(msg.Params)-1]
+		}
+		// Failing before services challenged us means they are lagging or unavailable
+		transient := !s.saslChallenged && msg.Command != irc.RPL_NICKLOCKED
+		if transient && s.saslAttempts <= s.Settings.SASLRetries {
+			delay := s.Settings.SASLRetryDelay
+			if delay <= 0 {
+				delay = DefaultSASLRetryDelay
+			}
+			log.Printf("[%s] SASL authentication failed (%s), retrying in %s", s.name, reason, delay)
+			s.newSASLAttempt()
+			go s.retrySASL(ctx, delay)
+			return
+		}
+		go s.Settings.ErrorCallback(ctx, s.name, &SASLError{
+			Attempts:  s.saslAttempts,
+			Message:   reason,
+			Name:      s.name,
+			Transient: transient,
+		})
+	}
+}
+
+// retrySASL authenticates again after a delay
+func (s *IrcServer) retrySASL(ctx context.Context, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+		s.startSASL(ctx)
+	}
+}
@@ -0,0 +1,376 @@
+package client
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+const (
+	// ErrLinkChannel is sent when joining a channel forwarded us to another one
+	ErrLinkChannel = "470"
+	// RplHostHidden is sent when our displayed host changes (such as when a cloak is applied)
+	RplHostHidden = "396"
+	// chghostCommand is sent when the username or host of someone changes (IRCv3 chghost)
+	chghostCommand = "CHGHOST"
+)
+
+// ServerState tracks state of our connection to a server
+type ServerState struct {
+	// away is the reason we are marked away for (empty if we aren't)
+	away string
+	// batches maps reference tags of open batches to their type and parameters
+	batches map[string]*Batch
+	// capabilities is the set of IRCv3 capabilities enabled on the connection
+	capabilities map[string]struct{}
+	// channels is the set of channels we have joined
+	channels map[string]struct{}
+	// channelStates maps channels we have joined to their members, topic and modes
+	channelStates map[string]*channelState
+	// forwards maps channels we tried to join to channels we were forwarded to
+	forwards map[string]string
+	// host is our host as seen by others (empty if unknown)
+	host string
+	// isupport holds features advertised by the server in RPL_ISUPPORT
+	isupport map[string]string
+	// labelCount is the number of labels assigned to our requests
+	labelCount uint64
+	// labelOrder lists labels of remembered requests from oldest to newest
+	labelOrder []string
+	// labels maps labels to the requests we sent with them
+	labels map[string]*irc.Message
+	// lag is the round-trip time of our last answered PING (zero if unknown)
+	lag time.Duration
+	// motd is the last complete message of the day received
+	motd string
+	// motdLines are lines of a message of the day being received
+	motdLines []string
+	// motdReceived is set once the server sent its message of the day (or said it has none)
+	motdReceived bool
+	// mutex protects the state
+	mutex sync.RWMutex
+	// nick is our current nick
+	nick string
+	// ops is the set of channels in which we may change modes
+	ops map[string]struct{}
+	// pingSent is when we sent the PING we are waiting for
+	pingSent time.Time
+	// pingToken is the token of the PING we are waiting for
+	pingToken string
+	// user is our username as seen by others (empty if unknown)
+	user string
+}
+
+// channelKey normalises a channel name for use as a map key (mutex must be held)
+func (st *ServerState) channelKey(channel string) string {
+	return FoldCase(st.caseMapping(), channel)
+}
+
+// Handle updates state from a message received from the server
+func (st *ServerState) Handle(msg *irc.Message) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	// Messages from ourselves are interesting
+	fromUs := msg.Prefix != nil && st.isUs(msg.Prefix.Name)
+	// Messages from ourselves show how others see us
+	if fromUs && len(msg.Prefix.User) > 0 && len(msg.Prefix.Host) > 0 {
+		st.user = msg.Prefix.User
+		st.host = msg.Prefix.Host
+	}
+	st.trackChannels(msg, fromUs)
+	switch msg.Command {
+	case irc.RPL_WELCOME:
+		// First parameter of welcome is our nick
+		if len(msg.Params) > 0 {
+			st.nick = msg.Params[0]
+		}
+	case irc.RPL_ISUPPORT:
+		// Parameters between our nick and the trailing text are tokens
+		if len(msg.Params) > 2 {
+			for _, token := range msg.Params[1 : len(msg.Params)-1] {
+				if strings.HasPrefix(token, "-") {
+					delete(st.isupport, strings.ToUpper(token[1:]))
+					continue
+				}
+				kv := strings.SplitN(token, "=", 2)
+				value := ""
+				if len(kv) > 1 {
+					value = kv[1]
+				}
+				st.isupport[strings.ToUpper(kv[0])] = unescapeISupport(value)
+			}
+		}
+	case irc.RPL_MOTDSTART:
+		st.motdLines = nil
+	case irc.RPL_MOTD:
+		// Lines are usually prefixed with "- "
+		if len(msg.Params) > 1 {
+			st.motdLines = append(st.motdLines, strings.TrimPrefix(msg.Params[len(msg.Params)-1], "- "))
+		}
+	case irc.RPL_ENDOFMOTD:
+		st.motd = strings.Join(st.motdLines, "\n")
+		st.motdLines = nil
+		st.motdReceived = true
+	case irc.ERR_NOMOTD:
+		st.motd = ""
+		st.motdLines = nil
+		st.motdReceived = true
+	case irc.NICK:
+		if fromUs && len(msg.Params) > 0 {
+			st.nick = msg.Params[0]
+		}
+	case RplHostHidden:
+		// Parameters are our nick, our new host (possibly user@host) and a text
+		if len(msg.Params) > 2 {
+			if i := strings.LastIndex(msg.Params[1], "@"); i >= 0 {
+				st.user = msg.Params[1][:i]
+				st.host = msg.Params[1][i+1:]
+			} else {
+				st.host = msg.Params[1]
+			}
+		}
+	case chghostCommand:
+		// Parameters are the new username and host
+		if fromUs && len(msg.Params) > 1 {
+			st.user = msg.Params[0]
+			st.host = msg.Params[1]
+		}
+	case irc.JOIN:
+		if fromUs && len(msg.Params) > 0 {
+			st.channels[st.channelKey(msg.Params[0])] = struct{}{}
+			// We got into the channel itself after all
+			delete(st.forwards, st.channelKey(msg.Params[0]))
+		}
+	case ErrLinkChannel:
+		// Parameters are our nick, the channel we tried to join and the one we are joining instead
+		if len(msg.Params) > 2 {
+			st.forwards[st.channelKey(msg.Params[1])] = msg.Params[2]
+		}
+	case irc.PART:
+		if fromUs && len(msg.Params) > 0 {
+			delete(st.channels, st.channelKey(msg.Params[0]))
+			delete(st.ops, st.channelKey(msg.Params[0]))
+		}
+	case irc.RPL_NAMREPLY:
+		// Parameters are our nick, the channel type, the channel and names
+		if len(msg.Params) > 3 {
+			st.handleNames(msg.Params[2], msg.Params[3])
+		}
+	case irc.MODE:
+		if len(msg.Params) > 1 {
+			st.handleMode(msg.Params[0], msg.Params[1], msg.Params[2:])
+		}
+	case BatchCommand:
+		st.trackBatch(msg)
+	case irc.CAP:
+		st.handleCAP(msg)
+	case irc.PONG:
+		// Last parameter of PONG is the token of our PING
+		if len(st.pingToken) > 0 && len(msg.Params) > 0 && msg.Params[len(msg.Params)-1] == st.pingToken {
+			st.lag = time.Since(st.pingSent)
+			st.pingToken = ""
+		}
+	case irc.RPL_UNAWAY:
+		st.away = ""
+	case irc.KICK:
+		if len(msg.Params) > 1 && st.isUs(msg.Params[1]) {
+			delete(st.channels, st.channelKey(msg.Params[0]))
+			delete(st.ops, st.channelKey(msg.Params[0]))
+		}
+	}
+}
+
+// handleCAP tracks enabled capabilities (mutex must be held)
+func (st *ServerState) handleCAP(msg *irc.Message) {
+	// Parameters are our nick, the subcommand and a list of capabilities
+	if len(msg.Params) < 3 {
+		return
+	}
+	for _, token := range strings.Fields(msg.Params[len(msg.Params)-1]) {
+		switch msg.Params[1] {
+		case irc.CAP_ACK:
+			// Capabilities prefixed with "-" were disabled
+			if strings.HasPrefix(token, "-") {
+				delete(st.capabilities, token[1:])
+			} else {
+				st.capabilities[token] = struct{}{}
+			}
+		case capDEL:
+			delete(st.capabilities, token)
+		}
+	}
+}
+
+// Capabilities returns capabilities enabled on the connection in alphabetical order
+func (st *ServerState) Capabilities() []string {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	caps := make([]string, 0, len(st.capabilities))
+	for capability := range st.capabilities {
+		caps = append(caps, capability)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+// HasCapability returns true if a capability is enabled on the connection
+func (st *ServerState) HasCapability(capability string) bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	_, ok := st.capabilities[capability]
+	return ok
+}
+
+// resetCapabilities forgets capabilities enabled on a previous connection
+func (st *ServerState) resetCapabilities() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.capabilities = make(map[string]struct{})
+}
+
+// InChannel returns true if we have joined channel
+func (st *ServerState) InChannel(channel string) bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	_, ok := st.channels[st.channelKey(channel)]
+	return ok
+}
+
+// Forwarded returns the channel we were forwarded to when trying to join channel
+func (st *ServerState) Forwarded(channel string) (string, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	to, ok := st.forwards[st.channelKey(channel)]
+	return to, ok
+}
+
+// ISupport returns the value of a feature advertised by the server and whether it was advertised
+func (st *ServerState) ISupport(key string) (string, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	value, ok := st.isupport[strings.ToUpper(key)]
+	return value, ok
+}
+
+// ISupportAll returns a copy of all features advertised by the server
+func (st *ServerState) ISupportAll() map[string]string {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	features := make(map[string]string, len(st.isupport))
+	for key, value := range st.isupport {
+		features[key] = value
+	}
+	return features
+}
+
+// unescapeISupport decodes \xHH escapes in the value of a feature (such as spaces in NETWORK)
+func unescapeISupport(value string) string {
+	if !strings.Contains(value, "\\x") {
+		return value
+	}
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if b, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				sb.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(value[i])
+	}
+	return sb.String()
+}
+
+// Lag returns the round-trip time of our last answered PING (zero if unknown)
+func (st *ServerState) Lag() time.Duration {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.lag
+}
+
+// Away returns the reason we are marked away for (empty if we aren't)
+func (st *ServerState) Away() string {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.away
+}
+
+// SetAway records the reason we are marked away for (empty if we are back)
+func (st *ServerState) SetAway(reason string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.away = reason
+}
+
+// trackAway records away status set by an AWAY message we sent
+func (st *ServerState) trackAway(msg *irc.Message) {
+	if msg.Command != irc.AWAY {
+		return
+	}
+	reason := ""
+	if len(msg.Params) > 0 {
+		reason = msg.Params[0]
+	}
+	st.SetAway(reason)
+}
+
+// MOTD returns the message of the day and whether it was received yet (it is empty if the server has none)
+func (st *ServerState) MOTD() (string, bool) {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.motd, st.motdReceived
+}
+
+// SetPingSent records that we sent a PING with token
+func (st *ServerState) SetPingSent(token string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.pingSent = time.Now()
+	st.pingToken = token
+}
+
+// PingPending returns true if we are still waiting for the PONG to the PING with token
+func (st *ServerState) PingPending(token string) bool {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return len(token) > 0 && st.pingToken == token
+}
+
+// Nick returns our current nick
+func (st *ServerState) Nick() string {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.nick
+}
+
+// PrefixLength returns the length of the prefix servers add when relaying our messages (including the leading
+// colon and trailing space) or 0 if it isn't known yet
+func (st *ServerState) PrefixLength() int {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	if len(st.user) == 0 || len(st.host) == 0 {
+		return 0
+	}
+	// Prefix is :nick!user@host followed by a space
+	return len(st.nick) + len(st.user) + len(st.host) + 4
+}
+
+// NewServerState creates a ServerState
+func NewServerState(nick string) *ServerState {
+	return &ServerState{
+		batches:       make(map[string]*Batch),
+		capabilities:  make(map[string]struct{}),
+		channels:      make(map[string]struct{}),
+		channelStates: make(map[string]*channelState),
+		forwards:      make(map[string]string),
+		isupport:      make(map[string]string),
+		labels:        make(map[string]*irc.Message),
+		nick:          nick,
+		ops:           make(map[string]struct{}),
+	}
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stsCapability advertises the IRCv3 strict transport security policy of a server
+const stsCapability = "sts"
+
+// STSPolicy is the strict transport security policy of a host: connect to it using TLS on Port
+type STSPolicy struct {
+	// Port is the port to connect to using TLS
+	Port int
+	// Expires is when the policy expires (zero if it was only received over an insecure connection and
+	// applies until we are restarted, or if it was removed)
+	Expires time.Time
+}
+
+// STSUpgradeError is reported if an insecure connection advertised a policy asking us to connect using TLS
+type STSUpgradeError struct {
+	Name string
+	// Port is the port to connect to using TLS
+	Port int
+}
+
+func (e *STSUpgradeError) Error() string {
+	return fmt.Sprintf("[%s] server requires TLS on port %d", e.Name, e.Port)
+}
+
+// parseSTSValue parses the value of the sts capability such as "port=6697" or "duration=2592000,preload"
+func parseSTSValue(value string) map[string]string {
+	keys := make(map[string]string)
+	for _, token := range strings.Split(value, ",") {
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) > 1 {
+			keys[kv[0]] = kv[1]
+		} else if len(kv[0]) > 0 {
+			keys[kv[0]] = ""
+		}
+	}
+	return keys
+}
+
+// applySTSPolicy connects using TLS (with verification) on the port required by a known policy of the host
+func (s *IrcServer) applySTSPolicy() {
+	if s.secure || s.Settings.STSLookup == nil {
+		return
+	}
+	policy, ok := s.Settings.STSLookup(s.Settings.Host)
+	if !ok {
+		return
+	}
+	log.Printf("[%s] Connecting to %s using TLS on port %d as required by its STS policy", s.name, s.Settings.Host, policy.Port)
+	s.secure = true
+	s.port = policy.Port
+	verified := *s.Settings
+	verified.VerifyTLS = true
+	s.tlsConfig = newTLSConfig(&verified)
+}
+
+// handleSTS honours the policy advertised by the server, returning true if we must reconnect using TLS
+// Policies advertised over insecure connections only ask us to upgrade, only secure ones set how long they last
+func (s *IrcServer) handleSTS(ctx context.Context, value string) bool {
+	keys := parseSTSValue(value)
+	if !s.secure {
+		port, err := strconv.Atoi(keys["port"])
+		if err != nil || port <= 0 || port > 65535 {
+			log.Printf("[%s] Ignoring STS policy without valid port: %s", s.name, value)
+			return false
+		}
+		go s.Settings.ErrorCallback(ctx, s.name, &STSUpgradeError{Name: s.name, Port: port})
+		return true
+	}
+	duration, err := strconv.ParseUint(keys["duration"], 10, 32)
+	if err != nil {
+		log.Printf("[%s] Ignoring STS policy without valid duration: %s", s.name, value)
+		return false
+	}
+	if s.Settings.STSCallback == nil {
+		return false
+	}
+	policy := STSPolicy{Port: s.port}
+	// A duration of zero removes the policy
+	if duration > 0 {
+		policy.Expires = time.Now().Add(time.Duration(duration) * time.Second)
+	}
+	s.Settings.STSCallback(ctx, s.name, s.Settings.Host, policy)
+	return false
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// tagsKey is the context key of tags of the message being handled
+type tagsKey struct{}
+
+// timeKey is the context key of the time of the message being handled
+type timeKey struct{}
+
+// tagValueReplacer unescapes tag values
+var tagValueReplacer = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+// ContextWithTags returns a context carrying tags of a message
+func ContextWithTags(ctx context.Context, tags map[string]string) context.Context {
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+// TagsFromContext returns tags of the message being handled (nil if it had none)
+func TagsFromContext(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	return tags
+}
+
+// ContextWithTime returns a context carrying the time of a message
+func ContextWithTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, timeKey{}, t)
+}
+
+// TimeFromContext returns the time of the message being handled and whether it is known
+func TimeFromContext(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(timeKey{}).(time.Time)
+	return t, ok
+}
+
+// messageTime returns the time a message was sent according to its server-time tag or when it was received
+func messageTime(tags map[string]string, received time.Time) time.Time {
+	if value, ok := tags["time"]; ok {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err == nil {
+			return t
+		}
+	}
+	return received
+}
+
+// parseTags parses the tags of a message (without the leading @)
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if len(tag) == 0 {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		value := ""
+		if len(kv) > 1 {
+			// A trailing lone backslash is dropped
+			value = tagValueReplacer.Replace(strings.TrimSuffix(kv[1], `\`))
+		}
+		tags[kv[0]] = value
+	}
+	return tags
+}
+
+// tagDecoder reads messages which may have tags from an input stream
+type tagDecoder struct {
+	reader *bufio.Reader
+}
+
+// newTagDecoder returns a tagDecoder reading from r
+func newTagDecoder(r io.Reader) *tagDecoder {
+	return &tagDecoder{reader: bufio.NewReader(r)}
+}
+
+// Decode reads a message and its tags (empty and malformed lines are skipped)
+func (d *tagDecoder) Decode() (*irc.Message, map[string]string, error) {
+	for {
+		line, err := d.reader.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		var tags map[string]string
+		if strings.HasPrefix(line, "@") {
+			i := strings.IndexByte(line, ' ')
+			if i < 0 {
+				continue
+			}
+			tags = parseTags(line[1:i])
+			line = strings.TrimLeft(line[i:], " ")
+		}
+		if msg := irc.ParseMessage(line); msg != nil {
+			return msg, tags, nil
+		}
+	}
+}
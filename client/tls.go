@@ -0,0 +1,176 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Fingerprint returns the SHA-256 fingerprint of a DER-encoded certificate as hex
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// defaultTLSMinVersion is the oldest TLS version used if none is configured
+const defaultTLSMinVersion = tls.VersionTLS12
+
+// tlsVersions maps names of TLS versions to their values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ValidateTLSVersion returns an error if version isn't a known TLS version such as 1.2
+func ValidateTLSVersion(version string) error {
+	if _, ok := tlsVersions[version]; !ok && len(version) > 0 {
+		return fmt.Errorf("unsupported TLS version: %s", version)
+	}
+	return nil
+}
+
+// cipherSuiteID returns the ID of a cipher suite named as in the IANA registry (such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256), insecure ones are included for old servers
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.Name == name {
+				return suite.ID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// ValidateCipherSuite returns an error if a cipher suite isn't supported
+func ValidateCipherSuite(name string) error {
+	if _, ok := cipherSuiteID(name); !ok {
+		return fmt.Errorf("unsupported cipher suite: %s", name)
+	}
+	return nil
+}
+
+// newTLSConfig creates TLS configuration for a server
+func newTLSConfig(settings *IrcServerSettings) *tls.Config {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !settings.VerifyTLS,
+		MinVersion:         defaultTLSMinVersion,
+		ServerName:         settings.Host,
+	}
+	if version, ok := tlsVersions[settings.TLSMinVersion]; ok {
+		tlsConfig.MinVersion = version
+	}
+	// Cipher suites of TLS 1.3 aren't configurable
+	for _, name := range settings.TLSCipherSuites {
+		if id, ok := cipherSuiteID(name); ok {
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	if len(settings.TLSCert) > 0 {
+		// Certificates are loaded on every handshake so renewed ones are used after reconnecting
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(settings.TLSCert, clientKeyFile(settings))
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+	if len(settings.TLSPin) > 0 || (len(settings.TLSCA) > 0 && settings.VerifyTLS) {
+		// We verify the certificate ourselves so we can use our CAs and fall back to the pin
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPinned(settings.Host, settings.TLSCA, settings.TLSPin, rawCerts)
+		}
+	}
+	return tlsConfig
+}
+
+// loadCAFile reads a pool of CA certificates from a PEM file
+// The file is read on every handshake so changes are used after reconnecting
+func loadCAFile(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("tls: no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// ValidateCAFile returns an error if a file of CA certificates can't be used
+func ValidateCAFile(caFile string) error {
+	_, err := loadCAFile(caFile)
+	return err
+}
+
+// ValidateClientCertificate returns an error if a client certificate and key (which may be in the certificate
+// file if keyFile is empty) can't be loaded
+func ValidateClientCertificate(certFile string, keyFile string) error {
+	if len(keyFile) == 0 {
+		keyFile = certFile
+	}
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	return err
+}
+
+// clientKeyFile returns the file holding the key of our client certificate (which may hold both)
+func clientKeyFile(settings *IrcServerSettings) string {
+	if len(settings.TLSKey) > 0 {
+		return settings.TLSKey
+	}
+	return settings.TLSCert
+}
+
+// verifyPinned verifies a certificate chain against the CAs in caFile (system CAs if empty), falling back to
+// checking the fingerprint if pinned
+func verifyPinned(host string, caFile string, pin string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("tls: no certificates from server")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	var roots *x509.CertPool
+	if len(caFile) > 0 {
+		var err error
+		if roots, err = loadCAFile(caFile); err != nil {
+			return err
+		}
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Intermediates: intermediates,
+		Roots:         roots,
+	})
+	if err == nil || len(pin) == 0 {
+		return err
+	}
+	// Accept the certificate if it is the one we expect
+	fingerprint := Fingerprint(rawCerts[0])
+	if fingerprint == pin {
+		return nil
+	}
+	return &PinError{
+		Expected:    pin,
+		Fingerprint: fingerprint,
+		VerifyError: err,
+	}
+}
@@ -3,24 +3,45 @@ package log
 import (
 	"bytes"
 	"container/ring"
+	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"sync"
+	"time"
 )
 
+// timestampRegexp matches timestamps added by the standard logger
+var timestampRegexp = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? `)
+
 // Logger contains custom elements of our logger
 type Logger struct {
 	config *LoggerConfig
-	ring   *ring.Ring
+	// last is the last message written without its timestamp
+	last string
+	// lastTime is when last was written
+	lastTime time.Time
+	// lastTimestamped is set if last had a timestamp
+	lastTimestamped bool
+	// mutex protects the logger
+	mutex sync.Mutex
+	// repeats is the number of times last was repeated since it was written
+	repeats int
+	ring    *ring.Ring
+	// timer flushes repeats at the end of the coalescing window
+	timer  *time.Timer
 	writer io.Writer
 }
 
 // LoggerConfig contains configuration for the logger
 type LoggerConfig struct {
-	RingSize int
+	// CoalesceWindow is how long identical consecutive messages are coalesced (0 disables)
+	CoalesceWindow time.Duration
+	RingSize       int
 }
 
-// Write handles writes
-func (l *Logger) Write(b []byte) (wrote int, err error) {
+// write writes a message to ring buffer and output
+func (l *Logger) write(b []byte) (wrote int, err error) {
 	// Convert message to string, set it to ring buffer
 	l.ring.Value = string(b)
 	// Move ringbuffer to next value
@@ -29,8 +50,65 @@ func (l *Logger) Write(b []byte) (wrote int, err error) {
 	return l.writer.Write(b)
 }
 
+// flushRepeats writes a summary of repeated messages if there were any
+func (l *Logger) flushRepeats() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if l.repeats > 0 {
+		summary := fmt.Sprintf("last message repeated %d times\n", l.repeats)
+		if l.lastTimestamped {
+			summary = time.Now().Format("2006/01/02 15:04:05 ") + summary
+		}
+		l.write([]byte(summary))
+	}
+	l.last = ""
+	l.repeats = 0
+}
+
+// Write handles writes
+func (l *Logger) Write(b []byte) (wrote int, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.config.CoalesceWindow <= 0 {
+		return l.write(b)
+	}
+	// Compare messages without timestamps
+	text := string(b)
+	timestamped := false
+	if loc := timestampRegexp.FindStringIndex(text); loc != nil {
+		text = text[loc[1]:]
+		timestamped = true
+	}
+	// Coalesce message repeated within the window
+	if text == l.last && time.Since(l.lastTime) < l.config.CoalesceWindow {
+		l.repeats++
+		if l.timer == nil {
+			var timer *time.Timer
+			timer = time.AfterFunc(l.config.CoalesceWindow-time.Since(l.lastTime), func() {
+				l.mutex.Lock()
+				defer l.mutex.Unlock()
+				// Ignore timer which was stopped while we were waiting for the mutex
+				if l.timer == timer {
+					l.flushRepeats()
+				}
+			})
+			l.timer = timer
+		}
+		return len(b), nil
+	}
+	l.flushRepeats()
+	l.last = text
+	l.lastTime = time.Now()
+	l.lastTimestamped = timestamped
+	return l.write(b)
+}
+
 // ShowRing returns ringbuffer as []byte
 func (l *Logger) ShowRing() (log []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	// Create bytes.Buffer
 	var b bytes.Buffer
 	// Iterate over ringbuffer
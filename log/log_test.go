@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"log"
 	"testing"
+	"time"
 
 	blog "github.com/fatalbanana/bananaboatbot/log"
 )
@@ -23,3 +24,30 @@ func TestLogger(t *testing.T) {
 		t.Fatalf("%s != %s", res, expected)
 	}
 }
+
+func TestCoalesce(t *testing.T) {
+	logger := blog.NewLogger(&blog.LoggerConfig{
+		CoalesceWindow: 50 * time.Millisecond,
+		RingSize:       4,
+	})
+	log.SetOutput(logger)
+	log.SetFlags(0)
+	log.Print("foo")
+	log.Print("foo")
+	log.Print("foo")
+	log.Print("bar")
+	res := logger.ShowRing()
+	expected := []byte("foo\nlast message repeated 2 times\nbar\n")
+	if !bytes.Equal(res, expected) {
+		t.Fatalf("%s != %s", res, expected)
+	}
+	// Repeats are summarised at the end of the window
+	log.Print("bar")
+	time.Sleep(100 * time.Millisecond)
+	log.Print("bar")
+	res = logger.ShowRing()
+	expected = []byte("last message repeated 2 times\nbar\nlast message repeated 1 times\nbar\n")
+	if !bytes.Equal(res, expected) {
+		t.Fatalf("%s != %s", res, expected)
+	}
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"flag"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/fatalbanana/bananaboatbot/bot"
 	"github.com/fatalbanana/bananaboatbot/client"
 	blog "github.com/fatalbanana/bananaboatbot/log"
+	"github.com/fatalbanana/bananaboatbot/redis"
+	"github.com/fatalbanana/bananaboatbot/store"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -20,33 +25,96 @@ const (
 
 func main() {
 	// Set up and parse commandline flags
+	dbFile := flag.String("db", "", "Path to database file for persistent state")
+	httpPrivate := flag.Bool("http-private", false, "Allow HTTP requests made by Lua scripts to private addresses")
 	luaFile := flag.String("lua", "", "Path to Lua script")
+	luaIdleTimeout := flag.Int("lua-idle-timeout", 300, "Seconds after which idle pooled Lua states are closed (0 disables)")
+	logCoalesce := flag.Int("log-coalesce", 0, "Seconds to coalesce identical consecutive log lines (0 disables)")
 	logCommands := flag.Bool("log-commands", false, "Log commands received from servers")
+	maxLuaStates := flag.Int("max-lua-states", 0, "Maximum number of pooled Lua states used by workers (0 is unlimited)")
 	maxReconnect := flag.Int("max-reconnect", 3600, "Maximum reconnect interval in seconds")
+	memoryLimit := flag.Int("memory-limit", 0, "Soft limit of memory usage in MiB approaching which cached state is shed (0 disables)")
+	reconnectStateTTL := flag.Int("reconnect-state-ttl", 3600, "Seconds to remember reconnect state across restarts")
+	stateEvents := flag.Bool("state-events", false, "Stream connection state changes from /events on WebUI")
+	redisURL := flag.String("redis", "", "URL of Redis server used by Lua scripts (such as redis://localhost:6379/0)")
 	ringSize := flag.Int("ring-size", 100, "Number of entries in log ringbuffer")
+	sqlFile := flag.String("sql", "", "Path to SQLite database used by Lua scripts")
+	shutdownTimeout := flag.Int("shutdown-timeout", 5, "Seconds to wait for servers to receive QUIT when shutting down")
 	webAddr := flag.String("addr", "localhost:9781", "Listening address for WebUI")
 	flag.Parse()
 
 	// Set up custom logger for maintaining log in ringbuffer
 	logger := blog.NewLogger(&blog.LoggerConfig{
-		RingSize: *ringSize,
+		CoalesceWindow: time.Duration(*logCoalesce) * time.Second,
+		RingSize:       *ringSize,
 	})
 	log.SetOutput(logger)
 
+	// Negative limits would become huge ones when converted from MiB
+	if *memoryLimit < 0 {
+		log.Fatalf("Invalid memory limit: %d", *memoryLimit)
+	}
+
+	// Open database if configured
+	var db *store.Store
+	if len(*dbFile) > 0 {
+		var err error
+		db, err = store.NewStore(&store.StoreConfig{
+			Path: *dbFile,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open database: %s", err)
+		}
+		defer db.Close()
+	}
+
+	// Open SQL database if configured
+	var sqlDB *sql.DB
+	if len(*sqlFile) > 0 {
+		var err error
+		sqlDB, err = store.OpenSQL(*sqlFile)
+		if err != nil {
+			log.Fatalf("Failed to open SQL database: %s", err)
+		}
+		defer sqlDB.Close()
+	}
+
+	// Set up Redis client if configured
+	var redisClient *redis.Client
+	if len(*redisURL) > 0 {
+		var err error
+		redisClient, err = redis.NewClient(*redisURL)
+		if err != nil {
+			log.Fatalf("Invalid Redis URL: %s", err)
+		}
+		defer redisClient.Close()
+	}
+
 	// Create BananaBoatBot
 	ctx, cancel := context.WithCancel(context.Background())
 	b := bot.NewBananaBoatBot(ctx,
 		&bot.BananaBoatBotConfig{
-			DefaultIrcPort: defaultIrcPort,
-			LogCommands:    *logCommands,
-			LuaFile:        *luaFile,
-			MaxReconnect:   *maxReconnect,
-			NewIrcServer:   client.NewIrcServer,
+			DefaultIrcPort:    defaultIrcPort,
+			HTTPPrivate:       *httpPrivate,
+			LogCommands:       *logCommands,
+			LuaFile:           *luaFile,
+			LuaIdleTimeout:    *luaIdleTimeout,
+			MaxLuaStates:      *maxLuaStates,
+			MaxReconnect:      *maxReconnect,
+			MemoryLimit:       uint64(*memoryLimit) << 20,
+			NewIrcServer:      client.NewIrcServer,
+			ReconnectStateTTL: *reconnectStateTTL,
+			Redis:             redisClient,
+			SQL:               sqlDB,
+			Store:             db,
 		},
 	)
 	defer func() {
+		// Give servers a while to receive QUIT before dropping connections
+		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, time.Duration(*shutdownTimeout)*time.Second)
+		defer shutdownCancel()
+		b.Close(shutdownCtx)
 		cancel()
-		b.Close(ctx)
 	}()
 
 	// Setup handlers for webserver
@@ -76,11 +144,14 @@ func main() {
 		}
 	})
 	http.Handle("/metrics", promhttp.Handler())
+	if *stateEvents {
+		http.HandleFunc("/events", b.ServeStateEvents)
+	}
 	// Start webserver
 	go http.ListenAndServe(*webAddr, nil)
 
-	// Catch interrupt signal and exit
+	// Catch interrupt and termination signals and exit
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	<-sigChan
 }
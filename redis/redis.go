@@ -0,0 +1,261 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPort is the port Redis listens on unless another is given
+	defaultPort = "6379"
+	// dialTimeout is how long connecting to Redis may take
+	dialTimeout = 10 * time.Second
+	// maxBulkLength is the longest string we accept in replies
+	maxBulkLength = 16 << 20
+	// maxArrayLength is the largest number of elements we accept in replies
+	maxArrayLength = 1 << 16
+)
+
+// Error is an error reply from Redis
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Client sends commands to a Redis server over a single connection
+type Client struct {
+	// addr is the host and port of the server
+	addr string
+	// password is used to authenticate if set
+	password string
+	// db is the number of the database selected after connecting
+	db int
+	// mutex protects conn & reader and serialises commands
+	mutex sync.Mutex
+	// conn is the connection to the server (nil if not connected)
+	conn net.Conn
+	// reader reads replies from conn
+	reader *bufio.Reader
+}
+
+// NewClient returns a client for a server given by a URL such as redis://:password@localhost:6379/0
+// Connecting is deferred until the first command
+func NewClient(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	c := &Client{addr: u.Host}
+	if len(u.Port()) == 0 {
+		c.addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); len(db) > 0 {
+		c.db, err = strconv.Atoi(db)
+		if err != nil || c.db < 0 {
+			return nil, fmt.Errorf("invalid database: %s", db)
+		}
+	}
+	return c, nil
+}
+
+// dial connects to the server, authenticating and selecting the database
+func (c *Client) dial(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var setup [][]string
+	if len(c.password) > 0 {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := roundTrip(ctx, conn, reader, args); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, reader, nil
+}
+
+// Do sends a command and returns its reply: a string, int64, nil, []interface{} or Error
+// Errors are returned for error replies as well as for failed connections
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		conn, reader, err := c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.reader = conn, reader
+	}
+	reply, err := roundTrip(ctx, c.conn, c.reader, args)
+	if _, ok := err.(Error); err != nil && !ok {
+		// Connection is in an unknown state, reconnect for the next command
+		c.conn.Close()
+		c.conn, c.reader = nil, nil
+	}
+	return reply, err
+}
+
+// Close closes the connection to the server
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn, c.reader = nil, nil
+	return err
+}
+
+// Subscribe calls fn with messages published to channels until ctx is done or the connection fails
+// Subscriptions use their own connection since it can't be used for other commands
+func (c *Client) Subscribe(ctx context.Context, channels []string, fn func(channel string, message string)) error {
+	conn, reader, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	// Unblock reads when we're done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+			conn.Close()
+		}
+	}()
+	if err := writeCommand(conn, append([]string{"SUBSCRIBE"}, channels...)); err != nil {
+		return err
+	}
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		// Messages are ["message", channel, payload], other pushes confirm subscriptions
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		channel, _ := parts[1].(string)
+		message, _ := parts[2].(string)
+		fn(channel, message)
+	}
+}
+
+// roundTrip writes a command and reads its reply, returning error replies as Error
+func roundTrip(ctx context.Context, conn net.Conn, reader *bufio.Reader, args []string) (interface{}, error) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if err := writeCommand(conn, args); err != nil {
+		return nil, err
+	}
+	reply, err := readReply(reader)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(Error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// writeCommand writes a command as an array of bulk strings
+func writeCommand(w io.Writer, args []string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// readLine reads a line terminated by CRLF
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errors.New("malformed reply")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a reply in the Redis serialisation protocol
+func readReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("malformed reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxBulkLength {
+			return nil, errors.New("malformed bulk string length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxArrayLength {
+			return nil, errors.New("malformed array length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		elements := make([]interface{}, n)
+		for i := range elements {
+			elements[i], err = readReply(reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("unexpected reply type: %q", line[0])
+}
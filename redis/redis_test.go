@@ -0,0 +1,100 @@
+package redis_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatalbanana/bananaboatbot/redis"
+	"github.com/fatalbanana/bananaboatbot/test"
+)
+
+func TestNewClient(t *testing.T) {
+	for _, u := range []string{"http://localhost", "redis://localhost/x", "redis://localhost/-1"} {
+		if _, err := redis.NewClient(u); err == nil {
+			t.Errorf("Invalid URL was accepted: %s", u)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u := test.FakeRedis(t, "secret")
+	c, err := redis.NewClient(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, tc := range []struct {
+		args     []string
+		expected interface{}
+	}{
+		{[]string{"GET", "key"}, nil},
+		{[]string{"SET", "key", "value\r\nwith newline"}, "OK"},
+		{[]string{"GET", "key"}, "value\r\nwith newline"},
+		{[]string{"INCR", "counter"}, int64(1)},
+		{[]string{"INCR", "counter"}, int64(2)},
+		{[]string{"EXPIRE", "counter", "60"}, int64(1)},
+		{[]string{"EXPIRE", "missing", "60"}, int64(0)},
+	} {
+		reply, err := c.Do(ctx, tc.args...)
+		if err != nil || reply != tc.expected {
+			t.Fatalf("Unexpected reply to %v: %v %v", tc.args, reply, err)
+		}
+	}
+	// Error replies don't break the connection
+	if _, err := c.Do(ctx, "INCR", "key"); err == nil {
+		t.Fatal("Expected error incrementing a string")
+	} else if _, ok := err.(redis.Error); !ok {
+		t.Fatalf("Unexpected error type: %T", err)
+	}
+	if reply, err := c.Do(ctx, "GET", "counter"); err != nil || reply != "2" {
+		t.Fatalf("Unexpected reply after error: %v %v", reply, err)
+	}
+	// Wrong password fails
+	wrong, err := redis.NewClient(strings.Replace(u, "secret", "wrong", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Do(ctx, "GET", "key"); err == nil {
+		t.Fatal("Expected error using wrong password")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := redis.NewClient(test.FakeRedis(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	subCtx, subCancel := context.WithCancel(ctx)
+	messages := make(chan string, 1)
+	done := make(chan error)
+	go func() {
+		done <- c.Subscribe(subCtx, []string{"events"}, func(channel string, message string) {
+			messages <- channel + " " + message
+		})
+	}()
+	// Publish until the subscription has been made
+	for {
+		n, err := c.Do(ctx, "PUBLISH", "events", "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == int64(1) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if msg := <-messages; msg != "events hello" {
+		t.Fatalf("Unexpected message: %s", msg)
+	}
+	subCancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Unexpected error from cancelled subscription: %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package store
+
+import (
+	"database/sql"
+	"net/url"
+
+	// Register the SQLite driver
+	_ "modernc.org/sqlite"
+)
+
+// sqlBusyTimeout is how many milliseconds SQLite waits for locks held by other processes
+const sqlBusyTimeout = "5000"
+
+// OpenSQL opens the SQLite database at path (creating it if it doesn't exist)
+func OpenSQL(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {"busy_timeout(" + sqlBusyTimeout + ")"}}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Statements are serialised so concurrent workers don't fail to lock the database
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
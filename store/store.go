@@ -0,0 +1,111 @@
+package store
+
+import (
+	"bytes"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is a persistent key-value store organised in buckets
+type Store struct {
+	config *StoreConfig
+	db     *bolt.DB
+}
+
+// KeyValue is a key and its value
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// StoreConfig contains configuration for the store
+type StoreConfig struct {
+	// Path to database file
+	Path string
+}
+
+// Close closes the underlying database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the value of a key or nil if it is not set
+func (s *Store) Get(bucket string, key string) (value []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		// Bucket doesn't exist yet so neither does the key
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(key))
+		// Copy value as it is only valid during the transaction
+		if v != nil {
+			value = make([]byte, len(v))
+			copy(value, v)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Set sets the value of a key, creating the bucket if needed
+func (s *Store) Set(bucket string, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Delete removes a key
+func (s *Store) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// Scan returns keys starting with prefix and their values in key order (at most limit of them unless limit is 0)
+func (s *Store) Scan(bucket string, prefix string, limit int) (pairs []KeyValue, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if limit > 0 && len(pairs) >= limit {
+				break
+			}
+			// Skip nested buckets
+			if v == nil {
+				continue
+			}
+			// Copy value as it is only valid during the transaction
+			value := make([]byte, len(v))
+			copy(value, v)
+			pairs = append(pairs, KeyValue{Key: string(k), Value: value})
+		}
+		return nil
+	})
+	return pairs, err
+}
+
+// NewStore opens or creates a Store
+func NewStore(config *StoreConfig) (*Store, error) {
+	db, err := bolt.Open(config.Path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		config: config,
+		db:     db,
+	}
+	return s, nil
+}
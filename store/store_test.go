@@ -0,0 +1,69 @@
+package store_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fatalbanana/bananaboatbot/store"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bananaboatbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := store.NewStore(&store.StoreConfig{
+		Path: filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Missing bucket
+	v, err := s.Get("bucket", "key")
+	if err != nil || v != nil {
+		t.Fatalf("Unexpected result from missing bucket: %s %s", v, err)
+	}
+	err = s.Set("bucket", "key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = s.Get("bucket", "key")
+	if err != nil || !bytes.Equal(v, []byte("value")) {
+		t.Fatalf("Unexpected result from Get: %s %s", v, err)
+	}
+	err = s.Delete("bucket", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = s.Get("bucket", "key")
+	if err != nil || v != nil {
+		t.Fatalf("Unexpected result from deleted key: %s %s", v, err)
+	}
+	// Scan keys by prefix
+	for _, key := range []string{"quote/2", "quote/1", "factoid/1", "quote/3"} {
+		err = s.Set("bucket", key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pairs, err := s.Scan("bucket", "quote/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || pairs[0].Key != "quote/1" || pairs[1].Key != "quote/2" || !bytes.Equal(pairs[1].Value, []byte("quote/2")) {
+		t.Fatalf("Unexpected result from Scan: %v", pairs)
+	}
+	pairs, err = s.Scan("bucket", "", 0)
+	if err != nil || len(pairs) != 4 {
+		t.Fatalf("Unexpected result from Scan: %v %s", pairs, err)
+	}
+	pairs, err = s.Scan("missing", "", 0)
+	if err != nil || len(pairs) != 0 {
+		t.Fatalf("Unexpected result from Scan of missing bucket: %v %s", pairs, err)
+	}
+}
@@ -0,0 +1,22 @@
+local bot = {}
+local botnick = 'testbot1'
+bot.handlers = {
+  ['PRIVMSG'] = function(net, nick, user, host, channel, message)
+    if channel ~= botnick then return end
+    -- Common mistakes: returning something other than a table
+    if message == 'string' then return 'oops' end
+    if message == 'number' then return 42 end
+    if message == 'boolean' then return true end
+    return { {command = 'PRIVMSG', params = {nick, message}} }
+  end,
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
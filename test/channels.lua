@@ -0,0 +1,18 @@
+local bot = {}
+local botnick = 'testbot1'
+bot.handlers = {}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+    channels = {
+      '#always',
+      {name = '#secret', key = 'hunter2'},
+      {name = '#Announce', once = true},
+    },
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
@@ -0,0 +1,8 @@
+local bot = dofile('../test/helpers.lua')
+-- Replayed messages are passed together
+bot.handlers.CHATHISTORY = function(net, target, messages)
+  local first = messages[1]
+  local when = first.time == 1577836800 and 'ok' or 'bad'
+  return { {command = 'PRIVMSG', params = {target, #messages .. ' ' .. first.nick .. ' ' .. first.text .. ' ' .. tostring(first.tags.msgid) .. ' ' .. when}} }
+end
+return bot
@@ -0,0 +1,30 @@
+local bot = {}
+local botnick = 'testbot1'
+bot.handlers = {}
+bot.commands = {
+  echo = {
+    func = function(net, nick, user, host, channel, args)
+      return { {command = 'PRIVMSG', params = {channel, args}} }
+    end,
+    description = 'Repeat text',
+  },
+  secret = {
+    func = function(net, nick, user, host, channel, args)
+      return { {command = 'PRIVMSG', params = {channel, 'secret'}} }
+    end,
+    admin = true,
+    description = 'Admin stuff',
+  },
+}
+bot.admins = {'boss!*@*.example.com'}
+bot.help = true
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
@@ -0,0 +1,13 @@
+local bot = dofile('../test/helpers.lua')
+bot.ctcp = {
+  CLIENTINFO = true,
+  PING = true,
+  TIME = true,
+  VERSION = 'TestBot 1.0',
+  -- Replies may be delegated to Lua (nil means no reply)
+  FINGER = function(net, nick, user, host, target, args)
+    if target == '#quiet' then return end
+    return 'hello ' .. nick
+  end,
+}
+return bot
@@ -0,0 +1,20 @@
+local bot = {}
+local botnick = 'testbot1'
+local function reply(greeting, punctuation, net, nick, user, host, channel, message)
+  if channel ~= botnick then return end
+  return { {command = 'PRIVMSG', params = {nick, greeting .. ' ' .. message .. punctuation}} }
+end
+bot.handlers = {
+  PRIVMSG = {func = reply, args = {'hello', '!'}},
+  NOTICE = {func = reply, args = {'psst', '...'}},
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
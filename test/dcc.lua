@@ -0,0 +1,13 @@
+local bot = dofile('../test/helpers.lua')
+-- Offers would otherwise be evaluated as Lua
+bot.handlers.PRIVMSG = nil
+bot.dcc = {
+  dir = os.getenv('BANANABOAT_TEST_DCC_DIR'),
+  max_size = 100,
+  allow = {'friend!*@*'},
+  callback = function(net, nick, user, host, result)
+    local text = result.error and ('failed: ' .. result.filename) or ('got ' .. result.size .. ' bytes')
+    return { {command = 'PRIVMSG', params = {nick, text}} }
+  end,
+}
+return bot
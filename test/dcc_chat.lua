@@ -0,0 +1,19 @@
+local bot = dofile('../test/helpers.lua')
+bot.dcc = {
+  address = '127.0.0.1',
+  allow = {'friend!*@*'},
+  chat = true,
+  -- Offers are made by tests on loopback
+  private = true,
+}
+bot.handlers.PRIVMSG = function(net, nick, user, host, target, message)
+  -- Chats are handled like any server
+  if net:sub(1, 4) == 'dcc:' then
+    return { {command = 'PRIVMSG', params = {nick, 'echo: ' .. message}} }
+  end
+  if message == 'chat with me' then
+    local name, err = bb.dcc_chat(net, nick)
+    return { {command = 'PRIVMSG', params = {target, name or err}} }
+  end
+end
+return bot
@@ -0,0 +1,4 @@
+-- Same as dcc.lua accepting offers on loopback
+local bot = dofile('../test/dcc.lua')
+bot.dcc.private = true
+return bot
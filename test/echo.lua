@@ -0,0 +1,10 @@
+local bot = dofile('../test/helpers.lua')
+bot.servers.test.echo_message = true
+-- Delivered messages are confirmed in a channel
+bot.handlers.ECHO = function(net, nick, user, host, command, target, text)
+  return { {command = 'PRIVMSG', params = {'#log', 'delivered ' .. command .. ' ' .. target .. ' ' .. text}} }
+end
+bot.handlers.PRIVMSG = function(net, nick, user, host, target, text)
+  return { {command = 'PRIVMSG', params = {'#log', 'got ' .. text}} }
+end
+return bot
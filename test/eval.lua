@@ -0,0 +1,4 @@
+-- Same as commands.lua with the built-in eval command enabled
+local bot = dofile('../test/commands.lua')
+bot.eval = {timeout = 1, max_output = 20, accounts = {'boss'}}
+return bot
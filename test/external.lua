@@ -0,0 +1,19 @@
+local bot = {}
+local botnick = 'testbot1'
+bot.handlers = {}
+bot.externals = {
+  PRIVMSG = {
+    url = os.getenv('BANANABOAT_TEST_URL'),
+    timeout = 5,
+  },
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
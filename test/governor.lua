@@ -0,0 +1,4 @@
+local bot = dofile('../test/trivial1.lua')
+bot.servers.test.max_connects = 1
+bot.servers.test.connect_window = 0.5
+return bot
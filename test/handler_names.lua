@@ -0,0 +1,10 @@
+local bot = dofile('../test/helpers.lua')
+-- Keys which can never match a command
+bot.handlers[''] = function() end
+bot.handlers['BAD NAME'] = function() end
+bot.handlers[true] = function() end
+-- Keys which are probably mistakes
+bot.handlers['notice'] = function() end
+bot.handlers[433] = function() end
+bot.handlers[1] = function() end
+return bot
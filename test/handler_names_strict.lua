@@ -0,0 +1,3 @@
+local bot = dofile('../test/handler_names.lua')
+bot.strict_handlers = true
+return bot
@@ -0,0 +1,4 @@
+local bot = dofile('../test/trivial1.lua')
+bot.servers.test.channels = {'#chan'}
+bot.servers.test.handover = true
+return bot
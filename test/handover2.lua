@@ -0,0 +1,3 @@
+local bot = dofile('../test/handover1.lua')
+bot.servers.test.server = 'localhost2'
+return bot
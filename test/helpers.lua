@@ -0,0 +1,29 @@
+local bot = {}
+local botnick = 'testbot1'
+-- Expressions evaluated below have access to the library as a global
+bb = require 'bananaboat'
+bot.handlers = {
+  -- Evaluate message as Lua and reply with the result
+  ['PRIVMSG'] = function(net, nick, user, host, channel, message)
+    if channel ~= botnick then return end
+    local f, err = loadstring(message)
+    if not f then
+      return { {command = 'PRIVMSG', params = {nick, 'error: ' .. err}} }
+    end
+    local ok, res = pcall(f)
+    if not ok then
+      return { {command = 'PRIVMSG', params = {nick, 'error: ' .. tostring(res)}} }
+    end
+    return { {command = 'PRIVMSG', params = {nick, tostring(res)}} }
+  end,
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
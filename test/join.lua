@@ -0,0 +1,6 @@
+local bot = dofile('../test/helpers.lua')
+-- Parameters of joins are echoed to a channel
+bot.handlers.JOIN = function(net, nick, user, host, ...)
+  return { {command = 'PRIVMSG', params = {'#log', select('#', ...) .. ' ' .. table.concat({...}, ' ')}} }
+end
+return bot
@@ -0,0 +1,26 @@
+local bot = {}
+local botnick = 'testbot1'
+local bb = require 'bananaboat'
+bot.handlers = {
+  -- Reply with output of helpers formatted for the locale of the channel
+  ['PRIVMSG'] = function(net, nick, user, host, channel, message)
+    if message ~= 'formats' then return end
+    local text = bb.locale() .. ' ' .. bb.format_bytes(1536) .. ' ' .. bb.format_time(0)
+    return { {command = 'PRIVMSG', params = {channel, text}} }
+  end,
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+    channels = {
+      '#plain',
+      {name = '#french', locale = 'fr_FR'},
+    },
+  },
+}
+bot.locale = 'de'
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
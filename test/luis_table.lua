@@ -0,0 +1,26 @@
+local bot = {}
+local botnick = 'testbot1'
+local bb = require 'bananaboat'
+bot.handlers = {
+  ['PRIVMSG'] = function(net, nick, user, host, channel, message)
+    if channel ~= botnick then return end
+    local res = bb.luis_predict("westus", "foo", "bar", message, {format = 'table', top = 2})
+    if not res then return end
+    local intents = {}
+    for _, i in ipairs(res.intents) do
+      table.insert(intents, string.format('%s=%s', i.intent, i.score))
+    end
+    local reply = string.format('%s %s %s %s', res.intent, res.score, res.entities[1].entity, table.concat(intents, ','))
+    return { {command = 'PRIVMSG', params = {botnick, reply}} }
+  end,
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
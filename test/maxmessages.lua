@@ -0,0 +1,25 @@
+local bot = {}
+local botnick = 'testbot1'
+-- flood returns a lot of messages
+local function flood(net, nick, user, host, channel, message)
+  local res = {}
+  for i = 1, 20 do
+    table.insert(res, {command = 'PRIVMSG', params = {nick, tostring(i)}})
+  end
+  return res
+end
+bot.handlers = {
+  NOTICE = flood,
+  PRIVMSG = {func = flood, max_messages = 3},
+}
+bot.max_messages = 5
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
@@ -0,0 +1,6 @@
+local bot = dofile('../test/helpers.lua')
+bot.servers.test.channels = {
+  {name = '#enforced', modes = '+nt-i'},
+  '#other',
+}
+return bot
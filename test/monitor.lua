@@ -0,0 +1,10 @@
+local bot = dofile('../test/helpers.lua')
+bot.servers.test.monitor = {'alice', os.getenv('BANANABOAT_TEST_MONITOR') or 'bob'}
+-- Presence changes are announced in a channel
+bot.handlers.ONLINE = function(net, nick, user, host, monitored)
+  return { {command = 'PRIVMSG', params = {'#chan', 'online ' .. monitored .. ' ' .. host}} }
+end
+bot.handlers.OFFLINE = function(net, nick, user, host, monitored)
+  return { {command = 'PRIVMSG', params = {'#chan', 'offline ' .. monitored}} }
+end
+return bot
@@ -0,0 +1,24 @@
+local bot = {}
+local botnick = 'testbot1'
+bot.handlers = {
+  ['PRIVMSG'] = function(net, nick, user, host, channel, message)
+    if channel == botnick and message == 'HELLO' then
+      return { {command = 'PRIVMSG', params = {nick, 'HELLO'}} }
+    end
+  end,
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.notify = {
+  net = 'test',
+  channel = '#ops',
+  interval = 0.1,
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
@@ -0,0 +1,20 @@
+local bot = dofile('../test/helpers.lua')
+-- Parsed numeric replies
+bot.handlers['324'] = {
+  func = function(net, nick, user, host, numeric, trailing, args)
+    return { {command = 'PRIVMSG', params = {'#out', numeric .. ' ' .. trailing .. ' ' .. table.concat(args, ',') .. ' ' .. #args}} }
+  end,
+  numeric = true,
+}
+-- Unpacked parameters are still the default
+bot.handlers['005'] = function(net, nick, user, host, p1, p2)
+  return { {command = 'PRIVMSG', params = {'#out', p1 .. ' ' .. p2}} }
+end
+-- Numerics without further parameters have no trailing text
+bot.handlers['999'] = {
+  func = function(net, nick, user, host, numeric, trailing, args)
+    return { {command = 'PRIVMSG', params = {'#out', numeric .. ' ' .. tostring(trailing) .. ' ' .. #args}} }
+  end,
+  numeric = true,
+}
+return bot
@@ -0,0 +1,29 @@
+local bot = {}
+local botnick = 'testbot1'
+local bb = require 'bananaboat'
+local replies = {
+  topic = { {command = 'TOPIC', params = {'#chan'}, trailing = 'multi word topic'} },
+  lines = { {command = 'PRIVMSG', params = {'nick1', 'line1\nline2\r\n\nline3'}} },
+  spaces = { {command = 'PRIVMSG', params = {'#chan one', 'text'}} },
+  inject = { {command = 'PRIVMSG\r\nQUIT', params = {'#chan', 'text'}} },
+  long = { {command = 'NOTICE', params = {'nick1', string.rep('abcd ', 100)}} },
+  ctcp = { {command = 'NOTICE', params = {'nick1', '\1VERSION bananaboat\n1.0\1\1'}} },
+  longctcp = { {command = 'NOTICE', params = {'nick1', '\1PING ' .. string.rep('x', 500) .. '\1'}} },
+  version = { bb.ctcp_reply('nick1', 'version', 'bananaboat') },
+}
+bot.handlers = {
+  PRIVMSG = function(net, nick, user, host, channel, message)
+    if channel ~= botnick then return end
+    return replies[message]
+  end,
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
@@ -0,0 +1,4 @@
+-- Same as outbound.lua but replacing line breaks with spaces
+local bot = dofile('../test/outbound.lua')
+bot.newlines = 'space'
+return bot
@@ -0,0 +1,4 @@
+-- Same as helpers.lua with a server password
+local bot = dofile('../test/helpers.lua')
+bot.servers.test.password = 'user/network:secret'
+return bot
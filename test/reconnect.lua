@@ -0,0 +1,11 @@
+local bot = dofile('../test/helpers.lua')
+bot.reconnect = {base = 2, multiplier = 3, jitter = 0.1}
+-- Servers override fields of the default strategy
+bot.servers.test.reconnect = {max = 30, reset_after = 60}
+-- Invalid strategies (delays above a day) are ignored in favour of the default
+bot.servers.huge = {server = 'localhost', tls = false, reconnect = {max = 1e6}}
+-- Reconnect attempts are announced in a channel
+bot.handlers.RECONNECT = function(net, nick, user, host, attempt, delay)
+  return { {command = 'PRIVMSG', params = {'#log', 'attempt ' .. attempt .. ' in ' .. delay}} }
+end
+return bot
@@ -0,0 +1,191 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis is an in-memory server speaking enough of the Redis protocol for tests
+type fakeRedis struct {
+	mutex       sync.Mutex
+	conns       []net.Conn
+	password    string
+	values      map[string]string
+	expiries    map[string]int
+	subscribers map[string][]net.Conn
+}
+
+// FakeRedis starts a fake Redis server requiring password (if set) and returns its URL
+func FakeRedis(t *testing.T, password string) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{
+		password:    password,
+		values:      make(map[string]string),
+		expiries:    make(map[string]int),
+		subscribers: make(map[string][]net.Conn),
+	}
+	t.Cleanup(func() {
+		l.Close()
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		for _, conn := range r.conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.mutex.Lock()
+			r.conns = append(r.conns, conn)
+			r.mutex.Unlock()
+			go r.serve(conn)
+		}
+	}()
+	if len(password) > 0 {
+		return fmt.Sprintf("redis://:%s@%s/1", password, l.Addr())
+	}
+	return "redis://" + l.Addr().String()
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// bulk formats a bulk string reply
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		r.unsubscribe(conn)
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	authenticated := len(r.password) == 0
+	for {
+		args, err := readCommand(reader)
+		if err != nil || len(args) == 0 {
+			return
+		}
+		command := strings.ToUpper(args[0])
+		if !authenticated && command != "AUTH" {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		r.mutex.Lock()
+		var reply string
+		switch {
+		case command == "AUTH" && len(args) == 2:
+			if args[1] == r.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case command == "SELECT" && len(args) == 2:
+			reply = "+OK\r\n"
+		case command == "GET" && len(args) == 2:
+			if v, ok := r.values[args[1]]; ok {
+				reply = bulk(v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case command == "SET" && len(args) >= 3:
+			r.values[args[1]] = args[2]
+			delete(r.expiries, args[1])
+			if len(args) == 5 && strings.ToUpper(args[3]) == "EX" {
+				r.expiries[args[1]], _ = strconv.Atoi(args[4])
+			}
+			reply = "+OK\r\n"
+		case command == "INCR" && len(args) == 2:
+			n, err := strconv.Atoi(r.values[args[1]])
+			if _, ok := r.values[args[1]]; ok && err != nil {
+				reply = "-ERR value is not an integer or out of range\r\n"
+				break
+			}
+			r.values[args[1]] = strconv.Itoa(n + 1)
+			reply = fmt.Sprintf(":%d\r\n", n+1)
+		case command == "EXPIRE" && len(args) == 3:
+			if _, ok := r.values[args[1]]; ok {
+				r.expiries[args[1]], _ = strconv.Atoi(args[2])
+				reply = ":1\r\n"
+			} else {
+				reply = ":0\r\n"
+			}
+		case command == "TTL" && len(args) == 2:
+			if ttl, ok := r.expiries[args[1]]; ok {
+				reply = fmt.Sprintf(":%d\r\n", ttl)
+			} else {
+				reply = ":-1\r\n"
+			}
+		case command == "PUBLISH" && len(args) == 3:
+			subscribers := r.subscribers[args[1]]
+			for _, sub := range subscribers {
+				fmt.Fprintf(sub, "*3\r\n%s%s%s", bulk("message"), bulk(args[1]), bulk(args[2]))
+			}
+			reply = fmt.Sprintf(":%d\r\n", len(subscribers))
+		case command == "SUBSCRIBE" && len(args) >= 2:
+			for i, channel := range args[1:] {
+				r.subscribers[channel] = append(r.subscribers[channel], conn)
+				reply += fmt.Sprintf("*3\r\n%s%s:%d\r\n", bulk("subscribe"), bulk(channel), i+1)
+			}
+		default:
+			reply = fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+		}
+		// Replies are written while holding the mutex so they aren't interleaved with published messages
+		fmt.Fprint(conn, reply)
+		r.mutex.Unlock()
+	}
+}
+
+// unsubscribe removes a closed connection from all channels
+func (r *fakeRedis) unsubscribe(conn net.Conn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for channel, subscribers := range r.subscribers {
+		for i, sub := range subscribers {
+			if sub == conn {
+				r.subscribers[channel] = append(subscribers[:i], subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+local bot = dofile('../test/helpers.lua')
+bot.servers.test.channels = {
+  {name = '#secret', key = 'hunter2'},
+}
+bot.servers.test.rejoin = {
+  delay = 0.01,
+  attempts = 2,
+  -- Channels we are kicked from for spamming aren't rejoined
+  veto = function(net, channel, kicker, reason)
+    return reason == 'spam'
+  end,
+}
+return bot
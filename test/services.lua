@@ -0,0 +1,12 @@
+-- Same as helpers.lua but with services configured for each server
+local bot = dofile('../test/helpers.lua')
+bot.servers.test.services = 'anope'
+bot.servers.other = {
+  server = 'localhost',
+  tls = false,
+  services = {
+    package = 'atheme',
+    chanserv_op = 'ChanServ OP {1} {2} +',
+  },
+}
+return bot
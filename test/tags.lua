@@ -0,0 +1,3 @@
+local bot = dofile('../test/helpers.lua')
+bot.servers.test.tags = {'+example.com/vendor'}
+return bot
@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fatalbanana/bananaboatbot/client"
 	irc "gopkg.in/sorcix/irc.v2"
@@ -35,6 +36,7 @@ type MockIrcServer struct {
 	messages     chan irc.Message
 	reconnectExp *uint64
 	settings     *client.IrcServerSettings
+	state        *client.ServerState
 }
 
 func NewMockIrcServer(parentCtx context.Context, name string, settings *client.IrcServerSettings) (client.IrcServerInterface, context.Context) {
@@ -45,6 +47,7 @@ func NewMockIrcServer(parentCtx context.Context, name string, settings *client.I
 		done:     ctx.Done(),
 		messages: messageOutput,
 		settings: settings,
+		state:    client.NewServerState(settings.Nick),
 	}
 	return m, ctx
 }
@@ -59,6 +62,10 @@ func (m *MockIrcServer) SetReconnectExp(val uint64) {
 	m.reconnectExp = &val
 }
 
+// SetReconnectDelay sets minimum delay before reconnecting
+func (m *MockIrcServer) SetReconnectDelay(delay time.Duration) {
+}
+
 func (m *MockIrcServer) Done() <-chan struct{} {
 	return m.done
 }
@@ -76,6 +83,10 @@ func (m *MockIrcServer) GetSettings() *client.IrcServerSettings {
 	return m.settings
 }
 
+func (m *MockIrcServer) GetState() *client.ServerState {
+	return m.state
+}
+
 func (m *MockIrcServer) GetMessages() chan irc.Message {
 	return m.messages
 }
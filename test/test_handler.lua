@@ -0,0 +1,20 @@
+-- Same as commands.lua with a command testing other handlers
+local bot = dofile('../test/commands.lua')
+local bb = require 'bananaboat'
+bot.handlers.JOIN = function(net, nick, user, host, channel)
+  return { {command = 'PRIVMSG', params = {channel, 'welcome\n' .. nick}} }
+end
+bot.commands.debug = {
+  func = function(net, nick, user, host, channel, args)
+    local out, err = bb.test_handler(args, {channel, 'hello world'})
+    if not out then
+      return { {command = 'PRIVMSG', params = {channel, err}} }
+    end
+    local lines = {}
+    for _, m in ipairs(out) do
+      table.insert(lines, m.net .. ' ' .. m.command .. ' ' .. table.concat(m.params, ','))
+    end
+    return { {command = 'PRIVMSG', params = {channel, table.concat(lines, '; ')}} }
+  end,
+}
+return bot
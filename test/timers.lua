@@ -0,0 +1,62 @@
+local bot = {}
+local botnick = 'testbot1'
+local bb = require 'bananaboat'
+-- Timers started while loading have no message to reply to so they name the server
+bb.timer(0.05, function(channel)
+  return { {net = 'test', command = 'PRIVMSG', params = {channel, 'loaded'}} }
+end, '#loaded')
+bot.handlers = {
+  ['PRIVMSG'] = function(net, nick, user, host, channel, message)
+    if channel ~= botnick then return end
+    if message == 'timer' then
+      bb.timer(0.01, function(args)
+        return { {command = 'PRIVMSG', params = {args.nick, 'tick'}} }
+      end, {nick = nick})
+    elseif message == 'pending' then
+      bb.timer(0.1, function()
+        return { {command = 'PRIVMSG', params = {nick, 'late'}} }
+      end)
+    elseif message == 'flood' then
+      -- Timers started by a worker while the script is reloaded
+      bb.worker(function(target)
+        local bb = require 'bananaboat'
+        -- Numeric loops upset checkptr in race-enabled builds
+        for _ in string.rep('x', 500):gmatch('x') do
+          bb.timer(0.1, function(channel)
+            return { {net = 'test', command = 'PRIVMSG', params = {channel, 'stale'}} }
+          end, target)
+        end
+        return { {command = 'PRIVMSG', params = {target, 'flooded'}} }
+      end, nick)
+    elseif message:match('^stale ') then
+      -- Worker starts a timer once the script was reloaded during its request
+      bb.worker(function(url)
+        local bb = require 'bananaboat'
+        bb.http_request{url = url}
+        local id, err = bb.timer(0.01, function()
+          return { {net = 'test', command = 'PRIVMSG', params = {'#stale', 'stale'}} }
+        end)
+        return { {net = 'test', command = 'PRIVMSG', params = {'#stale', tostring(err)}} }
+      end, message:sub(7))
+    elseif message == 'cron' then
+      local id = bb.cron('*/5 9-17 * * 1-5', function() end)
+      return { {command = 'PRIVMSG', params = {nick, tostring(bb.cancel_timer(id)) .. ' ' .. tostring(bb.cancel_timer(id))}} }
+    elseif message == 'badcron' then
+      local ok, err = pcall(bb.cron, '61 * * * *', function() end)
+      return { {command = 'PRIVMSG', params = {nick, tostring(err)}} }
+    elseif message == 'nevercron' then
+      local ok, err = pcall(bb.cron, '0 0 30 2 *', function() end)
+      return { {command = 'PRIVMSG', params = {nick, tostring(err)}} }
+    end
+  end,
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
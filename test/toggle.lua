@@ -0,0 +1,32 @@
+local bot = {}
+local botnick = 'testbot1'
+local bb = require 'bananaboat'
+bot.handlers = {
+  NOTICE = function(net, nick, user, host, channel, message)
+    return { {command = 'PRIVMSG', params = {nick, 'notice'}} }
+  end,
+  PRIVMSG = function(net, nick, user, host, channel, message)
+    local res
+    if message == 'off' then
+      res = bb.disable_handler('NOTICE')
+    elseif message == 'on' then
+      res = bb.enable_handler('NOTICE')
+    elseif message == 'missing' then
+      res = bb.disable_handler('INVALID')
+    elseif message == 'list' then
+      local handlers = bb.list_handlers()
+      res = string.format('NOTICE=%s PRIVMSG=%s', tostring(handlers.NOTICE), tostring(handlers.PRIVMSG))
+    end
+    return { {command = 'PRIVMSG', params = {nick, tostring(res)}} }
+  end,
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot
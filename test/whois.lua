@@ -0,0 +1,13 @@
+local bot = dofile('../test/helpers.lua')
+-- Results of WHOIS are announced in a channel
+function announce_whois(net, nick, result, err)
+  if not result then
+    return { {command = 'PRIVMSG', params = {'#chan', 'error ' .. nick .. ': ' .. err}} }
+  end
+  local text = table.concat({
+    result.nick, result.user, result.host, result.realname, result.account or 'none',
+    tostring(result.idle), table.concat(result.channels, ','), tostring(result.secure),
+  }, ' ')
+  return { {command = 'PRIVMSG', params = {'#chan', text}} }
+end
+return bot
@@ -0,0 +1,55 @@
+local bot = {}
+local botnick = 'testbot1'
+local bb = require 'bananaboat'
+bot.handlers = {
+  ['PRIVMSG'] = function(net, nick, user, host, channel, message)
+    if channel ~= botnick then return end
+    if message == 'nested' then
+      local args = {
+        target = nick,
+        fns = {
+          shout = function(s) return string.upper(s) end,
+        },
+      }
+      -- Tables may refer to themselves
+      args.self = args
+      bb.worker(function(args)
+        return { {command = 'PRIVMSG', params = {args.self.target, args.fns.shout('nested')}} }
+      end, args)
+    elseif message == 'param' then
+      bb.worker(function(nick)
+        local bb = require 'bananaboat'
+        return { {command = 'PRIVMSG', params = {nick, bb.param(2) .. bb.param(3)}} }
+      end, nick)
+    elseif message == 'context' then
+      -- Default context describes the message being handled
+      bb.worker_with_context(nil, function(ctx, word)
+        return { {command = 'PRIVMSG', params = {ctx.target, ctx.nick .. ': ' .. word}} }
+      end, 'done')
+    elseif message == 'custom' then
+      bb.worker_with_context({asker = nick, channel = '#chan'}, function(ctx)
+        return { {command = 'PRIVMSG', params = {ctx.asker, 'result for ' .. ctx.channel}} }
+      end)
+    elseif message == 'many' then
+      local params = {}
+      for i = 1, 33 do
+        params[i] = i
+      end
+      local ok, err = pcall(bb.worker, function() end, unpack(params))
+      return { {command = 'PRIVMSG', params = {nick, tostring(err)}} }
+    elseif message == 'keys' then
+      local ok, err = pcall(bb.worker, function() end, {[{}] = true})
+      return { {command = 'PRIVMSG', params = {nick, tostring(err)}} }
+    end
+  end,
+}
+bot.servers = {
+  test = {
+    server = 'localhost',
+    tls = false,
+  },
+}
+bot.nick = botnick
+bot.username = 'a'
+bot.realname = 'e'
+return bot